@@ -7,6 +7,7 @@
 package leveldb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -34,6 +35,7 @@ const (
 	batchHeaderLen = 8 + 4
 	batchGrowRec   = 3000
 	batchBufioSize = 16
+	batchReadChunk = 64 * 1024
 )
 
 // BatchReplay wraps basic batch operations.
@@ -42,12 +44,48 @@ type BatchReplay interface {
 	Delete(key []byte)
 }
 
+// BatchKind is the kind of a batch record.
+type BatchKind int
+
+// Batch record kinds.
+const (
+	BatchPut BatchKind = iota
+	BatchDelete
+)
+
+func (k BatchKind) String() string {
+	switch k {
+	case BatchPut:
+		return "Put"
+	case BatchDelete:
+		return "Delete"
+	}
+	return fmt.Sprintf("BatchKind(%d)", int(k))
+}
+
+// BatchRecord is a record of a batch, see Batch.Records.
+type BatchRecord struct {
+	Kind  BatchKind
+	Key   []byte
+	Value []byte // nil for BatchDelete
+}
+
 type batchIndex struct {
 	keyType            keyType
 	keyPos, keyLen     int
 	valuePos, valueLen int
 }
 
+// Returns true if the batch holds other records than deletes.
+func (b *Batch) hasValues() bool {
+	for _, index := range b.index {
+		if index.keyType != keyTypeDel {
+			return true
+		}
+	}
+	return false
+}
+
 func (index batchIndex) k(data []byte) []byte {
 	return data[index.keyPos : index.keyPos+index.keyLen]
 }
@@ -70,6 +108,9 @@ type Batch struct {
 
 	// internalLen is sums of key/value pair length plus 8-bytes internal key.
 	internalLen int
+
+	// Number of leading records that must be synced, see MarkSyncPoint.
+	syncPoint int
 }
 
 func (b *Batch) grow(n int) {
@@ -111,6 +152,52 @@ func (b *Batch) appendRec(kt keyType, key, value []byte) {
 	b.internalLen += index.keyLen + index.valueLen + 8
 }
 
+// Appends 'put operation' of the given key, reading the value of the given
+// size from r into the batch buffer. The buffer grows as the value is read,
+// by chunks, so that a reader holding less than size bytes doesn't get the
+// whole size allocated. The batch is left untouched if the value can't be
+// read whole.
+func (b *Batch) appendRecReader(key []byte, size int, r io.Reader) error {
+	n := 1 + binary.MaxVarintLen32 + len(key) + binary.MaxVarintLen64
+	b.grow(n)
+	index := batchIndex{keyType: keyTypeVal}
+	o := len(b.data)
+	data := b.data[:o+n]
+	data[o] = byte(keyTypeVal)
+	o++
+	o += binary.PutUvarint(data[o:], uint64(len(key)))
+	index.keyPos = o
+	index.keyLen = len(key)
+	o += copy(data[o:], key)
+	o += binary.PutUvarint(data[o:], uint64(size))
+	index.valuePos = o
+	index.valueLen = size
+	// The record header isn't part of the batch until the value is read.
+	start := len(b.data)
+	b.data = data[:o]
+	for read := 0; read < size; {
+		chunk := size - read
+		if chunk > batchReadChunk {
+			chunk = batchReadChunk
+		}
+		b.grow(chunk)
+		data = b.data[:o+chunk]
+		if _, err := io.ReadFull(r, data[o:]); err != nil {
+			b.data = b.data[:start]
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		o += chunk
+		read += chunk
+		b.data = data
+	}
+	b.index = append(b.index, index)
+	b.internalLen += index.keyLen + index.valueLen + 8
+	return nil
+}
+
 // Put appends 'put operation' of the given key/value pair to the batch.
 // It is safe to modify the contents of the argument after Put returns but not
 // before.
@@ -125,8 +212,28 @@ func (b *Batch) Delete(key []byte) {
 	b.appendRec(keyTypeDel, key, nil)
 }
 
+// MarkSyncPoint marks that the records appended so far must be synced to
+// the journal when the batch is written by DB.Write, even if
+// WriteOptions.Sync is false. It has no effect on an empty batch.
+//
+// A batch is written atomically, as a single journal record, thus the
+// whole batch is synced, including the records appended after the sync
+// point. To get cheaper non-synced writes for them, write them with a
+// second batch instead. The sync point is not part of the batch dump, and
+// is ignored if the NoSync option is set, and by Transaction.Write.
+func (b *Batch) MarkSyncPoint() {
+	b.syncPoint = len(b.index)
+}
+
+// SyncPoint returns the number of records marked to be synced by
+// MarkSyncPoint, or zero if none is.
+func (b *Batch) SyncPoint() int {
+	return b.syncPoint
+}
+
 // Dump dumps batch contents. The returned slice can be loaded into the
-// batch using Load method.
+// batch using Load method, or NewBatchFromDump; the format is the one of
+// the journal records, thus stable, and can be shipped to another node.
 // The returned slice is not its own copy, so the contents should not be
 // modified.
 func (b *Batch) Dump() []byte {
@@ -141,6 +248,19 @@ func (b *Batch) Load(data []byte) error {
 	return b.decode(data, -1)
 }
 
+// NewBatchFromDump returns a new batch holding the records of the given
+// slice, as returned by Dump. It returns an error satisfying
+// errors.IsCorrupted if the slice is malformed.
+// The given slice is copied, it is safe to modify its contents after
+// NewBatchFromDump returns.
+func NewBatchFromDump(data []byte) (*Batch, error) {
+	b := new(Batch)
+	if err := b.decode(append([]byte(nil), data...), -1); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 // Replay replays batch contents.
 func (b *Batch) Replay(r BatchReplay) error {
 	for _, index := range b.index {
@@ -154,6 +274,72 @@ func (b *Batch) Replay(r BatchReplay) error {
 	return nil
 }
 
+// Returns the first key that has more than one record in the batch, or
+// nil if keys are unique.
+func (b *Batch) duplicateKey() []byte {
+	if len(b.index) < 2 {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(b.index))
+	for _, index := range b.index {
+		key := index.k(b.data)
+		if _, ok := seen[string(key)]; ok {
+			return key
+		}
+		seen[string(key)] = struct{}{}
+	}
+	return nil
+}
+
+// Records returns the records of the batch, in insertion order. Writing
+// the same key more than once yields a record for each write.
+// The returned keys and values are not their own copy, so the contents
+// should not be modified.
+func (b *Batch) Records() []BatchRecord {
+	recs := make([]BatchRecord, 0, len(b.index))
+	for _, index := range b.index {
+		switch index.keyType {
+		case keyTypeVal:
+			recs = append(recs, BatchRecord{BatchPut, index.k(b.data), index.v(b.data)})
+		case keyTypeDel:
+			recs = append(recs, BatchRecord{BatchDelete, index.k(b.data), nil})
+		}
+	}
+	return recs
+}
+
+const (
+	batchStringMaxRecs = 16
+	batchStringMaxLen  = 32
+)
+
+func batchStringQuote(b []byte) string {
+	if len(b) > batchStringMaxLen {
+		return fmt.Sprintf("%q...", b[:batchStringMaxLen])
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+// String returns a human-readable representation of the batch records.
+// Long keys and values, and records beyond the first few are elided.
+func (b *Batch) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "leveldb.Batch{Len·%d", b.Len())
+	for i, r := range b.Records() {
+		if i == batchStringMaxRecs {
+			fmt.Fprintf(&buf, " ...%d more", b.Len()-i)
+			break
+		}
+		if r.Kind == BatchPut {
+			fmt.Fprintf(&buf, " Put(%s, %s)", batchStringQuote(r.Key), batchStringQuote(r.Value))
+		} else {
+			fmt.Fprintf(&buf, " Delete(%s)", batchStringQuote(r.Key))
+		}
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
 // Len returns number of records in the batch.
 func (b *Batch) Len() int {
 	return len(b.index)
@@ -164,6 +350,7 @@ func (b *Batch) Reset() {
 	b.data = b.data[:0]
 	b.index = b.index[:0]
 	b.internalLen = 0
+	b.syncPoint = 0
 }
 
 func (b *Batch) replayInternal(fn func(i int, kt keyType, k, v []byte) error) error {
@@ -181,6 +368,9 @@ func (b *Batch) append(p *Batch) {
 	b.data = append(b.data, p.data...)
 	b.index = append(b.index, p.index...)
 	b.internalLen += p.internalLen
+	if p.syncPoint > 0 {
+		b.syncPoint = oi + p.syncPoint
+	}
 
 	// Updating index offset.
 	if ob != 0 {
@@ -198,6 +388,7 @@ func (b *Batch) decode(data []byte, expectedLen int) error {
 	b.data = data
 	b.index = b.index[:0]
 	b.internalLen = 0
+	b.syncPoint = 0
 	err := decodeBatch(data, func(i int, index batchIndex) error {
 		b.index = append(b.index, index)
 		b.internalLen += index.keyLen + index.valueLen + 8
@@ -212,7 +403,7 @@ func (b *Batch) decode(data []byte, expectedLen int) error {
 	return nil
 }
 
-func (b *Batch) putMem(seq uint64, mdb *memdb.DB) error {
+func (b *Batch) putMem(seq uint64, mdb memdb.Table) error {
 	var ik []byte
 	for i, index := range b.index {
 		ik = makeInternalKey(ik, index.k(b.data), seq+uint64(i), index.keyType)
@@ -223,7 +414,7 @@ func (b *Batch) putMem(seq uint64, mdb *memdb.DB) error {
 	return nil
 }
 
-func (b *Batch) revertMem(seq uint64, mdb *memdb.DB) error {
+func (b *Batch) revertMem(seq uint64, mdb memdb.Table) error {
 	var ik []byte
 	for i, index := range b.index {
 		ik = makeInternalKey(ik, index.k(b.data), seq+uint64(i), index.keyType)
@@ -251,7 +442,7 @@ func decodeBatch(data []byte, fn func(i int, index batchIndex) error) error {
 		// Key.
 		x, n := binary.Uvarint(data[o:])
 		o += n
-		if n <= 0 || o+int(x) > len(data) {
+		if n <= 0 || x > uint64(len(data)-o) {
 			return newErrBatchCorrupted("bad record: invalid key length")
 		}
 		index.keyPos = o
@@ -262,7 +453,7 @@ func decodeBatch(data []byte, fn func(i int, index batchIndex) error) error {
 		if index.keyType == keyTypeVal {
 			x, n = binary.Uvarint(data[o:])
 			o += n
-			if n <= 0 || o+int(x) > len(data) {
+			if n <= 0 || x > uint64(len(data)-o) {
 				return newErrBatchCorrupted("bad record: invalid value length")
 			}
 			index.valuePos = o
@@ -280,7 +471,7 @@ func decodeBatch(data []byte, fn func(i int, index batchIndex) error) error {
 	return nil
 }
 
-func decodeBatchToMem(data []byte, expectSeq uint64, mdb *memdb.DB) (seq uint64, batchLen int, err error) {
+func decodeBatchToMem(data []byte, expectSeq uint64, mdb memdb.Table) (seq uint64, batchLen int, err error) {
 	seq, batchLen, err = decodeBatchHeader(data)
 	if err != nil {
 		return 0, 0, err
@@ -9,9 +9,12 @@ package leveldb
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
 	"testing/quick"
 
+	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/testutil"
 )
 
@@ -145,3 +148,139 @@ func TestBatch(t *testing.T) {
 	}
 	t.Logf("length=%d internalLen=%d", len(kvs), internalLen)
 }
+
+func TestBatch_Records(t *testing.T) {
+	b := new(Batch)
+	b.Put([]byte("foo"), []byte("v1"))
+	b.Delete([]byte("bar"))
+	b.Put([]byte("foo"), []byte("v2"))
+	b.Put([]byte("baz"), nil)
+
+	want := []BatchRecord{
+		{BatchPut, []byte("foo"), []byte("v1")},
+		{BatchDelete, []byte("bar"), nil},
+		{BatchPut, []byte("foo"), []byte("v2")},
+		{BatchPut, []byte("baz"), []byte{}},
+	}
+	recs := b.Records()
+	if len(recs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(recs), len(want))
+	}
+	for i, r := range recs {
+		if r.Kind != want[i].Kind || !bytes.Equal(r.Key, want[i].Key) || !bytes.Equal(r.Value, want[i].Value) {
+			t.Errorf("record %d: got %v %q %q, want %v %q %q", i, r.Kind, r.Key, r.Value, want[i].Kind, want[i].Key, want[i].Value)
+		}
+	}
+
+	if s, want := b.String(), `leveldb.Batch{Len·4 Put("foo", "v1") Delete("bar") Put("foo", "v2") Put("baz", "")}`; s != want {
+		t.Errorf("String: got %s, want %s", s, want)
+	}
+
+	b.Reset()
+	for i := 0; i < 20; i++ {
+		b.Put(bytes.Repeat([]byte{'k'}, 40), []byte("v"))
+	}
+	s := b.String()
+	if !strings.HasSuffix(s, " ...4 more}") || !strings.Contains(s, `Put("`+strings.Repeat("k", 32)+`"..., "v")`) {
+		t.Errorf("String: got %s", s)
+	}
+}
+
+func TestBatch_NewBatchFromDump(t *testing.T) {
+	b := new(Batch)
+	b.Put([]byte("foo"), []byte("v1"))
+	b.Delete([]byte("bar"))
+	b.Put([]byte("baz"), nil)
+
+	data := append([]byte(nil), b.Dump()...)
+	nb, err := NewBatchFromDump(data)
+	if err != nil {
+		t.Fatal("NewBatchFromDump: got error: ", err)
+	}
+	// The dump is copied.
+	for i := range data {
+		data[i] = 0
+	}
+	if got, want := nb.String(), b.String(); got != want {
+		t.Errorf("round-trip: got %s, want %s", got, want)
+	}
+	if !bytes.Equal(nb.Dump(), b.Dump()) {
+		t.Errorf("round-trip: dump differs")
+	}
+
+	valid := b.Dump()
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"truncated key", valid[:2]},
+		{"truncated value", valid[:len("\x01\x03foo\x02")]},
+		{"invalid type", append([]byte{0x7f}, valid[1:]...)},
+		{"overflowing key length", []byte("\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01foo")},
+		{"huge key length", []byte("\x01\xff\xff\xff\xff\xff\xff\xff\xff\x7ffoo")},
+	} {
+		if _, err := NewBatchFromDump(c.data); !errors.IsCorrupted(err) {
+			t.Errorf("%s: got error %v, want corrupted", c.name, err)
+		}
+	}
+}
+
+func TestBatch_MarkSyncPoint(t *testing.T) {
+	b := new(Batch)
+	b.MarkSyncPoint()
+	if n := b.SyncPoint(); n != 0 {
+		t.Fatalf("SyncPoint of an empty batch: got %d, want 0", n)
+	}
+	b.Put([]byte("foo"), []byte("v1"))
+	b.Put([]byte("bar"), []byte("v2"))
+	b.MarkSyncPoint()
+	b.Delete([]byte("baz"))
+	if n := b.SyncPoint(); n != 2 {
+		t.Fatalf("SyncPoint: got %d, want 2", n)
+	}
+
+	nb := new(Batch)
+	nb.Put([]byte("qux"), nil)
+	nb.append(b)
+	if n := nb.SyncPoint(); n != 3 {
+		t.Errorf("SyncPoint after append: got %d, want 3", n)
+	}
+	if err := nb.Load(b.Dump()); err != nil {
+		t.Fatal("Load: got error: ", err)
+	}
+	if n := nb.SyncPoint(); n != 0 {
+		t.Errorf("SyncPoint after Load: got %d, want 0", n)
+	}
+	b.Reset()
+	if n := b.SyncPoint(); n != 0 {
+		t.Errorf("SyncPoint after Reset: got %d, want 0", n)
+	}
+}
+
+func TestBatch_AppendRecReader(t *testing.T) {
+	b := new(Batch)
+	b.Put([]byte("k1"), []byte("v1"))
+	dump := append([]byte(nil), b.Dump()...)
+
+	// A short reader doesn't get the whole size allocated, and leaves the
+	// batch untouched.
+	err := b.appendRecReader([]byte("k2"), 1<<30, strings.NewReader("short"))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("appendRecReader: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if cap(b.data) > 4*batchReadChunk {
+		t.Errorf("appendRecReader: buffer grown to %d bytes", cap(b.data))
+	}
+	if b.Len() != 1 || !bytes.Equal(b.Dump(), dump) {
+		t.Errorf("appendRecReader: batch modified on error")
+	}
+
+	value := bytes.Repeat([]byte("0123456789"), batchReadChunk/4)
+	if err := b.appendRecReader([]byte("k2"), len(value), bytes.NewReader(value)); err != nil {
+		t.Fatal("appendRecReader: got error: ", err)
+	}
+	recs := b.Records()
+	if len(recs) != 2 || string(recs[1].Key) != "k2" || !bytes.Equal(recs[1].Value, value) {
+		t.Errorf("appendRecReader: got %d records, want the value read whole", len(recs))
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/btcsuite/goleveldb/leveldb/iterator"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/storage"
+	"github.com/btcsuite/goleveldb/leveldb/util"
 )
 
 func randomString(r *rand.Rand, n int) []byte {
@@ -449,10 +450,51 @@ func BenchmarkDBGet(b *testing.B) {
 	p := openDBBench(b, false)
 	p.populate(b.N)
 	p.fill()
+	b.ReportAllocs()
 	p.gets()
 	p.close()
 }
 
+func BenchmarkDBGetBufferPool(b *testing.B) {
+	p := openDBBench(b, false)
+	p.populate(b.N)
+	p.fill()
+
+	pool := util.NewBufferPool(opt.DefaultBlockSize)
+	p.ro = &opt.ReadOptions{BufferPool: pool}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range p.keys {
+		value, err := p.db.Get(p.keys[i], p.ro)
+		if err != nil {
+			b.Error("got error: ", err)
+		}
+		pool.Put(value)
+	}
+	b.StopTimer()
+	pool.Close()
+	p.close()
+}
+
+func BenchmarkDBGetTo(b *testing.B) {
+	p := openDBBench(b, false)
+	p.populate(b.N)
+	p.fill()
+
+	var value []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range p.keys {
+		var err error
+		value, err = p.db.GetTo(value[:0], p.keys[i], p.ro)
+		if err != nil {
+			b.Error("got error: ", err)
+		}
+	}
+	b.StopTimer()
+	p.close()
+}
+
 func BenchmarkDBGetRandom(b *testing.B) {
 	p := openDBBench(b, false)
 	p.populate(b.N)
@@ -505,3 +547,149 @@ func BenchmarkDBReadConcurrent2(b *testing.B) {
 		}
 	})
 }
+
+func benchmarkDBOpenJournals(b *testing.B, concurrency int) {
+	const (
+		numJournals = 16
+		numBatches  = 256
+	)
+
+	var batches []*Batch
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < numBatches; i++ {
+		batch := new(Batch)
+		for j := 0; j < 16; j++ {
+			batch.Put(randomString(r, 16), randomString(r, 256))
+		}
+		batches = append(batches, batch)
+	}
+	o := &opt.Options{RecoveryConcurrency: concurrency}
+
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		if err := os.RemoveAll(benchDB); err != nil {
+			b.Fatal("cannot remove old db: ", err)
+		}
+		stor, err := storage.OpenFile(benchDB, false)
+		if err != nil {
+			b.Fatal("cannot open stor: ", err)
+		}
+		db, err := Open(stor, o)
+		if err != nil {
+			b.Fatal("cannot open db: ", err)
+		}
+		db.Close()
+		seq := uint64(1)
+		for n := int64(0); n < numJournals; n++ {
+			if seq, err = writeTestJournal(stor, 100+n, seq, batches...); err != nil {
+				b.Fatal("cannot write journal: ", err)
+			}
+		}
+
+		b.StartTimer()
+		db, err = Open(stor, o)
+		b.StopTimer()
+		if err != nil {
+			b.Fatal("cannot open db: ", err)
+		}
+		db.Close()
+		stor.Close()
+	}
+	os.RemoveAll(benchDB)
+}
+
+func BenchmarkDBOpenJournals(b *testing.B) {
+	benchmarkDBOpenJournals(b, 1)
+}
+
+func BenchmarkDBOpenJournalsConcurrent(b *testing.B) {
+	benchmarkDBOpenJournals(b, 4)
+}
+
+func benchmarkDBGetConcurrent(b *testing.B, shards int) {
+	p := openDBBench(b, false)
+	p.o.CompactionTableSize = 64 * opt.KiB
+	p.o.TableCacheShards = shards
+	p.reopen()
+	p.populate(100000)
+	p.fill()
+	if err := p.db.CompactRange(util.Range{}); err != nil {
+		b.Fatal("cannot compact: ", err)
+	}
+	defer p.close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := p.db.Get(p.keys[r.Intn(len(p.keys))], p.ro); err != nil {
+				b.Error("got error: ", err)
+			}
+		}
+	})
+}
+
+func BenchmarkDBGetConcurrent(b *testing.B) {
+	benchmarkDBGetConcurrent(b, 1)
+}
+
+func BenchmarkDBGetConcurrentShards16(b *testing.B) {
+	benchmarkDBGetConcurrent(b, 16)
+}
+
+func benchmarkDBWriteManifestSync(b *testing.B, sync opt.ManifestSync) {
+	p := openDBBench(b, false)
+	// Small memdb and tables, so that most of the work is compaction.
+	p.o.WriteBuffer = 64 * opt.KiB
+	p.o.CompactionTableSize = 32 * opt.KiB
+	p.o.ManifestSync = sync
+	p.reopen()
+	p.populate(b.N)
+	p.randomize()
+	p.writes(100)
+	b.StartTimer()
+	if err := p.db.CompactRange(util.Range{}); err != nil {
+		b.Fatal("cannot compact: ", err)
+	}
+	b.StopTimer()
+	p.close()
+}
+
+func BenchmarkDBWriteManifestSyncEager(b *testing.B) {
+	benchmarkDBWriteManifestSync(b, opt.EagerManifestSync)
+}
+
+func BenchmarkDBWriteManifestSyncLazy(b *testing.B) {
+	benchmarkDBWriteManifestSync(b, opt.LazyManifestSync)
+}
+
+func benchmarkDBGetMissingMemTable(b *testing.B, bloomBits int) {
+	p := openDBBench(b, false)
+	// Keep all the keys in the memdb.
+	p.o.WriteBuffer = 64 * opt.MiB
+	p.o.MemTableBloomBits = bloomBits
+	p.reopen()
+	p.populate(100000)
+	p.fill()
+	defer p.close()
+
+	missing := make([][]byte, len(p.keys))
+	for i := range missing {
+		missing[i] = []byte(fmt.Sprintf("%016d", len(p.keys)+i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.db.Get(missing[i%len(missing)], p.ro); err != ErrNotFound {
+			b.Fatal("got error: ", err)
+		}
+	}
+}
+
+func BenchmarkDBGetMissingMemTable(b *testing.B) {
+	benchmarkDBGetMissingMemTable(b, 0)
+}
+
+func BenchmarkDBGetMissingMemTableBloom(b *testing.B) {
+	benchmarkDBGetMissingMemTable(b, 10)
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/btcsuite/goleveldb/leveldb/cache"
+	"github.com/btcsuite/goleveldb/leveldb/errors"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// Blob file layout.
+//
+// A blob file is a plain sequence of records, each record is a 4-bytes
+// masked CRC-32C of the value followed by the value itself. A table entry
+// of keyTypeBlob holds a blob pointer instead of the value; the pointer
+// is the blob file number, the record offset and the value length, each
+// encoded as uvarint.
+const blobRecordHeaderLen = 4
+
+// Cache namespace of the open blob files; namespace 0 is used by tables.
+const blobCacheNS = 1
+
+var errBlobPointer = errors.New("leveldb: invalid blob pointer")
+
+func newErrBlobCorrupted(fd storage.FileDesc, reason string) error {
+	return errors.NewErrCorrupted(fd, errors.New("leveldb: blob corrupted: "+reason))
+}
+
+type blobPointer struct {
+	num    int64
+	offset int64
+	size   int
+}
+
+func (p blobPointer) encode(dst []byte) []byte {
+	var buf [binary.MaxVarintLen64 * 3]byte
+	n := binary.PutUvarint(buf[:], uint64(p.num))
+	n += binary.PutUvarint(buf[n:], uint64(p.offset))
+	n += binary.PutUvarint(buf[n:], uint64(p.size))
+	return append(dst[:0], buf[:n]...)
+}
+
+func decodeBlobPointer(b []byte) (p blobPointer, err error) {
+	var x [3]uint64
+	for i := range x {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return p, errors.NewErrCorrupted(storage.FileDesc{}, errBlobPointer)
+		}
+		x[i] = v
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		return p, errors.NewErrCorrupted(storage.FileDesc{}, errBlobPointer)
+	}
+	if x[1] > math.MaxInt64 || x[2] > math.MaxInt32 {
+		fd := storage.FileDesc{Type: storage.TypeBlob, Num: int64(x[0])}
+		return p, newErrBlobCorrupted(fd, "invalid pointer")
+	}
+	p.num, p.offset, p.size = int64(x[0]), int64(x[1]), int(x[2])
+	return
+}
+
+// bWriter writes values into a blob file.
+type bWriter struct {
+	t *tOps
+
+	fd  storage.FileDesc
+	w   storage.Writer
+	off int64
+	buf []byte
+}
+
+// Append value to the blob file and returns its encoded pointer.
+func (w *bWriter) append(value []byte) ([]byte, error) {
+	var header [blobRecordHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[:], util.NewCRC(value).Value())
+	if _, err := w.w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.w.Write(value); err != nil {
+		return nil, err
+	}
+	p := blobPointer{w.fd.Num, w.off, len(value)}
+	w.off += int64(blobRecordHeaderLen + len(value))
+	w.buf = p.encode(w.buf)
+	return w.buf, nil
+}
+
+// Syncs and closes the blob file.
+func (w *bWriter) finish() error {
+	defer w.close()
+	if !w.t.noSync {
+		if err := w.w.Sync(); err != nil {
+			return err
+		}
+	}
+	w.t.setBlobSize(w.fd.Num, w.off)
+	return nil
+}
+
+// Closes the storage.Writer.
+func (w *bWriter) close() {
+	if w.w != nil {
+		w.w.Close()
+		w.w = nil
+	}
+}
+
+// Drops the blob file.
+func (w *bWriter) drop() {
+	w.close()
+	w.t.s.stor.Remove(w.fd)
+	w.t.s.reuseFileNum(w.fd.Num)
+	w.t.unpendBlob(w.fd.Num)
+	w.t.unsetBlobSize(w.fd.Num)
+}
+
+// bReader is a cached open blob file.
+type bReader struct {
+	fd   storage.FileDesc
+	r    storage.Reader
+	size int64
+}
+
+func (r *bReader) Release() {
+	r.r.Close()
+}
+
+// Creates an empty blob file and returns blob writer. The blob file is
+// kept pending until the table referring it is committed, see
+// blobGC.
+func (t *tOps) createBlob() (*bWriter, error) {
+	fd := storage.FileDesc{Type: storage.TypeBlob, Num: t.s.allocFileNum()}
+	t.blobMu.Lock()
+	t.blobPending[fd.Num] = struct{}{}
+	t.blobMu.Unlock()
+	fw, err := t.s.stor.Create(fd)
+	if err != nil {
+		t.unpendBlob(fd.Num)
+		return nil, err
+	}
+	return &bWriter{
+		t:  t,
+		fd: fd,
+		w:  fw,
+	}, nil
+}
+
+func (t *tOps) isBlobPending(num int64) bool {
+	t.blobMu.Lock()
+	defer t.blobMu.Unlock()
+	_, ok := t.blobPending[num]
+	return ok
+}
+
+func (t *tOps) unpendBlob(num int64) {
+	t.blobMu.Lock()
+	delete(t.blobPending, num)
+	t.blobMu.Unlock()
+}
+
+// Records the size of the given blob file, see blobsSize.
+func (t *tOps) setBlobSize(num, size int64) {
+	t.blobMu.Lock()
+	t.blobSize += size - t.blobSizes[num]
+	t.blobSizes[num] = size
+	t.blobMu.Unlock()
+}
+
+func (t *tOps) unsetBlobSize(num int64) {
+	t.blobMu.Lock()
+	t.blobSize -= t.blobSizes[num]
+	delete(t.blobSizes, num)
+	t.blobMu.Unlock()
+}
+
+// Returns the sum of the sizes of the blob files written by the DB, or
+// found when opening it with a quota, see DB.diskUsage.
+func (t *tOps) blobsSize() int64 {
+	t.blobMu.Lock()
+	defer t.blobMu.Unlock()
+	return t.blobSize
+}
+
+// Opens blob file. It returns a cache handle, which should
+// be released after use.
+func (t *tOps) openBlob(num int64) (ch *cache.Handle, err error) {
+	ch = t.cache.Get(blobCacheNS, uint64(num), func() (size int, value cache.Value) {
+		fd := storage.FileDesc{Type: storage.TypeBlob, Num: num}
+		var r storage.Reader
+		r, err = t.s.stor.Open(fd)
+		if err != nil {
+			return 0, nil
+		}
+		var fsize int64
+		fsize, err = r.Seek(0, io.SeekEnd)
+		if err != nil {
+			r.Close()
+			return 0, nil
+		}
+		return 1, &bReader{fd, r, fsize}
+	})
+	if ch == nil && err == nil {
+		err = ErrClosed
+	}
+	return
+}
+
+// Reads the value the given encoded blob pointer refers to.
+func (t *tOps) readBlob(ptr []byte, ro *opt.ReadOptions) ([]byte, error) {
+	p, err := decodeBlobPointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := t.openBlob(p.num)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Release()
+	br := ch.Value().(*bReader)
+
+	// Checked before allocating, the pointer may be corrupted.
+	if p.offset > br.size-blobRecordHeaderLen-int64(p.size) {
+		return nil, newErrBlobCorrupted(br.fd, "pointer out of range")
+	}
+	buf := make([]byte, blobRecordHeaderLen+p.size)
+	if _, err := br.r.ReadAt(buf, p.offset); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, newErrBlobCorrupted(br.fd, "truncated record")
+		}
+		return nil, err
+	}
+	value := buf[blobRecordHeaderLen:]
+	if opt.GetStrict(t.s.o.Options, ro, opt.StrictBlockChecksum) {
+		if binary.LittleEndian.Uint32(buf) != util.NewCRC(value).Value() {
+			return nil, newErrBlobCorrupted(br.fd, "checksum mismatch")
+		}
+	}
+	return value, nil
+}
+
+// Returns numbers of the blob files the given table refers to.
+func (t *tOps) blobRefs(f *tFile) ([]int64, error) {
+	var (
+		nums []int64
+		seen = make(map[int64]bool)
+	)
+	iter := t.newIterator(f, nil, &opt.ReadOptions{DontFillCache: true})
+	defer iter.Release()
+	for iter.Next() {
+		_, _, kt, kerr := parseInternalKey(iter.Key())
+		if kerr != nil || kt != keyTypeBlob {
+			continue
+		}
+		p, err := decodeBlobPointer(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if !seen[p.num] {
+			seen[p.num] = true
+			nums = append(nums, p.num)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return nums, nil
+}
+
+// Removes blob file from persistent storage. It waits until
+// no one use the the blob file.
+func (t *tOps) removeBlob(fd storage.FileDesc) {
+	t.cache.Delete(blobCacheNS, uint64(fd.Num), func() {
+		t.s.afterManifestSync(func() {
+			if err := t.s.stor.Remove(fd); err != nil {
+				t.s.logf("blob@remove removing @%d %q", fd.Num, err)
+			} else {
+				t.unsetBlobSize(fd.Num)
+				t.s.logf("blob@remove removed @%d", fd.Num)
+			}
+		})
+	})
+}
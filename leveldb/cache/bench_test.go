@@ -27,3 +27,45 @@ func BenchmarkLRUCache(b *testing.B) {
 		}
 	})
 }
+
+// Mixed workload of point requests on a working set and one-shot scans;
+// the hit rate of the point requests is reported.
+func BenchmarkCacheMixedWorkload(b *testing.B) {
+	const (
+		capacity   = 1000
+		workingSet = 800
+		scanEvery  = 100
+		scanLen    = 500
+	)
+	for _, tc := range testCachers {
+		b.Run(tc.name, func(b *testing.B) {
+			c := NewCache(tc.new(capacity))
+			r := rand.New(rand.NewSource(1))
+			scanKey := uint64(workingSet)
+			var hits, total int
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%scanEvery == 0 {
+					for j := 0; j < scanLen; j++ {
+						c.Get(0, scanKey, func() (int, Value) {
+							return 1, scanKey
+						}).Release()
+						scanKey++
+					}
+				}
+				key := uint64(r.Intn(workingSet))
+				hit := true
+				c.Get(0, key, func() (int, Value) {
+					hit = false
+					return 1, key
+				}).Release()
+				if hit {
+					hits++
+				}
+				total++
+			}
+			b.ReportMetric(float64(hits)/float64(total), "hit-rate")
+		})
+	}
+}
@@ -344,6 +344,48 @@ func (r *Cache) Size() int {
 	return int(atomic.LoadInt32(&r.size))
 }
 
+// NamespaceSize returns the sum of the sizes of the 'cache node' whose
+// namespace satisfies the given function, e.g. the share of a cache shared
+// by several users. Unlike Size it walks the whole map, so it should not be
+// called too often; the result is approximate if the map is concurrently
+// modified.
+func (r *Cache) NamespaceSize(match func(ns uint64) bool) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0
+	}
+
+	var (
+		size  int
+		nodes []*Node
+	)
+	h := (*mNode)(atomic.LoadPointer(&r.mHead))
+	for i := range h.buckets {
+		b := (*mBucket)(atomic.LoadPointer(&h.buckets[i]))
+		if b == nil {
+			b = h.initBucket(uint32(i))
+		}
+		b.mu.Lock()
+		for _, n := range b.node {
+			if match(n.ns) {
+				nodes = append(nodes, n)
+			}
+		}
+		b.mu.Unlock()
+
+		// The node lock is held while its value is being set, don't wait
+		// for it while holding the bucket lock.
+		for _, n := range nodes {
+			n.mu.Lock()
+			size += n.size
+			n.mu.Unlock()
+		}
+		nodes = nodes[:0]
+	}
+	return size
+}
+
 // Capacity returns cache capacity.
 func (r *Cache) Capacity() int {
 	if r.cacher == nil {
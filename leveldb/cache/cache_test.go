@@ -182,6 +182,21 @@ func TestCacheMap_NodesAndSize(t *testing.T) {
 	}
 }
 
+func TestCacheMap_NamespaceSize(t *testing.T) {
+	c := NewCache(nil)
+	for i := 0; i < 1000; i++ {
+		set(c, uint64(i%3), uint64(i), i, i%3+1, nil)
+	}
+	for ns, want := range []int{334, 333 * 2, 333 * 3} {
+		if got := c.NamespaceSize(func(x uint64) bool { return x == uint64(ns) }); got != want {
+			t.Errorf("namespace %d: invalid size: want=%d got=%d", ns, want, got)
+		}
+	}
+	if got := c.NamespaceSize(func(uint64) bool { return true }); got != c.Size() {
+		t.Errorf("all namespaces: invalid size: want=%d got=%d", c.Size(), got)
+	}
+}
+
 func TestLRUCache_Capacity(t *testing.T) {
 	c := NewCache(NewLRU(10))
 	if c.Capacity() != 10 {
@@ -561,3 +576,145 @@ func TestLRUCache_Close(t *testing.T) {
 		t.Errorf("delFunc isn't called 1 times: got=%d", delFuncCalled)
 	}
 }
+
+var testCachers = []struct {
+	name string
+	new  func(capacity int) Cacher
+}{
+	{"LRU", NewLRU},
+	{"2Q", New2Q},
+	{"CLOCK", NewClock},
+}
+
+func TestCacher_Capacity(t *testing.T) {
+	for _, tc := range testCachers {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCache(tc.new(10))
+			for i := 0; i < 100; i++ {
+				set(c, uint64(i%3), uint64(i), i, 1+i%2, nil).Release()
+				if c.Size() > 10 {
+					t.Fatalf("size exceeds capacity: got=%d", c.Size())
+				}
+			}
+			c.SetCapacity(4)
+			if c.Capacity() != 4 {
+				t.Errorf("invalid capacity: want=%d got=%d", 4, c.Capacity())
+			}
+			if c.Size() > 4 {
+				t.Errorf("size exceeds capacity: got=%d", c.Size())
+			}
+			c.EvictNS(0)
+			c.EvictNS(1)
+			c.EvictNS(2)
+			if c.Nodes() != 0 || c.Size() != 0 {
+				t.Errorf("cache not empty after EvictNS: nodes=%d size=%d", c.Nodes(), c.Size())
+			}
+		})
+	}
+}
+
+func TestCacher_DeleteAndClose(t *testing.T) {
+	for _, tc := range testCachers {
+		t.Run(tc.name, func(t *testing.T) {
+			relFuncCalled := 0
+			relFunc := func() {
+				relFuncCalled++
+			}
+			delFuncCalled := 0
+			delFunc := func() {
+				delFuncCalled++
+			}
+
+			c := NewCache(tc.new(10))
+			set(c, 0, 1, 1, 1, relFunc).Release()
+			set(c, 0, 2, 2, 1, relFunc).Release()
+			h3 := set(c, 0, 3, 3, 1, relFunc)
+			if !c.Delete(0, 1, delFunc) {
+				t.Error("Cache.Delete on #1 return false")
+			}
+			if h := c.Get(0, 1, nil); h != nil {
+				t.Errorf("Cache.Get on #1 return non-nil: %v", h.Value())
+			}
+			if !c.Evict(0, 2) {
+				t.Error("Cache.Evict on #2 return false")
+			}
+			if h := c.Get(0, 2, nil); h != nil {
+				t.Errorf("Cache.Get on #2 return non-nil: %v", h.Value())
+			}
+			if relFuncCalled != 2 || delFuncCalled != 1 {
+				t.Errorf("invalid release/delete calls: rel=%d del=%d", relFuncCalled, delFuncCalled)
+			}
+
+			c.Close()
+			h3.Release()
+			if relFuncCalled != 3 {
+				t.Errorf("relFunc isn't called 3 times: got=%d", relFuncCalled)
+			}
+		})
+	}
+}
+
+func TestClockCache_SecondChance(t *testing.T) {
+	c := NewCache(NewClock(3))
+	set(c, 0, 1, 1, 1, nil).Release()
+	set(c, 0, 2, 2, 1, nil).Release()
+	set(c, 0, 3, 3, 1, nil).Release()
+	if h := c.Get(0, 1, nil); h != nil { // referenced
+		h.Release()
+	}
+	set(c, 0, 4, 4, 1, nil).Release()
+
+	for _, key := range []uint64{1, 3, 4} {
+		if h := c.Get(0, key, nil); h == nil {
+			t.Errorf("miss for key '%d'", key)
+		} else {
+			h.Release()
+		}
+	}
+	if h := c.Get(0, 2, nil); h != nil {
+		t.Errorf("hit for key '%d'", 2)
+		h.Release()
+	}
+}
+
+func Test2QCache_ScanResistance(t *testing.T) {
+	// Keys of the working set, requested again after a while.
+	working := []uint64{0, 1, 2, 3, 4}
+	access := func(c *Cache, key uint64) (hit bool) {
+		hit = true
+		c.Get(0, key, func() (int, Value) {
+			hit = false
+			return 1, key
+		}).Release()
+		return
+	}
+
+	for _, tc := range []struct {
+		name string
+		new  func(capacity int) Cacher
+		want bool
+	}{
+		{"LRU", NewLRU, false},
+		{"2Q", New2Q, true},
+	} {
+		c := NewCache(tc.new(20))
+		for _, key := range working {
+			access(c, key)
+		}
+		for key := uint64(100); key < 120; key++ {
+			access(c, key)
+		}
+		for _, key := range working {
+			access(c, key)
+		}
+		// One-shot scan.
+		for key := uint64(1000); key < 2000; key++ {
+			access(c, key)
+		}
+		for _, key := range working {
+			if hit := access(c, key); hit != tc.want {
+				t.Errorf("%s: key '%d' after scan: want hit=%v, got hit=%v", tc.name, key, tc.want, hit)
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"sync"
+	"unsafe"
+)
+
+type clockNode struct {
+	n   *Node
+	h   *Handle
+	ban bool
+	ref bool
+
+	next, prev *clockNode
+}
+
+func (n *clockNode) insert(at *clockNode) {
+	x := at.next
+	at.next = n
+	n.prev = at
+	n.next = x
+	x.prev = n
+}
+
+func (n *clockNode) remove() {
+	if n.prev != nil {
+		n.prev.next = n.next
+		n.next.prev = n.prev
+		n.prev = nil
+		n.next = nil
+	} else {
+		panic("BUG: removing removed node")
+	}
+}
+
+type clock struct {
+	mu       sync.Mutex
+	capacity int
+	used     int
+	ring     clockNode
+	hand     *clockNode
+}
+
+func (r *clock) reset() {
+	r.ring.next = &r.ring
+	r.ring.prev = &r.ring
+	r.hand = &r.ring
+	r.used = 0
+}
+
+// Unlinks the node from the ring, moving the hand past it; need
+// external synchronization.
+func (r *clock) unlink(cn *clockNode) {
+	if r.hand == cn {
+		r.hand = cn.next
+	}
+	cn.remove()
+	cn.n.CacheData = nil
+	r.used -= cn.n.Size()
+}
+
+// Sweeps the hand until the used size fits the capacity, giving
+// referenced nodes a second chance; need external synchronization.
+func (r *clock) sweep() (evicted []*clockNode) {
+	for r.used > r.capacity {
+		cn := r.hand
+		if cn == &r.ring {
+			cn = cn.next
+			if cn == &r.ring {
+				panic("BUG: invalid CLOCK used or capacity counter")
+			}
+		}
+		r.hand = cn.next
+		if cn.ref {
+			cn.ref = false
+			continue
+		}
+		r.unlink(cn)
+		evicted = append(evicted, cn)
+	}
+	return
+}
+
+func (r *clock) Capacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.capacity
+}
+
+func (r *clock) SetCapacity(capacity int) {
+	r.mu.Lock()
+	r.capacity = capacity
+	evicted := r.sweep()
+	r.mu.Unlock()
+
+	for _, cn := range evicted {
+		cn.h.Release()
+	}
+}
+
+func (r *clock) Promote(n *Node) {
+	var evicted []*clockNode
+
+	r.mu.Lock()
+	if n.CacheData == nil {
+		if n.Size() <= r.capacity {
+			// Insert right behind the hand, so it is the last one to be
+			// visited by the sweep.
+			cn := &clockNode{n: n, h: n.GetHandle()}
+			cn.insert(r.hand.prev)
+			n.CacheData = unsafe.Pointer(cn)
+			r.used += n.Size()
+			evicted = r.sweep()
+		}
+	} else {
+		cn := (*clockNode)(n.CacheData)
+		if !cn.ban {
+			cn.ref = true
+		}
+	}
+	r.mu.Unlock()
+
+	for _, cn := range evicted {
+		cn.h.Release()
+	}
+}
+
+func (r *clock) Ban(n *Node) {
+	r.mu.Lock()
+	if n.CacheData == nil {
+		n.CacheData = unsafe.Pointer(&clockNode{n: n, ban: true})
+	} else {
+		cn := (*clockNode)(n.CacheData)
+		if !cn.ban {
+			r.unlink(cn)
+			cn.ban = true
+			n.CacheData = unsafe.Pointer(cn)
+			r.mu.Unlock()
+
+			cn.h.Release()
+			cn.h = nil
+			return
+		}
+	}
+	r.mu.Unlock()
+}
+
+func (r *clock) Evict(n *Node) {
+	r.mu.Lock()
+	cn := (*clockNode)(n.CacheData)
+	if cn == nil || cn.ban {
+		r.mu.Unlock()
+		return
+	}
+	r.unlink(cn)
+	r.mu.Unlock()
+
+	cn.h.Release()
+}
+
+func (r *clock) EvictNS(ns uint64) {
+	var evicted []*clockNode
+
+	r.mu.Lock()
+	for e := r.ring.next; e != &r.ring; {
+		cn := e
+		e = e.next
+		if cn.n.NS() == ns {
+			r.unlink(cn)
+			evicted = append(evicted, cn)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, cn := range evicted {
+		cn.h.Release()
+	}
+}
+
+func (r *clock) EvictAll() {
+	var evicted []*clockNode
+
+	r.mu.Lock()
+	for cn := r.ring.next; cn != &r.ring; cn = cn.next {
+		cn.n.CacheData = nil
+		evicted = append(evicted, cn)
+	}
+	r.reset()
+	r.mu.Unlock()
+
+	for _, cn := range evicted {
+		cn.h.Release()
+	}
+}
+
+func (r *clock) Close() error {
+	return nil
+}
+
+// NewClock create a new CLOCK-cache. CLOCK approximates LRU with a
+// reference bit per entry instead of reordering entries on every hit,
+// which makes cache hits cheaper.
+func NewClock(capacity int) Cacher {
+	r := &clock{capacity: capacity}
+	r.reset()
+	return r
+}
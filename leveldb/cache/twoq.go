@@ -0,0 +1,290 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+)
+
+type twoQNode struct {
+	n   *Node
+	h   *Handle
+	ban bool
+	hot bool
+
+	next, prev *twoQNode
+}
+
+func (n *twoQNode) insert(at *twoQNode) {
+	x := at.next
+	at.next = n
+	n.prev = at
+	n.next = x
+	x.prev = n
+}
+
+func (n *twoQNode) remove() {
+	if n.prev != nil {
+		n.prev.next = n.next
+		n.next.prev = n.prev
+		n.prev = nil
+		n.next = nil
+	} else {
+		panic("BUG: removing removed node")
+	}
+}
+
+type twoQGhostKey struct {
+	ns, key uint64
+}
+
+type twoQGhost struct {
+	k    twoQGhostKey
+	size int
+}
+
+// twoQ is the full version of the 2Q algorithm: new nodes enter the 'in'
+// FIFO queue, nodes evicted from it are remembered by key in the ghost
+// queue, and only nodes requested again while remembered are admitted to
+// the 'hot' LRU queue. One-shot nodes, e.g. read by a scan, never reach
+// the 'hot' queue and thus can't evict it.
+type twoQ struct {
+	mu       sync.Mutex
+	capacity int
+	used     int
+
+	in     twoQNode
+	inUsed int
+	hot    twoQNode
+
+	ghosts    map[twoQGhostKey]*list.Element
+	ghostList list.List
+	ghostUsed int
+}
+
+// Capacity of the 'in' queue, relative to the cache capacity.
+func (r *twoQ) inCapacity() int {
+	return r.capacity / 4
+}
+
+// Capacity of the ghost queue, relative to the cache capacity.
+func (r *twoQ) ghostCapacity() int {
+	return r.capacity / 2
+}
+
+func (r *twoQ) reset() {
+	r.in.next = &r.in
+	r.in.prev = &r.in
+	r.hot.next = &r.hot
+	r.hot.prev = &r.hot
+	r.used = 0
+	r.inUsed = 0
+	r.ghosts = make(map[twoQGhostKey]*list.Element)
+	r.ghostList.Init()
+	r.ghostUsed = 0
+}
+
+// Need external synchronization.
+func (r *twoQ) unlink(qn *twoQNode) {
+	qn.remove()
+	qn.n.CacheData = nil
+	r.used -= qn.n.Size()
+	if !qn.hot {
+		r.inUsed -= qn.n.Size()
+	}
+}
+
+// Need external synchronization.
+func (r *twoQ) addGhost(n *Node) {
+	k := twoQGhostKey{n.NS(), n.Key()}
+	if e, ok := r.ghosts[k]; ok {
+		r.ghostUsed -= r.ghostList.Remove(e).(twoQGhost).size
+	}
+	r.ghosts[k] = r.ghostList.PushFront(twoQGhost{k, n.Size()})
+	r.ghostUsed += n.Size()
+	for r.ghostUsed > r.ghostCapacity() {
+		g := r.ghostList.Remove(r.ghostList.Back()).(twoQGhost)
+		delete(r.ghosts, g.k)
+		r.ghostUsed -= g.size
+	}
+}
+
+// Need external synchronization.
+func (r *twoQ) removeGhost(k twoQGhostKey) bool {
+	e, ok := r.ghosts[k]
+	if ok {
+		r.ghostUsed -= r.ghostList.Remove(e).(twoQGhost).size
+		delete(r.ghosts, k)
+	}
+	return ok
+}
+
+// Evicts nodes until the used size fits the capacity. Nodes are taken
+// from the 'in' queue while it exceeds its share, or if the 'hot' queue
+// is empty; need external synchronization.
+func (r *twoQ) reclaim() (evicted []*twoQNode) {
+	for r.used > r.capacity {
+		var qn *twoQNode
+		if r.in.prev != &r.in && (r.inUsed > r.inCapacity() || r.hot.prev == &r.hot) {
+			qn = r.in.prev
+			r.addGhost(qn.n)
+		} else if r.hot.prev != &r.hot {
+			qn = r.hot.prev
+		} else {
+			panic("BUG: invalid 2Q used or capacity counter")
+		}
+		r.unlink(qn)
+		evicted = append(evicted, qn)
+	}
+	return
+}
+
+func (r *twoQ) Capacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.capacity
+}
+
+func (r *twoQ) SetCapacity(capacity int) {
+	r.mu.Lock()
+	r.capacity = capacity
+	evicted := r.reclaim()
+	r.mu.Unlock()
+
+	for _, qn := range evicted {
+		qn.h.Release()
+	}
+}
+
+func (r *twoQ) Promote(n *Node) {
+	var evicted []*twoQNode
+
+	r.mu.Lock()
+	if n.CacheData == nil {
+		if n.Size() <= r.capacity {
+			qn := &twoQNode{n: n, h: n.GetHandle()}
+			if r.removeGhost(twoQGhostKey{n.NS(), n.Key()}) {
+				qn.hot = true
+				qn.insert(&r.hot)
+			} else {
+				qn.insert(&r.in)
+				r.inUsed += n.Size()
+			}
+			n.CacheData = unsafe.Pointer(qn)
+			r.used += n.Size()
+			evicted = r.reclaim()
+		}
+	} else {
+		qn := (*twoQNode)(n.CacheData)
+		// Hits on the 'in' queue are considered correlated and don't
+		// move the node.
+		if !qn.ban && qn.hot {
+			qn.remove()
+			qn.insert(&r.hot)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, qn := range evicted {
+		qn.h.Release()
+	}
+}
+
+func (r *twoQ) Ban(n *Node) {
+	r.mu.Lock()
+	if n.CacheData == nil {
+		n.CacheData = unsafe.Pointer(&twoQNode{n: n, ban: true})
+	} else {
+		qn := (*twoQNode)(n.CacheData)
+		if !qn.ban {
+			r.unlink(qn)
+			qn.ban = true
+			n.CacheData = unsafe.Pointer(qn)
+			r.mu.Unlock()
+
+			qn.h.Release()
+			qn.h = nil
+			return
+		}
+	}
+	r.mu.Unlock()
+}
+
+func (r *twoQ) Evict(n *Node) {
+	r.mu.Lock()
+	qn := (*twoQNode)(n.CacheData)
+	if qn == nil || qn.ban {
+		r.mu.Unlock()
+		return
+	}
+	r.unlink(qn)
+	r.mu.Unlock()
+
+	qn.h.Release()
+}
+
+func (r *twoQ) EvictNS(ns uint64) {
+	var evicted []*twoQNode
+
+	r.mu.Lock()
+	for _, q := range []*twoQNode{&r.in, &r.hot} {
+		for e := q.next; e != q; {
+			qn := e
+			e = e.next
+			if qn.n.NS() == ns {
+				r.unlink(qn)
+				evicted = append(evicted, qn)
+			}
+		}
+	}
+	for e := r.ghostList.Front(); e != nil; {
+		g := e.Value.(twoQGhost)
+		e = e.Next()
+		if g.k.ns == ns {
+			r.removeGhost(g.k)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, qn := range evicted {
+		qn.h.Release()
+	}
+}
+
+func (r *twoQ) EvictAll() {
+	var evicted []*twoQNode
+
+	r.mu.Lock()
+	for _, q := range []*twoQNode{&r.in, &r.hot} {
+		for qn := q.next; qn != q; qn = qn.next {
+			qn.n.CacheData = nil
+			evicted = append(evicted, qn)
+		}
+	}
+	r.reset()
+	r.mu.Unlock()
+
+	for _, qn := range evicted {
+		qn.h.Release()
+	}
+}
+
+func (r *twoQ) Close() error {
+	return nil
+}
+
+// New2Q create a new scan-resistant 2Q-cache. Nodes are admitted to the
+// main LRU queue only when requested again shortly after being evicted
+// from a smaller FIFO queue, so one-shot requests, e.g. from a scan,
+// don't evict frequently requested nodes.
+func New2Q(capacity int) Cacher {
+	r := &twoQ{capacity: capacity}
+	r.reset()
+	return r
+}
@@ -63,3 +63,12 @@ func (icmp *iComparer) Successor(dst, b []byte) []byte {
 	}
 	return nil
 }
+
+// Prefix returns the user key, so that the versions of a key share a
+// bucket of a memdb.HashDB.
+func (icmp *iComparer) Prefix(key []byte) []byte {
+	if len(key) < 8 {
+		return key
+	}
+	return internalKey(key).ukey()
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func benchmarkCompare(b *testing.B, cmp BasicComparer, n int) {
+	r := rand.New(rand.NewSource(1))
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = make([]byte, n)
+		r.Read(keys[i])
+		// Share a long prefix, as sorted keys of a block do.
+		copy(keys[i], keys[0][:n*3/4])
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cmp.Compare(keys[i%len(keys)], keys[(i+1)%len(keys)])
+	}
+}
+
+func BenchmarkBytesComparer8(b *testing.B) {
+	benchmarkCompare(b, DefaultComparer, 8)
+}
+
+func BenchmarkFixedLengthComparer8(b *testing.B) {
+	benchmarkCompare(b, NewFixedLengthComparer(8), 8)
+}
+
+func BenchmarkBytesComparer32(b *testing.B) {
+	benchmarkCompare(b, DefaultComparer, 32)
+}
+
+func BenchmarkFixedLengthComparer32(b *testing.B) {
+	benchmarkCompare(b, NewFixedLengthComparer(32), 32)
+}
@@ -55,3 +55,13 @@ type Comparer interface {
 	// corruption on the internal state.
 	Successor(dst, b []byte) []byte
 }
+
+// KeyChecker is the interface that wraps the basic CheckKey method. A
+// Comparer may implement it to reject keys it isn't meant to order; the
+// keys of write operations are then checked if the StrictKeys flag of the
+// DB 'strict level' is set.
+type KeyChecker interface {
+	// CheckKey returns an error if the given key is not valid for the
+	// comparer.
+	CheckKey(key []byte) error
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestFixedLengthComparer(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 4, 8, 20} {
+		cmp := NewFixedLengthComparer(n)
+		keys := make([][]byte, 100)
+		for i := range keys {
+			keys[i] = make([]byte, n)
+			r.Read(keys[i])
+			if i%10 == 0 {
+				// Differ in the last byte only.
+				copy(keys[i], keys[0])
+				keys[i][n-1] = byte(i)
+			}
+		}
+		// Shortened keys, as in index blocks.
+		keys = append(keys, nil, []byte{0xff}, keys[0][:n-1])
+		for _, a := range keys {
+			for _, b := range keys {
+				if got, want := cmp.Compare(a, b), bytes.Compare(a, b); got != want {
+					t.Fatalf("n=%d: Compare(%x, %x): got %d, want %d", n, a, b, got, want)
+				}
+			}
+		}
+
+		kc := cmp.(KeyChecker)
+		if err := kc.CheckKey(keys[0]); err != nil {
+			t.Errorf("n=%d: CheckKey: got error: %v", n, err)
+		}
+		if err := kc.CheckKey(append(keys[0], 0)); err == nil {
+			t.Errorf("n=%d: CheckKey on longer key: got nil error", n)
+		}
+	}
+
+	if a, b := NewFixedLengthComparer(8).Name(), NewFixedLengthComparer(16).Name(); a == b {
+		t.Errorf("comparers of different lengths share name %q", a)
+	}
+
+	for _, n := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewFixedLengthComparer(%d): want panic", n)
+				}
+			}()
+			NewFixedLengthComparer(n)
+		}()
+	}
+}
+
+func TestTransformComparer(t *testing.T) {
+	cmp := NewTransformComparer(bytes.ToLower, "test.CaseInsensitive")
+	if got := cmp.Name(); got != "test.CaseInsensitive" {
+		t.Errorf("Name: got %q", got)
+	}
+
+	keys := [][]byte{[]byte("b"), []byte("C"), []byte("a"), []byte("B"), []byte("ab"), []byte("Aa"), nil}
+	sort.Slice(keys, func(i, j int) bool { return cmp.Compare(keys[i], keys[j]) < 0 })
+	want := []string{"", "a", "Aa", "ab", "B", "b", "C"}
+	for i, key := range keys {
+		if string(key) != want[i] {
+			t.Fatalf("order: got %q, want %q", keys, want)
+		}
+	}
+	for i, a := range keys {
+		if got := cmp.Compare(a, append([]byte{}, a...)); got != 0 {
+			t.Errorf("Compare(%q, %q): got %d, want 0", a, a, got)
+		}
+		if i > 0 {
+			if got := cmp.Compare(keys[i-1], a); got != -1 {
+				t.Errorf("Compare(%q, %q): got %d, want -1", keys[i-1], a, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+type fixedLengthComparer struct {
+	n int
+}
+
+// Longer keys are left to bytes.Compare, which is vectorized on most
+// platforms and beats comparing words in a loop.
+func (*fixedLengthComparer) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (c *fixedLengthComparer) Name() string {
+	return fmt.Sprintf("leveldb.FixedLengthComparator.%d", c.n)
+}
+
+func (*fixedLengthComparer) Separator(dst, a, b []byte) []byte {
+	return DefaultComparer.Separator(dst, a, b)
+}
+
+func (*fixedLengthComparer) Successor(dst, b []byte) []byte {
+	return DefaultComparer.Successor(dst, b)
+}
+
+func (c *fixedLengthComparer) CheckKey(key []byte) error {
+	if len(key) != c.n {
+		return fmt.Errorf("leveldb/comparer: invalid key length %d, want %d", len(key), c.n)
+	}
+	return nil
+}
+
+func compareUint64(x, y uint64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// Compares 4-bytes keys as big-endian integers. Shortened keys of the
+// index blocks, see Separator and Successor, have other lengths.
+type fixedLength4Comparer struct {
+	fixedLengthComparer
+}
+
+func (*fixedLength4Comparer) Compare(a, b []byte) int {
+	if len(a) != 4 || len(b) != 4 {
+		return bytes.Compare(a, b)
+	}
+	return compareUint64(uint64(binary.BigEndian.Uint32(a)), uint64(binary.BigEndian.Uint32(b)))
+}
+
+// Compares 8-bytes keys as big-endian integers, see fixedLength4Comparer.
+type fixedLength8Comparer struct {
+	fixedLengthComparer
+}
+
+func (*fixedLength8Comparer) Compare(a, b []byte) int {
+	if len(a) != 8 || len(b) != 8 {
+		return bytes.Compare(a, b)
+	}
+	return compareUint64(binary.BigEndian.Uint64(a), binary.BigEndian.Uint64(b))
+}
+
+// NewFixedLengthComparer returns a Comparer for keys that are all exactly
+// n bytes long, e.g. hashes or integers. It orders keys as DefaultComparer
+// does, 4 and 8 bytes keys being compared as big-endian integers. It also
+// implements KeyChecker, rejecting keys of any other length once the
+// opt.StrictKeys flag is set. It panics if n isn't positive.
+//
+// The name of the comparer includes n, so a DB created with it can only
+// be opened with the same n.
+func NewFixedLengthComparer(n int) Comparer {
+	switch {
+	case n <= 0:
+		panic("leveldb/comparer: invalid fixed key length")
+	case n == 4:
+		return &fixedLength4Comparer{fixedLengthComparer{n}}
+	case n == 8:
+		return &fixedLength8Comparer{fixedLengthComparer{n}}
+	}
+	return &fixedLengthComparer{n}
+}
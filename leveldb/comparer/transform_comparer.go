@@ -0,0 +1,58 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import "bytes"
+
+type transformComparer struct {
+	transform func([]byte) []byte
+	name      string
+}
+
+// Keys with the same transformed form are ordered bytewise, as only equal
+// keys may compare equal.
+func (c *transformComparer) Compare(a, b []byte) int {
+	if r := bytes.Compare(c.transform(a), c.transform(b)); r != 0 {
+		return r
+	}
+	return bytes.Compare(a, b)
+}
+
+func (c *transformComparer) Name() string {
+	return c.name
+}
+
+// Keys aren't shortened, as a shortened key may have a transformed form
+// ordered anywhere.
+func (*transformComparer) Separator(dst, a, b []byte) []byte {
+	return nil
+}
+
+func (*transformComparer) Successor(dst, b []byte) []byte {
+	return nil
+}
+
+// NewTransformComparer returns a Comparer ordering keys by their form
+// returned by transform, compared bytewise, e.g. bytes.ToLower for a case
+// insensitive order. Keys are stored as they are written, so reads return
+// the original keys. Keys with the same transformed form are still
+// distinct keys, ordered bytewise after each other; e.g. "B" and "b" both
+// sort between "a" and "c".
+//
+// The transform defines the order, so it needn't preserve the bytewise
+// order, but it must be deterministic: a key must always be transformed
+// to the same bytes. It must not modify its argument, and is called on
+// every comparison.
+//
+// The name is stored in the DB as the comparer name, see Comparer.Name,
+// and must be changed whenever the transform is.
+func NewTransformComparer(transform func([]byte) []byte, name string) Comparer {
+	if transform == nil {
+		panic("leveldb/comparer: nil transform")
+	}
+	return &transformComparer{transform: transform, name: name}
+}
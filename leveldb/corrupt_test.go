@@ -8,11 +8,16 @@ package leveldb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"strings"
 	"testing"
 
+	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/filter"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/storage"
@@ -163,6 +168,50 @@ func (h *dbCorruptHarness) corrupt(ft storage.FileType, fi, offset, n int) {
 	w.Close()
 }
 
+func (h *dbCorruptHarness) truncate(ft storage.FileType, fi, n int) {
+	p := &h.dbHarness
+	t := p.t
+
+	fds, _ := p.stor.List(ft)
+	sortFds(fds)
+	if fi < 0 {
+		fi = len(fds) - 1
+	}
+	if fi >= len(fds) {
+		t.Fatalf("no such file with type %q with index %d", ft, fi)
+	}
+
+	fd := fds[fi]
+	r, err := h.stor.Open(fd)
+	if err != nil {
+		t.Fatal("cannot open file: ", err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("cannot read file: ", err)
+	}
+	r.Close()
+
+	if n > len(buf) {
+		n = len(buf)
+	}
+	buf = buf[:len(buf)-n]
+
+	err = h.stor.Remove(fd)
+	if err != nil {
+		t.Fatal("cannot remove old file: ", err)
+	}
+	w, err := h.stor.Create(fd)
+	if err != nil {
+		t.Fatal("cannot create new file: ", err)
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		t.Fatal("cannot write new file: ", err)
+	}
+	w.Close()
+}
+
 func (h *dbCorruptHarness) removeAll(ft storage.FileType) {
 	fds, err := h.stor.List(ft)
 	if err != nil {
@@ -244,6 +293,92 @@ func TestCorruptDB_Journal(t *testing.T) {
 	h.check(36, 36)
 }
 
+func TestCorruptDB_JournalTruncatedTail(t *testing.T) {
+	h := newDbCorruptHarnessWopt(t, &opt.Options{
+		BlockCacheCapacity: 100,
+		Strict:             opt.StrictJournalChecksum | opt.StrictJournal,
+	})
+	defer h.close()
+
+	h.build(100)
+	h.check(100, 100)
+	h.closeDB()
+	h.truncate(storage.TypeJournal, -1, ctValSize/2)
+
+	// Read-only mode leaves the journal as is.
+	h.o.ReadOnly = true
+	h.openDB()
+	h.check(99, 99)
+	if report := h.db.RecoveryReport(); report.BytesTruncated == 0 {
+		t.Errorf("truncated journal, read-only: got %+v, want truncated bytes", report)
+	}
+	h.closeDB()
+
+	h.o.ReadOnly = false
+	h.openDB()
+	h.check(99, 99)
+	if report := h.db.RecoveryReport(); report.BytesTruncated == 0 {
+		t.Errorf("truncated journal: got %+v, want truncated bytes", report)
+	}
+}
+
+func TestCorruptDB_JournalInteriorCorruption(t *testing.T) {
+	h := newDbCorruptHarnessWopt(t, &opt.Options{
+		BlockCacheCapacity: 100,
+		Strict:             opt.StrictJournalChecksum | opt.StrictJournal,
+	})
+	defer h.close()
+
+	h.build(100)
+	h.check(100, 100)
+	h.closeDB()
+	h.corrupt(storage.TypeJournal, -1, 19, 1)
+
+	h.openAssert(false)
+}
+
+func TestCorruptDB_RecoveryReport(t *testing.T) {
+	h := newDbCorruptHarness(t)
+	defer h.close()
+
+	openWithReport := func() *RecoveryReport {
+		db, report, err := OpenWithRecoveryReport(h.stor, h.o)
+		if err != nil {
+			t.Fatal("OpenWithRecoveryReport: got error: ", err)
+		}
+		h.db = db
+		return report
+	}
+
+	h.closeDB()
+	if report := openWithReport(); *report != (RecoveryReport{}) {
+		t.Errorf("empty journal: got %+v, want zero", report)
+	}
+
+	h.build(100)
+	h.closeDB()
+	h.truncate(storage.TypeJournal, -1, ctValSize/2)
+	report := openWithReport()
+	h.check(99, 99)
+	if report.JournalsReplayed != 1 || report.RecordsReplayed != 99 || report.RecordsSkipped != 0 {
+		t.Errorf("truncated journal: got %+v, want 99 records replayed from 1 journal", report)
+	}
+	if report.BytesTruncated == 0 || report.BytesDropped != 0 {
+		t.Errorf("truncated journal: got %+v, want only truncated bytes", report)
+	}
+
+	h.build(100)
+	h.closeDB()
+	h.corrupt(storage.TypeJournal, -1, 19, 1)
+	report = openWithReport()
+	if report.RecordsReplayed == 0 || report.RecordsReplayed >= 100 {
+		t.Errorf("corrupted journal: got %+v, want some records replayed", report)
+	}
+	if report.BytesDropped == 0 || report.BytesTruncated != 0 {
+		t.Errorf("corrupted journal: got %+v, want only dropped bytes", report)
+	}
+}
+
 func TestCorruptDB_Table(t *testing.T) {
 	h := newDbCorruptHarness(t)
 	defer h.close()
@@ -366,6 +501,111 @@ func TestCorruptDB_CorruptedManifest(t *testing.T) {
 	h.getVal("foo", "hello")
 }
 
+func TestCorruptDB_CorruptedManifestFallback(t *testing.T) {
+	h := newDbCorruptHarness(t)
+	defer h.close()
+
+	h.put("foo", "hello")
+	h.compactMem()
+	h.compactRange("", "")
+	h.reopenDB()
+	h.getVal("foo", "hello")
+	h.closeDB()
+
+	fds, _ := h.stor.List(storage.TypeManifest)
+	if len(fds) != 2 {
+		t.Fatalf("expect 2 manifest files, got %d", len(fds))
+	}
+	h.corrupt(storage.TypeManifest, -1, 0, 1000)
+	before, _ := h.stor.List(storage.TypeAll)
+	var maxNum int64
+	existed := make(map[storage.FileDesc]bool)
+	for _, fd := range before {
+		existed[fd] = true
+		if fd.Num > maxNum {
+			maxNum = fd.Num
+		}
+	}
+
+	h.openDB()
+	// The backup predates some files, their numbers aren't reused.
+	after, _ := h.stor.List(storage.TypeAll)
+	for _, fd := range after {
+		if !existed[fd] && fd.Num <= maxNum {
+			t.Errorf("file created after fallback: got %s-%d, want numbered above %d", fd.Type, fd.Num, maxNum)
+		}
+	}
+	h.getVal("foo", "hello")
+	h.put("bar", "world")
+	h.reopenDB()
+	h.getVal("foo", "hello")
+	h.getVal("bar", "world")
+}
+
+func TestCorruptDB_CorruptedManifestFallbackNewerTable(t *testing.T) {
+	h := newDbCorruptHarness(t)
+	defer h.close()
+
+	h.put("foo", "hello")
+	h.compactMem()
+	h.reopenDB()
+	// Flushed after the manifest rotation, only the active manifest refers
+	// to the table.
+	h.put("bar", "world")
+	h.compactMem()
+	h.closeDB()
+
+	tables, _ := h.stor.List(storage.TypeTable)
+	h.corrupt(storage.TypeManifest, -1, 0, 1000)
+
+	// Falling back to the backup manifest would drop the table.
+	h.openAssert(false)
+	if fds, _ := h.stor.List(storage.TypeTable); len(fds) != len(tables) {
+		t.Fatalf("tables after failed open: got %d, want %d", len(fds), len(tables))
+	}
+
+	h.recover()
+	h.getVal("foo", "hello")
+	h.getVal("bar", "world")
+}
+
+func TestCorruptDB_CorruptedManifestRetained(t *testing.T) {
+	h := newDbCorruptHarnessWopt(t, &opt.Options{
+		BlockCacheCapacity:    100,
+		KeepObsoleteManifests: 2,
+		Strict:                opt.StrictJournalChecksum,
+	})
+	defer h.close()
+
+	for i := 0; i < 4; i++ {
+		h.put("foo", fmt.Sprint(i))
+		h.compactMem()
+		h.reopenDB()
+	}
+	h.closeDB()
+	// The current manifest, its backup and the retained ones.
+	if fds, _ := h.stor.List(storage.TypeManifest); len(fds) != 4 {
+		t.Fatalf("manifests: got %d, want 4", len(fds))
+	}
+
+	// Recovered from the backup, not from an older retained manifest.
+	h.corrupt(storage.TypeManifest, -1, 0, 1000)
+	h.openDB()
+	h.getVal("foo", "3")
+	h.closeDB()
+	// The corrupted manifest isn't retained, the backup of the new manifest
+	// still precedes it.
+	if fds, _ := h.stor.List(storage.TypeManifest); len(fds) != 4 {
+		t.Fatalf("manifests after fallback: got %d, want 4", len(fds))
+	}
+
+	// The retained manifests aren't tried once the backup is corrupted too.
+	fds, _ := h.stor.List(storage.TypeManifest)
+	h.corrupt(storage.TypeManifest, len(fds)-1, 0, 1000)
+	h.corrupt(storage.TypeManifest, len(fds)-2, 0, 1000)
+	h.openAssert(false)
+}
+
 func TestCorruptDB_CompactionInputError(t *testing.T) {
 	h := newDbCorruptHarness(t)
 	defer h.close()
@@ -494,3 +734,63 @@ func TestCorruptDB_RecoverTable(t *testing.T) {
 	}
 	h.check(985, 985)
 }
+
+func TestCorruptDB_BlobPointer(t *testing.T) {
+	for _, strict := range []opt.Strict{opt.DefaultStrict, opt.NoStrict} {
+		h := newDbCorruptHarnessWopt(t, &opt.Options{
+			Strict:            strict,
+			EnableBlobFiles:   true,
+			BlobFileThreshold: 100,
+		})
+
+		h.put("a", strings.Repeat("a", 100))
+		h.compactMem()
+		fds, err := h.stor.List(storage.TypeBlob)
+		if err != nil || len(fds) != 1 {
+			t.Fatalf("List blob files: got %v, %v; want 1 file", fds, err)
+		}
+
+		// Pointers into the blob file a corrupted table may hold: sizes
+		// overflowing an int or beyond the file, negative offsets and
+		// offsets beyond the file.
+		num := uint64(fds[0].Num)
+		ptrs := map[string][3]uint64{
+			"b": {num, 0, 1 << 63},
+			"c": {num, 0, math.MaxInt32 + 1},
+			"d": {num, 1 << 63, 1},
+			"e": {num, 0, 1 << 30},
+			"f": {num, 1 << 20, 1},
+		}
+		mem := h.db.getEffectiveMem()
+		for k, x := range ptrs {
+			var ptr []byte
+			for _, v := range x {
+				ptr = binary.AppendUvarint(ptr, v)
+			}
+			if err := mem.Put(makeInternalKey(nil, []byte(k), h.db.getSeq(), keyTypeBlob), ptr); err != nil {
+				mem.decref()
+				t.Fatal("Put: got error: ", err)
+			}
+		}
+		mem.decref()
+		h.compactMem()
+
+		h.getVal("a", strings.Repeat("a", 100))
+		for k := range ptrs {
+			if _, err := h.db.Get([]byte(k), h.ro); !errors.IsCorrupted(err) {
+				t.Errorf("strict=%#x Get(%q): got error %v, want corrupted", strict, k, err)
+			}
+		}
+		iter := h.db.NewIterator(nil, h.ro)
+		for iter.Next() {
+			if k := string(iter.Key()); k != "a" {
+				t.Errorf("strict=%#x Iterator: got key %q", strict, k)
+			}
+		}
+		if err := iter.Error(); !errors.IsCorrupted(err) {
+			t.Errorf("strict=%#x Iterator: got error %v, want corrupted", strict, err)
+		}
+		iter.Release()
+		h.close()
+	}
+}
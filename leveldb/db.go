@@ -8,10 +8,12 @@ package leveldb
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -37,13 +39,17 @@ type DB struct {
 	cWriteDelayN           int32 // The cumulative number of write delays
 	inWritePaused          int32 // The indicator whether write operation is paused by compaction
 	aliveSnaps, aliveIters int32
+	outOfSpace             int32 // The indicator whether compaction failed for lack of disk space, see Healthy
 
 	// Session.
-	s *session
+	s         *session
+	catchUpMu sync.Mutex // Secondary catch up.
+	labelDB   string     // Profiling label, see setLabels.
+	recovery  RecoveryReport
 
 	// MemDB.
 	memMu           sync.RWMutex
-	memPool         chan *memdb.DB
+	memPool         chan memdb.Table
 	mem, frozenMem  *memDB
 	journal         *journal.Writer
 	journalWriter   storage.Writer
@@ -52,8 +58,10 @@ type DB struct {
 	frozenSeq       uint64
 
 	// Snapshot.
-	snapsMu   sync.Mutex
-	snapsList *list.List
+	snapsMu      sync.Mutex
+	snapsList    *list.List
+	retainSeq    uint64 // Sequence retained from compaction, see RetainSequence
+	compactedSeq uint64 // Sequence compactions may have dropped entries before, see NewIteratorAtSequence
 
 	// Write.
 	batchPool    sync.Pool
@@ -65,18 +73,30 @@ type DB struct {
 	writeDelayN  int
 	tr           *Transaction
 
+	// Write stall reported to OnWriteStall, see updateWriteStall.
+	writeStallMu sync.Mutex
+	writeStall   int
+
 	// Compaction.
 	compCommitLk     sync.Mutex
 	tcompCmdC        chan cCmd
 	tcompPauseC      chan chan<- struct{}
+	tcompUserPauseC  chan (<-chan struct{})
+	tcompUserResumeC chan struct{}
+	tcompUserPauseMu sync.Mutex
 	mcompCmdC        chan cCmd
 	compErrC         chan error
 	compPerErrC      chan error
 	compErrSetC      chan error
 	compWriteLocking bool
 	compStats        cStats
+	compStatsWMu     sync.Mutex
 	memdbMaxLevel    int // For testing.
 
+	// Blob GC; only accessed by table compaction goroutine.
+	blobGCPending bool
+	blobRefs      map[int64][]int64 // blob files referred to by table
+
 	// Close.
 	closeW sync.WaitGroup
 	closeC chan struct{}
@@ -92,9 +112,11 @@ func openDB(s *session) (*DB, error) {
 		// Initial sequence
 		seq: s.stSeqNum,
 		// MemDB
-		memPool: make(chan *memdb.DB, 1),
+		memPool: make(chan memdb.Table, 1),
 		// Snapshot
 		snapsList: list.New(),
+		// Tables may have been compacted up to the last flushed sequence.
+		compactedSeq: s.stSeqNum,
 		// Write
 		batchPool:    sync.Pool{New: newBatch},
 		writeMergeC:  make(chan writeMerge),
@@ -102,15 +124,17 @@ func openDB(s *session) (*DB, error) {
 		writeLockC:   make(chan struct{}, 1),
 		writeAckC:    make(chan error),
 		// Compaction
-		tcompCmdC:   make(chan cCmd),
-		tcompPauseC: make(chan chan<- struct{}),
-		mcompCmdC:   make(chan cCmd),
-		compErrC:    make(chan error),
-		compPerErrC: make(chan error),
-		compErrSetC: make(chan error),
+		tcompCmdC:       make(chan cCmd),
+		tcompPauseC:     make(chan chan<- struct{}),
+		tcompUserPauseC: make(chan (<-chan struct{})),
+		mcompCmdC:       make(chan cCmd),
+		compErrC:        make(chan error),
+		compPerErrC:     make(chan error),
+		compErrSetC:     make(chan error),
 		// Close
 		closeC: make(chan struct{}),
 	}
+	db.setLabels()
 
 	// Read-only mode.
 	readOnly := s.o.GetReadOnly()
@@ -139,19 +163,25 @@ func openDB(s *session) (*DB, error) {
 	}
 
 	// Doesn't need to be included in the wait group.
-	go db.compactionError()
-	go db.mpoolDrain()
+	db.goLabeled("compaction-error", db.compactionError)
+	db.goLabeled("mpool-drain", db.mpoolDrain)
 
 	if readOnly {
 		db.SetReadOnly()
 	} else {
+		// The recovered level-0 may already stall writes.
+		db.updateWriteStall()
 		db.closeW.Add(2)
-		go db.tCompaction()
-		go db.mCompaction()
+		db.goLabeled("table-compaction", db.tCompaction)
+		db.goLabeled("memdb-compaction", db.mCompaction)
+		if db.s.lazyManifestSync() {
+			db.closeW.Add(1)
+			db.goLabeled("manifest-sync", db.mManifestSync)
+		}
 		// go db.jWriter()
 	}
 
-	s.logf("db@open done T·%v", time.Since(start))
+	s.logFields(map[string]interface{}{"T": time.Since(start)}, "db@open done")
 
 	runtime.SetFinalizer(db, (*DB).Close)
 	return db, nil
@@ -169,6 +199,9 @@ func openDB(s *session) (*DB, error) {
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func Open(stor storage.Storage, o *opt.Options) (db *DB, err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
 	s, err := newSession(stor, o)
 	if err != nil {
 		return
@@ -185,6 +218,7 @@ func Open(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 		if !os.IsNotExist(err) || s.o.GetErrorIfMissing() {
 			return
 		}
+		s.stSeqNum = s.o.GetInitialSequence()
 		err = s.create()
 		if err != nil {
 			return
@@ -194,9 +228,67 @@ func Open(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 		return
 	}
 
+	err = s.checkNumLevels()
+	if err != nil {
+		return
+	}
 	return openDB(s)
 }
 
+// RecoveryReport summarizes what was done to recover the DB when opened,
+// see OpenWithRecoveryReport and DB.RecoveryReport.
+type RecoveryReport struct {
+	// JournalsReplayed is the number of journals replayed into the DB.
+	// Empty journals, such as the one of a DB closed without any write,
+	// aren't counted.
+	JournalsReplayed int
+
+	// RecordsReplayed is the number of journal records, i.e. write batches,
+	// applied to the DB.
+	RecordsReplayed int
+
+	// RecordsSkipped is the number of journal records skipped because they
+	// are corrupted. Corrupted records fail the open instead with
+	// opt.StrictJournal.
+	RecordsSkipped int
+
+	// BytesDropped is the number of journal bytes dropped because they are
+	// corrupted, e.g. by a bad checksum. Corrupted chunks fail the open
+	// instead with opt.StrictJournal.
+	BytesDropped int64
+
+	// BytesTruncated is the number of journal bytes dropped because they
+	// are an incomplete record at the tail of a journal, as left by a
+	// crash in the middle of a write.
+	BytesTruncated int64
+}
+
+// OpenWithRecoveryReport is like Open, but also returns a report of the
+// recovery actions taken while opening the DB, e.g. so that data dropped
+// by a crash can be alerted on. The report is zero if there was nothing
+// to recover.
+func OpenWithRecoveryReport(stor storage.Storage, o *opt.Options) (*DB, *RecoveryReport, error) {
+	db, err := Open(stor, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	report := db.RecoveryReport()
+	return db, &report, nil
+}
+
+// RecoveryReport returns the report of the recovery actions taken while
+// opening the DB, however it was opened. Journals replayed later by
+// DB.CatchUpWithPrimary aren't accounted.
+func (db *DB) RecoveryReport() RecoveryReport {
+	return db.recovery
+}
+
+func fileOptions(o *opt.Options) *storage.FileOptions {
+	return &storage.FileOptions{
+		ExtendedCurrent: o.GetExtendedCurrentFile(),
+	}
+}
+
 // OpenFile opens or creates a DB for the given path.
 // The DB will be created if not exist, unless ErrorIfMissing is true.
 // Also, if ErrorIfExist is true and the DB exist OpenFile will returns
@@ -212,7 +304,7 @@ func Open(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func OpenFile(path string, o *opt.Options) (db *DB, err error) {
-	stor, err := storage.OpenFile(path, o.GetReadOnly())
+	stor, err := storage.OpenFileWithOptions(path, o.GetReadOnly(), fileOptions(o))
 	if err != nil {
 		return
 	}
@@ -230,9 +322,16 @@ func OpenFile(path string, o *opt.Options) (db *DB, err error) {
 // The DB must already exist or it will returns an error.
 // Also, Recover will ignore ErrorIfMissing and ErrorIfExist options.
 //
+// The format version of the DB is recovered from the tables; Recover fails
+// with ErrUnsupportedFormat if they need a newer format version than
+// MaxFormatVersion.
+//
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func Recover(stor storage.Storage, o *opt.Options) (db *DB, err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
 	s, err := newSession(stor, o)
 	if err != nil {
 		return
@@ -248,6 +347,10 @@ func Recover(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 	if err != nil {
 		return
 	}
+	err = s.checkNumLevels()
+	if err != nil {
+		return
+	}
 	return openDB(s)
 }
 
@@ -262,7 +365,7 @@ func Recover(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func RecoverFile(path string, o *opt.Options) (db *DB, err error) {
-	stor, err := storage.OpenFile(path, false)
+	stor, err := storage.OpenFileWithOptions(path, false, fileOptions(o))
 	if err != nil {
 		return
 	}
@@ -279,6 +382,8 @@ func recoverTable(s *session, o *opt.Options) error {
 	o = dupOptions(o)
 	// Mask StrictReader, lets StrictRecovery doing its job.
 	o.Strict &= ^opt.StrictReader
+	// The block size ceiling only applies to new writes.
+	o.MaxBlockSize = 0
 
 	// Get all tables and sort it by file number.
 	fds, err := s.stor.List(storage.TypeTable)
@@ -291,6 +396,9 @@ func recoverTable(s *session, o *opt.Options) error {
 		maxSeq                                                            uint64
 		recoveredKey, goodKey, corruptedKey, corruptedBlock, droppedTable int
 
+		// Oldest format version supporting the recovered tables.
+		formatVersion = opt.FormatV1
+
 		// We will drop corrupted table.
 		strict = o.GetStrict(opt.StrictRecovery)
 		noSync = o.GetNoSync()
@@ -298,7 +406,7 @@ func recoverTable(s *session, o *opt.Options) error {
 		rec   = &sessionRecord{}
 		bpool = util.NewBufferPool(o.GetBlockSize() + 5)
 	)
-	buildTable := func(iter iterator.Iterator) (tmpFd storage.FileDesc, size int64, err error) {
+	buildTable := func(iter iterator.Iterator, o *opt.Options) (tmpFd storage.FileDesc, size int64, err error) {
 		tmpFd = s.newTemp()
 		writer, err := s.stor.Create(tmpFd)
 		if err != nil {
@@ -337,7 +445,7 @@ func recoverTable(s *session, o *opt.Options) error {
 				return
 			}
 		}
-		size = int64(tw.BytesLen())
+		size = tw.BytesLen()
 		return
 	}
 	recoverTable := func(fd storage.FileDesc) error {
@@ -362,6 +470,7 @@ func recoverTable(s *session, o *opt.Options) error {
 		var (
 			tSeq                                     uint64
 			tgoodKey, tcorruptedKey, tcorruptedBlock int
+			tblob                                    bool
 			imin, imax                               []byte
 		)
 		tr, err := table.NewReader(reader, size, fd, nil, bpool, o)
@@ -381,12 +490,15 @@ func recoverTable(s *session, o *opt.Options) error {
 		// Scan the table.
 		for iter.Next() {
 			key := iter.Key()
-			_, seq, _, kerr := parseInternalKey(key)
+			_, seq, kt, kerr := parseInternalKey(key)
 			if kerr != nil {
 				tcorruptedKey++
 				continue
 			}
 			tgoodKey++
+			if kt == keyTypeBlob {
+				tblob = true
+			}
 			if seq > tSeq {
 				tSeq = seq
 			}
@@ -415,8 +527,15 @@ func recoverTable(s *session, o *opt.Options) error {
 			if tcorruptedKey > 0 || tcorruptedBlock > 0 {
 				// Rebuild the table.
 				s.logf("table@recovery rebuilding @%d", fd.Num)
+				// Keep the layout of the table, so that it needs the same
+				// format version.
+				to := dupOptions(o)
+				to.TwoLevelIndex = tr.TwoLevelIndex()
+				if !tr.Transformed() {
+					to.BlockTransform = nil
+				}
 				iter := tr.NewIterator(nil, nil)
-				tmpFd, newSize, err := buildTable(iter)
+				tmpFd, newSize, err := buildTable(iter, to)
 				iter.Release()
 				if err != nil {
 					return err
@@ -431,6 +550,18 @@ func recoverTable(s *session, o *opt.Options) error {
 			if tSeq > maxSeq {
 				maxSeq = tSeq
 			}
+			tformatVersion := opt.FormatV1
+			switch {
+			case tr.Transformed():
+				tformatVersion = opt.FormatV4
+			case tr.TwoLevelIndex():
+				tformatVersion = opt.FormatV3
+			case tblob:
+				tformatVersion = opt.FormatV2
+			}
+			if tformatVersion > formatVersion {
+				formatVersion = tformatVersion
+			}
 			recoveredKey += tgoodKey
 			// Add table to level 0.
 			rec.addTable(0, fd.Num, size, imin, imax)
@@ -462,6 +593,14 @@ func recoverTable(s *session, o *opt.Options) error {
 	// Set sequence number.
 	rec.setSeqNum(maxSeq)
 
+	// Record the format version the recovered tables need, the DB may only
+	// be upgraded up to MaxFormatVersion.
+	if max := o.GetMaxFormatVersion(); formatVersion > max {
+		return &ErrUnsupportedFormat{Version: formatVersion, Latest: max}
+	} else if formatVersion > opt.FormatV1 {
+		rec.setFormatVersion(formatVersion)
+	}
+
 	// Create new manifest.
 	if err := s.create(); err != nil {
 		return err
@@ -471,6 +610,158 @@ func recoverTable(s *session, o *opt.Options) error {
 	return s.commit(rec)
 }
 
+// journalRecords holds records of a journal that was read ahead of
+// replay.
+type journalRecords struct {
+	records   [][]byte
+	truncated int64
+	dropped   int64
+	err       error
+}
+
+// Reports whether the journal holds nothing at all, not even corrupted
+// data, as a journal just created does; see RecoveryReport.
+func (r *journalRecords) empty() bool {
+	return len(r.records) == 0 && r.truncated == 0 && r.dropped == 0
+}
+
+// journalReader reads journals ahead of replay, concurrently, bounded by
+// opt.Options.RecoveryConcurrency, both in number of journals and in their
+// total size. Records must be consumed in journal order using get.
+type journalReader struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	closed  bool
+	n       int   // Journals read and not consumed yet.
+	size    int64 // Total size of these journals.
+	maxN    int
+	maxSize int64
+
+	sizes []int64
+	resC  []chan *journalRecords
+}
+
+func (db *DB) newJournalReader(fds []storage.FileDesc, strict, checksum bool) *journalReader {
+	jr := &journalReader{
+		maxN:    db.s.o.GetRecoveryConcurrency(),
+		maxSize: int64(db.s.o.GetRecoveryConcurrency()) * int64(db.s.o.GetWriteBuffer()),
+		sizes:   make([]int64, len(fds)),
+		resC:    make([]chan *journalRecords, len(fds)),
+	}
+	jr.cond.L = &jr.mu
+	for i := range jr.resC {
+		jr.resC[i] = make(chan *journalRecords, 1)
+	}
+	db.goLabeled("journal-reader", func() {
+		for i, fd := range fds {
+			// The size is only used for bounding read-ahead, errors are
+			// reported by readJournal.
+			size, _ := fileSize(db.s.stor, fd)
+			if !jr.acquire(size) {
+				return
+			}
+			jr.sizes[i] = size
+			go func(resC chan<- *journalRecords, fd storage.FileDesc) {
+				resC <- db.readJournal(fd, strict, checksum)
+			}(jr.resC[i], fd)
+		}
+	})
+	return jr
+}
+
+// Waits until a journal of the given size may be read. A journal is always
+// read if no other is, even if it exceeds the size bound.
+func (jr *journalReader) acquire(size int64) bool {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	for !jr.closed && jr.n > 0 && (jr.n >= jr.maxN || jr.size+size > jr.maxSize) {
+		jr.cond.Wait()
+	}
+	if jr.closed {
+		return false
+	}
+	jr.n++
+	jr.size += size
+	return true
+}
+
+// Returns records of the i-th journal, waits until it is read.
+func (jr *journalReader) get(i int) *journalRecords {
+	r := <-jr.resC[i]
+	jr.mu.Lock()
+	jr.n--
+	jr.size -= jr.sizes[i]
+	jr.cond.Broadcast()
+	jr.mu.Unlock()
+	return r
+}
+
+// Stops reading further journals.
+func (jr *journalReader) close() {
+	jr.mu.Lock()
+	jr.closed = true
+	jr.cond.Broadcast()
+	jr.mu.Unlock()
+}
+
+// Reads all records of the given journal.
+func (db *DB) readJournal(fd storage.FileDesc, strict, checksum bool) *journalRecords {
+	res := &journalRecords{}
+	fr, err := db.s.stor.Open(fd)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer fr.Close()
+
+	jr := journal.NewReader(fr, dropper{s: db.s, fd: fd, dropped: &res.dropped}, strict, checksum)
+	var (
+		transform opt.BlockTransform
+		first     = true
+	)
+	for {
+		r, err := jr.Next()
+		if err != nil {
+			if err != io.EOF {
+				res.err = errors.SetFd(err, fd)
+			}
+			break
+		}
+
+		buf := &util.Buffer{}
+		if _, err := buf.ReadFrom(r); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				// This is error returned due to corruption, with strict == false,
+				// or due to incomplete journal at the tail.
+				continue
+			}
+
+			res.err = errors.SetFd(err, fd)
+			break
+		}
+		rec := buf.Bytes()
+		if first {
+			first = false
+			if isJournalTransformHeader(rec) {
+				if transform, err = db.checkJournalTransform(fd, rec); err != nil {
+					res.err = err
+					break
+				}
+				continue
+			}
+		}
+		if transform != nil {
+			if rec, err = transform.Decode(nil, rec); err != nil {
+				res.err = errors.NewErrCorrupted(fd, err)
+				break
+			}
+		}
+		res.records = append(res.records, rec)
+	}
+	res.truncated = jr.Truncated()
+	return res
+}
+
 func (db *DB) recoverJournal() error {
 	// Get all journals and sort it by file number.
 	rawFds, err := db.s.stor.List(storage.TypeJournal)
@@ -505,33 +796,25 @@ func (db *DB) recoverJournal() error {
 			checksum    = db.s.o.GetStrict(opt.StrictJournalChecksum)
 			writeBuffer = db.s.o.GetWriteBuffer()
 
-			jr       *journal.Reader
-			mdb      = memdb.New(db.s.icmp, writeBuffer)
-			buf      = &util.Buffer{}
+			jr       = db.newJournalReader(fds, strict, checksum)
+			mdb      = db.newMemTable(writeBuffer)
 			batchSeq uint64
 			batchLen int
 		)
+		defer jr.close()
 
-		for _, fd := range fds {
+		for i, fd := range fds {
 			db.logf("journal@recovery recovering @%d", fd.Num)
 
-			fr, err := db.s.stor.Open(fd)
-			if err != nil {
-				return err
-			}
-
-			// Create or reset journal reader instance.
-			if jr == nil {
-				jr = journal.NewReader(fr, dropper{db.s, fd}, strict, checksum)
-			} else {
-				jr.Reset(fr, dropper{db.s, fd}, strict, checksum)
+			jrec := jr.get(i)
+			if jrec.err != nil {
+				return jrec.err
 			}
 
 			// Flush memdb and remove obsolete journal file.
 			if !ofd.Zero() {
 				if mdb.Len() > 0 {
 					if _, err := db.s.flushMemdb(rec, mdb, 0); err != nil {
-						fr.Close()
 						return err
 					}
 				}
@@ -539,65 +822,50 @@ func (db *DB) recoverJournal() error {
 				rec.setJournalNum(fd.Num)
 				rec.setSeqNum(db.seq)
 				if err := db.s.commit(rec); err != nil {
-					fr.Close()
 					return err
 				}
 				rec.resetAddedTables()
 
-				db.s.stor.Remove(ofd)
+				db.removeJournal(ofd)
 				ofd = storage.FileDesc{}
 			}
 
 			// Replay journal to memdb.
 			mdb.Reset()
-			for {
-				r, err := jr.Next()
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-
-					fr.Close()
-					return errors.SetFd(err, fd)
-				}
-
-				buf.Reset()
-				if _, err := buf.ReadFrom(r); err != nil {
-					if err == io.ErrUnexpectedEOF {
-						// This is error returned due to corruption, with strict == false.
-						continue
-					}
-
-					fr.Close()
-					return errors.SetFd(err, fd)
-				}
-				batchSeq, batchLen, err = decodeBatchToMem(buf.Bytes(), db.seq, mdb)
+			for _, r := range jrec.records {
+				batchSeq, batchLen, err = decodeBatchToMem(r, db.seq, mdb)
 				if err != nil {
 					if !strict && errors.IsCorrupted(err) {
 						db.s.logf("journal error: %v (skipped)", err)
+						db.recovery.RecordsSkipped++
 						// We won't apply sequence number as it might be corrupted.
 						continue
 					}
 
-					fr.Close()
 					return errors.SetFd(err, fd)
 				}
+				db.recovery.RecordsReplayed++
 
 				// Save sequence number.
-				db.seq = batchSeq + uint64(batchLen)
+				db.seq = batchSeq + uint64(batchLen) - 1
 
 				// Flush it if large enough.
 				if mdb.Size() >= writeBuffer {
 					if _, err := db.s.flushMemdb(rec, mdb, 0); err != nil {
-						fr.Close()
 						return err
 					}
 
 					mdb.Reset()
 				}
 			}
-
-			fr.Close()
+			if jrec.truncated > 0 {
+				db.logf("journal@recovery truncated @%d S·%s", fd.Num, shortenb(jrec.truncated))
+			}
+			if !jrec.empty() {
+				db.recovery.JournalsReplayed++
+			}
+			db.recovery.BytesTruncated += jrec.truncated
+			db.recovery.BytesDropped += jrec.dropped
 			ofd = fd
 		}
 
@@ -614,6 +882,16 @@ func (db *DB) recoverJournal() error {
 		return err
 	}
 
+	// Upgrade on-disk format version, if needed.
+	if v := db.s.upgradeFormatVersion(); v > 0 {
+		db.logf("db@open upgrading format version %d -> %d", db.s.formatVersion(), v)
+		rec.setFormatVersion(v)
+	}
+
+	if n := db.s.numLevels(); n > 0 {
+		rec.setNumLevels(n)
+	}
+
 	// Commit.
 	rec.setJournalNum(db.journalFd.Num)
 	rec.setSeqNum(db.seq)
@@ -628,24 +906,50 @@ func (db *DB) recoverJournal() error {
 
 	// Remove the last obsolete journal file.
 	if !ofd.Zero() {
-		db.s.stor.Remove(ofd)
+		db.removeJournal(ofd)
 	}
 
 	return nil
 }
 
 func (db *DB) recoverJournalRO() error {
+	if db.s.shared || db.s.pinned {
+		// Only the tables are read, see OpenShared and OpenAtManifest.
+		db.mem = &memDB{db: db, Table: db.newMemTable(0), ref: 1}
+		return nil
+	}
+
+	mdb, seq, err := db.replayJournalRO(db.s.stJournalNum, db.s.stPrevJournalNum, db.seq, &db.recovery)
+	if err != nil {
+		return err
+	}
+
+	// Set memDB.
+	db.seq = seq
+	db.mem = &memDB{db: db, Table: mdb, ref: 1}
+
+	return nil
+}
+
+// Replays journals starting from the given journal number into a new
+// memdb, without modifying the DB state. The replay is summarized into
+// report, if not nil.
+func (db *DB) replayJournalRO(journalNum, prevJournalNum int64, seq uint64, report *RecoveryReport) (memdb.Table, uint64, error) {
+	if report == nil {
+		report = &RecoveryReport{}
+	}
+
 	// Get all journals and sort it by file number.
 	rawFds, err := db.s.stor.List(storage.TypeJournal)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	sortFds(rawFds)
 
 	// Journals that will be recovered.
 	var fds []storage.FileDesc
 	for _, fd := range rawFds {
-		if fd.Num >= db.s.stJournalNum || fd.Num == db.s.stPrevJournalNum {
+		if fd.Num >= journalNum || fd.Num == prevJournalNum {
 			fds = append(fds, fd)
 		}
 	}
@@ -656,7 +960,7 @@ func (db *DB) recoverJournalRO() error {
 		checksum    = db.s.o.GetStrict(opt.StrictJournalChecksum)
 		writeBuffer = db.s.o.GetWriteBuffer()
 
-		mdb = memdb.New(db.s.icmp, writeBuffer)
+		mdb = db.newMemTable(writeBuffer)
 	)
 
 	// Recover journals.
@@ -664,76 +968,56 @@ func (db *DB) recoverJournalRO() error {
 		db.logf("journal@recovery RO·Mode F·%d", len(fds))
 
 		var (
-			jr       *journal.Reader
-			buf      = &util.Buffer{}
+			jr       = db.newJournalReader(fds, strict, checksum)
 			batchSeq uint64
 			batchLen int
 		)
+		defer jr.close()
 
-		for _, fd := range fds {
+		for i, fd := range fds {
 			db.logf("journal@recovery recovering @%d", fd.Num)
 
-			fr, err := db.s.stor.Open(fd)
-			if err != nil {
-				return err
-			}
-
-			// Create or reset journal reader instance.
-			if jr == nil {
-				jr = journal.NewReader(fr, dropper{db.s, fd}, strict, checksum)
-			} else {
-				jr.Reset(fr, dropper{db.s, fd}, strict, checksum)
+			jrec := jr.get(i)
+			if jrec.err != nil {
+				return nil, 0, jrec.err
 			}
 
 			// Replay journal to memdb.
-			for {
-				r, err := jr.Next()
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-
-					fr.Close()
-					return errors.SetFd(err, fd)
-				}
-
-				buf.Reset()
-				if _, err := buf.ReadFrom(r); err != nil {
-					if err == io.ErrUnexpectedEOF {
-						// This is error returned due to corruption, with strict == false.
-						continue
-					}
-
-					fr.Close()
-					return errors.SetFd(err, fd)
-				}
-				batchSeq, batchLen, err = decodeBatchToMem(buf.Bytes(), db.seq, mdb)
+			for _, r := range jrec.records {
+				batchSeq, batchLen, err = decodeBatchToMem(r, seq, mdb)
 				if err != nil {
 					if !strict && errors.IsCorrupted(err) {
 						db.s.logf("journal error: %v (skipped)", err)
+						report.RecordsSkipped++
 						// We won't apply sequence number as it might be corrupted.
 						continue
 					}
 
-					fr.Close()
-					return errors.SetFd(err, fd)
+					return nil, 0, errors.SetFd(err, fd)
 				}
+				report.RecordsReplayed++
 
 				// Save sequence number.
-				db.seq = batchSeq + uint64(batchLen)
+				seq = batchSeq + uint64(batchLen) - 1
 			}
-
-			fr.Close()
+			if jrec.truncated > 0 {
+				db.logf("journal@recovery truncated @%d S·%s", fd.Num, shortenb(jrec.truncated))
+			}
+			if !jrec.empty() {
+				report.JournalsReplayed++
+			}
+			report.BytesTruncated += jrec.truncated
+			report.BytesDropped += jrec.dropped
 		}
 	}
 
-	// Set memDB.
-	db.mem = &memDB{db: db, DB: mdb, ref: 1}
-
-	return nil
+	return mdb, seq, nil
 }
 
-func memGet(mdb *memdb.DB, ikey internalKey, icmp *iComparer) (ok bool, mv []byte, err error) {
+func memGet(mdb memdb.Table, ikey internalKey, icmp *iComparer, ro *opt.ReadOptions) (ok bool, mv []byte, err error) {
+	if b, isBloom := mdb.(*memBloomTable); isBloom && !ro.GetIgnoreFilters() && !b.mayContain(ikey.ukey()) {
+		return
+	}
 	mk, mv, err := mdb.Find(ikey)
 	if err == nil {
 		ukey, _, kt, kerr := parseInternalKey(mk)
@@ -754,30 +1038,61 @@ func memGet(mdb *memdb.DB, ikey internalKey, icmp *iComparer) (ok bool, mv []byt
 	return
 }
 
-func (db *DB) get(auxm *memdb.DB, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions) (value []byte, err error) {
+func (db *DB) get(auxm memdb.Table, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions) (value []byte, err error) {
+	value, err = db.getMeta(auxm, auxt, key, seq, ro, nil)
+	_, value = splitValueMeta(value, db.s.o.GetValueMetaSize())
+	return
+}
+
+// Splits the given stored value into its metadata header of the given size
+// and its body, see opt.Options.ValueMetaSize. A value shorter than the
+// header, e.g. written before the option was set, is returned whole with a
+// nil header.
+func splitValueMeta(value []byte, n int) (vmeta, body []byte) {
+	if n == 0 || len(value) < n {
+		return nil, value
+	}
+	return value[:n:n], value[n:]
+}
+
+// Returns a copy of the given value, allocated from ro.BufferPool if set.
+func copyValue(value []byte, ro *opt.ReadOptions) []byte {
+	if p := ro.GetBufferPool(); p != nil {
+		return append(p.Get(len(value))[:0], value...)
+	}
+	return append([]byte{}, value...)
+}
+
+// Like get, but records where the key was found in meta if it isn't nil.
+func (db *DB) getMeta(auxm memdb.Table, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions, meta *ReadMeta) (value []byte, err error) {
 	ikey := makeInternalKey(nil, key, seq, keyTypeSeek)
 
 	if auxm != nil {
-		if ok, mv, me := memGet(auxm, ikey, db.s.icmp); ok {
-			return append([]byte{}, mv...), me
+		if ok, mv, me := memGet(auxm, ikey, db.s.icmp, ro); ok {
+			meta.setSource(ReadSourceMemTable)
+			return copyValue(mv, ro), me
 		}
 	}
 
-	em, fm := db.getMems()
-	for _, m := range [...]*memDB{em, fm} {
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	for i, m := range [...]*memDB{em, fm} {
 		if m == nil {
 			continue
 		}
 		defer m.decref()
 
-		if ok, mv, me := memGet(m.DB, ikey, db.s.icmp); ok {
-			return append([]byte{}, mv...), me
+		if ok, mv, me := memGet(m.Table, ikey, db.s.icmp, ro); ok {
+			if i == 0 {
+				meta.setSource(ReadSourceMemTable)
+			} else {
+				meta.setSource(ReadSourceImmutable)
+			}
+			return copyValue(mv, ro), me
 		}
 	}
 
-	v := db.s.version()
-	value, cSched, err := v.get(auxt, ikey, ro, false)
-	v.release()
+	value, cSched, err := v.get(auxt, ikey, ro, false, meta)
 	if cSched {
 		// Trigger table compaction.
 		db.compTrigger(db.tcompCmdC)
@@ -785,6 +1100,14 @@ func (db *DB) get(auxm *memdb.DB, auxt tFiles, key []byte, seq uint64, ro *opt.R
 	return
 }
 
+// Returns ErrNotFound with the key if VerboseNotFound is set, see Get.
+func (db *DB) notFound(err error, key []byte) error {
+	if err == ErrNotFound && db.s.o.GetVerboseNotFound() {
+		return errors.NewErrKeyNotFound(key)
+	}
+	return err
+}
+
 func nilIfNotFound(err error) error {
 	if err == ErrNotFound {
 		return nil
@@ -792,30 +1115,29 @@ func nilIfNotFound(err error) error {
 	return err
 }
 
-func (db *DB) has(auxm *memdb.DB, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions) (ret bool, err error) {
+func (db *DB) has(auxm memdb.Table, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions) (ret bool, err error) {
 	ikey := makeInternalKey(nil, key, seq, keyTypeSeek)
 
 	if auxm != nil {
-		if ok, _, me := memGet(auxm, ikey, db.s.icmp); ok {
+		if ok, _, me := memGet(auxm, ikey, db.s.icmp, ro); ok {
 			return me == nil, nilIfNotFound(me)
 		}
 	}
 
-	em, fm := db.getMems()
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
 	for _, m := range [...]*memDB{em, fm} {
 		if m == nil {
 			continue
 		}
 		defer m.decref()
 
-		if ok, _, me := memGet(m.DB, ikey, db.s.icmp); ok {
+		if ok, _, me := memGet(m.Table, ikey, db.s.icmp, ro); ok {
 			return me == nil, nilIfNotFound(me)
 		}
 	}
 
-	v := db.s.version()
-	_, cSched, err := v.get(auxt, ikey, ro, true)
-	v.release()
+	_, cSched, err := v.get(auxt, ikey, ro, true, nil)
 	if cSched {
 		// Trigger table compaction.
 		db.compTrigger(db.tcompCmdC)
@@ -829,10 +1151,12 @@ func (db *DB) has(auxm *memdb.DB, auxt tFiles, key []byte, seq uint64, ro *opt.R
 }
 
 // Get gets the value for the given key. It returns ErrNotFound if the
-// DB does not contains the key.
+// DB does not contains the key, or an errors.ErrKeyNotFound wrapping it if
+// the VerboseNotFound option is set.
 //
 // The returned slice is its own copy, it is safe to modify the contents
-// of the returned slice.
+// of the returned slice. It is allocated from ro.BufferPool if set, see
+// opt.ReadOptions.BufferPool.
 // It is safe to modify the contents of the argument after Get returns.
 func (db *DB) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
 	err = db.ok()
@@ -840,9 +1164,171 @@ func (db *DB) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
 		return
 	}
 
+	if m := db.s.o.GetMetricsHook(); m != nil {
+		defer func(start time.Time) {
+			m.ObserveGet(time.Since(start), err == nil)
+		}(time.Now())
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	value, err = db.get(nil, nil, key, se.seq, ro)
+	if db.s.shared && isFileMissing(err) {
+		err = db.retryShared(func() (err error) {
+			value, err = db.get(nil, nil, key, db.getSeq(), ro)
+			return
+		})
+	}
+	err = db.notFound(err, key)
+	return
+}
+
+// appendBuffer is a BufferPool handing out the spare capacity of dst,
+// grown if needed, so that the value read by GetTo is read into dst.
+type appendBuffer struct {
+	ro  opt.ReadOptions
+	dst []byte
+}
+
+func (b *appendBuffer) Get(n int) []byte {
+	if cap(b.dst)-len(b.dst) < n {
+		dst := make([]byte, len(b.dst), len(b.dst)+n)
+		copy(dst, b.dst)
+		b.dst = dst
+	}
+	return b.dst[len(b.dst) : len(b.dst)+n]
+}
+
+func (*appendBuffer) Put([]byte) {}
+
+var appendBufferPool = sync.Pool{
+	New: func() interface{} { return new(appendBuffer) },
+}
+
+// GetTo is like Get, but appends the value for the given key to dst, and
+// returns the extended slice; dst is grown if its capacity isn't enough.
+// Reusing the returned slice as dst of the next call saves allocating a
+// value per call. On error dst is returned as is.
+//
+// The returned slice is owned by the caller, as it is dst or a copy of it;
+// ro.BufferPool is not used.
+// It is safe to modify the contents of the arguments after GetTo returns.
+func (db *DB) GetTo(dst, key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	b := appendBufferPool.Get().(*appendBuffer)
+	if ro != nil {
+		b.ro = *ro
+	}
+	b.ro.BufferPool = b
+	b.dst = dst
+	value, err := db.Get(key, &b.ro)
+	if err == nil {
+		// The value most likely is in the spare capacity of b.dst already,
+		// so this doesn't copy it.
+		dst = append(b.dst, value...)
+	}
+	*b = appendBuffer{}
+	appendBufferPool.Put(b)
+	return dst, err
+}
+
+// ReadSource is where a read was served from, see ReadMeta.
+type ReadSource int
+
+// Read sources.
+const (
+	// ReadSourceNone means the key wasn't found anywhere.
+	ReadSourceNone ReadSource = iota
+	// ReadSourceMemTable means the key was found in the memtable.
+	ReadSourceMemTable
+	// ReadSourceImmutable means the key was found in the frozen memtable
+	// which is being flushed.
+	ReadSourceImmutable
+	// ReadSourceTable means the key was found in a table.
+	ReadSourceTable
+)
+
+func (s ReadSource) String() string {
+	switch s {
+	case ReadSourceNone:
+		return "none"
+	case ReadSourceMemTable:
+		return "memtable"
+	case ReadSourceImmutable:
+		return "immutable"
+	case ReadSourceTable:
+		return "table"
+	}
+	return fmt.Sprintf("ReadSource(%d)", int(s))
+}
+
+// ReadMeta describes how a read was served, see GetWithMeta. A key that
+// was found deleted is reported at where the deletion was found.
+type ReadMeta struct {
+	// Source is where the key was found.
+	Source ReadSource
+	// Level and FileNum are the level and file number of the table the
+	// key was found at, if Source is ReadSourceTable.
+	Level   int
+	FileNum int64
+	// TablesSearched is the number of tables looked up.
+	TablesSearched int
+	// FilterChecked is whether a filter was consulted by any of the table
+	// lookups.
+	FilterChecked bool
+}
+
+func (m *ReadMeta) setSource(src ReadSource) {
+	if m != nil {
+		m.Source = src
+	}
+}
+
+func (m *ReadMeta) setTable(level int, t *tFile) {
+	if m != nil {
+		m.Source = ReadSourceTable
+		m.Level = level
+		m.FileNum = t.fd.Num
+	}
+}
+
+// GetWithMeta is like Get, but also reports where the key was found, which
+// helps diagnosing read amplification. Get doesn't collect the ReadMeta,
+// so it has no overhead for the common case.
+//
+// The meta is valid even if err is ErrNotFound, in which case it tells
+// where the key was found deleted, if anywhere.
+func (db *DB) GetWithMeta(key []byte, ro *opt.ReadOptions) (value []byte, meta ReadMeta, err error) {
+	err = db.ok()
+	if err != nil {
+		return
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	value, err = db.getMeta(nil, nil, key, se.seq, ro, &meta)
+	_, value = splitValueMeta(value, db.s.o.GetValueMetaSize())
+	err = db.notFound(err, key)
+	return
+}
+
+// GetValueMeta is like Get, but also returns the metadata header of the
+// value, see opt.Options.ValueMetaSize. The header is nil if the option
+// isn't set, or if the value is shorter than the header.
+//
+// The returned slices are their own copy, it is safe to modify their
+// contents.
+func (db *DB) GetValueMeta(key []byte, ro *opt.ReadOptions) (value, vmeta []byte, err error) {
+	err = db.ok()
+	if err != nil {
+		return
+	}
+
 	se := db.acquireSnapshot()
 	defer db.releaseSnapshot(se)
-	return db.get(nil, nil, key, se.seq, ro)
+	value, err = db.getMeta(nil, nil, key, se.seq, ro, nil)
+	vmeta, value = splitValueMeta(value, db.s.o.GetValueMetaSize())
+	err = db.notFound(err, key)
+	return
 }
 
 // Has returns true if the DB does contains the given key.
@@ -856,7 +1342,101 @@ func (db *DB) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
 
 	se := db.acquireSnapshot()
 	defer db.releaseSnapshot(se)
-	return db.has(nil, nil, key, se.seq, ro)
+	ret, err = db.has(nil, nil, key, se.seq, ro)
+	if db.s.shared && isFileMissing(err) {
+		err = db.retryShared(func() (err error) {
+			ret, err = db.has(nil, nil, key, db.getSeq(), ro)
+			return
+		})
+	}
+	return
+}
+
+func (db *DB) getMulti(keys [][]byte, seq uint64, ro *opt.ReadOptions) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, err := db.get(nil, nil, key, seq, ro)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// GetMulti gets the values for the given keys, as of a single point in
+// time. The value of a key the DB does not contains is nil, the value of
+// an existing key is never nil even if empty.
+//
+// The returned slices are their own copies, it is safe to modify the
+// contents of the returned slices.
+// It is safe to modify the contents of the argument after GetMulti returns.
+func (db *DB) GetMulti(keys [][]byte, ro *opt.ReadOptions) (values [][]byte, err error) {
+	err = db.ok()
+	if err != nil {
+		return
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	values, err = db.getMulti(keys, se.seq, ro)
+	if db.s.shared && isFileMissing(err) {
+		err = db.retryShared(func() (err error) {
+			values, err = db.getMulti(keys, db.getSeq(), ro)
+			return
+		})
+	}
+	return
+}
+
+// KeyMayExist is a fast, approximate, Has. It returns mayExist false if
+// the DB definitely doesn't contain the given key; it never reads data
+// blocks, only the memdbs, the table indexes and the filters (see
+// opt.Options.Filter), so mayExist true may be a false positive. If the
+// key is found in a memdb its value is returned too, with valueKnown
+// true, saving a Get.
+//
+// KeyMayExist returns mayExist true on error, e.g. if the DB is closed;
+// a subsequent Get reports the error.
+//
+// The returned slice is its own copy, it is safe to modify the contents
+// of the returned slice.
+// It is safe to modify the contents of the argument after KeyMayExist
+// returns.
+func (db *DB) KeyMayExist(key []byte) (mayExist bool, value []byte, valueKnown bool) {
+	if err := db.ok(); err != nil {
+		return true, nil, false
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	ikey := makeInternalKey(nil, key, se.seq, keyTypeSeek)
+
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	for _, m := range [...]*memDB{em, fm} {
+		if m == nil {
+			continue
+		}
+		defer m.decref()
+
+		if ok, mv, me := memGet(m.Table, ikey, db.s.icmp, nil); ok {
+			if me != nil {
+				return false, nil, false
+			}
+			_, mv = splitValueMeta(mv, db.s.o.GetValueMetaSize())
+			return true, append([]byte{}, mv...), true
+		}
+	}
+
+	ret, err := v.mayContain(ikey)
+	return ret || err != nil, nil, false
 }
 
 // NewIterator returns an iterator for the latest snapshot of the
@@ -870,10 +1450,14 @@ func (db *DB) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
 // Slice allows slicing the iterator to only contains keys in the given
 // range. A nil Range.Start is treated as a key before all keys in the
 // DB. And a nil Range.Limit is treated as a key after all keys in
-// the DB.
+// the DB. An empty non-nil Range.Limit is the empty key, which sorts first,
+// so no key is in the range.
 //
 // The iterator must be released after use, by calling Release method.
 //
+// The iterator implements iterator.ProgressReporter, e.g. to report the
+// approximate progress of a long scan.
+//
 // Also read Iterator documentation of the leveldb/iterator package.
 func (db *DB) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
 	if err := db.ok(); err != nil {
@@ -916,34 +1500,87 @@ func (db *DB) GetSnapshot() (*Snapshot, error) {
 //	leveldb.blockpool
 //		Returns block pool stats.
 //	leveldb.cachedblock
-//		Returns size of cached block.
+//		Returns size of cached block, or zero if block caching is disabled.
 //	leveldb.openedtables
 //		Returns number of opened tables.
 //	leveldb.alivesnaps
 //		Returns number of alive snapshots.
 //	leveldb.aliveiters
 //		Returns number of alive iterators.
+//	leveldb.filterstats
+//		Returns filter checks of table lookups: the number of checks,
+//		of true negatives, i.e. tables skipped, and of false positives,
+//		i.e. tables read in vain, and the false positive rate.
 func (db *DB) GetProperty(name string) (value string, err error) {
 	err = db.ok()
 	if err != nil {
 		return
 	}
 
-	const prefix = "leveldb."
-	if !strings.HasPrefix(name, prefix) {
+	if !strings.HasPrefix(name, propertyPrefix) {
 		return "", ErrNotFound
 	}
-	p := name[len(prefix):]
+
+	v := db.s.version()
+	defer v.release()
+	return db.property(v, name[len(propertyPrefix):])
+}
+
+const (
+	propertyPrefix         = "leveldb."
+	propertyNumFilesPrefix = "num-files-at-level"
+)
+
+// The properties returned by Properties, besides the number of files at
+// each level.
+var propertyNames = []string{
+	"stats",
+	"iostats",
+	"writedelay",
+	"sstables",
+	"blockpool",
+	"cachedblock",
+	"openedtables",
+	"alivesnaps",
+	"aliveiters",
+	"filterstats",
+}
+
+// Properties returns the values of all the properties documented by
+// GetProperty, keyed by their name, with leveldb.num-files-at-level{n} for
+// each level of the DB. The properties are taken from a single view of the
+// DB, so unlike multiple GetProperty calls, a compaction can't change the
+// tables in between.
+func (db *DB) Properties() (map[string]string, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
 
 	v := db.s.version()
 	defer v.release()
 
-	numFilesPrefix := "num-files-at-level"
+	props := make(map[string]string, len(propertyNames)+len(v.levels))
+	for level := range v.levels {
+		props[fmt.Sprintf("%s%s%d", propertyPrefix, propertyNumFilesPrefix, level)] = fmt.Sprint(v.tLen(level))
+	}
+	for _, p := range propertyNames {
+		value, err := db.property(v, p)
+		if err != nil {
+			return nil, err
+		}
+		props[propertyPrefix+p] = value
+	}
+	return props, nil
+}
+
+// Returns the value of the given property, without the "leveldb." prefix,
+// for the given version.
+func (db *DB) property(v *version, p string) (value string, err error) {
 	switch {
-	case strings.HasPrefix(p, numFilesPrefix):
+	case strings.HasPrefix(p, propertyNumFilesPrefix):
 		var level uint
 		var rest string
-		n, _ := fmt.Sscanf(p[len(numFilesPrefix):], "%d%s", &level, &rest)
+		n, _ := fmt.Sscanf(p[len(propertyNumFilesPrefix):], "%d%s", &level, &rest)
 		if n != 1 {
 			err = ErrNotFound
 		} else {
@@ -980,17 +1617,27 @@ func (db *DB) GetProperty(name string) (value string, err error) {
 	case p == "blockpool":
 		value = fmt.Sprintf("%v", db.s.tops.bpool)
 	case p == "cachedblock":
+		var size int
 		if db.s.tops.bcache != nil {
-			value = fmt.Sprintf("%d", db.s.tops.bcache.Size())
-		} else {
-			value = "<nil>"
+			size = db.s.tops.bcache.Size()
 		}
+		value = fmt.Sprintf("%d", size)
 	case p == "openedtables":
 		value = fmt.Sprintf("%d", db.s.tops.cache.Size())
 	case p == "alivesnaps":
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveSnaps))
 	case p == "aliveiters":
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveIters))
+	case p == "filterstats":
+		tops := db.s.tops
+		checked := atomic.LoadUint64(&tops.filterChecked)
+		negative := atomic.LoadUint64(&tops.filterNegative)
+		falsePositives := atomic.LoadUint64(&tops.filterFalsePositives)
+		var rate float64
+		if n := negative + falsePositives; n > 0 {
+			rate = float64(falsePositives) / float64(n)
+		}
+		value = fmt.Sprintf("Checked:%d Negative:%d FalsePositive:%d FPRate:%.5f", checked, negative, falsePositives, rate)
 	default:
 		err = ErrNotFound
 	}
@@ -1012,6 +1659,7 @@ type DBStats struct {
 
 	BlockCacheSize    int
 	OpenedTablesCount int
+	PinnedIndexSize   int64
 
 	LevelSizes        []int64
 	LevelTablesCounts []int
@@ -1039,6 +1687,7 @@ func (db *DB) Stats(s *DBStats) error {
 	} else {
 		s.BlockCacheSize = 0
 	}
+	s.PinnedIndexSize = atomic.LoadInt64(&db.s.tops.pinnedIndexSize)
 
 	s.AliveIterators = atomic.LoadInt32(&db.aliveIters)
 	s.AliveSnapshots = atomic.LoadInt32(&db.aliveSnaps)
@@ -1067,6 +1716,176 @@ func (db *DB) Stats(s *DBStats) error {
 	return nil
 }
 
+// MemoryUsage is the approximate memory held by a DB, by component, see
+// DB.ApproximateMemoryUsage. The sizes are in bytes.
+type MemoryUsage struct {
+	// MemTables is the size of the memory held by the memdbs, the
+	// effective one and the frozen one being flushed, if any: their
+	// key/value buffers as allocated, their index structures and their
+	// filters, see opt.Options.MemTableBloomBits. Only the key/value
+	// buffer capacity is accounted for a memdb.Table that doesn't
+	// implement memdb.MemoryUser.
+	MemTables int64
+
+	// BlockCache is the size of the blocks of this DB held by the block
+	// cache. Only the share of this DB is accounted if the block cache is
+	// shared, see opt.Options.BlockCache.
+	BlockCache int64
+
+	// TableIndexes is the size of the index and filter blocks held by the
+	// open tables, outside of the block cache.
+	TableIndexes int64
+
+	// BufferPool is the size of the block buffers held for reuse.
+	BufferPool int64
+}
+
+// Returns the memory held by the given memdb, see MemoryUsage.MemTables.
+func memTableUsage(t memdb.Table) int {
+	if u, ok := t.(memdb.MemoryUser); ok {
+		return u.MemoryUsage()
+	}
+	return t.Capacity()
+}
+
+// Total returns the sum of the components.
+func (u *MemoryUsage) Total() int64 {
+	return u.MemTables + u.BlockCache + u.TableIndexes + u.BufferPool
+}
+
+// ApproximateMemoryUsage returns the approximate memory held by the DB, by
+// component. It doesn't account for the memory held by the Go runtime on
+// behalf of the DB, such as the overhead of the memdb structures, of the
+// open files or of the in-flight reads. If the block cache is shared it
+// walks the cache to find the share of the DB, so it should not be called
+// too often.
+func (db *DB) ApproximateMemoryUsage() (*MemoryUsage, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	u := &MemoryUsage{}
+	em, fm := db.getMems()
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			u.MemTables += int64(memTableUsage(m.Table))
+			m.decref()
+		}
+	}
+	t := db.s.tops
+	if t.bcache != nil {
+		if !t.bcacheShared {
+			u.BlockCache = int64(t.bcache.Size())
+		} else {
+			id := t.bcacheNS >> bcacheIDShift
+			u.BlockCache = int64(t.bcache.NamespaceSize(func(ns uint64) bool {
+				return ns>>bcacheIDShift == id
+			}))
+		}
+	}
+	u.TableIndexes = atomic.LoadInt64(&t.pinnedIndexSize) + atomic.LoadInt64(&t.pinnedFilterSize)
+	u.BufferPool = int64(t.bpool.PooledSize())
+	return u, nil
+}
+
+// KeyRange returns copies of the smallest and the largest keys of the DB,
+// or nil keys if the DB is empty.
+//
+// The keys are found from the key ranges of the tables and of the memdb,
+// which is cheaper than seeking every level as the First and Last methods
+// of an iterator do. KeyRange only falls back to seeking if the smallest
+// or the largest key of these ranges has been deleted.
+func (db *DB) KeyRange() (smallest, largest []byte, err error) {
+	if err = db.ok(); err != nil {
+		return
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+
+	var umin, umax []byte
+	add := func(imin, imax internalKey) {
+		if umin == nil || db.s.icmp.uCompare(imin.ukey(), umin) < 0 {
+			umin = imin.ukey()
+		}
+		if umax == nil || db.s.icmp.uCompare(imax.ukey(), umax) > 0 {
+			umax = imax.ukey()
+		}
+	}
+
+	// The memdbs are read along with the version, so that keys flushed
+	// meanwhile aren't missed by both.
+	em, fm, v := db.getMemsVersion()
+	defer v.release()
+	for _, tables := range v.levels {
+		if len(tables) > 0 {
+			add(tables.getRange(db.s.icmp))
+		}
+	}
+	for _, m := range [...]*memDB{em, fm} {
+		if m == nil {
+			continue
+		}
+		iter := m.NewIterator(nil)
+		if iter.First() {
+			imin := append(internalKey{}, iter.Key()...)
+			iter.Last()
+			add(imin, append(internalKey{}, iter.Key()...))
+		}
+		iter.Release()
+		m.decref()
+	}
+	if umin == nil {
+		return nil, nil, nil
+	}
+
+	if smallest, err = db.liveKeyRangeEnd(umin, se.seq, true); err != nil {
+		return nil, nil, err
+	}
+	if largest, err = db.liveKeyRangeEnd(umax, se.seq, false); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// Returns a copy of the given end of the key range of the DB if the key
+// isn't deleted at seq, see KeyRange. Otherwise, it seeks the first, or
+// the last, key at seq.
+func (db *DB) liveKeyRangeEnd(ukey []byte, seq uint64, first bool) ([]byte, error) {
+	ok, err := db.has(nil, nil, ukey, seq, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return append([]byte{}, ukey...), nil
+	}
+
+	iter := db.newIterator(nil, nil, seq, nil, nil)
+	defer iter.Release()
+	if first {
+		ok = iter.First()
+	} else {
+		ok = iter.Last()
+	}
+	if !ok {
+		return nil, iter.Error()
+	}
+	return append([]byte{}, iter.Key()...), nil
+}
+
+// LastSequence returns the sequence number of the last write to the DB.
+// Each Put or Delete, including those of a batch, takes one sequence
+// number; see opt.Options.InitialSequence.
+func (db *DB) LastSequence() uint64 {
+	return db.getSeq()
+}
+
+// FormatVersion returns the on-disk format version of the DB, see
+// opt.Options.MaxFormatVersion.
+func (db *DB) FormatVersion() int {
+	return db.s.formatVersion()
+}
+
 // SizeOf calculates approximate sizes of the given key ranges.
 // The length of the returned sizes are equal with the length of the given
 // ranges. The returned sizes measure storage space usage, so if the user
@@ -1103,6 +1922,131 @@ func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 	return sizes, nil
 }
 
+var errSplitCount = errors.New("leveldb: invalid split count")
+
+// SplitRange returns up to n-1 keys splitting the given key range into n
+// shards which hold approximately the same number of bytes, e.g. to spread
+// the range across nodes or to scan it in parallel. The split keys are in
+// increasing order and strictly within the range; shard i is the range
+// from split key i-1 to split key i.
+//
+// The split keys are taken from the data block boundaries found in the
+// table indexes, weighted by the block sizes, so they need not be keys of
+// the DB. Fewer split keys are returned if the range spans too few blocks.
+// As for SizeOf, recently written data may not be accounted for.
+//
+// A nil Range.Start is treated as a key before all keys in the DB.
+// And a nil Range.Limit is treated as a key after all keys in the DB.
+func (db *DB) SplitRange(r util.Range, n int) ([][]byte, error) {
+	if n < 1 {
+		return nil, errSplitCount
+	}
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	v := db.s.version()
+	defer v.release()
+
+	type boundary struct {
+		ukey []byte
+		size int64
+	}
+	var (
+		bounds []boundary
+		total  int64
+		slice  = internalSlice(&r)
+	)
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if !t.overlaps(db.s.icmp, r.Start, r.Limit) {
+				continue
+			}
+			entries, err := db.s.tops.indexEntries(t, slice)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				ukey, _, _, err := parseInternalKey(e.Key)
+				if err != nil {
+					return nil, err
+				}
+				bounds = append(bounds, boundary{ukey, int64(e.Handle.Length)})
+				total += int64(e.Handle.Length)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return db.s.icmp.uCompare(bounds[i].ukey, bounds[j].ukey) < 0
+	})
+
+	var (
+		splits [][]byte
+		cum    int64
+	)
+	for _, b := range bounds {
+		if len(splits) == n-1 {
+			break
+		}
+		cum += b.size
+		// Split once the bytes before the boundary reach the next 1/n of
+		// the total.
+		if cum*int64(n) < int64(len(splits)+1)*total {
+			continue
+		}
+		if (r.Start != nil && db.s.icmp.uCompare(b.ukey, r.Start) <= 0) ||
+			(r.Limit != nil && db.s.icmp.uCompare(b.ukey, r.Limit) >= 0) ||
+			(len(splits) > 0 && db.s.icmp.uCompare(b.ukey, splits[len(splits)-1]) <= 0) {
+			continue
+		}
+		splits = append(splits, b.ukey)
+	}
+	return splits, nil
+}
+
+// WarmCache reads the tables of the DB in the given key range, faulting
+// their index and data blocks into the block cache, so that subsequent
+// reads of the range hit the cache. Nothing is returned to the caller;
+// ro.DontFillCache is ignored.
+//
+// WarmCache stops early and returns ctx.Err() if the given context is
+// done.
+//
+// A nil Range.Start is treated as a key before all keys in the DB.
+// And a nil Range.Limit is treated as a key after all keys in the DB.
+func (db *DB) WarmCache(ctx context.Context, r util.Range, ro *opt.ReadOptions) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	var wro opt.ReadOptions
+	if ro != nil {
+		wro = *ro
+	}
+	wro.DontFillCache = false
+
+	v := db.s.version()
+	defer v.release()
+
+	its := v.getIterators(internalSlice(&r), &wro)
+	defer func() {
+		for _, iter := range its {
+			iter.Release()
+		}
+	}()
+	for _, iter := range its {
+		for iter.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
 // Close closes the DB. This will also releases any outstanding snapshot,
 // abort any in-flight compaction and discard open transaction.
 //
@@ -1153,12 +2097,12 @@ func (db *DB) Close() error {
 	}
 
 	if db.writeDelayN > 0 {
-		db.logf("db@write was delayed N·%d T·%v", db.writeDelayN, db.writeDelay)
+		db.logFields(map[string]interface{}{"N": db.writeDelayN, "T": db.writeDelay}, "db@write was delayed")
 	}
 
 	// Close session.
 	db.s.close()
-	db.logf("db@close done T·%v", time.Since(start))
+	db.logFields(map[string]interface{}{"T": time.Since(start)}, "db@close done")
 	db.s.release()
 
 	if db.closer != nil {
@@ -0,0 +1,87 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+)
+
+// blobGC removes blob files no longer referred to by any table of the live
+// versions. Only whole blob files are collected, values of a partially
+// obsolete blob file are never rewritten.
+//
+// This must be called by the table compaction goroutine, as memdb flush
+// pauses table compaction before creating its blob files.
+func (db *DB) blobGC() error {
+	db.blobGCPending = false
+
+	n, rem, err := db.obsoleteBlobs()
+	if err != nil {
+		return err
+	}
+	for _, fd := range rem {
+		db.s.tops.removeBlob(fd)
+	}
+	db.logf("blob@gc F·%d G·%d", n, len(rem))
+	return nil
+}
+
+// Returns the number of blob files and the obsolete ones, blob files
+// referred to by committed tables are unpended along the way. Same
+// constraint as blobGC applies.
+func (db *DB) obsoleteBlobs() (n int, rem []storage.FileDesc, err error) {
+	fds, err := db.s.stor.List(storage.TypeBlob)
+	if err != nil || len(fds) == 0 {
+		return 0, nil, err
+	}
+
+	// Tables are scanned once and then cached, since they are immutable.
+	tables := db.s.liveTables()
+	defer db.s.releaseLiveTables(tables)
+	refs := make(map[int64][]int64, len(tables))
+	live := make(map[int64]bool)
+	for _, t := range tables {
+		nums, ok := db.blobRefs[t.fd.Num]
+		if !ok {
+			nums, err = db.s.tops.blobRefs(t)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		refs[t.fd.Num] = nums
+		for _, num := range nums {
+			live[num] = true
+		}
+	}
+	db.blobRefs = refs
+
+	for _, fd := range fds {
+		if live[fd.Num] {
+			// Referred to by a committed table, no longer pending.
+			db.s.tops.unpendBlob(fd.Num)
+			continue
+		}
+		if db.s.tops.isBlobPending(fd.Num) {
+			continue
+		}
+		rem = append(rem, fd)
+	}
+	return len(fds), rem, nil
+}
+
+// GCBlobFiles removes blob files that are no longer referred to by the DB,
+// see opt.Options.EnableBlobFiles. Obsolete blob files are also removed
+// automatically once table compaction drops the entries referring to them.
+func (db *DB) GCBlobFiles() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.s.o.GetReadOnly() {
+		return ErrReadOnly
+	}
+	return db.compTriggerBlobGC(db.tcompCmdC)
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+)
+
+type coalescedRec struct {
+	kt    keyType
+	value []byte
+}
+
+// CoalescingWriter buffers writes to a DB in memory, keeping only the
+// latest write of each key, and writes them to the DB as a single batch
+// periodically or once enough keys are buffered. Overwriting the same keys
+// over and over then costs a single write per key and flush.
+//
+// Reads through the CoalescingWriter see its buffered writes.
+//
+// Buffered writes are not durable: they are lost if the process crashes
+// before they are flushed, i.e. up to the flush interval, or the number of
+// keys the buffer holds, of the latest writes.
+//
+// CoalescingWriter is safe for concurrent use.
+type CoalescingWriter struct {
+	db      *DB
+	maxKeys int
+
+	mu       sync.Mutex
+	buf      map[string]coalescedRec
+	flushing map[string]coalescedRec // being written by Flush
+	closed   bool
+
+	flushMu sync.Mutex // serializes flushes
+	closeC  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewCoalescingWriter returns a CoalescingWriter flushing its buffered
+// writes every flushInterval, and as soon as maxKeys distinct keys are
+// buffered, by the write which filled the buffer. A non-positive
+// flushInterval or maxKeys disables the respective trigger; the writes are
+// then only flushed on demand, see CoalescingWriter.Flush.
+//
+// The CoalescingWriter must be closed before the DB, by calling its Close
+// method, to flush its remaining writes.
+func (db *DB) NewCoalescingWriter(flushInterval time.Duration, maxKeys int) *CoalescingWriter {
+	w := &CoalescingWriter{
+		db:      db,
+		maxKeys: maxKeys,
+		buf:     make(map[string]coalescedRec),
+		closeC:  make(chan struct{}),
+	}
+	if flushInterval > 0 {
+		w.wg.Add(1)
+		go w.mFlush(flushInterval)
+	}
+	return w
+}
+
+func (w *CoalescingWriter) mFlush(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				w.db.logf("coalesce@flush error %q", err)
+			}
+		case <-w.closeC:
+			return
+		case <-w.db.closeC:
+			return
+		}
+	}
+}
+
+func (w *CoalescingWriter) putRec(kt keyType, key, value []byte) error {
+	if err := w.db.checkRecSize(key, value); err != nil {
+		return err
+	}
+	if kt != keyTypeDel {
+		if err := w.db.checkValueMeta(len(value)); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.buf[string(key)] = coalescedRec{kt: kt, value: append([]byte(nil), value...)}
+	full := w.maxKeys > 0 && len(w.buf) >= w.maxKeys
+	w.mu.Unlock()
+
+	if full {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Put buffers setting the value for the given key, overwriting any
+// previous buffered write of the key.
+//
+// It is safe to modify the contents of the arguments after Put returns.
+func (w *CoalescingWriter) Put(key, value []byte) error {
+	return w.putRec(keyTypeVal, key, value)
+}
+
+// Delete buffers deleting the given key, overwriting any previous buffered
+// write of the key.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (w *CoalescingWriter) Delete(key []byte) error {
+	return w.putRec(keyTypeDel, key, nil)
+}
+
+// Returns the buffered write of the given key, if any.
+func (w *CoalescingWriter) buffered(key []byte) (rec coalescedRec, ok bool, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return rec, false, ErrClosed
+	}
+	if rec, ok = w.buf[string(key)]; !ok {
+		rec, ok = w.flushing[string(key)]
+	}
+	return
+}
+
+// Get gets the value for the given key, from the buffered writes or else
+// from the DB, see DB.Get.
+//
+// The returned slice is its own copy, it is safe to modify the contents
+// of the returned slice.
+// It is safe to modify the contents of the argument after Get returns.
+func (w *CoalescingWriter) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	rec, ok, err := w.buffered(key)
+	switch {
+	case err != nil:
+		return nil, err
+	case !ok:
+		return w.db.Get(key, ro)
+	case rec.kt == keyTypeDel:
+		return nil, w.db.notFound(ErrNotFound, key)
+	}
+	_, value := splitValueMeta(rec.value, w.db.s.o.GetValueMetaSize())
+	return append([]byte(nil), value...), nil
+}
+
+// Has returns true if the buffered writes or else the DB contains the
+// given key, see DB.Has.
+//
+// It is safe to modify the contents of the argument after Has returns.
+func (w *CoalescingWriter) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	rec, ok, err := w.buffered(key)
+	switch {
+	case err != nil:
+		return false, err
+	case !ok:
+		return w.db.Has(key, ro)
+	}
+	return rec.kt == keyTypeVal, nil
+}
+
+// Flush writes the buffered writes to the DB as a single batch. If the
+// write fails, the writes are kept buffered, unless overwritten since, to
+// be retried by the next flush.
+func (w *CoalescingWriter) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	if len(w.buf) == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+	recs := w.buf
+	w.buf = make(map[string]coalescedRec)
+	w.flushing = recs
+	w.mu.Unlock()
+
+	batch := new(Batch)
+	for key, rec := range recs {
+		batch.appendRec(rec.kt, []byte(key), rec.value)
+	}
+	err := w.db.Write(batch, nil)
+
+	w.mu.Lock()
+	if err != nil {
+		for key, rec := range recs {
+			if _, ok := w.buf[key]; !ok {
+				w.buf[key] = rec
+			}
+		}
+	}
+	w.flushing = nil
+	w.mu.Unlock()
+	return err
+}
+
+// Close flushes the buffered writes and stops the periodic flush. Other
+// methods return ErrClosed once the CoalescingWriter is closed. Close
+// doesn't close the DB.
+func (w *CoalescingWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.closeC)
+	w.wg.Wait()
+	return w.Flush()
+}
@@ -7,6 +7,8 @@
 package leveldb
 
 import (
+	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
@@ -136,6 +138,79 @@ hasperr:
 	}
 }
 
+// CompactionRecord describes a completed compaction. A record of each
+// compaction is written to opt.Options.CompactionStatsWriter, as one JSON
+// object per line.
+type CompactionRecord struct {
+	// Type is either "memdb" for a memdb flush, "table" for a table
+	// compaction, "table-move" for a table moved to the next level
+	// without being rewritten or "table-rewrite" for a table rewritten
+	// at its level by DB.RewriteAll.
+	Type string `json:"type"`
+
+	// Level is the source level, or -1 for a memdb flush. OutputLevel is
+	// the level the output tables are added to.
+	Level       int `json:"level"`
+	OutputLevel int `json:"output_level"`
+
+	// Inputs and Outputs are the file numbers of the input and output
+	// tables.
+	Inputs  []int64 `json:"inputs"`
+	Outputs []int64 `json:"outputs"`
+
+	// ReadBytes is the size of the input tables, or the memdb size for a
+	// memdb flush. WriteBytes is the size of the output tables.
+	ReadBytes  int64 `json:"read_bytes"`
+	WriteBytes int64 `json:"write_bytes"`
+
+	// WriteAmplification is WriteBytes divided by the input size of the
+	// source level, zero if the latter is zero.
+	WriteAmplification float64 `json:"write_amplification"`
+
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Reports the compaction to the MetricsHook and CompactionStatsWriter
+// options, if set.
+func (db *DB) reportCompaction(r *CompactionRecord, sourceSize int64) {
+	if m := db.s.o.GetMetricsHook(); m != nil {
+		m.ObserveCompaction(r.Duration, r.Level, r.OutputLevel, r.ReadBytes, r.WriteBytes)
+	}
+	w := db.s.o.GetCompactionStatsWriter()
+	if w == nil {
+		return
+	}
+	if sourceSize > 0 {
+		r.WriteAmplification = float64(r.WriteBytes) / float64(sourceSize)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		db.logf("compaction@stats error %q", err)
+		return
+	}
+	db.compStatsWMu.Lock()
+	defer db.compStatsWMu.Unlock()
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		db.logf("compaction@stats error %q", err)
+	}
+}
+
+func addedTableNums(rec *sessionRecord) []int64 {
+	nums := make([]int64, len(rec.addedTables))
+	for i, r := range rec.addedTables {
+		nums[i] = r.num
+	}
+	return nums
+}
+
+func deletedTableNums(rec *sessionRecord) []int64 {
+	nums := make([]int64, len(rec.deletedTables))
+	for i, r := range rec.deletedTables {
+		nums[i] = r.num
+	}
+	return nums
+}
+
 type compactionTransactCounter int
 
 func (cnt *compactionTransactCounter) incr() {
@@ -186,6 +261,7 @@ func (db *DB) compactionTransact(name string, t compactionTransactInterface) {
 		if err != nil {
 			db.logf("%s error I·%d %q", name, cnt, err)
 		}
+		db.setOutOfSpace(err)
 
 		// Set compaction error status.
 		select {
@@ -207,7 +283,8 @@ func (db *DB) compactionTransact(name string, t compactionTransactInterface) {
 			db.compactionExitTransact()
 		}
 
-		if !disableBackoff {
+		// A full disk is unlikely to be freed right away, so always back off.
+		if !disableBackoff || isOutOfSpace(err) {
 			// Reset backoff duration if counter is advancing.
 			if cnt > lastCnt {
 				backoff = backoffMin
@@ -262,6 +339,7 @@ func (db *DB) compactionCommit(name string, rec *sessionRecord) {
 	db.compactionTransactFunc(name+"@commit", func(cnt *compactionTransactCounter) error {
 		return db.s.commit(rec)
 	}, nil)
+	db.updateWriteStall()
 }
 
 func (db *DB) memCompaction() {
@@ -271,7 +349,7 @@ func (db *DB) memCompaction() {
 	}
 	defer mdb.decref()
 
-	db.logf("memdb@flush N·%d S·%s", mdb.Len(), shortenb(mdb.Size()))
+	db.logf("memdb@flush N·%d S·%s", mdb.Len(), shortenb(int64(mdb.Size())))
 
 	// Don't compact empty memdb.
 	if mdb.Len() == 0 {
@@ -301,7 +379,7 @@ func (db *DB) memCompaction() {
 	// Generate tables.
 	db.compactionTransactFunc("memdb@flush", func(cnt *compactionTransactCounter) (err error) {
 		stats.startTimer()
-		flushLevel, err = db.s.flushMemdb(rec, mdb.DB, db.memdbMaxLevel)
+		flushLevel, err = db.s.flushMemdb(rec, mdb.Table, db.memdbMaxLevel)
 		stats.stopTimer()
 		return
 	}, func() error {
@@ -322,12 +400,22 @@ func (db *DB) memCompaction() {
 	db.compactionCommit("memdb", rec)
 	stats.stopTimer()
 
-	db.logf("memdb@flush committed F·%d T·%v", len(rec.addedTables), stats.duration)
+	db.logFields(map[string]interface{}{"F": len(rec.addedTables), "T": stats.duration}, "memdb@flush committed")
 
 	for _, r := range rec.addedTables {
 		stats.write += r.size
 	}
 	db.compStats.addStat(flushLevel, stats)
+	db.reportCompaction(&CompactionRecord{
+		Type:        "memdb",
+		Level:       -1,
+		OutputLevel: flushLevel,
+		Inputs:      []int64{},
+		Outputs:     addedTableNums(rec),
+		ReadBytes:   int64(mdb.Size()),
+		WriteBytes:  stats.write,
+		Duration:    stats.duration,
+	}, int64(mdb.Size()))
 
 	// Drop frozen memdb.
 	db.dropFrozenMem()
@@ -360,12 +448,13 @@ type tableCompactionBuilder struct {
 	snapKerrCnt     int
 	snapDropCnt     int
 
-	kerrCnt int
-	dropCnt int
+	kerrCnt     int
+	dropCnt     int
+	blobDropped bool // Some dropped entries point to blob files.
 
 	minSeq    uint64
 	strict    bool
-	tableSize int
+	tableSize int64
 
 	tw *tWriter
 }
@@ -386,7 +475,7 @@ func (b *tableCompactionBuilder) appendKV(key, value []byte) error {
 
 		// Create new table.
 		var err error
-		b.tw, err = b.s.tops.create()
+		b.tw, err = b.s.tops.create(b.c.sourceLevel+1, b.tableSize)
 		if err != nil {
 			return err
 		}
@@ -407,7 +496,7 @@ func (b *tableCompactionBuilder) flush() error {
 	}
 	b.rec.addTableFile(b.c.sourceLevel+1, t)
 	b.stat1.write += t.size
-	b.s.logf("table@build created L%d@%d N·%d S·%s %q:%q", b.c.sourceLevel+1, t.fd.Num, b.tw.tw.EntriesLen(), shortenb(int(t.size)), t.imin, t.imax)
+	b.s.logf("table@build created L%d@%d N·%d S·%s %q:%q", b.c.sourceLevel+1, t.fd.Num, b.tw.tw.EntriesLen(), shortenb(t.size), t.imin, t.imax)
 	b.tw = nil
 	return nil
 }
@@ -484,6 +573,9 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 			switch {
 			case lastSeq <= b.minSeq:
 				// Dropped because newer entry for same user key exist
+				if kt == keyTypeBlob {
+					b.blobDropped = true
+				}
 				fallthrough // (A)
 			case kt == keyTypeDel && seq <= b.minSeq && b.c.baseLevelForKey(lastUkey):
 				// For this user key:
@@ -549,6 +641,13 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 		rec.delTable(c.sourceLevel, t.fd.Num)
 		rec.addTableFile(c.sourceLevel+1, t)
 		db.compactionCommit("table-move", rec)
+		db.reportCompaction(&CompactionRecord{
+			Type:        "table-move",
+			Level:       c.sourceLevel,
+			OutputLevel: c.sourceLevel + 1,
+			Inputs:      []int64{t.fd.Num},
+			Outputs:     []int64{t.fd.Num},
+		}, 0)
 		return
 	}
 
@@ -560,7 +659,7 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 			rec.delTable(c.sourceLevel+i, t.fd.Num)
 		}
 	}
-	sourceSize := int(stats[0].read + stats[1].read)
+	sourceSize := stats[0].read + stats[1].read
 	minSeq := db.minSeq()
 	db.logf("table@compaction L%d·%d -> L%d·%d S·%s Q·%d", c.sourceLevel, len(c.levels[0]), c.sourceLevel+1, len(c.levels[1]), shortenb(sourceSize), minSeq)
 
@@ -581,13 +680,27 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 	db.compactionCommit("table", rec)
 	stats[1].stopTimer()
 
-	resultSize := int(stats[1].write)
+	if b.blobDropped {
+		db.blobGCPending = true
+	}
+
+	resultSize := stats[1].write
 	db.logf("table@compaction committed F%s S%s Ke·%d D·%d T·%v", sint(len(rec.addedTables)-len(rec.deletedTables)), sshortenb(resultSize-sourceSize), b.kerrCnt, b.dropCnt, stats[1].duration)
 
 	// Save compaction stats
 	for i := range stats {
 		db.compStats.addStat(c.sourceLevel+1, &stats[i])
 	}
+	db.reportCompaction(&CompactionRecord{
+		Type:        "table",
+		Level:       c.sourceLevel,
+		OutputLevel: c.sourceLevel + 1,
+		Inputs:      deletedTableNums(rec),
+		Outputs:     addedTableNums(rec),
+		ReadBytes:   stats[0].read + stats[1].read,
+		WriteBytes:  stats[1].write,
+		Duration:    stats[1].duration,
+	}, stats[0].read)
 }
 
 func (db *DB) tableRangeCompaction(level int, umin, umax []byte) error {
@@ -628,6 +741,23 @@ func (db *DB) tableRangeCompaction(level int, umin, umax []byte) error {
 	return nil
 }
 
+// Compacts the given table into the next level, see DB.CompactFile.
+func (db *DB) tableFileCompaction(num int64) error {
+	v := db.s.version()
+	level, t := v.findTable(num)
+	if t == nil {
+		v.release()
+		return ErrTableNotFound
+	}
+	if !db.s.levelCompactable(level) {
+		v.release()
+		return fmt.Errorf("leveldb: table @%d is on the last level", num)
+	}
+	db.logf("table@compaction file L%d@%d", level, num)
+	db.tableCompaction(newCompaction(db.s, v, level, tFiles{t}, true), true)
+	return nil
+}
+
 func (db *DB) tableAutoCompaction() {
 	if c := db.s.pickCompaction(); c != nil {
 		db.tableCompaction(c, false)
@@ -658,6 +788,68 @@ func (db *DB) pauseCompaction(ch chan<- struct{}) {
 	}
 }
 
+// Wait until the table compaction resumed by ResumeCompactions; the memdb
+// compaction is still allowed to pause table compaction meanwhile.
+func (db *DB) waitUserResume(resumeC <-chan struct{}) {
+	db.logf("table@compaction paused")
+	for {
+		select {
+		case <-resumeC:
+			db.logf("table@compaction resumed")
+			return
+		case ch := <-db.tcompPauseC:
+			db.pauseCompaction(ch)
+		case <-db.closeC:
+			db.compactionExitTransact()
+		}
+	}
+}
+
+// PauseCompactions pauses table compaction of the DB. It waits for the
+// in-flight table compaction, if any, to finish and then won't schedule new
+// table compaction until ResumeCompactions is called. Calling PauseCompactions
+// on already paused DB is no-op.
+//
+// Memdb compaction is not paused, so writes continue and level-0 tables may
+// grow while table compaction is paused. Thus the writes may still be slowed
+// down or paused once level-0 tables reach opt.Options.WriteL0SlowdownTrigger
+// or opt.Options.WriteL0PauseTrigger respectively, and will only continue
+// after table compaction is resumed. CompactRange also blocks until table
+// compaction is resumed.
+func (db *DB) PauseCompactions() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.s.o.GetReadOnly() {
+		return ErrReadOnly
+	}
+
+	db.tcompUserPauseMu.Lock()
+	defer db.tcompUserPauseMu.Unlock()
+	if db.tcompUserResumeC != nil {
+		return nil
+	}
+	resumeC := make(chan struct{})
+	select {
+	case db.tcompUserPauseC <- resumeC:
+	case <-db.closeC:
+		return ErrClosed
+	}
+	db.tcompUserResumeC = resumeC
+	return nil
+}
+
+// ResumeCompactions resumes table compaction paused by PauseCompactions.
+// Calling ResumeCompactions on DB that isn't paused is no-op.
+func (db *DB) ResumeCompactions() {
+	db.tcompUserPauseMu.Lock()
+	defer db.tcompUserPauseMu.Unlock()
+	if db.tcompUserResumeC != nil {
+		close(db.tcompUserResumeC)
+		db.tcompUserResumeC = nil
+	}
+}
+
 type cCmd interface {
 	ack(err error)
 }
@@ -676,6 +868,64 @@ func (r cAuto) ack(err error) {
 	}
 }
 
+type cBlobGC struct {
+	ackC chan<- error
+}
+
+func (r cBlobGC) ack(err error) {
+	if r.ackC != nil {
+		defer func() {
+			recover()
+		}()
+		r.ackC <- err
+	}
+}
+
+type cPurge struct {
+	res  *purgeResult
+	trim bool
+	ackC chan<- error
+}
+
+func (r cPurge) ack(err error) {
+	if r.ackC != nil {
+		defer func() {
+			recover()
+		}()
+		r.ackC <- err
+	}
+}
+
+type cRewrite struct {
+	level int
+	num   int64
+	done  *bool
+	ackC  chan<- error
+}
+
+func (r cRewrite) ack(err error) {
+	if r.ackC != nil {
+		defer func() {
+			recover()
+		}()
+		r.ackC <- err
+	}
+}
+
+type cFile struct {
+	num  int64
+	ackC chan<- error
+}
+
+func (r cFile) ack(err error) {
+	if r.ackC != nil {
+		defer func() {
+			recover()
+		}()
+		r.ackC <- err
+	}
+}
+
 type cRange struct {
 	level    int
 	min, max []byte
@@ -743,6 +993,97 @@ func (db *DB) compTriggerRange(compC chan<- cCmd, level int, min, max []byte) (e
 	return err
 }
 
+// Send blob GC request.
+func (db *DB) compTriggerBlobGC(compC chan<- cCmd) (err error) {
+	ch := make(chan error)
+	defer close(ch)
+	// Send cmd.
+	select {
+	case compC <- cBlobGC{ch}:
+	case err := <-db.compErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	// Wait cmd.
+	select {
+	case err = <-ch:
+	case err = <-db.compErrC:
+	case <-db.closeC:
+		return ErrClosed
+	}
+	return err
+}
+
+// Send table rewrite request, see DB.RewriteAll. It returns whether the
+// table got rewritten.
+func (db *DB) compTriggerRewrite(compC chan<- cCmd, level int, num int64) (bool, error) {
+	ch := make(chan error)
+	defer close(ch)
+	// Only read once acknowledged.
+	done := new(bool)
+	// Send cmd.
+	select {
+	case compC <- cRewrite{level, num, done, ch}:
+	case err := <-db.compErrC:
+		return false, err
+	case <-db.closeC:
+		return false, ErrClosed
+	}
+	// Wait cmd.
+	select {
+	case err := <-ch:
+		return *done, err
+	case err := <-db.compErrC:
+		return false, err
+	case <-db.closeC:
+		return false, ErrClosed
+	}
+}
+
+// Send table file compaction request, see DB.CompactFile.
+func (db *DB) compTriggerFile(compC chan<- cCmd, num int64) (err error) {
+	ch := make(chan error)
+	defer close(ch)
+	// Send cmd.
+	select {
+	case compC <- cFile{num, ch}:
+	case err := <-db.compErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	// Wait cmd.
+	select {
+	case err = <-ch:
+	case err = <-db.compErrC:
+	case <-db.closeC:
+		return ErrClosed
+	}
+	return err
+}
+
+func (db *DB) compTriggerPurge(compC chan<- cCmd, res *purgeResult, trim bool) (err error) {
+	ch := make(chan error)
+	defer close(ch)
+	// Send cmd.
+	select {
+	case compC <- cPurge{res, trim, ch}:
+	case err := <-db.compErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	// Wait cmd.
+	select {
+	case err = <-ch:
+	case err = <-db.compErrC:
+	case <-db.closeC:
+		return ErrClosed
+	}
+	return err
+}
+
 func (db *DB) mCompaction() {
 	var x cCmd
 
@@ -808,6 +1149,9 @@ func (db *DB) tCompaction() {
 			case ch := <-db.tcompPauseC:
 				db.pauseCompaction(ch)
 				continue
+			case resumeC := <-db.tcompUserPauseC:
+				db.waitUserResume(resumeC)
+				continue
 			case <-db.closeC:
 				return
 			default:
@@ -831,11 +1175,19 @@ func (db *DB) tCompaction() {
 				waitQ[i] = nil
 			}
 			waitQ = waitQ[:0]
+			if db.blobGCPending {
+				if err := db.blobGC(); err != nil {
+					db.logf("blob@gc error %q", err)
+				}
+			}
 			select {
 			case x = <-db.tcompCmdC:
 			case ch := <-db.tcompPauseC:
 				db.pauseCompaction(ch)
 				continue
+			case resumeC := <-db.tcompUserPauseC:
+				db.waitUserResume(resumeC)
+				continue
 			case <-db.closeC:
 				return
 			}
@@ -850,6 +1202,19 @@ func (db *DB) tCompaction() {
 				}
 			case cRange:
 				x.ack(db.tableRangeCompaction(cmd.level, cmd.min, cmd.max))
+			case cBlobGC:
+				x.ack(db.blobGC())
+			case cFile:
+				x.ack(db.tableFileCompaction(cmd.num))
+			case cRewrite:
+				*cmd.done = db.tableRewrite(cmd.level, cmd.num)
+				x.ack(nil)
+			case cPurge:
+				err := db.purgeObsoleteFiles(cmd.res)
+				if err == nil && cmd.trim {
+					err = db.trimManifest(cmd.res)
+				}
+				x.ack(err)
 			default:
 				panic("leveldb: unknown command")
 			}
@@ -0,0 +1,247 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/btcsuite/goleveldb/leveldb/errors"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+)
+
+// Name of the bundle entry holding the manifest, see DB.ExportSSTables.
+const exportManifestName = "MANIFEST"
+
+var errExportBlobFiles = errors.New("leveldb: export of tables referring to blob files is not supported")
+
+func newErrExportCorrupted(reason string) error {
+	return errors.NewErrCorrupted(storage.FileDesc{}, errors.New("leveldb: export bundle corrupted: "+reason))
+}
+
+func exportTableName(num int64) string {
+	return fmt.Sprintf("%06d.ldb", num)
+}
+
+// ExportSSTables writes to w a bundle of the tables of the DB, which
+// ImportSSTables rebuilds a DB from. The tables are copied as is, without
+// decoding their keys, which is much faster than exporting the DB key by
+// key.
+//
+// The bundle is a tar archive holding a manifest, which records the level,
+// the size and the key range of each table along with the comparer name
+// and the last sequence number of the DB, followed by the tables.
+//
+// The memdb is flushed first, so that the bundle holds every write done
+// before ExportSSTables is called. The bundle is then consistent with a
+// snapshot taken after the flush: the tables are pinned until written, so
+// concurrent writes and compactions don't affect it.
+//
+// Tables referring to blob files, see opt.Options.EnableBlobFiles, can't
+// be exported. Obsolete blob files not yet removed don't prevent export.
+func (db *DB) ExportSSTables(w io.Writer) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	em, fm := db.getMems()
+	flush := fm != nil || (em != nil && em.Len() > 0)
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			m.decref()
+		}
+	}
+	if flush {
+		if err := db.CompactMemtable(); err != nil {
+			return err
+		}
+	}
+
+	v := db.s.version()
+	defer v.release()
+	if err := db.checkExportBlobRefs(v); err != nil {
+		return err
+	}
+
+	// The sequence number is read after the version is, so that it isn't
+	// lower than the sequence number of any key of the tables.
+	rec := &sessionRecord{}
+	rec.setComparer(db.s.icmp.uName())
+	rec.setSeqNum(db.getSeq())
+	if fv := db.s.formatVersion(); fv > opt.FormatV1 {
+		rec.setFormatVersion(fv)
+	}
+	if n := db.s.numLevels(); n > 0 {
+		rec.setNumLevels(n)
+	}
+	v.fillRecord(rec)
+	var buf bytes.Buffer
+	if err := rec.encode(&buf); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: exportManifestName, Mode: 0644, Size: int64(buf.Len())}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for _, r := range rec.addedTables {
+		if err := db.exportTable(tw, r); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Returns errExportBlobFiles if a table of the given version refers to a
+// blob file. Tables are only scanned if there are blob files.
+func (db *DB) checkExportBlobRefs(v *version) error {
+	if fds, err := db.s.stor.List(storage.TypeBlob); err != nil || len(fds) == 0 {
+		return err
+	}
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			nums, err := db.s.tops.blobRefs(t)
+			if err != nil {
+				return err
+			}
+			if len(nums) > 0 {
+				return errExportBlobFiles
+			}
+		}
+	}
+	return nil
+}
+
+func (db *DB) exportTable(tw *tar.Writer, r atRecord) error {
+	// The table is read through the table cache, as the storage may not
+	// allow opening it again while cached.
+	ch, err := db.s.tops.open(&tFile{fd: storage.FileDesc{Type: storage.TypeTable, Num: r.num}, size: r.size})
+	if err != nil {
+		return err
+	}
+	defer ch.Release()
+
+	if err := tw.WriteHeader(&tar.Header{Name: exportTableName(r.num), Mode: 0644, Size: r.size}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, io.NewSectionReader(ch.Value().(*tReader).r, 0, r.size))
+	return err
+}
+
+// ImportSSTables creates a DB in the given storage from a bundle written by
+// DB.ExportSSTables. The tables are written to the storage as is, without
+// decoding their keys, and registered at the same levels they were
+// exported from. It returns os.ErrExist if the storage already holds a DB.
+//
+// The keys keep the sequence numbers they had in the exported DB, and the
+// last sequence number of the created DB is set to the one of the exported
+// DB, or to opt.Options.InitialSequence if greater. The keys thus sort as
+// they did in the exported DB, and writes to the created DB get higher
+// sequence numbers than every imported key, so they supersede them.
+//
+// The options must use the comparer of the exported DB. The DB can be
+// opened once ImportSSTables returns; if it returns an error, the storage
+// may hold some of the tables and should be discarded.
+func ImportSSTables(stor storage.Storage, r io.Reader, o *opt.Options) (err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+	s, err := newSession(stor, o)
+	if err != nil {
+		return
+	}
+	defer func() {
+		s.close()
+		s.release()
+	}()
+
+	if err = s.recover(); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF || (err == nil && hdr.Name != exportManifestName) {
+		return newErrExportCorrupted("missing manifest")
+	} else if err != nil {
+		return
+	}
+	erec := &sessionRecord{}
+	if err = erec.decode(tr); err != nil {
+		return
+	}
+	if erec.comparer != s.icmp.uName() {
+		return newErrExportCorrupted(fmt.Sprintf("comparer mismatch, want %q, got %q", s.icmp.uName(), erec.comparer))
+	}
+	tables := make(map[string]atRecord, len(erec.addedTables))
+	for _, t := range erec.addedTables {
+		tables[exportTableName(t.num)] = t
+	}
+
+	rec := &sessionRecord{}
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		t, ok := tables[hdr.Name]
+		if !ok || hdr.Size != t.size {
+			return newErrExportCorrupted(fmt.Sprintf("unexpected entry %q", hdr.Name))
+		}
+		delete(tables, hdr.Name)
+		num := s.allocFileNum()
+		if err = importTable(s, storage.FileDesc{Type: storage.TypeTable, Num: num}, tr, t.size); err != nil {
+			return
+		}
+		rec.addTable(t.level, num, t.size, t.imin, t.imax)
+	}
+	if len(tables) > 0 {
+		return newErrExportCorrupted(fmt.Sprintf("%d tables missing", len(tables)))
+	}
+
+	seq := erec.seqNum
+	if iseq := s.o.GetInitialSequence(); iseq > seq {
+		seq = iseq
+	}
+	rec.setSeqNum(seq)
+	if erec.has(recFormatVersion) {
+		rec.setFormatVersion(erec.formatVersion)
+	}
+	if erec.has(recNumLevels) {
+		rec.setNumLevels(erec.numLevels)
+	}
+	if err = s.create(); err != nil {
+		return
+	}
+	return s.commit(rec)
+}
+
+func importTable(s *session, fd storage.FileDesc, r io.Reader, size int64) error {
+	w, err := s.stor.Create(fd)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, r, size); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
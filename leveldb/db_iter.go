@@ -7,6 +7,7 @@
 package leveldb
 
 import (
+	"encoding/binary"
 	"errors"
 	"math/rand"
 	"runtime"
@@ -34,10 +35,14 @@ func (mr *memdbReleaser) Release() {
 }
 
 func (db *DB) newRawIterator(auxm *memDB, auxt tFiles, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
-	strict := opt.GetStrict(db.s.o.Options, ro, opt.StrictReader)
-	em, fm := db.getMems()
-	v := db.s.version()
+	em, fm, v := db.getMemsVersion()
+	return db.newRawIteratorFrom(auxm, auxt, em, fm, v, slice, ro)
+}
 
+// Creates raw iterator over the given memdbs and version, the iterator
+// takes over the caller references.
+func (db *DB) newRawIteratorFrom(auxm *memDB, auxt tFiles, em, fm *memDB, v *version, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	strict := opt.GetStrict(db.s.o.Options, ro, opt.StrictReader)
 	tableIts := v.getIterators(slice, ro)
 	n := len(tableIts) + len(auxt) + 3
 	its := make([]iterator.Iterator, 0, n)
@@ -65,26 +70,64 @@ func (db *DB) newRawIterator(auxm *memDB, auxt tFiles, slice *util.Range, ro *op
 	return mi
 }
 
+func internalSlice(slice *util.Range) *util.Range {
+	if slice == nil {
+		return nil
+	}
+	islice := &util.Range{}
+	if slice.Start != nil {
+		islice.Start = makeInternalKey(nil, slice.Start, keyMaxSeq, keyTypeSeek)
+	}
+	if slice.Limit != nil {
+		islice.Limit = makeInternalKey(nil, slice.Limit, keyMaxSeq, keyTypeSeek)
+	}
+	return islice
+}
+
 func (db *DB) newIterator(auxm *memDB, auxt tFiles, seq uint64, slice *util.Range, ro *opt.ReadOptions) *dbIter {
-	var islice *util.Range
-	if slice != nil {
-		islice = &util.Range{}
-		if slice.Start != nil {
-			islice.Start = makeInternalKey(nil, slice.Start, keyMaxSeq, keyTypeSeek)
-		}
-		if slice.Limit != nil {
-			islice.Limit = makeInternalKey(nil, slice.Limit, keyMaxSeq, keyTypeSeek)
+	islice := internalSlice(slice)
+	rawIter := db.newRawIterator(auxm, auxt, islice, ro)
+	return db.newDBIter(rawIter, islice, seq, ro)
+}
+
+// Creates iterators for each of the given ranges, all sharing the same
+// memdbs and version.
+func (db *DB) newIterators(seq uint64, ranges []util.Range, ro *opt.ReadOptions) []iterator.Iterator {
+	iters := make([]iterator.Iterator, len(ranges))
+	if len(ranges) == 0 {
+		return iters
+	}
+	em, fm, v := db.getMemsVersion()
+	for i := range ranges {
+		if i > 0 {
+			em.incref()
+			if fm != nil {
+				fm.incref()
+			}
+			db.s.vmu.Lock()
+			v.incref()
+			db.s.vmu.Unlock()
 		}
+		islice := internalSlice(&ranges[i])
+		rawIter := db.newRawIteratorFrom(nil, nil, em, fm, v, islice, ro)
+		iters[i] = db.newDBIter(rawIter, islice, seq, ro)
 	}
-	rawIter := db.newRawIterator(auxm, auxt, islice, ro)
+	return iters
+}
+
+func (db *DB) newDBIter(rawIter iterator.Iterator, islice *util.Range, seq uint64, ro *opt.ReadOptions) *dbIter {
 	iter := &dbIter{
 		db:     db,
 		icmp:   db.s.icmp,
 		iter:   rawIter,
+		islice: islice,
 		seq:    seq,
 		strict: opt.GetStrict(db.s.o.Options, ro, opt.StrictReader),
+		ro:     ro,
 		key:    make([]byte, 0),
 		value:  make([]byte, 0),
+
+		vmetaSize: db.s.o.GetValueMetaSize(),
 	}
 	atomic.AddInt32(&db.aliveIters, 1)
 	runtime.SetFinalizer(iter, (*dbIter).Release)
@@ -105,20 +148,48 @@ const (
 	dirForward
 )
 
+// ValueMetaIterator is implemented by the iterators of a DB, such as the
+// ones returned by DB.NewIterator and Snapshot.NewIterator.
+type ValueMetaIterator interface {
+	iterator.Iterator
+
+	// Meta returns the metadata header of the current value, see
+	// opt.Options.ValueMetaSize; Value then returns the value body. It
+	// returns nil if the option isn't set, or if the value is shorter
+	// than the header. The caller should not modify its contents.
+	Meta() []byte
+}
+
+// CursorIterator is implemented by the iterators of a DB, such as the
+// ones returned by DB.NewIterator and Snapshot.NewIterator.
+type CursorIterator interface {
+	iterator.Iterator
+
+	// SaveCursor returns an opaque token of the current position of the
+	// iterator and of the sequence it reads at, which DB.NewIteratorFromCursor
+	// resumes iterating from. It returns nil if the iterator isn't
+	// positioned at a key.
+	SaveCursor() []byte
+}
+
 // dbIter represent an interator states over a database session.
 type dbIter struct {
 	db     *DB
 	icmp   *iComparer
 	iter   iterator.Iterator
+	islice *util.Range // bounds as internal keys, used by Progress
 	seq    uint64
 	strict bool
+	ro     *opt.ReadOptions
 
 	smaplingGap int
+	vmetaSize   int
 	dir         dir
 	key         []byte
 	value       []byte
 	err         error
 	releaser    util.Releaser
+	released    int32
 }
 
 func (i *dbIter) sampleSeek() {
@@ -207,11 +278,14 @@ func (i *dbIter) next() bool {
 					// Skip deleted key.
 					i.key = append(i.key[:0], ukey...)
 					i.dir = dirForward
-				case keyTypeVal:
+				case keyTypeVal, keyTypeBlob:
 					if i.dir == dirSOI || i.icmp.uCompare(ukey, i.key) > 0 {
 						i.key = append(i.key[:0], ukey...)
 						i.value = append(i.value[:0], i.iter.Value()...)
 						i.dir = dirForward
+						if kt == keyTypeBlob {
+							return i.readBlob()
+						}
 						return true
 					}
 				}
@@ -247,19 +321,20 @@ func (i *dbIter) Next() bool {
 
 func (i *dbIter) prev() bool {
 	i.dir = dirBackward
-	del := true
+	del, blob := true, false
 	if i.iter.Valid() {
 		for {
 			if ukey, seq, kt, kerr := parseInternalKey(i.iter.Key()); kerr == nil {
 				i.sampleSeek()
 				if seq <= i.seq {
 					if !del && i.icmp.uCompare(ukey, i.key) < 0 {
-						return true
+						break
 					}
 					del = (kt == keyTypeDel)
 					if !del {
 						i.key = append(i.key[:0], ukey...)
 						i.value = append(i.value[:0], i.iter.Value()...)
+						blob = (kt == keyTypeBlob)
 					}
 				}
 			} else if i.strict {
@@ -276,6 +351,20 @@ func (i *dbIter) prev() bool {
 		i.iterErr()
 		return false
 	}
+	if blob {
+		return i.readBlob()
+	}
+	return true
+}
+
+// Replaces the blob pointer in i.value with the value it refers to.
+func (i *dbIter) readBlob() bool {
+	value, err := i.db.s.tops.readBlob(i.value, i.ro)
+	if err != nil {
+		i.setErr(err)
+		return false
+	}
+	i.value = value
 	return true
 }
 
@@ -322,11 +411,35 @@ func (i *dbIter) Value() []byte {
 	if i.err != nil || i.dir <= dirEOI {
 		return nil
 	}
-	return i.value
+	_, body := splitValueMeta(i.value, i.vmetaSize)
+	return body
+}
+
+// SaveCursor returns a token of the current position, see CursorIterator.
+// The token is the sequence of the iterator followed by the current key.
+func (i *dbIter) SaveCursor() []byte {
+	if i.err != nil || i.dir <= dirEOI {
+		return nil
+	}
+	cursor := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(i.key))
+	n := binary.PutUvarint(cursor, i.seq)
+	return append(cursor[:n], i.key...)
+}
+
+// Meta returns the metadata header of the current value, see
+// ValueMetaIterator.
+func (i *dbIter) Meta() []byte {
+	if i.err != nil || i.dir <= dirEOI {
+		return nil
+	}
+	vmeta, _ := splitValueMeta(i.value, i.vmetaSize)
+	return vmeta
 }
 
 func (i *dbIter) Release() {
-	if i.dir != dirReleased {
+	// Only the first call releases, even if called concurrently; so the
+	// alive iterators counter is decremented once.
+	if atomic.CompareAndSwapInt32(&i.released, 0, 1) {
 		// Clear the finalizer.
 		runtime.SetFinalizer(i, nil)
 
@@ -358,3 +471,57 @@ func (i *dbIter) SetReleaser(releaser util.Releaser) {
 func (i *dbIter) Error() error {
 	return i.err
 }
+
+// Progress returns the approximate fraction, from 0 to 1, of the bytes of
+// the iterator's range preceding the current key, estimated from the
+// tables of the current version the way DB.SizeOf does. It is 0 before the
+// first key and 1 once exhausted.
+//
+// The estimate ignores the memdbs and sums the approximate offsets of the
+// key within the tables of every level, hence it is only meaningful once
+// most of the range is in tables, and it may go backward as the scan
+// crosses table and level boundaries.
+func (i *dbIter) Progress() float64 {
+	switch {
+	case i.dir == dirEOI:
+		return 1
+	case i.dir <= dirSOI || i.err != nil:
+		return 0
+	}
+
+	v := i.db.s.version()
+	defer v.release()
+
+	var start, limit []byte
+	if i.islice != nil {
+		start, limit = i.islice.Start, i.islice.Limit
+	}
+	var begin, end int64
+	var err error
+	if start != nil {
+		if begin, err = v.offsetOf(start); err != nil {
+			return 0
+		}
+	}
+	if limit != nil {
+		if end, err = v.offsetOf(limit); err != nil {
+			return 0
+		}
+	} else {
+		for _, tables := range v.levels {
+			end += tables.size()
+		}
+	}
+	cur, err := v.offsetOf(makeInternalKey(nil, i.key, keyMaxSeq, keyTypeSeek))
+	if err != nil || end <= begin {
+		return 0
+	}
+	switch p := float64(cur-begin) / float64(end-begin); {
+	case p < 0:
+		return 0
+	case p > 1:
+		return 1
+	default:
+		return p
+	}
+}
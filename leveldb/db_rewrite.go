@@ -0,0 +1,220 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"context"
+
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+)
+
+// RewriteAll rewrites every table of the DB with the table options of o,
+// e.g. to apply a new compression, filter or block size to the whole DB
+// in place, instead of dumping and reloading it. The tables are rewritten
+// one by one from the bottom level up, each at its level and with its
+// entries unchanged, while the DB stays available. Each rewritten table
+// is logged and reported to opt.Options.CompactionStatsWriter as a
+// "table-rewrite" compaction.
+//
+// Only the options defining the table format are taken from o, which are
+// BlockRestartInterval, BlockSize, Compression, CompressionPerLevel,
+// Filter and TwoLevelIndex; a nil o means their defaults. They apply to
+// every table written from then on, including the ones of memdb flushes
+// and table compactions, until the DB is closed; the DB should be
+// reopened with them afterward. The tables are read with the filter the
+// DB was opened with, so a new filter is only used once the DB is
+// reopened with it.
+//
+// The comparer and the block transform can't be changed, as the DB
+// couldn't read the rewritten tables; an *ErrInvalidOption is returned if
+// o sets different ones, while unset ones keep those of the DB. Changing
+// them requires a reload.
+//
+// RewriteAll returns the number of tables rewritten. It stops early and
+// returns ctx.Err() if the given context is done; the tables rewritten
+// until then keep the new options.
+func (db *DB) RewriteAll(ctx context.Context, o *opt.Options) (n int, err error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	if db.s.o.GetReadOnly() {
+		return 0, ErrReadOnly
+	}
+	if err := o.Validate(); err != nil {
+		return 0, err
+	}
+	if o != nil && o.Comparer != nil && o.Comparer.Name() != db.s.icmp.uName() {
+		return 0, &ErrInvalidOption{Name: "Comparer", Reason: "can't be changed by a rewrite"}
+	}
+	if o != nil && o.BlockTransform != nil && transformName(o.BlockTransform) != transformName(db.s.o.GetBlockTransform()) {
+		return 0, &ErrInvalidOption{Name: "BlockTransform", Reason: "can't be changed by a rewrite"}
+	}
+
+	if o == nil {
+		o = &opt.Options{}
+	}
+	wo := db.s.o.Options.Clone()
+	wo.BlockRestartInterval = o.BlockRestartInterval
+	wo.BlockSize = o.BlockSize
+	wo.Compression = o.Compression
+	wo.CompressionPerLevel = o.CompressionPerLevel
+	wo.Filter = o.Filter
+	wo.TwoLevelIndex = o.TwoLevelIndex
+	db.s.tops.wopt.Store(wo)
+
+	// Tables are numbered in creation order, every table numbered from
+	// here on is written with the new options.
+	lastNum := db.s.nextFileNum()
+	db.logf("table@rewrite started @%d", lastNum)
+	for {
+		if err := ctx.Err(); err != nil {
+			db.logf("table@rewrite canceled N·%d %q", n, err)
+			return n, err
+		}
+		level, num, left := db.pickRewrite(lastNum)
+		if left == 0 {
+			break
+		}
+		db.logf("table@rewrite picked L%d@%d N·%d", level, num, left)
+		done, err := db.compTriggerRewrite(db.tcompCmdC, level, num)
+		if err != nil {
+			return n, err
+		}
+		if done {
+			n++
+		}
+	}
+	db.logf("table@rewrite done N·%d", n)
+	return n, nil
+}
+
+// Returns the name of the given block transform, or an empty string if
+// it is nil.
+func transformName(t opt.BlockTransform) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name()
+}
+
+// Picks the next table to rewrite, the first one of the bottommost level
+// holding tables numbered before lastNum. It also returns the number of
+// such tables, zero if none.
+func (db *DB) pickRewrite(lastNum int64) (level int, num int64, n int) {
+	v := db.s.version()
+	defer v.release()
+
+	for i := len(v.levels) - 1; i >= 0; i-- {
+		for _, t := range v.levels[i] {
+			if t.fd.Num < lastNum {
+				if n == 0 {
+					level, num = i, t.fd.Num
+				}
+				n++
+			}
+		}
+	}
+	return
+}
+
+// Rewrites the given table at its level with the current table options,
+// see DB.RewriteAll. It does nothing and returns false if the table is no
+// longer at that level, e.g. if it got compacted since picked.
+func (db *DB) tableRewrite(level int, num int64) bool {
+	// Check for pause event.
+	select {
+	case ch := <-db.tcompPauseC:
+		db.pauseCompaction(ch)
+	case <-db.closeC:
+		db.compactionExitTransact()
+	default:
+	}
+
+	v := db.s.version()
+	defer v.release()
+
+	var t *tFile
+	if level < len(v.levels) {
+		for _, x := range v.levels[level] {
+			if x.fd.Num == num {
+				t = x
+				break
+			}
+		}
+	}
+	if t == nil {
+		db.logf("table@rewrite skipping L%d@%d", level, num)
+		return false
+	}
+
+	rec := &sessionRecord{}
+	rec.delTable(level, t.fd.Num)
+	stats := &cStatStaging{read: t.size}
+	db.compactionTransactFunc("table@rewrite", func(cnt *compactionTransactCounter) (err error) {
+		stats.startTimer()
+		defer stats.stopTimer()
+
+		tw, err := db.s.tops.create(level, t.size)
+		if err != nil {
+			return err
+		}
+		// Fail on corrupted blocks rather than dropping their entries.
+		ro := &opt.ReadOptions{
+			DontFillCache: true,
+			Strict:        opt.StrictOverride | opt.StrictReader,
+		}
+		iter := db.s.tops.newIterator(t, nil, ro)
+		defer iter.Release()
+		for iter.Next() {
+			cnt.incr()
+			if err := tw.append(iter.Key(), iter.Value()); err != nil {
+				tw.drop()
+				return err
+			}
+		}
+		if err := iter.Error(); err != nil {
+			tw.drop()
+			return err
+		}
+		nt, err := tw.finish()
+		if err != nil {
+			tw.drop()
+			return err
+		}
+		rec.addTableFile(level, nt)
+		stats.write = nt.size
+		return nil
+	}, func() error {
+		for _, r := range rec.addedTables {
+			db.logf("table@rewrite revert @%d", r.num)
+			if err := db.s.stor.Remove(storage.FileDesc{Type: storage.TypeTable, Num: r.num}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Commit.
+	stats.startTimer()
+	db.compactionCommit("table-rewrite", rec)
+	stats.stopTimer()
+
+	db.logf("table@rewrite committed L%d@%d -> @%d S·%s -> %s T·%v", level, t.fd.Num, rec.addedTables[0].num, shortenb(stats.read), shortenb(stats.write), stats.duration)
+	db.compStats.addStat(level, stats)
+	db.reportCompaction(&CompactionRecord{
+		Type:        "table-rewrite",
+		Level:       level,
+		OutputLevel: level,
+		Inputs:      deletedTableNums(rec),
+		Outputs:     addedTableNums(rec),
+		ReadBytes:   stats.read,
+		WriteBytes:  stats.write,
+		Duration:    stats.duration,
+	}, stats.read)
+	return true
+}
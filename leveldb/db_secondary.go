@@ -0,0 +1,359 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"os"
+
+	"github.com/btcsuite/goleveldb/leveldb/errors"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+)
+
+// Number of attempts when the primary removes files while a secondary is
+// reading them.
+const secondaryRetry = 5
+
+func isFileMissing(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if e, ok := err.(*errors.ErrCorrupted); ok {
+		_, ok = e.Err.(*errors.ErrMissingFiles)
+		return ok
+	}
+	return false
+}
+
+// retrySecondary calls fn until it doesn't fail due to files removed by
+// the primary.
+func retrySecondary(s *session, fn func() error) (err error) {
+	for i := 0; i < secondaryRetry; i++ {
+		if err = fn(); err == nil || !isFileMissing(err) {
+			return
+		}
+		s.logf("secondary@retry %v", err)
+	}
+	return
+}
+
+// OpenSecondary opens a secondary, read-only, instance of the DB in the
+// given storage, while the primary instance may still be writing to it.
+// The secondary never writes to the storage nor takes its lock, since
+// the primary holds it exclusively; use storage.OpenFileUnlocked or
+// OpenSecondaryFile for a file-system backed storage.
+//
+// The secondary sees the state of the DB at the time it is opened. Use
+// CatchUpWithPrimary to pick up the changes made by the primary since.
+// The ReadOnly option is implied and ErrorIfMissing, ErrorIfExist are
+// ignored; the DB must exist.
+//
+// The returned DB instance is safe for concurrent use.
+// The DB must be closed after use, by calling Close method.
+func OpenSecondary(stor storage.Storage, o *opt.Options) (db *DB, err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+	var so opt.Options
+	if o != nil {
+		so = *o
+	}
+	so.ReadOnly = true
+
+	s, err := newSecondarySession(stor, &so)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			s.close()
+			s.release()
+		}
+	}()
+
+	err = retrySecondary(s, func() error {
+		if err := s.recover(); err != nil {
+			return err
+		}
+		if err := s.checkNumLevels(); err != nil {
+			return err
+		}
+		db, err = openDB(s)
+		return err
+	})
+	return
+}
+
+// OpenSecondaryFile opens a secondary instance of the DB for the given
+// path, see OpenSecondary.
+//
+// The returned DB instance is safe for concurrent use.
+// The DB must be closed after use, by calling Close method.
+func OpenSecondaryFile(path string, o *opt.Options) (db *DB, err error) {
+	stor, err := storage.OpenFileUnlocked(path)
+	if err != nil {
+		return
+	}
+	db, err = OpenSecondary(stor, o)
+	if err != nil {
+		stor.Close()
+	} else {
+		db.closer = stor
+	}
+	return
+}
+
+// OpenShared opens a lenient, read-only, instance of the DB in the given
+// storage, while another instance may still be writing to it. It is a
+// lighter sibling of OpenSecondary: only the tables listed by the manifest
+// at open time are read, writes still in the journals of the writer are
+// not visible, and CatchUpWithPrimary is not supported. Like a secondary,
+// it never writes to the storage nor takes its lock; use
+// storage.OpenFileUnlocked or OpenSharedFile for a file-system backed
+// storage.
+//
+// The reads are eventually consistent. When a Get or Has hits a table that
+// the writer removed meanwhile, the instance reloads the latest manifest
+// and retries, thus seeing the writes flushed by the writer since; reads
+// that don't hit a removed table keep seeing the older state, which
+// includes removed tables the instance still holds open. Iterators
+// and snapshots are not retried, they may fail with an error satisfying
+// os.IsNotExist or errors.IsCorrupted once the writer removes a table they
+// need, in which case they should be recreated.
+//
+// No lock is shared with the writer, the storage lock being held
+// exclusively: nothing keeps the writer from removing the files the
+// instance reads, which relies on the retries above. A writer whose readers
+// can't afford such failures must keep its obsolete tables around itself,
+// e.g. by holding a snapshot for as long as the readers need them.
+//
+// The ReadOnly option is implied and ErrorIfMissing, ErrorIfExist are
+// ignored; the DB must exist.
+//
+// The returned DB instance is safe for concurrent use.
+// The DB must be closed after use, by calling Close method.
+func OpenShared(stor storage.Storage, o *opt.Options) (db *DB, err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+	var so opt.Options
+	if o != nil {
+		so = *o
+	}
+	so.ReadOnly = true
+
+	s, err := newSecondarySession(stor, &so)
+	if err != nil {
+		return
+	}
+	s.shared = true
+	defer func() {
+		if err != nil {
+			s.close()
+			s.release()
+		}
+	}()
+
+	err = retrySecondary(s, func() error {
+		if err := s.recover(); err != nil {
+			return err
+		}
+		if err := s.checkNumLevels(); err != nil {
+			return err
+		}
+		db, err = openDB(s)
+		return err
+	})
+	return
+}
+
+// OpenSharedFile opens a lenient read-only instance of the DB for the
+// given path, see OpenShared.
+//
+// The returned DB instance is safe for concurrent use.
+// The DB must be closed after use, by calling Close method.
+func OpenSharedFile(path string, o *opt.Options) (db *DB, err error) {
+	stor, err := storage.OpenFileUnlocked(path)
+	if err != nil {
+		return
+	}
+	db, err = OpenShared(stor, o)
+	if err != nil {
+		stor.Close()
+	} else {
+		db.closer = stor
+	}
+	return
+}
+
+// OpenAtManifest opens a read-only instance of the DB in the given storage
+// as of the given manifest generation, rather than the one the CURRENT
+// file points to. It is meant for debugging, e.g. to compare the DB
+// before and after a suspect compaction.
+//
+// Only the tables listed by the manifest are read, the writes still in
+// the journals are not visible. The tables must still be present, they
+// are usually removed by compaction in the meantime, thus the storage is
+// likely a copy of the DB. The instance never writes to the storage nor
+// takes its lock, in particular the CURRENT file is left untouched; use
+// storage.OpenFileUnlocked or OpenAtManifestFile for a file-system backed
+// storage.
+//
+// The ReadOnly option is implied and ErrorIfMissing, ErrorIfExist are
+// ignored; the DB must exist.
+//
+// The returned DB instance is safe for concurrent use.
+// The DB must be closed after use, by calling Close method.
+func OpenAtManifest(stor storage.Storage, manifestNum int64, o *opt.Options) (db *DB, err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+	var so opt.Options
+	if o != nil {
+		so = *o
+	}
+	so.ReadOnly = true
+
+	s, err := newSecondarySession(stor, &so)
+	if err != nil {
+		return
+	}
+	s.pinned = true
+	s.manifestFd = storage.FileDesc{Type: storage.TypeManifest, Num: manifestNum}
+	defer func() {
+		if err != nil {
+			s.close()
+			s.release()
+		}
+	}()
+
+	if err = s.recover(); err != nil {
+		return
+	}
+	if err = s.checkNumLevels(); err != nil {
+		return
+	}
+	return openDB(s)
+}
+
+// OpenAtManifestFile opens a read-only instance of the DB for the given
+// path as of the given manifest generation, see OpenAtManifest.
+//
+// The returned DB instance is safe for concurrent use.
+// The DB must be closed after use, by calling Close method.
+func OpenAtManifestFile(path string, manifestNum int64, o *opt.Options) (db *DB, err error) {
+	stor, err := storage.OpenFileUnlocked(path)
+	if err != nil {
+		return
+	}
+	db, err = OpenAtManifest(stor, manifestNum, o)
+	if err != nil {
+		stor.Close()
+	} else {
+		db.closer = stor
+	}
+	return
+}
+
+// retryShared reloads the manifest and calls fn until it doesn't fail
+// due to files removed by the writer; see OpenShared.
+func (db *DB) retryShared(fn func() error) (err error) {
+	for i := 0; i < secondaryRetry; i++ {
+		db.catchUpMu.Lock()
+		err = db.refreshShared()
+		db.catchUpMu.Unlock()
+		if err == nil {
+			err = fn()
+		}
+		if err == nil || !isFileMissing(err) {
+			return
+		}
+		db.logf("shared@retry %v", err)
+	}
+	return
+}
+
+func (db *DB) refreshShared() error {
+	fd, err := db.s.stor.GetMeta()
+	if err != nil {
+		return err
+	}
+	staging, rec, err := db.s.recoverManifest(fd)
+	if err != nil {
+		return err
+	}
+	// Published under the memdb lock, see getMemsVersion.
+	db.memMu.Lock()
+	db.s.manifestFd = fd
+	db.s.setVersion(staging.finish())
+	db.memMu.Unlock()
+	db.s.setNextFileNum(rec.nextFileNum)
+	db.s.recordCommited(rec)
+	if rec.seqNum > db.getSeq() {
+		db.setSeq(rec.seqNum)
+	}
+	db.logf("shared@refresh %s-%d Q·%d", fd.Type, fd.Num, rec.seqNum)
+	return nil
+}
+
+// CatchUpWithPrimary re-reads the manifest and journals written by the
+// primary, so that the secondary sees the tables and writes made by the
+// primary since it was opened or last caught up. Tables removed by the
+// primary in the meantime are retried on a fresher manifest.
+//
+// Iterators and snapshots acquired before CatchUpWithPrimary keep reading
+// their original tables, as long as they are still open or present, but
+// the primary may have compacted away older versions of keys they need.
+//
+// CatchUpWithPrimary returns ErrNotSecondary if the DB was not opened with
+// OpenSecondary.
+func (db *DB) CatchUpWithPrimary() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if !db.s.secondary || db.s.shared || db.s.pinned {
+		return ErrNotSecondary
+	}
+
+	db.catchUpMu.Lock()
+	defer db.catchUpMu.Unlock()
+	return retrySecondary(db.s, db.catchUp)
+}
+
+func (db *DB) catchUp() error {
+	fd, err := db.s.stor.GetMeta()
+	if err != nil {
+		return err
+	}
+	staging, rec, err := db.s.recoverManifest(fd)
+	if err != nil {
+		return err
+	}
+	mdb, seq, err := db.replayJournalRO(rec.journalNum, rec.prevJournalNum, rec.seqNum, nil)
+	if err != nil {
+		return err
+	}
+
+	// The version and the memdb are swapped at once, under the memdb lock,
+	// so that concurrent reads never pair the new memdb with the old
+	// version, missing entries flushed by the primary, see getMemsVersion.
+	db.memMu.Lock()
+	db.s.manifestFd = fd
+	db.s.setVersion(staging.finish())
+	mem := db.mem
+	db.mem = &memDB{db: db, Table: mdb, ref: 1}
+	db.memMu.Unlock()
+	db.s.setNextFileNum(rec.nextFileNum)
+	db.s.recordCommited(rec)
+	mem.decref()
+	if seq > db.getSeq() {
+		db.setSeq(seq)
+	}
+
+	db.logf("secondary@catchup %s-%d Q·%d", fd.Type, fd.Num, seq)
+	return nil
+}
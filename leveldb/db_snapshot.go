@@ -8,6 +8,7 @@ package leveldb
 
 import (
 	"container/list"
+	"encoding/binary"
 	"fmt"
 	"runtime"
 	"sync"
@@ -59,16 +60,117 @@ func (db *DB) releaseSnapshot(se *snapshotElement) {
 	}
 }
 
-// Gets minimum sequence that not being snapshotted.
+// Gets minimum sequence that not being snapshotted nor retained, for a
+// compaction to drop the entries it hides; the entries visible before it
+// are then no longer available, see NewIteratorAtSequence.
 func (db *DB) minSeq() uint64 {
 	db.snapsMu.Lock()
 	defer db.snapsMu.Unlock()
 
+	seq := db.getSeq()
 	if e := db.snapsList.Front(); e != nil {
-		return e.Value.(*snapshotElement).seq
+		seq = e.Value.(*snapshotElement).seq
+	}
+	if db.retainSeq > 0 && db.retainSeq < seq {
+		seq = db.retainSeq
 	}
+	if seq > db.compactedSeq {
+		db.compactedSeq = seq
+	}
+	return seq
+}
 
-	return db.getSeq()
+// AliveSnapshotSequences returns the sequence numbers of the snapshots
+// not yet released, see LastSequence, in increasing order. Snapshots taken
+// at the same sequence are listed once. The first one is of the oldest
+// snapshot, which keeps compactions from dropping the entries visible at
+// its sequence even once overwritten or deleted.
+func (db *DB) AliveSnapshotSequences() []uint64 {
+	db.snapsMu.Lock()
+	defer db.snapsMu.Unlock()
+
+	seqs := make([]uint64, 0, db.snapsList.Len())
+	for e := db.snapsList.Front(); e != nil; e = e.Next() {
+		seqs = append(seqs, e.Value.(*snapshotElement).seq)
+	}
+	return seqs
+}
+
+// RetainSequence keeps compactions from dropping the entries visible at
+// the given sequence, as if a snapshot at seq were held, so that
+// NewIteratorAtSequence may read at seq or any later sequence. Retaining
+// sequence zero stops retaining. It returns ErrSequenceCompacted, and
+// retains nothing, if the entries visible at seq may already be dropped.
+//
+// Retained entries take space until the retained sequence is raised.
+func (db *DB) RetainSequence(seq uint64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.snapsMu.Lock()
+	defer db.snapsMu.Unlock()
+	if seq > 0 && seq < db.compactedSeq {
+		return ErrSequenceCompacted
+	}
+	db.retainSeq = seq
+	return nil
+}
+
+// NewIteratorAtSequence returns an iterator of the DB as it was at the
+// given sequence, see LastSequence, as would a snapshot taken then. The
+// sequence must not be after the last sequence, and the entries visible
+// at it must not have been dropped by a compaction since; the iterator
+// fails with ErrSequenceCompacted otherwise. Compactions keep the entries
+// visible at sequences held by a snapshot or by RetainSequence; without
+// either, a sequence is available until the next table compaction. The
+// sequences before the DB was opened may not be available.
+//
+// Slice allows slicing the iterator, see NewIterator.
+//
+// The iterator must be released after use, by calling Release method.
+func (db *DB) NewIteratorAtSequence(seq uint64, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	if err := db.ok(); err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	if last := db.getSeq(); seq > last {
+		return iterator.NewEmptyIterator(fmt.Errorf("leveldb: sequence %d is after the last sequence %d", seq, last))
+	}
+
+	// The iterator holds the version, so the check after creating it
+	// covers all compactions committed before.
+	iter := db.newIterator(nil, nil, seq, slice, ro)
+	db.snapsMu.Lock()
+	compacted := seq < db.compactedSeq
+	db.snapsMu.Unlock()
+	if compacted {
+		iter.Release()
+		return iterator.NewEmptyIterator(ErrSequenceCompacted)
+	}
+	return iter
+}
+
+// NewIteratorFromCursor returns an iterator resuming the iteration saved
+// by CursorIterator.SaveCursor, e.g. by a batch job resuming its scan once
+// restarted. The iterator reads at the same sequence as the saved one, see
+// NewIteratorAtSequence, and is positioned at the saved key, so that Next
+// moves to the key following it. It fails with ErrInvalidCursor if the
+// token is malformed, and with ErrSequenceCompacted if the entries visible
+// at the sequence were dropped by a compaction since; holding a snapshot or
+// calling RetainSequence keeps them. As with NewIteratorAtSequence, the
+// sequences before the DB was opened may not be available, so the token is
+// best resumed while the DB that saved it is still open.
+//
+// The iterator must be released after use, by calling Release method.
+func (db *DB) NewIteratorFromCursor(cursor []byte, ro *opt.ReadOptions) iterator.Iterator {
+	seq, n := binary.Uvarint(cursor)
+	if n <= 0 {
+		return iterator.NewEmptyIterator(ErrInvalidCursor)
+	}
+	iter := db.NewIteratorAtSequence(seq, nil, ro)
+	if iter.Error() == nil {
+		iter.Seek(cursor[n:])
+	}
+	return iter
 }
 
 // Snapshot is a DB snapshot.
@@ -95,7 +197,7 @@ func (snap *Snapshot) String() string {
 }
 
 // Get gets the value for the given key. It returns ErrNotFound if
-// the DB does not contains the key.
+// the DB does not contains the key, see DB.Get.
 //
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Get returns.
@@ -110,7 +212,8 @@ func (snap *Snapshot) Get(key []byte, ro *opt.ReadOptions) (value []byte, err er
 		err = ErrSnapshotReleased
 		return
 	}
-	return snap.db.get(nil, nil, key, snap.elem.seq, ro)
+	value, err = snap.db.get(nil, nil, key, snap.elem.seq, ro)
+	return value, snap.db.notFound(err, key)
 }
 
 // Has returns true if the DB does contains the given key.
@@ -130,6 +233,26 @@ func (snap *Snapshot) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error)
 	return snap.db.has(nil, nil, key, snap.elem.seq, ro)
 }
 
+// GetMulti gets the values for the given keys. The value of a key the DB
+// does not contains is nil, the value of an existing key is never nil
+// even if empty.
+//
+// The caller should not modify the contents of the returned slices, but
+// it is safe to modify the contents of the argument after GetMulti returns.
+func (snap *Snapshot) GetMulti(keys [][]byte, ro *opt.ReadOptions) (values [][]byte, err error) {
+	err = snap.db.ok()
+	if err != nil {
+		return
+	}
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.released {
+		err = ErrSnapshotReleased
+		return
+	}
+	return snap.db.getMulti(keys, snap.elem.seq, ro)
+}
+
 // NewIterator returns an iterator for the snapshot of the underlying DB.
 // The returned iterator is not safe for concurrent use, but it is safe to use
 // multiple iterators concurrently, with each in a dedicated goroutine.
@@ -161,6 +284,39 @@ func (snap *Snapshot) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterat
 	return snap.db.newIterator(nil, nil, snap.elem.seq, slice, ro)
 }
 
+// NewParallelIterators returns an iterator for each of the given key
+// ranges, all over the snapshot of the underlying DB. The ranges are
+// treated as the slice argument of NewIterator, and are typically
+// disjoint. The iterators share the same view of the DB, so each of them
+// can be used in a dedicated goroutine to scan the snapshot in parallel;
+// the key/value pairs are consistent across all of them.
+//
+// Each iterator must be released after use, by calling Release method.
+// Releasing the snapshot doesn't mean releasing the iterators too, the
+// iterators would be still valid until released.
+func (snap *Snapshot) NewParallelIterators(ranges []util.Range, ro *opt.ReadOptions) []iterator.Iterator {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	// The DB is unset once the snapshot is released.
+	if snap.released {
+		return newEmptyIterators(len(ranges), ErrSnapshotReleased)
+	}
+	if err := snap.db.ok(); err != nil {
+		return newEmptyIterators(len(ranges), err)
+	}
+	// Since iterators already hold version ref, they doesn't need to
+	// hold snapshot ref.
+	return snap.db.newIterators(snap.elem.seq, ranges, ro)
+}
+
+func newEmptyIterators(n int, err error) []iterator.Iterator {
+	iters := make([]iterator.Iterator, n)
+	for i := range iters {
+		iters[i] = iterator.NewEmptyIterator(err)
+	}
+	return iters
+}
+
 // Release releases the snapshot. This will not release any returned
 // iterators, the iterators would still be valid until released or the
 // underlying DB is closed.
@@ -9,6 +9,7 @@ package leveldb
 import (
 	"errors"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/btcsuite/goleveldb/leveldb/journal"
@@ -22,7 +23,7 @@ var (
 
 type memDB struct {
 	db *DB
-	*memdb.DB
+	memdb.Table
 	ref int32
 }
 
@@ -39,10 +40,10 @@ func (m *memDB) decref() {
 		// Only put back memdb with std capacity.
 		if m.Capacity() == m.db.s.o.GetWriteBuffer() {
 			m.Reset()
-			m.db.mpoolPut(m.DB)
+			m.db.mpoolPut(m.Table)
 		}
 		m.db = nil
-		m.DB = nil
+		m.Table = nil
 	} else if ref < 0 {
 		panic("negative memdb ref")
 	}
@@ -71,7 +72,21 @@ func (db *DB) sampleSeek(ikey internalKey) {
 	v.release()
 }
 
-func (db *DB) mpoolPut(mem *memdb.DB) {
+// Creates a memdb table of the given capacity, see
+// opt.Options.MemTableFactory and MemTableArenaBlockSize. The arena block
+// size is ignored if the factory doesn't support it, a combination that
+// opt.Options.Validate rejects anyway.
+func (db *DB) newMemTable(capacity int) memdb.Table {
+	f := db.s.o.GetMemTableFactory()
+	if bs := db.s.o.GetMemTableArenaBlockSize(); bs > 0 {
+		if af, ok := f.(memdb.ArenaFactory); ok {
+			return af.NewWithArenaBlockSize(db.s.icmp, capacity, bs)
+		}
+	}
+	return f.New(db.s.icmp, capacity)
+}
+
+func (db *DB) mpoolPut(mem memdb.Table) {
 	if !db.isClosed() {
 		select {
 		case db.memPool <- mem:
@@ -81,17 +96,21 @@ func (db *DB) mpoolPut(mem *memdb.DB) {
 }
 
 func (db *DB) mpoolGet(n int) *memDB {
-	var mdb *memdb.DB
+	var mdb memdb.Table
 	select {
 	case mdb = <-db.memPool:
 	default:
 	}
-	if mdb == nil || mdb.Capacity() < n {
-		mdb = memdb.New(db.s.icmp, maxInt(db.s.o.GetWriteBuffer(), n))
+	// Pooled memdb might be created before write buffer size changed.
+	if mdb == nil || mdb.Capacity() < n || mdb.Capacity() != db.s.o.GetWriteBuffer() {
+		mdb = db.newMemTable(maxInt(db.s.o.GetWriteBuffer(), n))
+		if bits := db.s.o.GetMemTableBloomBits(); bits > 0 {
+			mdb = newMemBloomTable(mdb, bits)
+		}
 	}
 	return &memDB{
-		db: db,
-		DB: mdb,
+		db:    db,
+		Table: mdb,
 	}
 }
 
@@ -120,6 +139,13 @@ func (db *DB) mpoolDrain() {
 // Create new memdb and froze the old one; need external synchronization.
 // newMem only called synchronously by the writer.
 func (db *DB) newMem(n int) (mem *memDB, err error) {
+	var header []byte
+	if t := db.s.o.GetBlockTransform(); t != nil {
+		if header, err = makeJournalTransformHeader(t); err != nil {
+			return
+		}
+	}
+
 	fd := storage.FileDesc{Type: storage.TypeJournal, Num: db.s.allocFileNum()}
 	w, err := db.s.stor.Create(fd)
 	if err != nil {
@@ -141,6 +167,13 @@ func (db *DB) newMem(n int) (mem *memDB, err error) {
 		db.journalWriter.Close()
 		db.frozenJournalFd = db.journalFd
 	}
+	if header != nil {
+		// The record is buffered, errors are kept by the journal writer and
+		// returned by the next write.
+		if jw, err := db.journal.Next(); err == nil {
+			jw.Write(header)
+		}
+	}
 	db.journalWriter = w
 	db.journalFd = fd
 	db.frozenMem = db.mem
@@ -158,6 +191,20 @@ func (db *DB) newMem(n int) (mem *memDB, err error) {
 func (db *DB) getMems() (e, f *memDB) {
 	db.memMu.RLock()
 	defer db.memMu.RUnlock()
+	return db.getMemsLocked()
+}
+
+// Get all memdbs and the current version at once. Secondary and shared
+// instances publish a new version under the memdb lock, so that reads
+// never pair a memdb with a version of another generation.
+func (db *DB) getMemsVersion() (e, f *memDB, v *version) {
+	db.memMu.RLock()
+	defer db.memMu.RUnlock()
+	e, f = db.getMemsLocked()
+	return e, f, db.s.version()
+}
+
+func (db *DB) getMemsLocked() (e, f *memDB) {
 	if db.mem != nil {
 		db.mem.incref()
 	} else if !db.isClosed() {
@@ -201,11 +248,14 @@ func (db *DB) getFrozenMem() *memDB {
 // Drop frozen memdb; assume that frozen memdb isn't nil.
 func (db *DB) dropFrozenMem() {
 	db.memMu.Lock()
-	if err := db.s.stor.Remove(db.frozenJournalFd); err != nil {
-		db.logf("journal@remove removing @%d %q", db.frozenJournalFd.Num, err)
-	} else {
-		db.logf("journal@remove removed @%d", db.frozenJournalFd.Num)
-	}
+	fd := db.frozenJournalFd
+	db.s.afterManifestSync(func() {
+		if err := db.s.removeObsolete(fd); err != nil {
+			db.logf("journal@remove removing @%d %q", fd.Num, err)
+		} else {
+			db.logf("journal@remove removed @%d", fd.Num)
+		}
+	})
 	db.frozenJournalFd = storage.FileDesc{}
 	db.frozenMem.decref()
 	db.frozenMem = nil
@@ -237,3 +287,85 @@ func (db *DB) ok() error {
 	}
 	return nil
 }
+
+// Whether the error is caused by a full disk.
+func isOutOfSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// Updates the out of space status after a compaction attempt; errors not
+// caused by a full disk leave it unchanged.
+func (db *DB) setOutOfSpace(err error) {
+	var oos int32
+	if isOutOfSpace(err) {
+		oos = 1
+	} else if err != nil {
+		return
+	}
+	if atomic.SwapInt32(&db.outOfSpace, oos) == oos {
+		return
+	}
+	if oos == 1 {
+		db.logf("db@space out of space %q", err)
+	} else {
+		db.log("db@space recovered")
+	}
+	if f := db.s.o.GetOnOutOfSpace(); f != nil {
+		f(err)
+	}
+}
+
+// Check write ok status.
+func (db *DB) writeOk() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&db.outOfSpace) != 0 {
+		return ErrOutOfSpace
+	}
+	return nil
+}
+
+// Returns the disk space used by the tables of the current version, the
+// blob files and the journals, the latter approximated by the size of
+// their memdbs; see opt.Options.MaxTotalSize.
+func (db *DB) diskUsage() int64 {
+	v := db.s.version()
+	size := v.size
+	v.release()
+	size += db.s.tops.blobsSize()
+	em, fm := db.getMems()
+	if em != nil {
+		size += int64(em.Size())
+		em.decref()
+	}
+	if fm != nil {
+		size += int64(fm.Size())
+		fm.decref()
+	}
+	return size
+}
+
+// Check the disk usage against the MaxTotalSize option, for writes setting
+// a value.
+func (db *DB) checkQuota() error {
+	if max := db.s.o.GetMaxTotalSize(); max > 0 {
+		if size := db.diskUsage(); size > max {
+			return &ErrQuotaExceeded{Size: size, Max: max}
+		}
+	}
+	return nil
+}
+
+// Healthy returns nil if the DB accepts writes. Otherwise it returns
+// ErrClosed if the DB is closed, ErrOutOfSpace while the writes are
+// rejected because a compaction failed for lack of disk space, the DB
+// recovering by itself once the compaction succeeds, see
+// opt.Options.OnOutOfSpace, or ErrQuotaExceeded while writes setting a
+// value are rejected, see opt.Options.MaxTotalSize.
+func (db *DB) Healthy() error {
+	if err := db.writeOk(); err != nil {
+		return err
+	}
+	return db.checkQuota()
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"sync"
+
+	"github.com/btcsuite/goleveldb/leveldb/iterator"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// SwapDB holds a live DB which can be replaced by another DB while it is
+// being read, e.g. to make live a dataset rebuilt in a new directory.
+//
+// Every read through SwapDB is done against a single DB: a read which
+// started before a Swap keeps reading the DB it started with, until it is
+// done, while a read which started after a Swap reads the new DB. Hence a
+// read never sees a mix of both datasets.
+//
+// SwapDB is safe for concurrent use.
+type SwapDB struct {
+	mu  sync.RWMutex
+	cur *swapRef
+}
+
+type swapRef struct {
+	db *DB
+	wg sync.WaitGroup // in-flight reads
+}
+
+type swapReleaser struct {
+	once sync.Once
+	r    *swapRef
+}
+
+func (sr *swapReleaser) Release() {
+	sr.once.Do(sr.r.wg.Done)
+}
+
+// NewSwapDB returns a SwapDB whose live DB is the given DB. The DB is owned
+// by the SwapDB from then on, and is closed once swapped out.
+func NewSwapDB(db *DB) *SwapDB {
+	return &SwapDB{cur: &swapRef{db: db}}
+}
+
+func (s *SwapDB) acquire() (*swapRef, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cur == nil {
+		return nil, ErrClosed
+	}
+	s.cur.wg.Add(1)
+	return s.cur, nil
+}
+
+// View calls fn with the live DB, which isn't closed by a concurrent Swap
+// until fn returns. Thus fn may do several reads, e.g. using a snapshot,
+// against the same dataset. The DB must not be used after fn returns.
+func (s *SwapDB) View(fn func(db *DB) error) error {
+	r, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer r.wg.Done()
+	return fn(r.db)
+}
+
+// Get gets the value for the given key from the live DB, see DB.Get.
+func (s *SwapDB) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	err = s.View(func(db *DB) (err error) {
+		value, err = db.Get(key, ro)
+		return
+	})
+	return
+}
+
+// Has returns true if the live DB contains the given key, see DB.Has.
+func (s *SwapDB) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
+	err = s.View(func(db *DB) (err error) {
+		ret, err = db.Has(key, ro)
+		return
+	})
+	return
+}
+
+// NewIterator returns an iterator over the live DB, see DB.NewIterator.
+// The DB isn't closed by a concurrent Swap until the iterator is released,
+// so the whole iteration sees the same dataset.
+//
+// The iterator already has a releaser, so SetReleaser must not be called
+// on it.
+func (s *SwapDB) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	r, err := s.acquire()
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	iter := r.db.NewIterator(slice, ro)
+	iter.SetReleaser(&swapReleaser{r: r})
+	return iter
+}
+
+// Swap makes the given DB the live DB. Reads which start after Swap is
+// called read the new DB; Swap then waits for the reads of the previous DB
+// to be done, including its unreleased iterators, and closes it. Once Swap
+// returns, the files of the previous DB may be removed.
+//
+// The new DB is owned by the SwapDB, even if closing the previous DB
+// returned an error. Swap returns ErrClosed, without taking the new DB,
+// if the SwapDB is closed.
+func (s *SwapDB) Swap(db *DB) error {
+	s.mu.Lock()
+	old := s.cur
+	if old == nil {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.cur = &swapRef{db: db}
+	s.mu.Unlock()
+
+	old.wg.Wait()
+	return old.db.Close()
+}
+
+// SwapFile opens the DB at the given path, see OpenFile, and makes it the
+// live DB, see Swap. A dataset is typically built in a temporary directory,
+// closed, then made live by SwapFile with opt.Options.ReadOnly set.
+func (s *SwapDB) SwapFile(path string, o *opt.Options) error {
+	db, err := OpenFile(path, o)
+	if err != nil {
+		return err
+	}
+	if err = s.Swap(db); err == ErrClosed {
+		db.Close()
+	}
+	return err
+}
+
+// Close waits for the in-flight reads of the live DB to be done and closes
+// it. Other methods return ErrClosed once the SwapDB is closed.
+func (s *SwapDB) Close() error {
+	s.mu.Lock()
+	old := s.cur
+	s.cur = nil
+	s.mu.Unlock()
+	if old == nil {
+		return ErrClosed
+	}
+
+	old.wg.Wait()
+	return old.db.Close()
+}
@@ -9,26 +9,36 @@ package leveldb
 import (
 	"bytes"
 	"container/list"
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 	"unsafe"
 
 	"github.com/onsi/gomega"
 
+	"github.com/btcsuite/goleveldb/leveldb/cache"
 	"github.com/btcsuite/goleveldb/leveldb/comparer"
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/filter"
 	"github.com/btcsuite/goleveldb/leveldb/iterator"
+	"github.com/btcsuite/goleveldb/leveldb/journal"
+	"github.com/btcsuite/goleveldb/leveldb/memdb"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/storage"
 	"github.com/btcsuite/goleveldb/leveldb/testutil"
@@ -565,6 +575,11 @@ func Test_FieldsAligned(t *testing.T) {
 	testAligned(t, "session.stJournalNum", unsafe.Offsetof(p2.stJournalNum))
 	testAligned(t, "session.stPrevJournalNum", unsafe.Offsetof(p2.stPrevJournalNum))
 	testAligned(t, "session.stSeqNum", unsafe.Offsetof(p2.stSeqNum))
+	p3 := new(cachedOptions)
+	testAligned(t, "cachedOptions.writeBuffer", unsafe.Offsetof(p3.writeBuffer))
+	testAligned(t, "cachedOptions.writeL0SlowdownTrigger", unsafe.Offsetof(p3.writeL0SlowdownTrigger))
+	testAligned(t, "cachedOptions.writeL0PauseTrigger", unsafe.Offsetof(p3.writeL0PauseTrigger))
+	testAligned(t, "cachedOptions.compactionL0Trigger", unsafe.Offsetof(p3.compactionL0Trigger))
 }
 
 func TestDB_Locking(t *testing.T) {
@@ -1171,6 +1186,63 @@ func TestDB_SizeOf_MixOfSmallAndLarge(t *testing.T) {
 	}
 }
 
+func TestDB_SplitRange(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	for i := 0; i < 1000; i++ {
+		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	check := func(r util.Range, n int) {
+		t.Helper()
+		splits, err := h.db.SplitRange(r, n)
+		if err != nil {
+			t.Fatal("SplitRange: got error: ", err)
+		}
+		if len(splits) != n-1 {
+			t.Fatalf("SplitRange(%q, %q, %d): got %d split keys, want %d", r.Start, r.Limit, n, len(splits), n-1)
+		}
+		// SizeOf takes a nil limit as an empty key.
+		limit := r.Limit
+		if limit == nil {
+			limit = []byte("\xff")
+		}
+		bounds := append(append([][]byte{r.Start}, splits...), limit)
+		ranges := make([]util.Range, n)
+		for i := range ranges {
+			if bytes.Compare(bounds[i], bounds[i+1]) >= 0 {
+				t.Fatalf("SplitRange(%q, %q, %d): split keys out of order or range: %q", r.Start, r.Limit, n, splits)
+			}
+			ranges[i] = util.Range{Start: bounds[i], Limit: bounds[i+1]}
+		}
+		sizes, err := h.db.SizeOf(append(ranges, util.Range{Start: r.Start, Limit: limit}))
+		if err != nil {
+			t.Fatal("SizeOf: got error: ", err)
+		}
+		want := sizes[n] / int64(n)
+		for i, size := range sizes[:n] {
+			if size < want*3/4 || size > want*5/4 {
+				t.Errorf("SplitRange(%q, %q, %d): shard %d holds %d bytes, want about %d", r.Start, r.Limit, n, i, size, want)
+			}
+		}
+	}
+	check(util.Range{}, 1)
+	check(util.Range{}, 4)
+	check(util.Range{}, 10)
+	check(util.Range{Start: []byte(numKey(100)), Limit: []byte(numKey(500))}, 2)
+	check(util.Range{Start: []byte(numKey(100)), Limit: []byte(numKey(500))}, 5)
+
+	if _, err := h.db.SplitRange(util.Range{}, 0); err == nil {
+		t.Error("SplitRange with n=0: expect error")
+	}
+}
+
 func TestDB_Snapshot(t *testing.T) {
 	trun(t, func(h *dbHarness) {
 		h.put("foo", "v1")
@@ -1238,6 +1310,95 @@ func TestDB_SnapshotList(t *testing.T) {
 	}
 }
 
+func TestDB_SnapshotParallelIterators(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		for c := 'a'; c <= 'z'; c++ {
+			h.put(string(c), "v1")
+			if c == 'm' {
+				h.compactMem()
+			}
+		}
+		snap := h.getSnapshot()
+		for c := 'a'; c <= 'z'; c += 2 {
+			h.delete(string(c))
+			h.put(string(c)+"x", "v2")
+		}
+		h.compactMem()
+
+		ranges := []util.Range{
+			{Start: nil, Limit: []byte("h")},
+			{Start: []byte("h"), Limit: []byte("p")},
+			{Start: []byte("p"), Limit: nil},
+		}
+		iters := snap.NewParallelIterators(ranges, h.ro)
+		snap.Release()
+		if len(iters) != len(ranges) {
+			t.Fatalf("NewParallelIterators: got %d iterators, want %d", len(iters), len(ranges))
+		}
+
+		res := make([]string, len(iters))
+		var wg sync.WaitGroup
+		for i, iter := range iters {
+			wg.Add(1)
+			go func(i int, iter iterator.Iterator) {
+				defer wg.Done()
+				defer iter.Release()
+				for iter.Next() {
+					res[i] += string(iter.Key())
+				}
+				if err := iter.Error(); err != nil {
+					t.Errorf("iterator %d: got error: %v", i, err)
+				}
+			}(i, iter)
+		}
+		wg.Wait()
+
+		want := []string{"abcdefg", "hijklmno", "pqrstuvwxyz"}
+		for i := range want {
+			if res[i] != want[i] {
+				t.Errorf("iterator %d: got keys %q, want %q", i, res[i], want[i])
+			}
+		}
+	})
+}
+
+func TestDB_SnapshotParallelIteratorsErrors(t *testing.T) {
+	db, err := Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	ranges := []util.Range{{Limit: []byte("m")}, {Start: []byte("m")}}
+	check := func(iters []iterator.Iterator, want error) {
+		t.Helper()
+		if len(iters) != len(ranges) {
+			t.Fatalf("NewParallelIterators: got %d iterators, want %d", len(iters), len(ranges))
+		}
+		for i, iter := range iters {
+			if iter.Next() || iter.Error() != want {
+				t.Errorf("iterator %d: got error %v, want %v", i, iter.Error(), want)
+			}
+			iter.Release()
+		}
+	}
+
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		t.Fatal("GetSnapshot: got error: ", err)
+	}
+	if iters := snap.NewParallelIterators(nil, nil); len(iters) != 0 {
+		t.Errorf("NewParallelIterators without range: got %d iterators, want none", len(iters))
+	}
+	snap.Release()
+	check(snap.NewParallelIterators(ranges, nil), ErrSnapshotReleased)
+
+	snap, err = db.GetSnapshot()
+	if err != nil {
+		t.Fatal("GetSnapshot: got error: ", err)
+	}
+	db.Close()
+	check(snap.NewParallelIterators(ranges, nil), ErrClosed)
+}
+
 func TestDB_HiddenValuesAreRemoved(t *testing.T) {
 	trun(t, func(h *dbHarness) {
 		s := h.db.s
@@ -1649,6 +1810,377 @@ func TestDB_CustomComparer(t *testing.T) {
 	}
 }
 
+func TestDB_ComparerMismatch(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.closeDB()
+
+	h.o = &opt.Options{Comparer: numberComparer{}}
+	err := h.openDB0()
+	if e, ok := err.(*ErrComparerMismatch); !ok {
+		t.Fatalf("Open: got error %v, want ErrComparerMismatch", err)
+	} else if e.Expected != comparer.DefaultComparer.Name() || e.Got != "test.NumberComparer" {
+		t.Errorf("Open: got %#v", e)
+	}
+
+	h.o = nil
+	h.openDB()
+	h.getVal("foo", "v1")
+}
+
+func TestDB_FormatVersion(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	numBlobs := func() int {
+		fds, err := h.stor.List(storage.TypeBlob)
+		if err != nil {
+			t.Fatal("List: got error: ", err)
+		}
+		return len(fds)
+	}
+	checkVersion := func(want int) {
+		if got := h.db.FormatVersion(); got != want {
+			t.Errorf("FormatVersion: got %d, want %d", got, want)
+		}
+	}
+	large := strings.Repeat("x", 100)
+
+	checkVersion(opt.FormatV1)
+
+	// Blob files are left disabled, as they need a newer format version.
+	h.o = &opt.Options{EnableBlobFiles: true, BlobFileThreshold: 100, MaxFormatVersion: opt.FormatV1}
+	h.reopenDB()
+	checkVersion(opt.FormatV1)
+	h.put("foo", large)
+	h.compactMem()
+	if n := numBlobs(); n != 0 {
+		t.Errorf("blob files with FormatV1: got %d, want 0", n)
+	}
+
+	h.o.MaxFormatVersion = 0
+	h.reopenDB()
+	checkVersion(opt.FormatV2)
+	h.put("bar", large)
+	h.compactMem()
+	if n := numBlobs(); n != 1 {
+		t.Errorf("blob files with FormatV2: got %d, want 1", n)
+	}
+
+	// Never downgraded.
+	h.o = &opt.Options{MaxFormatVersion: opt.FormatV1}
+	h.reopenDB()
+	checkVersion(opt.FormatV2)
+	h.getVal("foo", large)
+	h.getVal("bar", large)
+	h.closeDB()
+
+	// Record a format version newer than supported.
+	s, err := newSession(h.stor, nil)
+	if err != nil {
+		t.Fatal("newSession: got error: ", err)
+	}
+	if err := s.recover(); err != nil {
+		t.Fatal("recover: got error: ", err)
+	}
+	rec := &sessionRecord{}
+	rec.setFormatVersion(opt.LatestFormat + 1)
+	if err := s.commit(rec); err != nil {
+		t.Fatal("commit: got error: ", err)
+	}
+	s.close()
+	s.release()
+
+	err = h.openDB0()
+	if e, ok := err.(*ErrUnsupportedFormat); !ok {
+		t.Fatalf("Open: got error %v, want ErrUnsupportedFormat", err)
+	} else if e.Version != opt.LatestFormat+1 || e.Latest != opt.LatestFormat {
+		t.Errorf("Open: got %#v", e)
+	}
+}
+
+// xorTransform is a block transform for testing, its key is the byte the
+// data is XOR'ed with.
+type xorTransform byte
+
+func (x xorTransform) Name() string { return "xor" }
+
+func (x xorTransform) Encode(dst, src []byte) ([]byte, error) {
+	for _, c := range src {
+		dst = append(dst, c^byte(x))
+	}
+	return dst, nil
+}
+
+func (x xorTransform) Decode(dst, src []byte) ([]byte, error) {
+	return x.Encode(dst, src)
+}
+
+func TestDB_BlockTransform(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockTransform:               xorTransform(0x5a),
+	})
+	defer h.close()
+
+	value := func(i int) string {
+		return fmt.Sprintf("plaintext value %03d", i)
+	}
+	putAll := func(from, to int) {
+		for i := from; i < to; i++ {
+			h.put(numKey(i), value(i))
+		}
+	}
+	checkAll := func(n int) {
+		for i := 0; i < n; i++ {
+			h.getVal(numKey(i), value(i))
+		}
+	}
+
+	if v := h.db.FormatVersion(); v != opt.FormatV4 {
+		t.Errorf("FormatVersion: got %d, want %d", v, opt.FormatV4)
+	}
+
+	// Some keys are in a table, some in the journal.
+	putAll(0, 100)
+	h.compactMem()
+	putAll(100, 200)
+	checkAll(200)
+	h.reopenDB()
+	checkAll(200)
+	putAll(200, 300)
+	h.closeDB()
+
+	fds, err := h.stor.List(storage.TypeJournal | storage.TypeTable)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	for _, fd := range fds {
+		r, err := h.stor.Open(fd)
+		if err != nil {
+			t.Fatal("Open: got error: ", err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal("ReadAll: got error: ", err)
+		}
+		if bytes.Contains(data, []byte("plaintext")) {
+			t.Errorf("%s holds plaintext", fd)
+		}
+	}
+
+	// Opening with another transform fails cleanly.
+	for _, tr := range []opt.BlockTransform{nil, xorTransform(0x33)} {
+		h.o.BlockTransform = tr
+		if err := h.openDB0(); err != ErrBlockTransform {
+			if err == nil {
+				h.closeDB0()
+			}
+			t.Fatalf("Open with transform %v: got error %v, want %v", tr, err, ErrBlockTransform)
+		}
+	}
+
+	// A transform can't be set if the DB can't be upgraded to FormatV4.
+	h.o.MaxFormatVersion = opt.FormatV3
+	h.o.BlockTransform = xorTransform(0x5a)
+	if err := h.openDB0(); err == nil {
+		h.closeDB0()
+		t.Fatal("Open with a transform and MaxFormatVersion FormatV3: got no error")
+	} else if e, ok := err.(*opt.ErrInvalidOption); !ok || e.Name != "BlockTransform" {
+		t.Fatalf("Open with a transform and MaxFormatVersion FormatV3: got error %v", err)
+	}
+
+	h.o.MaxFormatVersion = 0
+	h.openDB()
+	checkAll(300)
+	h.compactRange("", "")
+	checkAll(300)
+}
+
+func TestDB_CompressionPerLevel(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompressionPerLevel:          []opt.Compression{opt.NoCompression, opt.SnappyCompression},
+	})
+	defer h.close()
+
+	const n, valueLen = 100, 1000
+	value := strings.Repeat("v", valueLen)
+	levelSize := func(level int) int64 {
+		v := h.db.s.version()
+		defer v.release()
+		if level >= len(v.levels) {
+			return 0
+		}
+		return v.levels[level].size()
+	}
+
+	// Flushed tables are not compressed.
+	for r := 0; r < 2; r++ {
+		for i := 0; i < n; i++ {
+			h.put(numKey(i), value)
+		}
+		h.compactMem()
+	}
+	if size := levelSize(0); size < 2*n*valueLen {
+		t.Errorf("level-0 size: got %d, want at least %d", size, 2*n*valueLen)
+	}
+
+	// Tables compacted into level-1 are.
+	h.compactRangeAt(0, "", "")
+	if size := levelSize(0); size != 0 {
+		t.Errorf("level-0 size after compaction: got %d, want 0", size)
+	}
+	if size := levelSize(1); size == 0 || size > n*valueLen/10 {
+		t.Errorf("level-1 size: got %d, want at most %d", size, n*valueLen/10)
+	}
+
+	h.reopenDB()
+	for i := 0; i < n; i++ {
+		h.getVal(numKey(i), value)
+	}
+}
+
+func TestDB_TwoLevelIndex(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		BlockSize:        128,
+		TwoLevelIndex:    true,
+		MaxFormatVersion: opt.FormatV2,
+	})
+	defer h.close()
+
+	value := strings.Repeat("v", 50)
+	putAll := func(prefix string) {
+		for i := 0; i < 500; i++ {
+			h.put(fmt.Sprintf("%s%04d", prefix, i), value)
+		}
+		h.compactMem()
+	}
+	checkAll := func() {
+		for _, prefix := range []string{"a", "b"} {
+			for i := 0; i < 500; i++ {
+				h.getVal(fmt.Sprintf("%s%04d", prefix, i), value)
+			}
+		}
+		iter := h.db.NewIterator(nil, nil)
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			t.Error("iterator: got error: ", err)
+		}
+		if n != 1000 {
+			t.Errorf("iterator: got %d keys, want 1000", n)
+		}
+	}
+
+	// Two-level indexes are left disabled, as they need a newer format
+	// version.
+	if v := h.db.FormatVersion(); v != opt.FormatV1 {
+		t.Errorf("FormatVersion: got %d, want %d", v, opt.FormatV1)
+	}
+	putAll("a")
+
+	h.o.MaxFormatVersion = 0
+	h.reopenDB()
+	if v := h.db.FormatVersion(); v != opt.FormatV3 {
+		t.Errorf("FormatVersion: got %d, want %d", v, opt.FormatV3)
+	}
+	putAll("b")
+	checkAll()
+
+	h.reopenDB()
+	checkAll()
+	h.compactRange("", "")
+	checkAll()
+}
+
+func TestDB_RecoverFormatVersion(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestRecoverFormatVersion-%d", os.Getuid()))
+	defer os.RemoveAll(dbpath)
+	value := strings.Repeat("v", 100)
+
+	// Creates a DB holding a single table.
+	create := func(o *opt.Options) {
+		if err := os.RemoveAll(dbpath); err != nil {
+			t.Fatal("cannot remove old db: ", err)
+		}
+		db, err := OpenFile(dbpath, o)
+		if err != nil {
+			t.Fatal("OpenFile: got error: ", err)
+		}
+		for i := 0; i < 500; i++ {
+			if err := db.Put([]byte(numKey(i)), []byte(value), nil); err != nil {
+				t.Fatal("Put: got error: ", err)
+			}
+		}
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatal("CompactRange: got error: ", err)
+		}
+		db.Close()
+	}
+	recoverDB := func(o *opt.Options, want int) {
+		t.Helper()
+		db, err := RecoverFile(dbpath, o)
+		if err != nil {
+			t.Fatal("RecoverFile: got error: ", err)
+		}
+		defer db.Close()
+		if v := db.FormatVersion(); v != want {
+			t.Errorf("FormatVersion: got %d, want %d", v, want)
+		}
+		for i := 0; i < 500; i++ {
+			if v, err := db.Get([]byte(numKey(i)), nil); err != nil || string(v) != value {
+				t.Fatalf("Get(%q): got (%q, %v)", numKey(i), v, err)
+			}
+		}
+	}
+	recoverUnsupported := func(o *opt.Options, version int) {
+		t.Helper()
+		db, err := RecoverFile(dbpath, o)
+		if e, ok := err.(*ErrUnsupportedFormat); !ok {
+			if err == nil {
+				db.Close()
+			}
+			t.Errorf("RecoverFile: got error %v, want ErrUnsupportedFormat", err)
+		} else if e.Version != version || e.Latest != o.MaxFormatVersion {
+			t.Errorf("RecoverFile: got %#v", e)
+		}
+	}
+
+	// Tables with a two-level index are read whatever the options, the
+	// format version they need is recorded anyway.
+	create(&opt.Options{BlockSize: 128, TwoLevelIndex: true})
+	recoverUnsupported(&opt.Options{MaxFormatVersion: opt.FormatV2}, opt.FormatV3)
+	recoverDB(nil, opt.FormatV3)
+
+	create(&opt.Options{EnableBlobFiles: true, BlobFileThreshold: 100})
+	recoverUnsupported(&opt.Options{MaxFormatVersion: opt.FormatV1}, opt.FormatV2)
+	recoverDB(nil, opt.FormatV2)
+
+	// Blob files no table refers to don't need a newer format version.
+	create(nil)
+	stor, err := storage.OpenFile(dbpath, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	w, err := stor.Create(storage.FileDesc{Type: storage.TypeBlob, Num: 1000})
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Close()
+	stor.Close()
+	recoverDB(nil, opt.FormatV1)
+
+	create(&opt.Options{BlockTransform: xorTransform(0x5a)})
+	recoverDB(&opt.Options{BlockTransform: xorTransform(0x5a)}, opt.FormatV4)
+}
+
 func TestDB_ManualCompaction(t *testing.T) {
 	h := newDbHarness(t)
 	defer h.close()
@@ -1967,6 +2499,31 @@ func TestDB_CreateReopenDbOnFile2(t *testing.T) {
 	}
 }
 
+func TestDB_GoroutineLabels(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestGoroutineLabels-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	db, err := OpenFile(dbpath, nil)
+	if err != nil {
+		t.Fatal("cannot open db: ", err)
+	}
+	defer db.Close()
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal("cannot write goroutine profile: ", err)
+	}
+	for _, name := range []string{"table-compaction", "memdb-compaction", "compaction-error", "mpool-drain"} {
+		label := fmt.Sprintf("%q:%q, %q:%q", labelGoroutine, name, labelDB, dbpath)
+		if !strings.Contains(buf.String(), label) {
+			t.Errorf("goroutine labels {%s} not found", label)
+		}
+	}
+}
+
 func TestDB_DeletionMarkersOnMemdb(t *testing.T) {
 	h := newDbHarness(t)
 	defer h.close()
@@ -2170,20 +2727,153 @@ func TestDB_GetProperties(t *testing.T) {
 	}
 }
 
-func TestDB_GoleveldbIssue72and83(t *testing.T) {
-	h := newDbHarnessWopt(t, &opt.Options{
-		DisableLargeBatchTransaction: true,
-		WriteBuffer:                  1 * opt.MiB,
-		OpenFilesCacheCapacity:       3,
-	})
+func TestDB_Properties(t *testing.T) {
+	h := newDbHarness(t)
 	defer h.close()
 
-	const n, wn, dur = 10000, 100, 30 * time.Second
-
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	h.put("foo", "v1")
+	h.compactMem()
 
-	randomData := func(prefix byte, i int) []byte {
-		data := make([]byte, 1+4+32+64+32)
+	props, err := h.db.Properties()
+	if err != nil {
+		t.Fatal("Properties: got error: ", err)
+	}
+	for _, name := range []string{
+		"leveldb.num-files-at-level0",
+		"leveldb.stats",
+		"leveldb.iostats",
+		"leveldb.writedelay",
+		"leveldb.sstables",
+		"leveldb.blockpool",
+		"leveldb.cachedblock",
+		"leveldb.openedtables",
+		"leveldb.alivesnaps",
+		"leveldb.aliveiters",
+		"leveldb.filterstats",
+	} {
+		value, ok := props[name]
+		if !ok {
+			t.Errorf("Properties: missing %s", name)
+			continue
+		}
+		if want, err := h.db.GetProperty(name); err != nil {
+			t.Errorf("GetProperty(%s): got error: %v", name, err)
+		} else if value != want {
+			t.Errorf("Properties: %s: got %q, GetProperty returned %q", name, value, want)
+		}
+	}
+	var tables int
+	for name, value := range props {
+		if strings.HasPrefix(name, "leveldb.num-files-at-level") {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				t.Errorf("Properties: %s: got %q", name, value)
+			}
+			tables += n
+		}
+	}
+	if tables != 1 {
+		t.Errorf("Properties: got %d tables, want 1", tables)
+	}
+
+	h.closeDB()
+	if _, err := h.db.Properties(); err != ErrClosed {
+		t.Errorf("Properties after close: got error %v, want %v", err, ErrClosed)
+	}
+	h.db = nil
+}
+
+func TestDB_NoBlockCache(t *testing.T) {
+	for _, o := range []*opt.Options{
+		{DisableBlockCache: true},
+		{BlockCacher: opt.NoCacher},
+		{BlockCacheCapacity: -1},
+	} {
+		o.DisableLargeBatchTransaction = true
+		o.BlockSize = 256
+		testNoBlockCache(t, o)
+	}
+}
+
+func testNoBlockCache(t *testing.T, o *opt.Options) {
+	h := newDbHarnessWopt(t, o)
+	defer h.close()
+	if h.db.s.tops.bcache != nil {
+		t.Fatalf("block cache created with %+v", o)
+	}
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), fmt.Sprintf("v%d", i))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	check := func() {
+		for i := 0; i < n; i += 7 {
+			h.getVal(numKey(i), fmt.Sprintf("v%d", i))
+		}
+		iter := h.db.NewIterator(nil, nil)
+		var count int
+		for iter.Next() {
+			if want := numKey(count); string(iter.Key()) != want {
+				t.Fatalf("iterator: got key %q, want %q", iter.Key(), want)
+			}
+			count++
+		}
+		if count != n {
+			t.Fatalf("iterator: got %d entries, want %d", count, n)
+		}
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			count--
+			if want := numKey(count); string(iter.Key()) != want {
+				t.Fatalf("iterator: got key %q, want %q", iter.Key(), want)
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator: got error: ", err)
+		}
+		if count != 0 {
+			t.Fatalf("iterator: backward scan missed %d entries", count)
+		}
+		if value, err := h.db.GetProperty("leveldb.cachedblock"); err != nil {
+			t.Fatal("GetProperty: got error: ", err)
+		} else if value != "0" {
+			t.Fatalf("GetProperty(leveldb.cachedblock): got %q, want %q", value, "0")
+		}
+		stats := &DBStats{}
+		if err := h.db.Stats(stats); err != nil {
+			t.Fatal("Stats: got error: ", err)
+		}
+		if stats.BlockCacheSize != 0 {
+			t.Fatalf("Stats: got BlockCacheSize %d, want 0", stats.BlockCacheSize)
+		}
+	}
+	check()
+
+	if err := h.db.SetOptions(map[string]string{"BlockCacheCapacity": "1024"}); err == nil {
+		t.Fatal("SetOptions(BlockCacheCapacity): expected error with block caching disabled")
+	}
+
+	h.reopenDB()
+	check()
+}
+
+func TestDB_GoleveldbIssue72and83(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  1 * opt.MiB,
+		OpenFilesCacheCapacity:       3,
+	})
+	defer h.close()
+
+	const n, wn, dur = 10000, 100, 30 * time.Second
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	randomData := func(prefix byte, i int) []byte {
+		data := make([]byte, 1+4+32+64+32)
 		_, err := crand.Reader.Read(data[1 : len(data)-8])
 		if err != nil {
 			panic(err)
@@ -2535,11 +3225,11 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 	defer s.close()
 	var (
 		seq        uint64
-		targetSize = 5 * o.CompactionTableSize
+		targetSize = int64(5 * o.CompactionTableSize)
 		value      = bytes.Repeat([]byte{'0'}, 100)
 	)
 	for i := 0; i < 2; i++ {
-		tw, err := s.tops.create()
+		tw, err := s.tops.create(0, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -2565,7 +3255,7 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 
 	// Build grandparent.
 	v := s.version()
-	c := newCompaction(s, v, 1, append(tFiles{}, v.levels[1]...))
+	c := newCompaction(s, v, 1, append(tFiles{}, v.levels[1]...), false)
 	rec := &sessionRecord{}
 	b := &tableCompactionBuilder{
 		s:         s,
@@ -2574,7 +3264,7 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 		stat1:     new(cStatStaging),
 		minSeq:    0,
 		strict:    true,
-		tableSize: o.CompactionTableSize/3 + 961,
+		tableSize: int64(o.CompactionTableSize/3 + 961),
 	}
 	if err := b.run(new(compactionTransactCounter)); err != nil {
 		t.Fatal(err)
@@ -2589,7 +3279,7 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 
 	// Build level-1.
 	v = s.version()
-	c = newCompaction(s, v, 0, append(tFiles{}, v.levels[0]...))
+	c = newCompaction(s, v, 0, append(tFiles{}, v.levels[0]...), false)
 	rec = &sessionRecord{}
 	b = &tableCompactionBuilder{
 		s:         s,
@@ -2598,7 +3288,7 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 		stat1:     new(cStatStaging),
 		minSeq:    0,
 		strict:    true,
-		tableSize: o.CompactionTableSize,
+		tableSize: int64(o.CompactionTableSize),
 	}
 	if err := b.run(new(compactionTransactCounter)); err != nil {
 		t.Fatal(err)
@@ -2633,7 +3323,7 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 
 	// Compaction with transient error.
 	v = s.version()
-	c = newCompaction(s, v, 1, append(tFiles{}, v.levels[1]...))
+	c = newCompaction(s, v, 1, append(tFiles{}, v.levels[1]...), false)
 	rec = &sessionRecord{}
 	b = &tableCompactionBuilder{
 		s:         s,
@@ -2642,7 +3332,7 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 		stat1:     new(cStatStaging),
 		minSeq:    0,
 		strict:    true,
-		tableSize: o.CompactionTableSize,
+		tableSize: int64(o.CompactionTableSize),
 	}
 	stor.EmulateErrorOnce(testutil.ModeSync, storage.TypeTable, errors.New("table sync error (once)"))
 	stor.EmulateRandomError(testutil.ModeRead|testutil.ModeWrite, storage.TypeTable, 0.01, errors.New("table random IO error"))
@@ -2736,7 +3426,7 @@ func testDB_IterTriggeredCompaction(t *testing.T, limitDiv int) {
 		initialSize1 = h.sizeOf(limitKey, maxKey)
 	)
 
-	t.Logf("initial size %s [rest %s]", shortenb(int(initialSize0)), shortenb(int(initialSize1)))
+	t.Logf("initial size %s [rest %s]", shortenb(initialSize0), shortenb(initialSize1))
 
 	for r := 0; true; r++ {
 		if r >= mIter {
@@ -2758,7 +3448,7 @@ func testDB_IterTriggeredCompaction(t *testing.T, limitDiv int) {
 		// Check size.
 		size0 := h.sizeOf(startKey, limitKey)
 		size1 := h.sizeOf(limitKey, maxKey)
-		t.Logf("#%03d size %s [rest %s]", r, shortenb(int(size0)), shortenb(int(size1)))
+		t.Logf("#%03d size %s [rest %s]", r, shortenb(size0), shortenb(size1))
 		if size0 < initialSize0/10 {
 			break
 		}
@@ -2924,3 +3614,4653 @@ func TestDB_GracefulClose(t *testing.T) {
 	iter.Release()
 	closeWait.Wait()
 }
+
+func TestDB_SetOptions(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockCacheCapacity:           1000,
+	})
+	defer h.close()
+
+	if err := h.db.SetOptions(map[string]string{
+		"BlockCacheCapacity":  "2000",
+		"WriteBuffer":         "10000",
+		"WriteL0PauseTrigger": "20",
+		"CompactionL0Trigger": "0",
+	}); err != nil {
+		t.Fatal("SetOptions: got error: ", err)
+	}
+	if got := h.db.s.tops.bcache.Capacity(); got != 2000 {
+		t.Errorf("block cache capacity: got %d, want 2000", got)
+	}
+	if got := h.db.s.o.GetWriteBuffer(); got != 10000 {
+		t.Errorf("write buffer: got %d, want 10000", got)
+	}
+	if got := h.db.s.o.GetWriteL0PauseTrigger(); got != 20 {
+		t.Errorf("write L0 pause trigger: got %d, want 20", got)
+	}
+	if got := h.db.s.o.GetCompactionL0Trigger(); got != opt.DefaultCompactionL0Trigger {
+		t.Errorf("compaction L0 trigger: got %d, want %d", got, opt.DefaultCompactionL0Trigger)
+	}
+
+	// New write buffer applies to future memdb.
+	h.put("foo", "v1")
+	h.compactMem()
+	n := h.totalTables()
+	for i := 0; i < 100; i++ {
+		h.put(numKey(i), strings.Repeat("v", 1000))
+	}
+	h.waitMemCompaction()
+	if h.totalTables() <= n {
+		t.Error("expect memdb to be flushed with the new write buffer")
+	}
+	for i := 0; i < 100; i++ {
+		h.getVal(numKey(i), strings.Repeat("v", 1000))
+	}
+
+	for _, x := range []struct {
+		options map[string]string
+		reason  string
+	}{
+		{map[string]string{"Comparer": "x"}, "cannot be changed while the DB is open"},
+		{map[string]string{"Foo": "1"}, "unknown option"},
+		{map[string]string{"WriteBuffer": "x"}, `invalid value "x"`},
+		{map[string]string{"WriteBuffer": "20000", "BlockSize": "1"}, "cannot be changed while the DB is open"},
+	} {
+		err := h.db.SetOptions(x.options)
+		if e, ok := err.(*ErrInvalidOption); !ok || e.Reason != x.reason {
+			t.Errorf("SetOptions(%v): got error %v, want reason %q", x.options, err, x.reason)
+		}
+	}
+	// None should be applied on error.
+	if got := h.db.s.o.GetWriteBuffer(); got != 10000 {
+		t.Errorf("write buffer: got %d, want 10000", got)
+	}
+
+	h.closeDB()
+	if err := h.db.SetOptions(map[string]string{"WriteBuffer": "1"}); err != ErrClosed {
+		t.Errorf("SetOptions on closed DB: got error %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestDB_SetOptionsCaches(t *testing.T) {
+	check := func(h *dbHarness, name, reason string) {
+		t.Helper()
+		err := h.db.SetOptions(map[string]string{name: "10"})
+		if e, ok := err.(*ErrInvalidOption); !ok || e.Reason != reason {
+			t.Errorf("SetOptions(%s): got error %v, want reason %q", name, err, reason)
+		}
+	}
+
+	h := newDbHarness(t)
+	if err := h.db.SetOptions(map[string]string{"OpenFilesCacheCapacity": "10"}); err != nil {
+		t.Fatal("SetOptions: got error: ", err)
+	}
+	n := 0
+	for _, s := range h.db.s.tops.cache.shards {
+		n += s.Capacity()
+	}
+	if n != 10 {
+		t.Errorf("open files cache capacity: got %d, want 10", n)
+	}
+	h.close()
+
+	h = newDbHarnessWopt(t, &opt.Options{OpenFilesCacheCapacity: -1})
+	check(h, "OpenFilesCacheCapacity", "open files cache is disabled")
+	h.close()
+
+	bcache := cache.NewCache(cache.NewLRU(1000))
+	fcache := cache.NewCache(cache.NewLRU(10))
+	defer bcache.Close()
+	defer fcache.Close()
+	h = newDbHarnessWopt(t, &opt.Options{BlockCache: bcache, OpenFilesCache: fcache})
+	check(h, "BlockCacheCapacity", "block cache is shared")
+	check(h, "OpenFilesCacheCapacity", "open files cache is shared")
+	h.close()
+}
+
+func TestDB_PauseCompactions(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	if err := h.db.PauseCompactions(); err != nil {
+		t.Fatal("PauseCompactions: got error: ", err)
+	}
+	// Pausing twice is no-op.
+	if err := h.db.PauseCompactions(); err != nil {
+		t.Fatal("PauseCompactions: got error: ", err)
+	}
+
+	n := opt.DefaultCompactionL0Trigger + 2
+	for i := 0; i < n; i++ {
+		h.put("a", fmt.Sprintf("v%d", i))
+		h.put("z", fmt.Sprintf("v%d", i))
+		h.compactMem()
+	}
+	// Give table compaction a chance to run, if it wasn't paused.
+	time.Sleep(100 * time.Millisecond)
+	h.tablesPerLevel(fmt.Sprint(n))
+	h.getVal("a", fmt.Sprintf("v%d", n-1))
+
+	h.db.ResumeCompactions()
+	h.waitCompaction()
+	if got := h.db.s.tLen(0); got != 0 {
+		t.Errorf("level-0 tables after resume: got %d, want 0", got)
+	}
+	h.getVal("a", fmt.Sprintf("v%d", n-1))
+	h.getVal("z", fmt.Sprintf("v%d", n-1))
+
+	// Resuming twice is no-op.
+	h.db.ResumeCompactions()
+
+	// Closing paused DB.
+	if err := h.db.PauseCompactions(); err != nil {
+		t.Fatal("PauseCompactions: got error: ", err)
+	}
+	h.closeDB()
+	if err := h.db.PauseCompactions(); err != ErrClosed {
+		t.Errorf("PauseCompactions on closed DB: got error %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestDB_HintCompactionPriority(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	// Four level-1 tables of disjoint ranges.
+	h.db.memdbMaxLevel = 0
+	for _, prefix := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 10; i++ {
+			h.put(fmt.Sprintf("%s%02d", prefix, i), "v")
+		}
+		h.compactMem()
+		h.compactRangeAt(0, "", "")
+	}
+	h.tablesPerLevel("0,4")
+
+	if err := h.db.PauseCompactions(); err != nil {
+		t.Fatal("PauseCompactions: got error: ", err)
+	}
+	defer h.db.ResumeCompactions()
+
+	// Make level-1 due for compaction, all its tables are then equally
+	// eligible.
+	v := h.db.s.version()
+	v.cLevel, v.cScore = 1, 1
+	v.release()
+	picked := func() string {
+		c := h.db.s.pickCompaction()
+		if c == nil {
+			t.Fatal("pickCompaction: got nil")
+		}
+		defer c.release()
+		if c.sourceLevel != 1 || len(c.levels[0]) != 1 {
+			t.Fatalf("pickCompaction: got level %d, %d tables", c.sourceLevel, len(c.levels[0]))
+		}
+		return string(c.levels[0][0].imin.ukey())
+	}
+
+	if got := picked(); got != "a00" {
+		t.Errorf("without hint: got table starting at %q, want %q", got, "a00")
+	}
+	if err := h.db.HintCompactionPriority(util.Range{Start: []byte("c05"), Limit: []byte("c06")}); err != nil {
+		t.Fatal("HintCompactionPriority: got error: ", err)
+	}
+	if got := picked(); got != "c00" {
+		t.Errorf("with hint: got table starting at %q, want %q", got, "c00")
+	}
+	if err := h.db.HintCompactionPriority(util.Range{Start: []byte("e")}); err != nil {
+		t.Fatal("HintCompactionPriority: got error: ", err)
+	}
+	if got := picked(); got != "a00" {
+		t.Errorf("with hint past all tables: got table starting at %q, want %q", got, "a00")
+	}
+	if err := h.db.HintCompactionPriority(util.Range{Start: []byte("d")}); err != nil {
+		t.Fatal("HintCompactionPriority: got error: ", err)
+	}
+	if err := h.db.HintCompactionPriority(util.Range{}); err != nil {
+		t.Fatal("HintCompactionPriority: got error: ", err)
+	}
+	if got := picked(); got != "a00" {
+		t.Errorf("with hint cleared: got table starting at %q, want %q", got, "a00")
+	}
+}
+
+func TestDB_MaxKeyValueSize(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		MaxKeySize:                   8,
+		MaxValueSize:                 16,
+	})
+	defer h.close()
+
+	key := func(n int) []byte { return bytes.Repeat([]byte{'k'}, n) }
+	value := func(n int) []byte { return bytes.Repeat([]byte{'v'}, n) }
+
+	// At the limit.
+	if err := h.db.Put(key(8), value(16), h.wo); err != nil {
+		t.Fatal("Put at limit: got error: ", err)
+	}
+	h.getVal(string(key(8)), string(value(16)))
+
+	// Over the limit.
+	err := h.db.Put(key(9), value(1), h.wo)
+	if e, ok := err.(*ErrKeyTooLarge); !ok || e.Size != 9 || e.Max != 8 {
+		t.Errorf("Put key over limit: got error %v, want ErrKeyTooLarge", err)
+	}
+	err = h.db.Put(key(1), value(17), h.wo)
+	if e, ok := err.(*ErrValueTooLarge); !ok || e.Size != 17 || e.Max != 16 {
+		t.Errorf("Put value over limit: got error %v, want ErrValueTooLarge", err)
+	}
+	if err := h.db.Delete(key(9), h.wo); err == nil {
+		t.Error("Delete key over limit: expecting error")
+	}
+	h.getVal(string(key(8)), string(value(16)))
+
+	// Batch is rejected as a whole.
+	b := new(Batch)
+	b.Put([]byte("a"), value(16))
+	b.Put([]byte("b"), value(17))
+	if _, ok := h.db.Write(b, h.wo).(*ErrValueTooLarge); !ok {
+		t.Error("Write batch over limit: expecting ErrValueTooLarge")
+	}
+	h.get("a", false)
+
+	// Transaction.
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	if _, ok := tr.Put(key(9), nil, h.wo).(*ErrKeyTooLarge); !ok {
+		t.Error("Transaction.Put key over limit: expecting ErrKeyTooLarge")
+	}
+	if _, ok := tr.Write(b, h.wo).(*ErrValueTooLarge); !ok {
+		t.Error("Transaction.Write batch over limit: expecting ErrValueTooLarge")
+	}
+	if err := tr.Put([]byte("c"), value(16), h.wo); err != nil {
+		t.Error("Transaction.Put at limit: got error: ", err)
+	}
+	if err := tr.Commit(); err != nil {
+		t.Fatal("Commit: got error: ", err)
+	}
+	h.get("a", false)
+	h.getVal("c", string(value(16)))
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDB_CompactionStatsWriter(t *testing.T) {
+	w := &syncBuffer{}
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionStatsWriter:        w,
+	})
+	defer h.close()
+
+	h.db.memdbMaxLevel = 0
+	sizes := make(map[int64]int64)
+	addSizes := func() {
+		v := h.db.s.version()
+		for _, tables := range v.levels {
+			for _, t := range tables {
+				sizes[t.fd.Num] = t.size
+			}
+		}
+		v.release()
+	}
+	sum := func(nums []int64) (n int64) {
+		for _, num := range nums {
+			size, ok := sizes[num]
+			if !ok {
+				t.Fatalf("unknown table @%d", num)
+			}
+			n += size
+		}
+		return
+	}
+
+	h.put("a", "v1")
+	h.put("c", "v1")
+	h.compactMem()
+	addSizes()
+	h.put("b", "v2")
+	h.put("c", "v2")
+	h.compactMem()
+	addSizes()
+	h.compactRange("", "")
+	addSizes()
+	h.tablesPerLevel("0,1")
+
+	var recs []CompactionRecord
+	for _, line := range strings.Split(strings.TrimSpace(w.String()), "\n") {
+		var r CompactionRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("got %d records, want 3:\n%s", len(recs), w.String())
+	}
+	for i, r := range recs {
+		wantType, wantLevel, wantOutputLevel, wantInputs := "memdb", -1, 0, 0
+		if i == 2 {
+			wantType, wantLevel, wantOutputLevel, wantInputs = "table", 0, 1, 2
+		}
+		if r.Type != wantType || r.Level != wantLevel || r.OutputLevel != wantOutputLevel {
+			t.Errorf("record %d: got type %q L%d -> L%d", i, r.Type, r.Level, r.OutputLevel)
+		}
+		if len(r.Inputs) != wantInputs || len(r.Outputs) != 1 {
+			t.Errorf("record %d: got %d inputs and %d outputs", i, len(r.Inputs), len(r.Outputs))
+		}
+		if i == 2 {
+			if want := sum(r.Inputs); r.ReadBytes != want {
+				t.Errorf("record %d: got read bytes %d, want %d", i, r.ReadBytes, want)
+			}
+		}
+		if want := sum(r.Outputs); r.WriteBytes != want {
+			t.Errorf("record %d: got write bytes %d, want %d", i, r.WriteBytes, want)
+		}
+	}
+}
+
+func TestDB_InitialSequence(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		InitialSequence:              1000,
+	})
+	defer h.close()
+
+	if seq := h.db.LastSequence(); seq != 1000 {
+		t.Errorf("LastSequence: got %d, want 1000", seq)
+	}
+	h.put("foo", "v1")
+	b := new(Batch)
+	b.Put([]byte("bar"), []byte("v1"))
+	b.Delete([]byte("foo"))
+	if err := h.db.Write(b, h.wo); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if seq := h.db.LastSequence(); seq != 1003 {
+		t.Errorf("LastSequence: got %d, want 1003", seq)
+	}
+
+	// Ignored by existing DB.
+	h.o.InitialSequence = 5000
+	h.reopenDB()
+	if seq := h.db.LastSequence(); seq != 1003 {
+		t.Errorf("LastSequence after reopen: got %d, want 1003", seq)
+	}
+	h.getVal("bar", "v1")
+	h.get("foo", false)
+	h.closeDB()
+
+	// Writes can't go past the largest sequence number.
+	h.o.InitialSequence = keyMaxSeq - 2
+	h.stor.Close()
+	h.stor = testutil.NewStorage()
+	h.openDB()
+	b = new(Batch)
+	b.Put([]byte("foo"), []byte("v1"))
+	b.Put([]byte("bar"), []byte("v1"))
+	b.Put([]byte("baz"), []byte("v1"))
+	if err := h.db.Write(b, h.wo); err != ErrSequenceOverflow {
+		t.Errorf("Write past the largest sequence: got error %v, want %v", err, ErrSequenceOverflow)
+	}
+	h.put("foo", "v2")
+	h.put("bar", "v2")
+	if err := h.db.Put([]byte("baz"), []byte("v2"), h.wo); err != ErrSequenceOverflow {
+		t.Errorf("Put past the largest sequence: got error %v, want %v", err, ErrSequenceOverflow)
+	}
+	if seq := h.db.LastSequence(); seq != keyMaxSeq {
+		t.Errorf("LastSequence: got %d, want %d", seq, uint64(keyMaxSeq))
+	}
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	if err := tr.Put([]byte("baz"), []byte("v2"), h.wo); err != ErrSequenceOverflow {
+		t.Errorf("Transaction.Put past the largest sequence: got error %v, want %v", err, ErrSequenceOverflow)
+	}
+	tr.Discard()
+	h.getVal("foo", "v2")
+	h.get("baz", false)
+	h.closeDB()
+
+	stor := testutil.NewStorage()
+	defer stor.Close()
+	if _, err := Open(stor, &opt.Options{InitialSequence: keyMaxSeq + 1}); err == nil {
+		t.Error("Open with too large InitialSequence: expected error")
+	} else if _, ok := err.(*ErrInvalidOption); !ok {
+		t.Errorf("Open with too large InitialSequence: got error %v, want ErrInvalidOption", err)
+	}
+}
+
+func TestDB_PinIndexBlocks(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		PinIndexBlocks:               true,
+	})
+	defer h.close()
+
+	for i := 0; i < 3; i++ {
+		h.put(fmt.Sprintf("k%d", i), "v")
+		h.compactMem()
+	}
+
+	var stats DBStats
+	if err := h.db.Stats(&stats); err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if stats.PinnedIndexSize != 0 {
+		t.Errorf("PinnedIndexSize: got %d before any read, want 0", stats.PinnedIndexSize)
+	}
+	for i := 0; i < 3; i++ {
+		h.getVal(fmt.Sprintf("k%d", i), "v")
+	}
+	if err := h.db.Stats(&stats); err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if stats.PinnedIndexSize <= 0 {
+		t.Errorf("PinnedIndexSize: got %d, want > 0", stats.PinnedIndexSize)
+	}
+
+	h.closeDB()
+	h.o.PinIndexBlocks = false
+	h.openDB()
+	for i := 0; i < 3; i++ {
+		h.getVal(fmt.Sprintf("k%d", i), "v")
+	}
+	if err := h.db.Stats(&stats); err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if stats.PinnedIndexSize != 0 {
+		t.Errorf("PinnedIndexSize without pinning: got %d, want 0", stats.PinnedIndexSize)
+	}
+}
+
+func TestDB_KeyMayExist(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Filter:                       filter.NewBloomFilter(10),
+	})
+	defer h.close()
+
+	for i := 0; i < 1000; i += 2 {
+		h.put(fmt.Sprintf("key%04d", i), "v")
+	}
+	h.compactMem()
+	h.put("mem", "v1")
+	h.delete("key0000")
+
+	if mayExist, value, known := h.db.KeyMayExist([]byte("mem")); !mayExist || !known || string(value) != "v1" {
+		t.Errorf("KeyMayExist(mem): got %v %q %v, want true \"v1\" true", mayExist, value, known)
+	}
+	if mayExist, _, known := h.db.KeyMayExist([]byte("key0000")); mayExist || known {
+		t.Errorf("KeyMayExist(key0000): got %v %v, want false false", mayExist, known)
+	}
+	if mayExist, _, _ := h.db.KeyMayExist([]byte("zzz")); mayExist {
+		t.Error("KeyMayExist(zzz): got true past the last key")
+	}
+
+	falsePositives := 0
+	for i := 2; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		mayExist, value, known := h.db.KeyMayExist([]byte(key))
+		if known || value != nil {
+			t.Errorf("KeyMayExist(%s): got value known for a table key", key)
+		}
+		if i%2 == 0 {
+			if !mayExist {
+				t.Errorf("KeyMayExist(%s): got false for an existing key", key)
+			}
+		} else if mayExist {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("KeyMayExist: got %d false positives out of 499", falsePositives)
+	}
+}
+
+func TestDB_WarmCache(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockSize:                    512,
+	})
+	defer h.close()
+
+	for i := 0; i < 500; i++ {
+		h.put(fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	h.compactMem()
+	h.reopenDB()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.db.WarmCache(ctx, util.Range{}, nil); err != context.Canceled {
+		t.Errorf("WarmCache with canceled context: got error %v, want %v", err, context.Canceled)
+	}
+
+	var stats DBStats
+	h.db.Stats(&stats)
+	before := stats.BlockCacheSize
+	if err := h.db.WarmCache(context.Background(), util.Range{Start: []byte("key0100"), Limit: []byte("key0200")}, &opt.ReadOptions{DontFillCache: true}); err != nil {
+		t.Fatal("WarmCache: got error: ", err)
+	}
+	h.db.Stats(&stats)
+	if stats.BlockCacheSize <= before {
+		t.Fatalf("BlockCacheSize: got %d after WarmCache, want > %d", stats.BlockCacheSize, before)
+	}
+
+	// Scanning the warmed range must not read from the storage.
+	ioRead := stats.IORead
+	iter := h.db.NewIterator(&util.Range{Start: []byte("key0100"), Limit: []byte("key0200")}, nil)
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	iter.Release()
+	if n != 100 {
+		t.Fatalf("scan: got %d keys, want 100", n)
+	}
+	h.db.Stats(&stats)
+	if stats.IORead != ioRead {
+		t.Errorf("IORead: got %d more bytes read after WarmCache", stats.IORead-ioRead)
+	}
+}
+
+func TestDB_NumLevels(t *testing.T) {
+	o := &opt.Options{
+		DisableLargeBatchTransaction:  true,
+		Compression:                   opt.NoCompression,
+		WriteBuffer:                   10 * opt.KiB,
+		CompactionTableSize:           10 * opt.KiB,
+		CompactionTotalSize:           20 * opt.KiB,
+		CompactionTotalSizeMultiplier: 2,
+	}
+	fill := func(h *dbHarness) {
+		value := strings.Repeat("v", 500)
+		for i := 0; i < 2000; i++ {
+			h.put(fmt.Sprintf("key%05d", rand.Intn(100000)), value)
+		}
+		h.compactMem()
+		for i := 0; i < 10; i++ {
+			h.waitCompaction()
+		}
+	}
+	numLevels := func(h *dbHarness) int {
+		return strings.Count(h.getTablesPerLevel(), ",") + 1
+	}
+
+	// Without limit the workload spans more than three levels.
+	h := newDbHarnessWopt(t, o)
+	fill(h)
+	if n := numLevels(h); n <= 3 {
+		t.Fatalf("unlimited: got %d levels (%s), want more than 3", n, h.getTablesPerLevel())
+	}
+	h.closeDB()
+	h.o.NumLevels = 2
+	if err := h.openDB0(); err == nil {
+		t.Error("NumLevels below the existing levels: expected error")
+	} else if _, ok := err.(*ErrInvalidOption); !ok {
+		t.Errorf("NumLevels below the existing levels: got error %v, want ErrInvalidOption", err)
+	}
+	h.close()
+
+	no := *o
+	no.NumLevels = 3
+	h = newDbHarnessWopt(t, &no)
+	defer h.close()
+	fill(h)
+	if n := numLevels(h); n != 3 {
+		t.Fatalf("NumLevels 3: got %d levels (%s), want 3", n, h.getTablesPerLevel())
+	}
+	h.closeDB()
+
+	for _, n := range []int{-1, 1, 4} {
+		h.o.NumLevels = n
+		if err := h.openDB0(); err == nil {
+			t.Errorf("NumLevels %d: expected error", n)
+			h.closeDB()
+		} else if _, ok := err.(*ErrInvalidOption); !ok {
+			t.Errorf("NumLevels %d: got error %v, want ErrInvalidOption", n, err)
+		}
+	}
+
+	// Zero uses the recorded level count.
+	h.o.NumLevels = 0
+	h.openDB()
+	if n := h.db.s.numLevels(); n != 3 {
+		t.Errorf("NumLevels 0: got %d levels, want 3", n)
+	}
+	fill(h)
+	if n := numLevels(h); n != 3 {
+		t.Errorf("NumLevels 0: got %d levels (%s), want 3", n, h.getTablesPerLevel())
+	}
+}
+
+type testMetricsHook struct {
+	mu                      sync.Mutex
+	gets, hits, puts, bytes int
+	writes, records         int
+	compactions             []int
+}
+
+func (m *testMetricsHook) ObserveGet(d time.Duration, found bool) {
+	m.mu.Lock()
+	m.gets++
+	if found {
+		m.hits++
+	}
+	m.mu.Unlock()
+}
+
+func (m *testMetricsHook) ObservePut(d time.Duration, size int) {
+	m.mu.Lock()
+	m.puts++
+	m.bytes += size
+	m.mu.Unlock()
+}
+
+func (m *testMetricsHook) ObserveWrite(d time.Duration, batchLen int) {
+	m.mu.Lock()
+	m.writes++
+	m.records += batchLen
+	m.mu.Unlock()
+}
+
+func (m *testMetricsHook) ObserveCompaction(d time.Duration, level, outputLevel int, readBytes, writeBytes int64) {
+	m.mu.Lock()
+	m.compactions = append(m.compactions, level)
+	m.mu.Unlock()
+}
+
+func TestDB_MetricsHook(t *testing.T) {
+	m := &testMetricsHook{}
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		MetricsHook:                  m,
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v22")
+	h.getVal("foo", "v1")
+	h.get("baz", false)
+	b := new(Batch)
+	b.Put([]byte("baz"), []byte("v3"))
+	b.Delete([]byte("foo"))
+	h.write(b)
+	h.compactMem()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.puts != 2 || m.bytes != 11 {
+		t.Errorf("ObservePut: got %d calls, %d bytes, want 2 calls, 11 bytes", m.puts, m.bytes)
+	}
+	if m.gets != 2 || m.hits != 1 {
+		t.Errorf("ObserveGet: got %d calls, %d hits, want 2 calls, 1 hit", m.gets, m.hits)
+	}
+	if m.writes != 1 || m.records != 2 {
+		t.Errorf("ObserveWrite: got %d calls, %d records, want 1 call, 2 records", m.writes, m.records)
+	}
+	if len(m.compactions) != 1 || m.compactions[0] != -1 {
+		t.Errorf("ObserveCompaction: got levels %v, want [-1]", m.compactions)
+	}
+}
+
+func TestDB_RejectDuplicateKeys(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	reject := &opt.WriteOptions{RejectDuplicateKeys: true}
+
+	b := new(Batch)
+	b.Put([]byte("a"), []byte("v1"))
+	b.Put([]byte("b"), []byte("v1"))
+	b.Delete([]byte("a"))
+
+	err := h.db.Write(b, reject)
+	if e, ok := err.(*ErrDuplicateKey); !ok || string(e.Key) != "a" {
+		t.Fatalf("Write batch with duplicates: got error %v, want ErrDuplicateKey", err)
+	}
+	h.get("a", false)
+	h.get("b", false)
+
+	// Unique keys are accepted.
+	b2 := new(Batch)
+	b2.Put([]byte("a"), []byte("v2"))
+	b2.Put([]byte("b"), []byte("v2"))
+	if err := h.db.Write(b2, reject); err != nil {
+		t.Fatal("Write batch without duplicates: got error: ", err)
+	}
+	h.getVal("a", "v2")
+	h.getVal("b", "v2")
+
+	// Transaction.
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	if _, ok := tr.Write(b, reject).(*ErrDuplicateKey); !ok {
+		t.Error("Transaction.Write batch with duplicates: expecting ErrDuplicateKey")
+	}
+	if err := tr.Commit(); err != nil {
+		t.Fatal("Commit: got error: ", err)
+	}
+	h.getVal("a", "v2")
+
+	// Default is to let the last record win.
+	if err := h.db.Write(b, h.wo); err != nil {
+		t.Fatal("Write batch with duplicates: got error: ", err)
+	}
+	h.get("a", false)
+	h.getVal("b", "v1")
+}
+
+func TestDB_PurgeObsoleteFiles(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	h.compactMem()
+
+	// Leftover files, as if left behind by a crash.
+	stray := []storage.FileDesc{
+		{Type: storage.TypeTable, Num: 1},
+		{Type: storage.TypeJournal, Num: 1},
+		{Type: storage.TypeTemp, Num: 1},
+	}
+	var want int64
+	for i, fd := range stray {
+		w, err := h.stor.Create(fd)
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		data := bytes.Repeat([]byte{'x'}, 100*(i+1))
+		if _, err := w.Write(data); err != nil {
+			t.Fatal("Write: got error: ", err)
+		}
+		w.Close()
+		want += int64(len(data))
+	}
+
+	// Tables pinned by the iterator must be kept.
+	iter := h.db.NewIterator(nil, h.ro)
+	h.put("a", "v2")
+	h.compactMem()
+	h.compactRange("", "")
+
+	n, size, err := h.db.PurgeObsoleteFiles()
+	if err != nil {
+		t.Fatal("PurgeObsoleteFiles: got error: ", err)
+	}
+	if n != len(stray) || size != want {
+		t.Errorf("PurgeObsoleteFiles: got %d files %d bytes, want %d files %d bytes", n, size, len(stray), want)
+	}
+	for _, fd := range stray {
+		if r, err := h.stor.Open(fd); err == nil {
+			r.Close()
+			t.Errorf("%s-%d: not removed", fd.Type, fd.Num)
+		}
+	}
+	var res string
+	for iter.Next() {
+		res += fmt.Sprintf("(%s->%s)", iter.Key(), iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		t.Error("Iterator: got error: ", err)
+	}
+	iter.Release()
+	if want := "(a->v1)(b->v1)"; res != want {
+		t.Errorf("Iterator: got %q, want %q", res, want)
+	}
+
+	if n, _, err := h.db.PurgeObsoleteFiles(); err != nil || n != 0 {
+		t.Errorf("PurgeObsoleteFiles again: got %d files, %v; want none", n, err)
+	}
+	h.getVal("a", "v2")
+	h.getVal("b", "v1")
+	h.reopenDB()
+	h.getVal("a", "v2")
+	h.getVal("b", "v1")
+}
+
+func TestDB_FreeDiskSpace(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	storageSize := func() int64 {
+		fds, err := h.stor.List(storage.TypeAll)
+		if err != nil {
+			t.Fatal("List: got error: ", err)
+		}
+		var total int64
+		for _, fd := range fds {
+			// Bypass the open files check, the journal and the
+			// manifest are being written.
+			size, err := fileSize(h.stor.Storage, fd)
+			if err != nil {
+				t.Fatalf("%s-%d: got error: %v", fd.Type, fd.Num, err)
+			}
+			total += size
+		}
+		return total
+	}
+
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 50; j++ {
+			h.put(numKey(i*50+j), value)
+		}
+		h.compactMem()
+	}
+	for i := 0; i < 500; i++ {
+		h.delete(numKey(i))
+	}
+	h.put("foo", "v1")
+	h.compactMem()
+	h.compactRange("", "")
+
+	// Leftover file, as if left behind by a crash.
+	w, err := h.stor.Create(storage.FileDesc{Type: storage.TypeTable, Num: 1})
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte{'x'}, 10000)); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	w.Close()
+
+	before := storageSize()
+	size, err := h.db.FreeDiskSpace()
+	if err != nil {
+		t.Fatal("FreeDiskSpace: got error: ", err)
+	}
+	after := storageSize()
+	if after >= before {
+		t.Errorf("FreeDiskSpace: storage size got %d, want less than %d", after, before)
+	}
+	if size < before-after {
+		t.Errorf("FreeDiskSpace: got %d bytes removed, want at least %d", size, before-after)
+	}
+
+	h.getVal("foo", "v1")
+	h.get(numKey(0), false)
+	h.reopenDB()
+	h.getVal("foo", "v1")
+	h.get(numKey(0), false)
+}
+
+func TestDB_LazyManifestSync(t *testing.T) {
+	o := &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ManifestSync:                 opt.LazyManifestSync,
+		ManifestSyncInterval:         time.Hour,
+	}
+	h := newDbHarnessWopt(t, o)
+	defer h.close()
+
+	readFile := func(fd storage.FileDesc) []byte {
+		r, err := h.stor.Storage.Open(fd)
+		if err != nil {
+			t.Fatalf("%s-%d: got error: %v", fd.Type, fd.Num, err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s-%d: got error: %v", fd.Type, fd.Num, err)
+		}
+		return data
+	}
+
+	// Remember the manifest as last synced, to emulate a crash later.
+	if err := h.db.syncManifest(); err != nil {
+		t.Fatal("syncManifest: got error: ", err)
+	}
+	syncedFd := h.db.s.manifestFd
+	synced := readFile(syncedFd)
+	h.stor.ResetCounter(testutil.ModeSync, storage.TypeManifest)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), fmt.Sprintf("v%d", i))
+		if i%25 == 24 {
+			h.compactMem()
+		}
+	}
+	h.compactRange("", "")
+
+	if cnt, _ := h.stor.Counter(testutil.ModeSync, storage.TypeManifest); cnt != 0 {
+		t.Errorf("manifest synced %d times, want none", cnt)
+	}
+	h.db.s.manifestSyncMu.Lock()
+	pending := len(h.db.s.manifestPending)
+	h.db.s.manifestSyncMu.Unlock()
+	if pending == 0 {
+		t.Error("no removal waiting for the manifest sync")
+	}
+
+	// Emulate a crash losing the unsynced version edits.
+	stor := storage.NewMemStorage()
+	fds, err := h.stor.Storage.List(storage.TypeAll)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	for _, fd := range fds {
+		data := readFile(fd)
+		if fd.Type == storage.TypeManifest {
+			if fd != syncedFd {
+				continue
+			}
+			data = synced
+		}
+		w, err := stor.Create(fd)
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal("Write: got error: ", err)
+		}
+		w.Close()
+	}
+	if err := stor.SetMeta(syncedFd); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+	db, err := Open(stor, o)
+	if err != nil {
+		t.Fatal("Open after crash: got error: ", err)
+	}
+	for i := 0; i < n; i++ {
+		if v, err := db.Get([]byte(numKey(i)), nil); err != nil || string(v) != fmt.Sprintf("v%d", i) {
+			t.Fatalf("Get %s after crash: got %q, %v", numKey(i), v, err)
+		}
+	}
+	db.Close()
+
+	h.reopenDB()
+	if cnt, _ := h.stor.Counter(testutil.ModeSync, storage.TypeManifest); cnt == 0 {
+		t.Error("manifest not synced on close")
+	}
+	for i := 0; i < n; i++ {
+		h.getVal(numKey(i), fmt.Sprintf("v%d", i))
+	}
+}
+
+func TestDB_GetMulti(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		h.put("a", "v1")
+		h.put("b", "")
+		h.put("c", "v1")
+
+		keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+		check := func(name string, values [][]byte, err error, want []string) {
+			t.Helper()
+			if err != nil {
+				t.Fatalf("%s: got error: %v", name, err)
+			}
+			if len(values) != len(want) {
+				t.Fatalf("%s: got %d values, want %d", name, len(values), len(want))
+			}
+			for i, v := range values {
+				got := "<nil>"
+				if v != nil {
+					got = string(v)
+				}
+				if got != want[i] {
+					t.Errorf("%s: key %q: got %q, want %q", name, keys[i], got, want[i])
+				}
+			}
+		}
+
+		snap, err := h.db.GetSnapshot()
+		if err != nil {
+			t.Fatal("GetSnapshot: got error: ", err)
+		}
+		defer snap.Release()
+
+		h.put("a", "v2")
+		h.delete("c")
+		h.put("d", "v2")
+		h.compactMem()
+
+		values, err := h.db.GetMulti(keys, h.ro)
+		check("DB.GetMulti", values, err, []string{"v2", "", "<nil>", "v2"})
+		values, err = snap.GetMulti(keys, h.ro)
+		check("Snapshot.GetMulti", values, err, []string{"v1", "", "v1", "<nil>"})
+
+		for i, want := range []bool{true, true, true, false} {
+			if ret, err := snap.Has(keys[i], h.ro); err != nil || ret != want {
+				t.Errorf("Snapshot.Has(%q): got %v, %v; want %v", keys[i], ret, err, want)
+			}
+		}
+
+	})
+}
+
+func TestDB_Apply(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("bar", "v0")
+	b := new(Batch)
+	b.Put([]byte("foo"), []byte("v1"))
+	b.Delete([]byte("bar"))
+	if err := h.db.Apply(b.Dump(), h.wo); err != nil {
+		t.Fatal("Apply: got error: ", err)
+	}
+	h.getVal("foo", "v1")
+	h.get("bar", false)
+
+	// A malformed dump is rejected as a whole.
+	b.Reset()
+	b.Put([]byte("baz"), []byte("v1"))
+	b.Put([]byte("qux"), []byte("v1"))
+	dumped := b.Dump()
+	if err := h.db.Apply(dumped[:len(dumped)-1], h.wo); !errors.IsCorrupted(err) {
+		t.Errorf("Apply malformed dump: got error %v, want corrupted", err)
+	}
+	h.get("baz", false)
+	h.get("qux", false)
+}
+
+func TestDB_TableCacheShards(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		OpenFilesCacheCapacity:       10,
+		TableCacheShards:             4,
+	})
+	defer h.close()
+
+	c := h.db.s.tops.cache
+	capacities := func() (caps []int) {
+		for i := range c.shards {
+			caps = append(caps, c.shardCapacity(h.o.GetOpenFilesCacheCapacity(), i))
+		}
+		return
+	}
+	if got, want := fmt.Sprint(capacities()), "[3 3 2 2]"; got != want {
+		t.Errorf("shard capacities: got %s, want %s", got, want)
+	}
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		h.put(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i))
+		h.compactMem()
+	}
+	for r := 0; r < 2; r++ {
+		for i := 0; i < n; i++ {
+			h.getVal(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i))
+		}
+	}
+	var stats DBStats
+	if err := h.db.Stats(&stats); err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if stats.OpenedTablesCount == 0 || stats.OpenedTablesCount > 10 {
+		t.Errorf("OpenedTablesCount: got %d, want 1..10", stats.OpenedTablesCount)
+	}
+
+	// The shard count is capped by the capacity.
+	h.o.OpenFilesCacheCapacity = 2
+	h.reopenDB()
+	if n := len(h.db.s.tops.cache.shards); n != 2 {
+		t.Errorf("shards: got %d, want 2", n)
+	}
+	h.getVal("k00", "v0")
+	h.getVal(fmt.Sprintf("k%02d", n-1), fmt.Sprintf("v%d", n-1))
+}
+
+func TestDB_CompactMemtable(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	tableNums := func() map[int64]bool {
+		nums := make(map[int64]bool)
+		v := h.db.s.version()
+		for _, tables := range v.levels {
+			for _, t := range tables {
+				nums[t.fd.Num] = true
+			}
+		}
+		v.release()
+		return nums
+	}
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	h.compactRange("", "")
+	before := tableNums()
+	if len(before) == 0 {
+		t.Fatal("no tables after full compaction")
+	}
+
+	h.put("c", "v2")
+	h.delete("a")
+	if err := h.db.CompactMemtable(); err != nil {
+		t.Fatal("CompactMemtable: got error: ", err)
+	}
+	after := tableNums()
+	if len(after) != len(before)+1 {
+		t.Errorf("invalid tables count, want=%d got=%d", len(before)+1, len(after))
+	}
+	for num := range before {
+		if !after[num] {
+			t.Errorf("table @%d was compacted away", num)
+		}
+	}
+	if n := h.db.mem.Len(); n != 0 {
+		t.Errorf("memtable not empty, got=%d entries", n)
+	}
+	h.getVal("b", "v1")
+	h.getVal("c", "v2")
+	h.get("a", false)
+
+	// Empty memtable, nothing to flush.
+	if err := h.db.CompactMemtable(); err != nil {
+		t.Fatal("CompactMemtable: got error: ", err)
+	}
+	if got := tableNums(); len(got) != len(after) {
+		t.Errorf("invalid tables count after no-op, want=%d got=%d", len(after), len(got))
+	}
+}
+
+func TestDB_BlockCachePolicy(t *testing.T) {
+	for _, policy := range []opt.CachePolicy{opt.LRUCachePolicy, opt.TwoQueueCachePolicy, opt.ClockCachePolicy} {
+		t.Run(policy.String(), func(t *testing.T) {
+			h := newDbHarnessWopt(t, &opt.Options{
+				DisableLargeBatchTransaction: true,
+				BlockSize:                    512,
+				BlockCacheCapacity:           4 * opt.KiB,
+				BlockCachePolicy:             policy,
+			})
+			defer h.close()
+
+			for i := 0; i < 500; i++ {
+				h.put(fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+			}
+			h.compactMem()
+			h.reopenDB()
+
+			for n := 0; n < 2; n++ {
+				for i := 0; i < 500; i++ {
+					h.getVal(fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+				}
+			}
+			var stats DBStats
+			h.db.Stats(&stats)
+			if stats.BlockCacheSize == 0 || stats.BlockCacheSize > 4*opt.KiB {
+				t.Errorf("BlockCacheSize: got %d, want within (0, %d]", stats.BlockCacheSize, 4*opt.KiB)
+			}
+		})
+	}
+
+	// BlockCacher takes precedence over BlockCachePolicy.
+	var called bool
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockCacher: &opt.CacherFunc{NewFunc: func(capacity int) cache.Cacher {
+			called = true
+			return cache.NewLRU(capacity)
+		}},
+		BlockCachePolicy: opt.ClockCachePolicy,
+	})
+	defer h.close()
+	if !called {
+		t.Error("BlockCacher is not used")
+	}
+}
+
+func TestDB_PutReader(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  8 * opt.MiB,
+	})
+	defer h.close()
+
+	value := make([]byte, 3*opt.MiB)
+	rand.New(rand.NewSource(1)).Read(value)
+	if err := h.db.PutReader([]byte("big"), int64(len(value)), bytes.NewReader(value), h.wo); err != nil {
+		t.Fatal("PutReader: got error: ", err)
+	}
+	h.getVal("big", string(value))
+
+	// Short reader, nothing is written.
+	err := h.db.PutReader([]byte("short"), 10, strings.NewReader("12345"), h.wo)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("PutReader with short reader: got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	h.get("short", false)
+
+	// Only size bytes are read.
+	r := strings.NewReader("valuerest")
+	if err := h.db.PutReader([]byte("k"), 5, r, h.wo); err != nil {
+		t.Fatal("PutReader: got error: ", err)
+	}
+	if r.Len() != 4 {
+		t.Errorf("PutReader read past the value: %d bytes left, want 4", r.Len())
+	}
+	h.getVal("k", "value")
+
+	// Survives recovery from the journal.
+	h.reopenDB()
+	h.getVal("big", string(value))
+	h.getVal("k", "value")
+}
+
+func TestDB_PutReader_LargeBatchTransaction(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		WriteBuffer:     1 * opt.MiB,
+		EnableBlobFiles: true,
+	})
+	defer h.close()
+
+	value := bytes.Repeat([]byte("0123456789"), 400*opt.KiB)
+	if err := h.db.PutReader([]byte("big"), int64(len(value)), bytes.NewReader(value), h.wo); err != nil {
+		t.Fatal("PutReader: got error: ", err)
+	}
+	h.getVal("big", string(value))
+	if h.totalTables() == 0 {
+		t.Error("large value is not written by transaction")
+	}
+
+	h.o.MaxValueSize = 1024
+	h.reopenDB()
+	h.getVal("big", string(value))
+	err := h.db.PutReader([]byte("big"), int64(len(value)), bytes.NewReader(value), h.wo)
+	if _, ok := err.(*ErrValueTooLarge); !ok {
+		t.Errorf("PutReader over MaxValueSize: got error %v, want *ErrValueTooLarge", err)
+	}
+}
+
+func TestDB_FixedLengthComparer(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Comparer:                     comparer.NewFixedLengthComparer(8),
+		Strict:                       opt.DefaultStrict | opt.StrictKeys,
+	})
+	defer h.close()
+
+	for i := 0; i < 100; i++ {
+		h.put(fmt.Sprintf("key%05d", i), fmt.Sprintf("v%d", i))
+	}
+	if err := h.db.Put([]byte("short"), []byte("v"), h.wo); err == nil {
+		t.Error("Put with a short key: got nil error")
+	}
+	b := new(Batch)
+	b.Put([]byte("key99999"), []byte("v"))
+	b.Delete([]byte("too long key"))
+	if err := h.db.Write(b, h.wo); err == nil {
+		t.Error("Write with a long key: got nil error")
+	}
+	h.get("key99999", false)
+	if err := h.db.PutReader([]byte("short"), 1, strings.NewReader("v"), h.wo); err == nil {
+		t.Error("PutReader with a short key: got nil error")
+	}
+	if _, err := h.db.DeleteMulti([][]byte{[]byte("key00000"), []byte("short")}, h.wo); err == nil {
+		t.Error("DeleteMulti with a short key: got nil error")
+	}
+	h.getVal("key00000", "v0")
+
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	if err := tr.Put([]byte("short"), []byte("v"), h.wo); err == nil {
+		t.Error("Transaction.Put with a short key: got nil error")
+	}
+	if err := tr.Delete([]byte("short"), h.wo); err == nil {
+		t.Error("Transaction.Delete with a short key: got nil error")
+	}
+	if err := tr.Write(b, h.wo); err == nil {
+		t.Error("Transaction.Write with a long key: got nil error")
+	}
+	tr.Discard()
+
+	h.compactMem()
+	h.reopenDB()
+	for i := 0; i < 100; i++ {
+		h.getVal(fmt.Sprintf("key%05d", i), fmt.Sprintf("v%d", i))
+	}
+
+	// Keys are only checked under StrictKeys.
+	h.o.Strict = opt.DefaultStrict
+	h.reopenDB()
+	h.put("short", "v")
+	h.getVal("short", "v")
+
+	// The comparer name is persisted.
+	h.closeDB()
+	for _, cmp := range []comparer.Comparer{comparer.DefaultComparer, comparer.NewFixedLengthComparer(16)} {
+		h.o.Comparer = cmp
+		if err := h.openDB0(); err == nil {
+			h.db.Close()
+			t.Errorf("Open with comparer %q: got nil error", cmp.Name())
+		} else if _, ok := err.(*ErrComparerMismatch); !ok {
+			t.Errorf("Open with comparer %q: got error %v, want *ErrComparerMismatch", cmp.Name(), err)
+		}
+	}
+	h.o.Comparer = comparer.NewFixedLengthComparer(8)
+	h.openDB()
+}
+
+func TestDB_SharedCaches(t *testing.T) {
+	const (
+		blockCap = 16 * opt.KiB
+		filesCap = 4
+	)
+	bcache := cache.NewCache(cache.NewLRU(blockCap))
+	fcache := cache.NewCache(cache.NewLRU(filesCap))
+	defer bcache.Close()
+	defer fcache.Close()
+
+	// Both DBs have the same table numbers, their cached blocks and files
+	// must not collide.
+	var hs [2]*dbHarness
+	for i := range hs {
+		hs[i] = newDbHarnessWopt(t, &opt.Options{
+			DisableLargeBatchTransaction: true,
+			BlockSize:                    512,
+			WriteBuffer:                  64 * opt.KiB,
+			BlockCache:                   bcache,
+			OpenFilesCache:               fcache,
+		})
+		defer hs[i].close()
+		for j := 0; j < 2000; j++ {
+			hs[i].put(fmt.Sprintf("key%05d", j), fmt.Sprintf("db%d-%s", i, strings.Repeat("v", 100)))
+		}
+		hs[i].compactMem()
+		hs[i].reopenDB()
+	}
+	if hs[0].totalTables() < 2 {
+		t.Fatalf("too few tables: %d", hs[0].totalTables())
+	}
+
+	for n := 0; n < 2; n++ {
+		for j := 0; j < 2000; j += 7 {
+			for i, h := range hs {
+				h.getVal(fmt.Sprintf("key%05d", j), fmt.Sprintf("db%d-%s", i, strings.Repeat("v", 100)))
+			}
+		}
+	}
+	if size := bcache.Size(); size == 0 || size > blockCap {
+		t.Errorf("shared block cache size: got %d, want within (0, %d]", size, blockCap)
+	}
+	if size := fcache.Size(); size == 0 || size > filesCap {
+		t.Errorf("shared open files cache size: got %d, want within (0, %d]", size, filesCap)
+	}
+	var stats DBStats
+	hs[0].db.Stats(&stats)
+	if stats.BlockCacheSize != bcache.Size() || stats.OpenedTablesCount != fcache.Size() {
+		t.Errorf("stats don't report the shared caches: got %d/%d, want %d/%d",
+			stats.BlockCacheSize, stats.OpenedTablesCount, bcache.Size(), fcache.Size())
+	}
+	if err := hs[0].db.SetOptions(map[string]string{"BlockCacheCapacity": "1"}); err == nil {
+		t.Error("SetOptions on shared block cache: got nil error")
+	}
+
+	// Closed DBs leave nothing in the shared caches.
+	for _, h := range hs {
+		h.closeDB()
+	}
+	if bcache.Size() != 0 || fcache.Size() != 0 {
+		t.Errorf("shared caches not empty after close: blocks=%d files=%d", bcache.Size(), fcache.Size())
+	}
+}
+
+func TestDB_SharedBlockCacheIDs(t *testing.T) {
+	bcache := cache.NewCache(cache.NewLRU(opt.MiB))
+	defer bcache.Close()
+
+	h := newDbHarnessWopt(t, &opt.Options{BlockCache: bcache})
+	defer h.close()
+	for i := 0; i < 100; i++ {
+		h.put(fmt.Sprintf("key%03d", i), "v")
+	}
+	h.compactMem()
+	h.getVal("key050", "v")
+	blockCacheSize := func() int64 {
+		u, err := h.db.ApproximateMemoryUsage()
+		if err != nil {
+			t.Fatal("ApproximateMemoryUsage: got error: ", err)
+		}
+		return u.BlockCache
+	}
+	size := blockCacheSize()
+	if size == 0 {
+		t.Fatal("no blocks cached")
+	}
+
+	// Ids of closed DBs are reused, the cached blocks of the live DB are
+	// left alone past the number of available ids. A small write buffer
+	// keeps the opens cheap.
+	o := &opt.Options{BlockCache: bcache, WriteBuffer: opt.KiB}
+	for i := 0; i <= bcacheMaxID+1; i++ {
+		db, err := Open(storage.NewMemStorage(), o)
+		if err != nil {
+			t.Fatalf("Open #%d: got error: %v", i, err)
+		}
+		db.Close()
+	}
+	if got := blockCacheSize(); got != size {
+		t.Errorf("block cache size: got %d, want %d", got, size)
+	}
+	h.getVal("key050", "v")
+
+	// No ids left.
+	var ids []uint64
+	for {
+		id, err := allocBlockCacheID(bcache)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) != bcacheMaxID {
+		t.Errorf("free ids: got %d, want %d", len(ids), bcacheMaxID)
+	}
+	if db, err := Open(storage.NewMemStorage(), o); err != ErrBlockCacheFull {
+		if err == nil {
+			db.Close()
+		}
+		t.Errorf("Open with no ids left: got error %v, want %v", err, ErrBlockCacheFull)
+	}
+	for _, id := range ids {
+		freeBlockCacheID(bcache, id)
+	}
+
+	// Table numbers must not spill into the id.
+	f := newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: bcacheMaxNum + 1}, 0, nil, nil)
+	if _, err := h.db.s.tops.open(f); err != errTableNumOverflow {
+		t.Errorf("open table #%d: got error %v, want %v", f.fd.Num, err, errTableNumOverflow)
+	}
+}
+
+func TestDB_CheckConsistency(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for _, k := range []string{"a", "c", "e", "g"} {
+		h.put(k, "v1")
+		h.compactMem()
+	}
+	h.compactRange("", "")
+	if err := h.db.CheckConsistency(); err != nil {
+		t.Fatal("CheckConsistency: got error: ", err)
+	}
+
+	// Install a version with broken tables, which are neither written to
+	// the manifest nor to the storage.
+	v := h.db.s.version()
+	ik := func(k string) internalKey { return makeInternalKey(nil, []byte(k), 1, keyTypeVal) }
+	n1, n2, n3 := h.db.s.allocFileNum(), h.db.s.allocFileNum(), h.db.s.allocFileNum()
+	rec := &sessionRecord{}
+	rec.addTable(5, n1, 1, ik("x"), ik("z"))
+	rec.addTable(5, n2, 1, ik("y"), ik("zz"))
+	rec.addTable(6, n3, 1, ik("q"), ik("p"))
+	h.db.s.setVersion(v.spawn(rec))
+
+	err := h.db.CheckConsistency()
+	h.db.s.setVersion(v)
+	v.release()
+	if !errors.IsCorrupted(err) {
+		t.Fatalf("CheckConsistency: want corrupted error, got %v", err)
+	}
+	ierr, ok := err.(*errors.ErrCorrupted).Err.(*ErrInconsistent)
+	if !ok {
+		t.Fatalf("CheckConsistency: want ErrInconsistent, got %v", err)
+	}
+	fd := func(num int64) storage.FileDesc { return storage.FileDesc{Type: storage.TypeTable, Num: num} }
+	want := []string{
+		fmt.Sprintf("level 5 tables %s [x,v1 .. z,v1] and %s [y,v1 .. zz,v1] overlap", fd(n1), fd(n2)),
+		fmt.Sprintf("level 6 table %s smallest key q,v1 is greater than largest key p,v1", fd(n3)),
+		fmt.Sprintf("level 5 table %s is missing", fd(n1)),
+		fmt.Sprintf("level 5 table %s is missing", fd(n2)),
+		fmt.Sprintf("level 6 table %s is missing", fd(n3)),
+	}
+	if strings.Join(ierr.Problems, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("CheckConsistency: got problems %q, want %q", ierr.Problems, want)
+	}
+
+	if err := h.db.CheckConsistency(); err != nil {
+		t.Fatal("CheckConsistency: got error after restoring version: ", err)
+	}
+
+	// A table removed behind the DB's back.
+	v = h.db.s.version()
+	var tfd storage.FileDesc
+	for _, tables := range v.levels {
+		if len(tables) > 0 {
+			tfd = tables[0].fd
+		}
+	}
+	v.release()
+	if err := h.stor.Remove(tfd); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	err = h.db.CheckConsistency()
+	if err == nil || !strings.Contains(err.Error(), tfd.String()+" is missing") {
+		t.Fatalf("CheckConsistency: want missing %s, got %v", tfd, err)
+	}
+}
+
+// prefixFilter excludes the keys starting with 'n', and passes any other
+// key whether added or not.
+type prefixFilter struct{}
+
+func (prefixFilter) Name() string                         { return "leveldb.PrefixFilter" }
+func (prefixFilter) NewGenerator() filter.FilterGenerator { return prefixFilter{} }
+func (prefixFilter) Add(key []byte)                       {}
+func (prefixFilter) Generate(b filter.Buffer)             { b.WriteByte(0) }
+func (prefixFilter) Contains(filter, key []byte) bool     { return len(key) == 0 || key[0] != 'n' }
+
+func TestDB_FilterStats(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Filter:                       prefixFilter{},
+	})
+	defer h.close()
+
+	for _, k := range []string{"a", "k1", "k2", "k3", "z"} {
+		h.put(k, "v")
+	}
+	h.compactMem()
+
+	for _, k := range []string{"k1", "k2", "k3"} {
+		h.getVal(k, "v")
+	}
+	// Passed by the filter but not in the table.
+	h.get("m1", false)
+	h.get("m2", false)
+	if ret, err := h.db.Has([]byte("m3"), nil); err != nil || ret {
+		t.Fatalf("Has: got (%v, %v), want (false, nil)", ret, err)
+	}
+	// Excluded by the filter.
+	h.get("n1", false)
+
+	v, err := h.db.GetProperty("leveldb.filterstats")
+	if err != nil {
+		t.Fatal("GetProperty: got error: ", err)
+	}
+	if want := "Checked:7 Negative:1 FalsePositive:3 FPRate:0.75000"; v != want {
+		t.Fatalf("filterstats: got %q, want %q", v, want)
+	}
+}
+
+func TestDB_MergedIteratorAcrossDBs(t *testing.T) {
+	h1 := newDbHarness(t)
+	defer h1.close()
+	h2 := newDbHarness(t)
+	defer h2.close()
+
+	// Shard by key parity, "dup" is in both and the first shard wins.
+	for i := 0; i < 20; i++ {
+		h := h1
+		if i%2 == 1 {
+			h = h2
+		}
+		h.put(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%02d", i))
+	}
+	h1.put("dup", "v1")
+	h2.put("dup", "v2")
+	h2.compactMem()
+
+	snap, err := h2.db.GetSnapshot()
+	if err != nil {
+		t.Fatal("GetSnapshot: got error: ", err)
+	}
+	defer snap.Release()
+	// Not seen by the snapshot.
+	h2.put("k99", "v99")
+
+	iter := iterator.NewMergedIterator([]iterator.Iterator{
+		h1.db.NewIterator(nil, nil),
+		snap.NewIterator(nil, nil),
+	}, comparer.DefaultComparer, true)
+	defer iter.Release()
+
+	var got []string
+	for iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Value()))
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal("iterator: got error: ", err)
+	}
+	want := []string{"dup=v1"}
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("k%02d=v%02d", i, i))
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("merged iterator: got %v, want %v", got, want)
+	}
+
+	var rgot []string
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		rgot = append([]string{string(iter.Key()) + "=" + string(iter.Value())}, rgot...)
+	}
+	if strings.Join(rgot, " ") != strings.Join(want, " ") {
+		t.Fatalf("merged iterator backward: got %v, want %v", rgot, want)
+	}
+}
+
+func TestDB_OnTableCacheOpenEvict(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		open     = make(map[uint64]bool)
+		nOpen    int
+		nEvict   int
+		badEvict []uint64
+	)
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		OpenFilesCacheCapacity:       2,
+		OnTableCacheOpen: func(fileNum uint64) {
+			mu.Lock()
+			open[fileNum] = true
+			nOpen++
+			mu.Unlock()
+		},
+		OnTableCacheEvict: func(fileNum uint64) {
+			mu.Lock()
+			if !open[fileNum] {
+				badEvict = append(badEvict, fileNum)
+			}
+			delete(open, fileNum)
+			nEvict++
+			mu.Unlock()
+		},
+	})
+	defer h.close()
+
+	h.db.memdbMaxLevel = 0
+	if err := h.db.PauseCompactions(); err != nil {
+		t.Fatal("PauseCompactions: got error: ", err)
+	}
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		h.put(key, "v"+key)
+		h.compactMem()
+	}
+	for r := 0; r < 2; r++ {
+		for _, key := range keys {
+			h.getVal(key, "v"+key)
+		}
+	}
+
+	mu.Lock()
+	if nOpen < 2*len(keys) {
+		t.Errorf("open callbacks: got %d, want at least %d", nOpen, 2*len(keys))
+	}
+	if nEvict < nOpen-2 {
+		t.Errorf("evict callbacks: got %d, want at least %d", nEvict, nOpen-2)
+	}
+	if len(open) > 2 {
+		t.Errorf("open files: got %d, want at most 2", len(open))
+	}
+	mu.Unlock()
+
+	h.db.ResumeCompactions()
+	h.closeDB()
+	h.db = nil
+	mu.Lock()
+	defer mu.Unlock()
+	if len(open) != 0 || nOpen != nEvict {
+		t.Errorf("after close: got %d open callbacks and %d evict callbacks, files %v left open", nOpen, nEvict, open)
+	}
+	if len(badEvict) != 0 {
+		t.Errorf("evict callbacks for files not open: %v", badEvict)
+	}
+}
+
+func TestDB_OnWriteStall(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionL0Trigger:          2,
+		WriteL0SlowdownTrigger:       3,
+		WriteL0PauseTrigger:          5,
+		OnWriteStall: func(reason string, throttled bool) {
+			mu.Lock()
+			events = append(events, fmt.Sprintf("%s:%t", reason, throttled))
+			mu.Unlock()
+		},
+	})
+	defer h.close()
+	expect := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Join(events, " ") != strings.Join(want, " ") {
+			t.Fatalf("L0·%d: got write stall events %v, want %v", h.db.s.tLen(0), events, want)
+		}
+	}
+
+	h.db.memdbMaxLevel = 0
+	if err := h.db.PauseCompactions(); err != nil {
+		t.Fatal("PauseCompactions: got error: ", err)
+	}
+	for i := 1; i <= 5; i++ {
+		h.put("k", fmt.Sprintf("v%d", i))
+		h.compactMem()
+		if n := h.db.s.tLen(0); n != i {
+			t.Fatalf("L0 tables: got %d, want %d", n, i)
+		}
+		switch {
+		case i < 3:
+			expect()
+		case i < 5:
+			expect("slowdown:true")
+		default:
+			expect("slowdown:true", "pause:true")
+		}
+	}
+
+	h.db.ResumeCompactions()
+	h.waitCompaction()
+	expect("slowdown:true", "pause:true", "pause:false", "slowdown:false")
+
+	// The triggers must be ordered.
+	if err := h.db.SetOptions(map[string]string{"WriteL0PauseTrigger": "2"}); err == nil {
+		t.Error("SetOptions: want error for a pause trigger below the slowdown trigger")
+	}
+	if err := h.db.SetOptions(map[string]string{"WriteL0SlowdownTrigger": "4", "WriteL0PauseTrigger": "4"}); err != nil {
+		t.Error("SetOptions: got error: ", err)
+	}
+	if _, ok := h.db.SetOptions(map[string]string{"CompactionL0Trigger": "4"}).(*ErrInvalidOption); !ok {
+		t.Error("SetOptions: want ErrInvalidOption for a compaction trigger reaching the slowdown trigger")
+	}
+	if n := h.db.s.o.GetCompactionL0Trigger(); n != 2 {
+		t.Errorf("CompactionL0Trigger after rejected SetOptions: got %d, want 2", n)
+	}
+	for _, o := range []*opt.Options{
+		{WriteL0SlowdownTrigger: opt.DefaultCompactionL0Trigger},
+		{WriteL0SlowdownTrigger: 10, WriteL0PauseTrigger: 9},
+	} {
+		db, err := Open(storage.NewMemStorage(), o)
+		if _, ok := err.(*ErrInvalidOption); !ok {
+			if err == nil {
+				db.Close()
+			}
+			t.Errorf("Open(slowdown=%d, pause=%d): want ErrInvalidOption, got %v", o.WriteL0SlowdownTrigger, o.WriteL0PauseTrigger, err)
+		}
+		db, err = Recover(storage.NewMemStorage(), o)
+		if _, ok := err.(*ErrInvalidOption); !ok {
+			if err == nil {
+				db.Close()
+			}
+			t.Errorf("Recover(slowdown=%d, pause=%d): want ErrInvalidOption, got %v", o.WriteL0SlowdownTrigger, o.WriteL0PauseTrigger, err)
+		}
+	}
+}
+
+func TestDB_VerboseNotFound(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		VerboseNotFound:              true,
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.compactMem()
+	h.put("bar", "v2")
+	h.delete("bar")
+
+	snap := h.getSnapshot()
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+
+	for _, r := range []Reader{h.db, snap, tr} {
+		for _, key := range []string{"missing", "bar"} {
+			_, err := r.Get([]byte(key), nil)
+			if !stderrors.Is(err, ErrNotFound) {
+				t.Fatalf("%T.Get(%q): want ErrNotFound, got %v", r, key, err)
+			}
+			var kerr interface{ Key() []byte }
+			if !stderrors.As(err, &kerr) || string(kerr.Key()) != key {
+				t.Fatalf("%T.Get(%q): want error carrying the key, got %v", r, key, err)
+			}
+		}
+		h.getValr(r, "foo", "v1")
+	}
+	tr.Discard()
+	snap.Release()
+
+	// The sentinel is returned by default.
+	h.o.VerboseNotFound = false
+	h.reopenDB()
+	if _, err := h.db.Get([]byte("missing"), nil); err != ErrNotFound {
+		t.Fatalf("Get: want the ErrNotFound sentinel, got %v", err)
+	}
+}
+
+func TestDB_BatchSyncPoint(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	syncs := func() int {
+		n, _ := h.stor.Counter(testutil.ModeSync, storage.TypeJournal)
+		return n
+	}
+
+	// A sync point marked on an empty batch covers no record.
+	b := new(Batch)
+	b.MarkSyncPoint()
+	b.Put([]byte("foo"), []byte("v1"))
+	n := syncs()
+	if err := h.db.Write(b, nil); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if got := syncs(); got != n {
+		t.Fatalf("journal syncs: got %d, want %d", got, n)
+	}
+
+	b.MarkSyncPoint()
+	b.Put([]byte("bar"), []byte("v2"))
+	if err := h.db.Write(b, nil); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if got := syncs(); got != n+1 {
+		t.Fatalf("journal syncs: got %d, want %d", got, n+1)
+	}
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v2")
+
+	// Ignored with NoSync.
+	h.o.NoSync = true
+	h.reopenDB()
+	n = syncs()
+	if err := h.db.Write(b, nil); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if got := syncs(); got != n {
+		t.Fatalf("journal syncs with NoSync: got %d, want %d", got, n)
+	}
+}
+
+func TestDB_OutOfSpace(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []error
+	)
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		DisableCompactionBackoff:     true,
+		OnOutOfSpace: func(err error) {
+			mu.Lock()
+			events = append(events, err)
+			mu.Unlock()
+		},
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	enospc := &os.PathError{Op: "write", Path: "table", Err: syscall.ENOSPC}
+	h.stor.EmulateError(testutil.ModeWrite, storage.TypeTable, enospc)
+	if err := h.db.CompactMemtable(); !stderrors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("CompactMemtable: want ENOSPC, got %v", err)
+	}
+	if err := h.db.Healthy(); err != ErrOutOfSpace {
+		t.Fatalf("Healthy: got %v, want ErrOutOfSpace", err)
+	}
+	if err := h.db.Put([]byte("bar"), []byte("v2"), nil); err != ErrOutOfSpace {
+		t.Fatalf("Put: got %v, want ErrOutOfSpace", err)
+	}
+	h.getVal("foo", "v1")
+
+	// The compaction resumes once space is freed.
+	h.stor.EmulateError(testutil.ModeWrite, storage.TypeTable, nil)
+	deadline := time.Now().Add(10 * time.Second)
+	for h.db.Healthy() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Healthy: still out of space")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.put("bar", "v2")
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v2")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || !stderrors.Is(events[0], syscall.ENOSPC) || events[1] != nil {
+		t.Fatalf("OnOutOfSpace: got %v, want [ENOSPC <nil>]", events)
+	}
+}
+
+func TestDB_OutOfSpaceTransaction(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	// A failed compaction can't be emulated while the transaction holds
+	// the write lock, so the DB is flagged directly.
+	atomic.StoreInt32(&h.db.outOfSpace, 1)
+	if err := tr.Put([]byte("foo"), []byte("v1"), nil); err != ErrOutOfSpace {
+		t.Errorf("Transaction.Put: got %v, want ErrOutOfSpace", err)
+	}
+	if err := tr.Delete([]byte("foo"), nil); err != ErrOutOfSpace {
+		t.Errorf("Transaction.Delete: got %v, want ErrOutOfSpace", err)
+	}
+	b := new(Batch)
+	b.Put([]byte("foo"), []byte("v1"))
+	if err := tr.Write(b, nil); err != ErrOutOfSpace {
+		t.Errorf("Transaction.Write: got %v, want ErrOutOfSpace", err)
+	}
+	atomic.StoreInt32(&h.db.outOfSpace, 0)
+	if err := tr.Write(b, nil); err != nil {
+		t.Fatal("Transaction.Write: got error: ", err)
+	}
+	if err := tr.Commit(); err != nil {
+		t.Fatal("Transaction.Commit: got error: ", err)
+	}
+	h.getVal("foo", "v1")
+}
+
+func TestDB_IteratorProgress(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		CompactionTableSize:          20 * opt.KiB,
+	})
+	defer h.close()
+
+	const n = 1000
+	value := strings.Repeat("x", 100)
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), value)
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	for _, r := range []*util.Range{nil, {Start: []byte(numKey(200)), Limit: []byte(numKey(700))}} {
+		iter := h.db.NewIterator(r, nil)
+		p := iter.(iterator.ProgressReporter)
+		if got := p.Progress(); got != 0 {
+			t.Errorf("%v: Progress before the first key: got %v, want 0", r, got)
+		}
+		var count int
+		var first, last float64
+		for iter.Next() {
+			got := p.Progress()
+			if got < 0 || got > 1 {
+				t.Fatalf("%v: Progress at %q: got %v", r, iter.Key(), got)
+			}
+			if count == 0 {
+				first = got
+			}
+			last = got
+			count++
+		}
+		if first > 0.05 {
+			t.Errorf("%v: Progress at the first key: got %v, want about 0", r, first)
+		}
+		if last < 0.95 {
+			t.Errorf("%v: Progress at the last key: got %v, want about 1", r, last)
+		}
+		if got := p.Progress(); got != 1 {
+			t.Errorf("%v: Progress once exhausted: got %v, want 1", r, got)
+		}
+		if err := iter.Error(); err != nil {
+			t.Errorf("%v: iterator: got error: %v", r, err)
+		}
+		iter.Release()
+	}
+}
+
+func TestDB_IteratorReleaseTwice(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v2")
+	h.compactMem()
+	h.put("baz", "v3")
+
+	iter := h.db.NewIterator(nil, nil)
+	if !iter.First() {
+		t.Fatal("expected a key")
+	}
+	iter.Release()
+	iter.Release()
+	if n := atomic.LoadInt32(&h.db.aliveIters); n != 0 {
+		t.Fatalf("alive iterators after double release: got %d, want 0", n)
+	}
+
+	for x := 0; x < 10; x++ {
+		iter := h.db.NewIterator(nil, nil)
+		iter.Last()
+		var wg sync.WaitGroup
+		for y := 0; y < 2; y++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				iter.Release()
+			}()
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&h.db.aliveIters); n != 0 {
+			t.Fatalf("alive iterators after concurrent release: got %d, want 0", n)
+		}
+	}
+}
+
+func TestDB_DontFillCache(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockCacheCapacity:           1 * opt.MiB,
+		BlockSize:                    256,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	for i := 0; i < 500; i++ {
+		h.put(fmt.Sprintf("key%04d", i), strings.Repeat("v", 100))
+	}
+	h.compactMem()
+	h.reopenDB()
+
+	cacheSize := func() int {
+		return h.db.s.tops.bcache.Size()
+	}
+	before := cacheSize()
+
+	ro := &opt.ReadOptions{DontFillCache: true}
+	iter := h.db.NewIterator(nil, ro)
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	iter.Release()
+	if n != 500 {
+		t.Fatalf("scan: got %d keys, want 500", n)
+	}
+	for i := 0; i < 500; i += 50 {
+		if _, err := h.db.Get([]byte(fmt.Sprintf("key%04d", i)), ro); err != nil {
+			t.Fatal("Get: got error: ", err)
+		}
+	}
+	if got := cacheSize(); got != before {
+		t.Fatalf("block cache size after DontFillCache reads: got %d, want %d", got, before)
+	}
+
+	iter = h.db.NewIterator(nil, nil)
+	for iter.Next() {
+	}
+	iter.Release()
+	if got := cacheSize(); got <= before {
+		t.Fatalf("block cache size after normal scan: got %d, want > %d", got, before)
+	}
+}
+
+func TestDB_PreallocateTableFiles(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestPreallocate-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	o := &opt.Options{PreallocateTableFiles: true}
+	db, err := OpenFile(dbpath, o)
+	if err != nil {
+		t.Fatal("cannot open db: ", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i)), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	// The tables must not be padded past their content.
+	tables, err := filepath.Glob(filepath.Join(dbpath, "*.ldb"))
+	if err != nil {
+		t.Fatal("Glob: got error: ", err)
+	}
+	if len(tables) == 0 {
+		t.Fatal("no table created")
+	}
+	for _, name := range tables {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal("Stat: got error: ", err)
+		}
+		if fi.Size() >= int64(opt.DefaultCompactionTableSize) {
+			t.Errorf("%s: got size %d, want less than %d", name, fi.Size(), opt.DefaultCompactionTableSize)
+		}
+	}
+
+	db, err = OpenFile(dbpath, o)
+	if err != nil {
+		t.Fatal("cannot reopen db: ", err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key%04d", i)), nil)
+		if err != nil {
+			t.Fatalf("Get(key%04d): got error: %v", i, err)
+		}
+		if want := fmt.Sprintf("value%04d", i); string(v) != want {
+			t.Fatalf("Get(key%04d): got %q, want %q", i, v, want)
+		}
+	}
+}
+
+func TestDB_JSONLog(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestJSONLog-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	stor, err := storage.OpenFileWithOptions(dbpath, false, &storage.FileOptions{LogFormat: storage.LogJSON})
+	if err != nil {
+		t.Fatal("cannot open storage: ", err)
+	}
+	db, err := Open(stor, nil)
+	if err != nil {
+		stor.Close()
+		t.Fatal("cannot open db: ", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value"), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	stor.Close()
+
+	b, err := os.ReadFile(filepath.Join(dbpath, "LOG"))
+	if err != nil {
+		t.Fatal("cannot read LOG: ", err)
+	}
+	var n int
+	msgs := make(map[string]map[string]interface{})
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		var e struct {
+			Ts     string                 `json:"ts"`
+			Msg    string                 `json:"msg"`
+			Fields map[string]interface{} `json:"fields"`
+		}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, e.Ts); err != nil {
+			t.Errorf("invalid timestamp in line %q: %v", line, err)
+		}
+		if e.Msg == "" || e.Fields == nil {
+			t.Errorf("missing msg or fields in line %q", line)
+		}
+		msgs[e.Msg] = e.Fields
+		n++
+	}
+	if n == 0 {
+		t.Fatal("LOG is empty")
+	}
+	for _, msg := range []string{"db@open done", "memdb@flush committed", "db@close done"} {
+		fields, ok := msgs[msg]
+		if !ok {
+			t.Errorf("event %q not logged", msg)
+		} else if _, ok := fields["T"]; !ok {
+			t.Errorf("event %q: missing field T, got %v", msg, fields)
+		}
+	}
+}
+
+func TestDB_GetWithMeta(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Filter:                       filter.NewBloomFilter(10),
+	})
+	defer h.close()
+	h.db.memdbMaxLevel = 0
+
+	h.put("a", "v1")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.put("b", "v2")
+	h.compactMem()
+	h.put("c", "v3")
+	h.tablesPerLevel("1,1")
+
+	v := h.db.s.version()
+	l0, l1 := v.levels[0][0].fd.Num, v.levels[1][0].fd.Num
+	v.release()
+
+	tests := []struct {
+		key, value string
+		want       ReadMeta
+	}{
+		{"c", "v3", ReadMeta{Source: ReadSourceMemTable}},
+		{"b", "v2", ReadMeta{Source: ReadSourceTable, Level: 0, FileNum: l0, TablesSearched: 1, FilterChecked: true}},
+		{"a", "v1", ReadMeta{Source: ReadSourceTable, Level: 1, FileNum: l1, TablesSearched: 1, FilterChecked: true}},
+	}
+	for _, tt := range tests {
+		value, meta, err := h.db.GetWithMeta([]byte(tt.key), nil)
+		if err != nil {
+			t.Fatalf("GetWithMeta %q: got error: %v", tt.key, err)
+		}
+		if string(value) != tt.value {
+			t.Errorf("GetWithMeta %q: got value %q, want %q", tt.key, value, tt.value)
+		}
+		if meta != tt.want {
+			t.Errorf("GetWithMeta %q: got meta %+v, want %+v", tt.key, meta, tt.want)
+		}
+	}
+
+	if _, meta, err := h.db.GetWithMeta([]byte("d"), nil); err != ErrNotFound {
+		t.Errorf("GetWithMeta missing key: got error %v, want ErrNotFound", err)
+	} else if meta.Source != ReadSourceNone {
+		t.Errorf("GetWithMeta missing key: got source %v, want none", meta.Source)
+	}
+
+	// A deletion is reported where it was found.
+	h.delete("b")
+	if _, meta, err := h.db.GetWithMeta([]byte("b"), nil); err != ErrNotFound {
+		t.Errorf("GetWithMeta deleted key: got error %v, want ErrNotFound", err)
+	} else if meta.Source != ReadSourceMemTable {
+		t.Errorf("GetWithMeta deleted key: got source %v, want memtable", meta.Source)
+	}
+}
+
+type countingBufferPool struct {
+	*util.BufferPool
+	get, put int
+}
+
+func (p *countingBufferPool) Get(n int) []byte {
+	p.get++
+	return p.BufferPool.Get(n)
+}
+
+func (p *countingBufferPool) Put(b []byte) {
+	p.put++
+	p.BufferPool.Put(b)
+}
+
+func TestDB_GetBufferPool(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockCacheCapacity:           1 * opt.MiB,
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.compactMem()
+	h.put("bar", "v2")
+
+	pool := &countingBufferPool{BufferPool: util.NewBufferPool(64)}
+	defer pool.Close()
+	ro := &opt.ReadOptions{BufferPool: pool}
+	for i := 0; i < 3; i++ {
+		for _, kv := range [][2]string{{"foo", "v1"}, {"bar", "v2"}} {
+			value, err := h.db.Get([]byte(kv[0]), ro)
+			if err != nil {
+				t.Fatalf("Get %q: got error: %v", kv[0], err)
+			}
+			if string(value) != kv[1] {
+				t.Fatalf("Get %q: got %q, want %q", kv[0], value, kv[1])
+			}
+			// Recycling the value must not affect the DB, e.g. the
+			// cached block.
+			for j := range value {
+				value[j] = 'x'
+			}
+			pool.Put(value)
+		}
+	}
+	if pool.get != 6 {
+		t.Errorf("BufferPool.Get: got %d calls, want 6", pool.get)
+	}
+
+	if _, err := h.db.Get([]byte("baz"), ro); err != ErrNotFound {
+		t.Errorf("Get missing key: got error %v, want ErrNotFound", err)
+	}
+	if pool.get != 6 {
+		t.Errorf("BufferPool.Get: got %d calls for missing key, want 6", pool.get)
+	}
+}
+
+func TestDB_MaxCompactionBytes(t *testing.T) {
+	const maxBytes = 24 * opt.KiB
+	w := &syncBuffer{}
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		CompactionTableSize:          4 * opt.KiB,
+		CompactionSourceLimitFactor:  1000,
+		MaxCompactionBytes:           maxBytes,
+		CompactionStatsWriter:        w,
+	})
+	defer h.close()
+	h.db.memdbMaxLevel = 0
+
+	fill := func(value string) {
+		for i := 0; i < 500; i++ {
+			h.put(fmt.Sprintf("key%04d", i), strings.Repeat(value, 100))
+		}
+		h.compactMem()
+		// Level-specific compactions aren't limited.
+		h.compactRangeAt(0, "", "")
+	}
+	fill("a")
+	h.compactRangeAt(1, "", "")
+	fill("b")
+
+	v := h.db.s.version()
+	n1, n2 := len(v.levels[1]), len(v.levels[2])
+	total := v.levels[1].size() + v.levels[2].size()
+	v.release()
+	if n1 < 10 || n2 < 10 || total <= maxBytes {
+		t.Fatalf("setup: got %d L1 and %d L2 tables of %d bytes", n1, n2, total)
+	}
+
+	skip := strings.Count(w.String(), "\n")
+	h.compactRange("", "")
+	if v := h.db.s.version(); len(v.levels[1]) != 0 {
+		v.release()
+		t.Fatal("level-1 not fully compacted")
+	} else {
+		v.release()
+	}
+
+	var compactions int
+	for _, line := range strings.Split(strings.TrimSpace(w.String()), "\n")[skip:] {
+		var r CompactionRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		if r.Type != "table" || r.Level != 1 {
+			continue
+		}
+		compactions++
+		if r.ReadBytes > maxBytes {
+			t.Errorf("compaction read %d bytes, want <= %d", r.ReadBytes, maxBytes)
+		}
+	}
+	if compactions < 2 {
+		t.Errorf("got %d level-1 compactions, want more than one", compactions)
+	}
+
+	for i := 0; i < 500; i += 7 {
+		h.getVal(fmt.Sprintf("key%04d", i), strings.Repeat("b", 100))
+	}
+}
+
+func TestDB_OpenValidatesOptions(t *testing.T) {
+	stor := storage.NewMemStorage()
+	defer stor.Close()
+
+	o := &opt.Options{BlockSize: -1}
+	if db, err := Open(stor, o); err == nil {
+		db.Close()
+		t.Error("Open: want error for a negative BlockSize")
+	} else if e, ok := err.(*ErrInvalidOption); !ok || e.Name != "BlockSize" {
+		t.Errorf("Open: got error %v, want invalid BlockSize", err)
+	}
+	if db, err := Recover(stor, o); err == nil {
+		db.Close()
+		t.Error("Recover: want error for a negative BlockSize")
+	} else if _, ok := err.(*ErrInvalidOption); !ok {
+		t.Errorf("Recover: got error %v, want ErrInvalidOption", err)
+	}
+}
+
+func TestDB_TombstoneIterator(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+	h.db.memdbMaxLevel = 0
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		h.put(key, "v")
+	}
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	h.delete("a")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.delete("c")
+	h.compactMem()
+	h.delete("d")
+	h.tablesPerLevel("1,1,1")
+
+	tombstones := func(r util.Range) string {
+		iter := h.db.NewTombstoneIterator(r)
+		defer iter.Release()
+		var res []string
+		for iter.Next() {
+			res = append(res, fmt.Sprintf("%s@%d", iter.Key(), iter.Level()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("TombstoneIterator: got error: ", err)
+		}
+		return strings.Join(res, " ")
+	}
+	if got, want := tombstones(util.Range{}), "d@-1 c@0 a@1"; got != want {
+		t.Errorf("tombstones: got %q, want %q", got, want)
+	}
+	if got, want := tombstones(util.Range{Start: []byte("b"), Limit: []byte("d")}), "c@0"; got != want {
+		t.Errorf("tombstones in [b, d): got %q, want %q", got, want)
+	}
+
+	// Tombstones are dropped once compacted to the bottom.
+	h.compactMem()
+	h.compactRange("", "")
+	if got := tombstones(util.Range{}); got != "" {
+		t.Errorf("tombstones after full compaction: got %q, want none", got)
+	}
+	h.getKeyVal("(b->v)")
+}
+
+func TestDB_HashMemTable(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		MemTableFactory:              memdb.HashFactory,
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	h.put("baz", "v1")
+	snap := h.getSnapshot()
+	h.put("foo", "v2")
+	h.delete("bar")
+
+	h.getVal("foo", "v2")
+	h.get("bar", false)
+	h.getValr(snap, "foo", "v1")
+	h.getValr(snap, "bar", "v1")
+	h.getKeyVal("(baz->v1)(foo->v2)")
+	snap.Release()
+
+	h.compactMem()
+	h.put("qux", "v1")
+	h.getKeyVal("(baz->v1)(foo->v2)(qux->v1)")
+
+	h.reopenDB()
+	h.getVal("foo", "v2")
+	h.get("bar", false)
+	h.getKeyVal("(baz->v1)(foo->v2)(qux->v1)")
+}
+
+func TestDB_MemTableBloom(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		MemTableBloomBits:            10,
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	snap := h.getSnapshot()
+	h.put("foo", "v2")
+	h.delete("bar")
+
+	mem := h.db.getEffectiveMem()
+	if _, ok := mem.Table.(*memBloomTable); !ok {
+		t.Errorf("memdb: got %T, want *memBloomTable", mem.Table)
+	}
+	mem.decref()
+
+	h.getVal("foo", "v2")
+	h.get("bar", false)
+	h.get("baz", false)
+	h.getValr(snap, "foo", "v1")
+	h.getValr(snap, "bar", "v1")
+	snap.Release()
+
+	h.compactMem()
+	h.put("baz", "v1")
+	h.getVal("foo", "v2")
+	h.get("bar", false)
+	h.getVal("baz", "v1")
+
+	// The filter grows past the number of keys it was sized for.
+	b := newMemBloomTable(memdb.New(h.db.s.icmp, 0), 10)
+	const n = 5 * memBloomMinKeys
+	for i := 0; i < n; i++ {
+		if err := b.Put(makeInternalKey(nil, []byte(numKey(i)), 1, keyTypeVal), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if got := len(b.filters.Load().([]*memBloomFilter)); got < 2 {
+		t.Errorf("filters: got %d, want several", got)
+	}
+	var fp int
+	for i := 0; i < n; i++ {
+		if !b.mayContain([]byte(numKey(i))) {
+			t.Fatalf("mayContain(%s): got false for a present key", numKey(i))
+		}
+		if b.mayContain([]byte(numKey(n + i))) {
+			fp++
+		}
+	}
+	if fp > n/20 {
+		t.Errorf("false positives: got %d of %d", fp, n)
+	}
+	b.Reset()
+	if b.mayContain([]byte(numKey(0))) {
+		t.Error("mayContain after Reset: got true")
+	}
+}
+
+func TestDB_BlobFiles(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		EnableBlobFiles:              true,
+		BlobFileThreshold:            100,
+	})
+	defer h.close()
+
+	numBlobs := func() int {
+		fds, err := h.stor.List(storage.TypeBlob)
+		if err != nil {
+			t.Fatal("List: got error: ", err)
+		}
+		return len(fds)
+	}
+	large := func(c byte) string { return strings.Repeat(string(c), 100) }
+
+	h.put("a", "small")
+	h.put("b", large('b'))
+	h.put("c", large('c'))
+	h.put("d", strings.Repeat("d", 99))
+	h.compactMem()
+	if n := numBlobs(); n != 1 {
+		t.Fatalf("blob files after flush: got %d, want 1", n)
+	}
+
+	check := func() {
+		h.getVal("a", "small")
+		h.getVal("b", large('b'))
+		h.getVal("c", large('c'))
+		h.getVal("d", strings.Repeat("d", 99))
+		if ret, err := h.db.Has([]byte("b"), h.ro); err != nil || !ret {
+			t.Errorf("Has: got %v, %v; want true", ret, err)
+		}
+		want := "(a->small)(b->" + large('b') + ")(c->" + large('c') + ")(d->" + strings.Repeat("d", 99) + ")"
+		h.getKeyVal(want)
+
+		iter := h.db.NewIterator(nil, h.ro)
+		var res string
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			res = fmt.Sprintf("(%s->%s)", iter.Key(), iter.Value()) + res
+		}
+		if err := iter.Error(); err != nil {
+			t.Error("Iterator: got error: ", err)
+		}
+		iter.Release()
+		if res != want {
+			t.Errorf("Iterator backward: got=%q want=%q", res, want)
+		}
+	}
+	check()
+	h.compactRange("", "")
+	check()
+	h.reopenDB()
+	check()
+
+	// Overwrite all large values, the first blob file becomes obsolete once
+	// the table compaction drops the old entries.
+	iter := h.db.NewIterator(nil, h.ro)
+	h.put("b", large('B'))
+	h.put("c", large('C'))
+	h.compactMem()
+	h.compactRange("", "")
+	if err := h.db.GCBlobFiles(); err != nil {
+		t.Fatal("GCBlobFiles: got error: ", err)
+	}
+	// Still referred to by the iterator.
+	if n := numBlobs(); n != 2 {
+		t.Errorf("blob files with live iterator: got %d, want 2", n)
+	}
+	iter.Seek([]byte("c"))
+	if string(iter.Value()) != large('c') {
+		t.Errorf("Iterator: got value %q, want %q", iter.Value(), large('c'))
+	}
+	iter.Release()
+	if err := h.db.GCBlobFiles(); err != nil {
+		t.Fatal("GCBlobFiles: got error: ", err)
+	}
+	if n := numBlobs(); n != 1 {
+		t.Errorf("blob files after GC: got %d, want 1", n)
+	}
+	h.getVal("b", large('B'))
+	h.getVal("c", large('C'))
+	h.reopenDB()
+	h.getVal("b", large('B'))
+	h.getVal("c", large('C'))
+}
+
+// secondaryStorage fails any attempt to modify the storage.
+type secondaryStorage struct {
+	storage.Storage
+}
+
+var errSecondaryWrite = errors.New("secondary storage written")
+
+func (secondaryStorage) Lock() (storage.Locker, error) {
+	return nil, errSecondaryWrite
+}
+
+func (secondaryStorage) SetMeta(fd storage.FileDesc) error {
+	return errSecondaryWrite
+}
+
+func (secondaryStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	return nil, errSecondaryWrite
+}
+
+func (secondaryStorage) Remove(fd storage.FileDesc) error {
+	return errSecondaryWrite
+}
+
+func (secondaryStorage) Rename(oldfd, newfd storage.FileDesc) error {
+	return errSecondaryWrite
+}
+
+func TestDB_OpenSecondary(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	h.compactMem()
+	h.put("baz", "v1")
+
+	// Bypass the testing storage, which doesn't allow reading a file that
+	// is open for writing.
+	sdb, err := OpenSecondary(secondaryStorage{h.stor.Storage}, nil)
+	if err != nil {
+		t.Fatal("OpenSecondary: got error: ", err)
+	}
+	defer sdb.Close()
+	h.getValr(sdb, "foo", "v1")
+	h.getValr(sdb, "bar", "v1")
+	h.getValr(sdb, "baz", "v1")
+	if err := sdb.Put([]byte("foo"), []byte("v3"), nil); err != ErrReadOnly {
+		t.Errorf("Put on secondary: got error %v, want %v", err, ErrReadOnly)
+	}
+
+	// Primary removes the tables the secondary knows of.
+	h.put("foo", "v2")
+	h.delete("bar")
+	h.compactMem()
+	h.compactRange("", "")
+	h.put("qux", "v1")
+	h.getr(sdb, "qux", false)
+
+	if err := sdb.CatchUpWithPrimary(); err != nil {
+		t.Fatal("CatchUpWithPrimary: got error: ", err)
+	}
+	h.getValr(sdb, "foo", "v2")
+	h.getr(sdb, "bar", false)
+	h.getValr(sdb, "baz", "v1")
+	h.getValr(sdb, "qux", "v1")
+
+	// Primary reopened, with a new manifest.
+	h.reopenDB()
+	h.put("quux", "v1")
+	if err := sdb.CatchUpWithPrimary(); err != nil {
+		t.Fatal("CatchUpWithPrimary: got error: ", err)
+	}
+	h.getValr(sdb, "foo", "v2")
+	h.getValr(sdb, "quux", "v1")
+
+	if err := h.db.CatchUpWithPrimary(); err != ErrNotSecondary {
+		t.Errorf("CatchUpWithPrimary on primary: got error %v, want %v", err, ErrNotSecondary)
+	}
+}
+
+func TestDB_CatchUpWithPrimaryConcurrentReads(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("k000", "v")
+	sdb, err := OpenSecondary(secondaryStorage{h.stor.Storage}, nil)
+	if err != nil {
+		t.Fatal("OpenSecondary: got error: ", err)
+	}
+	defer sdb.Close()
+
+	// Keys below visible are caught up with, and must stay visible while
+	// the primary flushes them and the secondary catches up again.
+	var visible int32 = 1
+	stopC := make(chan struct{})
+	errC := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stopC:
+					return
+				default:
+				}
+				key := fmt.Sprintf("k%03d", rnd.Intn(int(atomic.LoadInt32(&visible))))
+				if _, err := sdb.Get([]byte(key), nil); err != nil {
+					errC <- fmt.Errorf("Get %q: %v", key, err)
+					return
+				}
+			}
+		}(int64(i))
+	}
+
+	for i := 1; i < 100; i++ {
+		h.put(fmt.Sprintf("k%03d", i), "v")
+		if err := sdb.CatchUpWithPrimary(); err != nil {
+			t.Fatal("CatchUpWithPrimary: got error: ", err)
+		}
+		atomic.StoreInt32(&visible, int32(i+1))
+		if i%10 == 0 {
+			h.compactMem()
+			if err := sdb.CatchUpWithPrimary(); err != nil {
+				t.Fatal("CatchUpWithPrimary: got error: ", err)
+			}
+		}
+	}
+	close(stopC)
+	wg.Wait()
+	close(errC)
+	for err := range errC {
+		t.Error(err)
+	}
+}
+
+func TestDB_OpenSecondaryInvalidOptions(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+	h.put("foo", "v1")
+
+	stor := secondaryStorage{h.stor.Storage}
+	o := &opt.Options{MemTableArenaBlockSize: 64 * opt.KiB, MemTableFactory: memdb.HashFactory}
+	opens := map[string]func() (*DB, error){
+		"OpenSecondary":  func() (*DB, error) { return OpenSecondary(stor, o) },
+		"OpenShared":     func() (*DB, error) { return OpenShared(stor, o) },
+		"OpenAtManifest": func() (*DB, error) { return OpenAtManifest(stor, h.db.s.manifestFd.Num, o) },
+	}
+	for name, open := range opens {
+		db, err := open()
+		if _, ok := err.(*opt.ErrInvalidOption); !ok {
+			t.Errorf("%s: got error %v, want *opt.ErrInvalidOption", name, err)
+		}
+		if db != nil {
+			db.Close()
+		}
+	}
+}
+
+func TestDB_OpenShared(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	h.compactMem()
+	h.put("zzz", "v1")
+
+	sdb, err := OpenShared(secondaryStorage{h.stor.Storage}, nil)
+	if err != nil {
+		t.Fatal("OpenShared: got error: ", err)
+	}
+	defer sdb.Close()
+	// Not flushed yet.
+	h.getr(sdb, "zzz", false)
+	if err := sdb.CatchUpWithPrimary(); err != ErrNotSecondary {
+		t.Errorf("CatchUpWithPrimary: got error %v, want %v", err, ErrNotSecondary)
+	}
+
+	// The writer removes the table the shared instance knows of, reads
+	// reload the manifest instead of failing.
+	h.put("foo", "v2")
+	h.compactMem()
+	h.compactRange("", "")
+	h.getValr(sdb, "foo", "v2")
+	h.getValr(sdb, "bar", "v1")
+	h.getValr(sdb, "zzz", "v1")
+	if ret, err := sdb.Has([]byte("bar"), nil); err != nil || !ret {
+		t.Errorf("Has: got %v %v, want true", ret, err)
+	}
+}
+
+func TestDB_OpenAtManifest(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	h.compactMem()
+	prev := h.db.s.manifestFd.Num
+
+	// Reopening rotates the manifest.
+	h.reopenDB()
+	h.put("foo", "v2")
+	h.put("baz", "v1")
+	h.compactMem()
+	cur := h.db.s.manifestFd
+	if cur.Num == prev {
+		t.Fatalf("manifest not rotated: @%d", cur.Num)
+	}
+	h.closeDB()
+
+	sdb, err := OpenAtManifest(secondaryStorage{h.stor.Storage}, prev, nil)
+	if err != nil {
+		t.Fatal("OpenAtManifest: got error: ", err)
+	}
+	h.getValr(sdb, "foo", "v1")
+	h.getValr(sdb, "bar", "v1")
+	h.getr(sdb, "baz", false)
+	if err := sdb.Put([]byte("foo"), []byte("v3"), nil); err != ErrReadOnly {
+		t.Errorf("Put: got error %v, want %v", err, ErrReadOnly)
+	}
+	if err := sdb.CatchUpWithPrimary(); err != ErrNotSecondary {
+		t.Errorf("CatchUpWithPrimary: got error %v, want %v", err, ErrNotSecondary)
+	}
+	if err := sdb.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	if _, err := OpenAtManifest(secondaryStorage{h.stor.Storage}, cur.Num+100, nil); err == nil {
+		t.Error("OpenAtManifest unknown manifest: expecting error")
+	}
+
+	// CURRENT is left untouched.
+	if fd, err := h.stor.GetMeta(); err != nil || fd != cur {
+		t.Errorf("CURRENT: got %v, %v; want %v", fd, err, cur)
+	}
+	h.openDB()
+	h.getVal("foo", "v2")
+	h.getVal("baz", "v1")
+}
+
+// writeTestJournal writes a journal file, each batch is written as a
+// journal record starting at the given sequence number.
+func writeTestJournal(stor storage.Storage, num int64, seq uint64, batches ...*Batch) (uint64, error) {
+	w, err := stor.Create(storage.FileDesc{Type: storage.TypeJournal, Num: num})
+	if err != nil {
+		return seq, err
+	}
+	defer w.Close()
+	jw := journal.NewWriter(w)
+	for _, b := range batches {
+		rw, err := jw.Next()
+		if err != nil {
+			return seq, err
+		}
+		if err := writeBatchesWithHeader(rw, []*Batch{b}, seq); err != nil {
+			return seq, err
+		}
+		seq += uint64(b.Len())
+	}
+	return seq, jw.Close()
+}
+
+func TestDB_RecoverJournalsConcurrently(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		h := newDbHarnessWopt(t, &opt.Options{
+			DisableLargeBatchTransaction: true,
+			RecoveryConcurrency:          n,
+			WriteBuffer:                  2 * opt.KiB,
+		})
+
+		h.put("foo", "v0")
+		h.closeDB()
+
+		seq := uint64(100)
+		for i := 0; i < 10; i++ {
+			var batches []*Batch
+			for j := 0; j < 20; j++ {
+				b := new(Batch)
+				b.Put([]byte("foo"), []byte(fmt.Sprintf("v%d", i+1)))
+				b.Put([]byte(fmt.Sprintf("key%02d.%02d", i, j)), bytes.Repeat([]byte{'x'}, 100))
+				batches = append(batches, b)
+			}
+			var err error
+			if seq, err = writeTestJournal(h.stor, int64(100+i), seq, batches...); err != nil {
+				t.Fatal("writeTestJournal: ", err)
+			}
+		}
+
+		h.openDB()
+		h.getVal("foo", "v10")
+		for i := 0; i < 10; i++ {
+			for j := 0; j < 20; j++ {
+				h.get(fmt.Sprintf("key%02d.%02d", i, j), true)
+			}
+		}
+		if got := atomic.LoadUint64(&h.db.seq); got != seq-1 {
+			t.Errorf("RecoveryConcurrency=%d: seq got %d, want %d", n, got, seq-1)
+		}
+		fds, err := h.stor.List(storage.TypeJournal)
+		if err != nil {
+			t.Fatal("List: ", err)
+		}
+		if len(fds) != 1 {
+			t.Errorf("RecoveryConcurrency=%d: got %d journals after recovery, want 1", n, len(fds))
+		}
+
+		h.reopenDB()
+		h.getVal("foo", "v10")
+		h.close()
+	}
+}
+
+func TestDB_RecoverJournalsReadAheadSize(t *testing.T) {
+	jr := &journalReader{
+		maxN:    4,
+		maxSize: 100,
+		sizes:   []int64{60, 60},
+		resC:    []chan *journalRecords{make(chan *journalRecords, 1), make(chan *journalRecords, 1)},
+	}
+	jr.cond.L = &jr.mu
+
+	// A journal exceeding the bound is read if no other is.
+	if !jr.acquire(200) {
+		t.Fatal("acquire: got false")
+	}
+	jr.resC[0] <- &journalRecords{}
+	jr.sizes[0] = 200
+	jr.get(0)
+
+	jr.sizes[0] = 60
+	if !jr.acquire(60) {
+		t.Fatal("acquire: got false")
+	}
+	doneC := make(chan bool, 1)
+	go func() {
+		doneC <- jr.acquire(60)
+	}()
+	select {
+	case <-doneC:
+		t.Fatal("journal read ahead beyond the size bound")
+	case <-time.After(50 * time.Millisecond):
+	}
+	jr.resC[0] <- &journalRecords{}
+	jr.get(0)
+	if !<-doneC {
+		t.Fatal("acquire after get: got false")
+	}
+
+	jr.close()
+	if jr.acquire(10) {
+		t.Error("acquire after close: got true")
+	}
+}
+
+func TestDB_SwapDB(t *testing.T) {
+	const nKey = 100
+	newDB := func(gen int) *DB {
+		db, err := Open(storage.NewMemStorage(), &opt.Options{WriteBuffer: 4 * opt.KiB})
+		if err != nil {
+			t.Fatal("Open: got error: ", err)
+		}
+		for i := 0; i < nKey; i++ {
+			if err := db.Put([]byte(numKey(i)), []byte(fmt.Sprintf("gen%03d", gen)), nil); err != nil {
+				t.Fatal("Put: got error: ", err)
+			}
+		}
+		return db
+	}
+
+	first := newDB(0)
+	s := NewSwapDB(first)
+
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+		errC = make(chan error, 4)
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				iter := s.NewIterator(nil, nil)
+				var gen string
+				n := 0
+				for iter.Next() {
+					if gen == "" {
+						gen = string(iter.Value())
+					} else if string(iter.Value()) != gen {
+						errC <- fmt.Errorf("iterator mixes datasets: got %q, want %q", iter.Value(), gen)
+						iter.Release()
+						return
+					}
+					n++
+				}
+				iter.Release()
+				if err := iter.Error(); err != nil {
+					errC <- fmt.Errorf("iterator: got error: %v", err)
+					return
+				}
+				if n != nKey {
+					errC <- fmt.Errorf("iterator: got %d keys, want %d", n, nKey)
+					return
+				}
+			}
+		}()
+	}
+
+	for gen := 1; gen <= 20; gen++ {
+		if err := s.Swap(newDB(gen)); err != nil {
+			t.Fatal("Swap: got error: ", err)
+		}
+		v, err := s.Get([]byte(numKey(gen)), nil)
+		if err != nil {
+			t.Fatal("Get: got error: ", err)
+		}
+		if want := fmt.Sprintf("gen%03d", gen); string(v) != want {
+			t.Fatalf("Get after swap #%d: got %q, want %q", gen, v, want)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errC:
+		t.Fatal(err)
+	default:
+	}
+
+	if _, err := first.Get([]byte(numKey(0)), nil); err != ErrClosed {
+		t.Errorf("Get on swapped out DB: got error %v, want ErrClosed", err)
+	}
+
+	// An unreleased iterator keeps the previous DB open.
+	iter := s.NewIterator(nil, nil)
+	swapped := make(chan error)
+	go func() {
+		swapped <- s.Swap(newDB(21))
+	}()
+	select {
+	case err := <-swapped:
+		t.Fatalf("Swap returned before the iterator was released: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ok, err := s.Has([]byte(numKey(0)), nil); err != nil || !ok {
+		t.Errorf("Has during swap: got %v, %v; want true", ok, err)
+	}
+	n := 0
+	for iter.Next() {
+		if string(iter.Value()) != "gen020" {
+			t.Fatalf("iterator: got %q, want %q", iter.Value(), "gen020")
+		}
+		n++
+	}
+	iter.Release()
+	if n != nKey {
+		t.Errorf("iterator: got %d keys, want %d", n, nKey)
+	}
+	if err := <-swapped; err != nil {
+		t.Fatal("Swap: got error: ", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	if _, err := s.Get([]byte(numKey(0)), nil); err != ErrClosed {
+		t.Errorf("Get after close: got error %v, want ErrClosed", err)
+	}
+	db := newDB(22)
+	if err := s.Swap(db); err != ErrClosed {
+		t.Errorf("Swap after close: got error %v, want ErrClosed", err)
+	}
+	db.Close()
+}
+
+func TestDB_SwapDBFile(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestSwapDB-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	var paths []string
+	for gen := 0; gen < 2; gen++ {
+		path := filepath.Join(dbpath, fmt.Sprintf("gen%d", gen))
+		db, err := OpenFile(path, nil)
+		if err != nil {
+			t.Fatal("cannot open db: ", err)
+		}
+		if err := db.Put([]byte("foo"), []byte(fmt.Sprintf("v%d", gen)), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal("Close: got error: ", err)
+		}
+		paths = append(paths, path)
+	}
+
+	o := &opt.Options{ReadOnly: true}
+	db, err := OpenFile(paths[0], o)
+	if err != nil {
+		t.Fatal("cannot open db: ", err)
+	}
+	s := NewSwapDB(db)
+	defer s.Close()
+	if v, err := s.Get([]byte("foo"), nil); err != nil || string(v) != "v0" {
+		t.Fatalf("Get: got %q, %v; want %q", v, err, "v0")
+	}
+	if err := s.SwapFile(paths[1], o); err != nil {
+		t.Fatal("SwapFile: got error: ", err)
+	}
+	if v, err := s.Get([]byte("foo"), nil); err != nil || string(v) != "v1" {
+		t.Fatalf("Get after swap: got %q, %v; want %q", v, err, "v1")
+	}
+	// The previous DB is closed, so its directory can be removed.
+	if err := os.RemoveAll(paths[0]); err != nil {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	if err := s.SwapFile(filepath.Join(dbpath, "missing"), &opt.Options{ErrorIfMissing: true}); err == nil {
+		t.Fatal("SwapFile of a missing DB: got nil error")
+	}
+	if v, err := s.Get([]byte("foo"), nil); err != nil || string(v) != "v1" {
+		t.Fatalf("Get after failed swap: got %q, %v; want %q", v, err, "v1")
+	}
+}
+
+func TestDB_TransformComparer(t *testing.T) {
+	o := &opt.Options{
+		Comparer:    comparer.NewTransformComparer(bytes.ToLower, "test.CaseInsensitive"),
+		WriteBuffer: 4 * opt.KiB,
+	}
+	h := newDbHarnessWopt(t, o)
+	defer h.close()
+
+	keys := []string{"Delta", "alpha", "Charlie", "bravo", "ALPHA", "echo", "Bravo"}
+	for _, key := range keys {
+		h.put(key, "v"+key)
+	}
+	want := []string{"ALPHA", "alpha", "Bravo", "bravo", "Charlie", "Delta", "echo"}
+	check := func() {
+		iter := h.db.NewIterator(nil, nil)
+		var got []string
+		for iter.Next() {
+			got = append(got, string(iter.Key()))
+			if v := string(iter.Value()); v != "v"+string(iter.Key()) {
+				t.Errorf("value of %q: got %q", iter.Key(), v)
+			}
+		}
+		iter.Release()
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("iteration order: got %q, want %q", got, want)
+		}
+		for _, key := range keys {
+			h.getVal(key, "v"+key)
+		}
+		h.get("ALPHa", false)
+	}
+	check()
+	h.compactMem()
+	h.compactRange("", "")
+	check()
+	h.reopenDB()
+	check()
+}
+
+func TestDB_EmptyKey(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		db := h.db
+		if err := db.Put(nil, []byte("nil"), h.wo); err != nil {
+			t.Fatal("Put(nil): got error: ", err)
+		}
+		if v, err := db.Get([]byte{}, h.ro); err != nil || string(v) != "nil" {
+			t.Fatalf("Get(empty): got %q, %v; want %q", v, err, "nil")
+		}
+		h.put("", "empty")
+		h.put("\x00", "zero")
+		h.put("a", "va")
+		if v, err := db.Get(nil, h.ro); err != nil || string(v) != "empty" {
+			t.Fatalf("Get(nil): got %q, %v; want %q", v, err, "empty")
+		}
+		if ok, err := db.Has(nil, h.ro); err != nil || !ok {
+			t.Fatalf("Has(nil): got %v, %v; want true", ok, err)
+		}
+
+		check := func(want ...string) {
+			iter := db.NewIterator(nil, h.ro)
+			defer iter.Release()
+			var got []string
+			for ok := iter.First(); ok; ok = iter.Next() {
+				if iter.Key() == nil {
+					t.Fatal("Key: got nil key")
+				}
+				got = append(got, string(iter.Key()))
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+				t.Fatalf("forward: got %q, want %q", got, want)
+			}
+			got = got[:0]
+			for ok := iter.Last(); ok; ok = iter.Prev() {
+				if iter.Key() == nil {
+					t.Fatal("Key: got nil key")
+				}
+				got = append([]string{string(iter.Key())}, got...)
+			}
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+				t.Fatalf("backward: got %q, want %q", got, want)
+			}
+			if len(want) > 0 {
+				if !iter.Seek(nil) || string(iter.Key()) != want[0] {
+					t.Fatalf("Seek(nil): got %q, want %q", iter.Key(), want[0])
+				}
+				if !iter.Seek([]byte{}) || string(iter.Key()) != want[0] {
+					t.Fatalf("Seek(empty): got %q, want %q", iter.Key(), want[0])
+				}
+			}
+		}
+		check("", "\x00", "a")
+
+		// An empty Range.Start is a bound like any other key, while an
+		// empty Range.Limit excludes every key.
+		iter := db.NewIterator(&util.Range{Start: []byte{}, Limit: []byte("a")}, h.ro)
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		iter.Release()
+		if n != 2 {
+			t.Errorf("iterator over [\"\", \"a\"): got %d keys, want 2", n)
+		}
+		iter = db.NewIterator(&util.Range{Limit: []byte{}}, h.ro)
+		if iter.First() {
+			t.Errorf("iterator over [nil, \"\"): got key %q", iter.Key())
+		}
+		iter.Release()
+
+		h.compactMem()
+		h.compactRange("", "")
+		check("", "\x00", "a")
+		h.reopenDB()
+		db = h.db
+		h.getVal("", "empty")
+		check("", "\x00", "a")
+
+		snap, err := db.GetSnapshot()
+		if err != nil {
+			t.Fatal("GetSnapshot: got error: ", err)
+		}
+		defer snap.Release()
+		h.delete("")
+		h.get("", false)
+		check("\x00", "a")
+		h.compactMem()
+		h.get("", false)
+		check("\x00", "a")
+		h.getValr(snap, "", "empty")
+
+		batch := new(Batch)
+		batch.Put([]byte{}, []byte("batch"))
+		batch.Delete([]byte("a"))
+		if err := db.Write(batch, h.wo); err != nil {
+			t.Fatal("Write: got error: ", err)
+		}
+		h.getVal("", "batch")
+		check("", "\x00")
+	})
+}
+
+func TestDB_CoalescingWriter(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	w := h.db.NewCoalescingWriter(0, 0)
+	seq := h.db.LastSequence()
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := w.Put([]byte("hot"), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	// Read-your-writes before the flush.
+	if v, err := w.Get([]byte("hot"), nil); err != nil || string(v) != fmt.Sprintf("v%d", n-1) {
+		t.Fatalf("Get: got %q, %v; want %q", v, err, fmt.Sprintf("v%d", n-1))
+	}
+	h.get("hot", false)
+	if got := h.db.LastSequence(); got != seq {
+		t.Fatalf("LastSequence before flush: got %d, want %d", got, seq)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal("Flush: got error: ", err)
+	}
+	if got := h.db.LastSequence(); got != seq+1 {
+		t.Fatalf("LastSequence after flush: got %d, want %d", got, seq+1)
+	}
+	h.getVal("hot", fmt.Sprintf("v%d", n-1))
+
+	// A buffered delete hides the key of the DB.
+	if err := w.Delete([]byte("hot")); err != nil {
+		t.Fatal("Delete: got error: ", err)
+	}
+	if _, err := w.Get([]byte("hot"), nil); err != ErrNotFound {
+		t.Fatalf("Get of a deleted key: got error %v, want ErrNotFound", err)
+	}
+	if ok, err := w.Has([]byte("hot"), nil); err != nil || ok {
+		t.Fatalf("Has of a deleted key: got %v, %v; want false", ok, err)
+	}
+	h.getVal("hot", fmt.Sprintf("v%d", n-1))
+	if err := w.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	h.get("hot", false)
+	if err := w.Put([]byte("foo"), []byte("v")); err != ErrClosed {
+		t.Fatalf("Put after close: got error %v, want ErrClosed", err)
+	}
+
+	// Flushed once the buffer is full, or on interval.
+	w = h.db.NewCoalescingWriter(0, 10)
+	for i := 0; i < 10; i++ {
+		if err := w.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v")); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	h.getVal("key9", "v")
+	w.Close()
+	w = h.db.NewCoalescingWriter(10*time.Millisecond, 0)
+	defer w.Close()
+	if err := w.Put([]byte("foo"), []byte("bar")); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if v, err := h.db.Get([]byte("foo"), nil); err == nil && string(v) == "bar" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("buffered write not flushed on interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDB_GetTo(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		h.put("foo", "v1")
+		h.put("bar", strings.Repeat("x", 1000))
+		h.compactMem()
+		h.put("baz", "v3")
+
+		buf := make([]byte, 0, 2048)
+		buf = append(buf, "prefix:"...)
+		for _, kv := range [][2]string{{"foo", "v1"}, {"baz", "v3"}, {"bar", strings.Repeat("x", 1000)}} {
+			got, err := h.db.GetTo(buf, []byte(kv[0]), h.ro)
+			if err != nil {
+				t.Fatalf("GetTo(%q): got error: %v", kv[0], err)
+			}
+			if want := "prefix:" + kv[1]; string(got) != want {
+				t.Fatalf("GetTo(%q): got %q, want %q", kv[0], got, want)
+			}
+			if &got[0] != &buf[0] {
+				t.Errorf("GetTo(%q): didn't reuse the capacity of dst", kv[0])
+			}
+		}
+
+		// Grows a too small dst.
+		small := []byte("p")
+		got, err := h.db.GetTo(small, []byte("bar"), h.ro)
+		if err != nil || string(got) != "p"+strings.Repeat("x", 1000) {
+			t.Fatalf("GetTo into small dst: got %q, %v", got, err)
+		}
+		if string(small) != "p" {
+			t.Errorf("GetTo modified dst: got %q", small)
+		}
+
+		// The result is retained across writes.
+		got, _ = h.db.GetTo(nil, []byte("baz"), h.ro)
+		h.put("baz", "v4")
+		h.compactMem()
+		if string(got) != "v3" {
+			t.Errorf("retained value: got %q, want %q", got, "v3")
+		}
+
+		got, err = h.db.GetTo(buf, []byte("missing"), h.ro)
+		if err != ErrNotFound {
+			t.Fatalf("GetTo(missing): got error %v, want ErrNotFound", err)
+		}
+		if string(got) != "prefix:" {
+			t.Errorf("GetTo(missing): got %q, want dst", got)
+		}
+	})
+}
+
+func TestDB_MaxTotalSize(t *testing.T) {
+	const quota = 64 * opt.KiB
+	h := newDbHarnessWopt(t, &opt.Options{
+		Compression:  opt.NoCompression,
+		MaxTotalSize: quota,
+		WriteBuffer:  16 * opt.KiB,
+	})
+	defer h.close()
+
+	value := bytes.Repeat([]byte{'v'}, 1000)
+	n := 0
+	for ; ; n++ {
+		err := h.db.Put([]byte(numKey(n)), value, h.wo)
+		if err == nil {
+			continue
+		}
+		e, ok := err.(*ErrQuotaExceeded)
+		if !ok {
+			t.Fatalf("Put #%d: got error %v, want ErrQuotaExceeded", n, err)
+		}
+		if e.Max != quota || e.Size <= quota {
+			t.Fatalf("Put #%d: got %+v", n, e)
+		}
+		break
+	}
+	if n == 0 || n > 2*quota/len(value) {
+		t.Fatalf("quota exceeded after %d puts", n)
+	}
+	if _, ok := h.db.Healthy().(*ErrQuotaExceeded); !ok {
+		t.Errorf("Healthy: got %v, want ErrQuotaExceeded", h.db.Healthy())
+	}
+	batch := new(Batch)
+	batch.Put([]byte("foo"), []byte("bar"))
+	if _, ok := h.db.Write(batch, h.wo).(*ErrQuotaExceeded); !ok {
+		t.Errorf("Write: want ErrQuotaExceeded")
+	}
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	if _, ok := tr.Put([]byte("foo"), []byte("bar"), h.wo).(*ErrQuotaExceeded); !ok {
+		t.Errorf("Transaction.Put: want ErrQuotaExceeded")
+	}
+	if _, ok := tr.Write(batch, h.wo).(*ErrQuotaExceeded); !ok {
+		t.Errorf("Transaction.Write: want ErrQuotaExceeded")
+	}
+	tr.Discard()
+	h.get("foo", false)
+
+	// Deletes are let through, and free the space once compacted.
+	batch.Reset()
+	batch.Delete([]byte(numKey(0)))
+	if err := h.db.Write(batch, h.wo); err != nil {
+		t.Fatal("Write of deletes: got error: ", err)
+	}
+	for i := 1; i < n; i++ {
+		h.delete(numKey(i))
+	}
+	if _, ok := h.db.Put([]byte("foo"), []byte("bar"), h.wo).(*ErrQuotaExceeded); !ok {
+		t.Errorf("Put before compaction: want ErrQuotaExceeded")
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	if err := h.db.Healthy(); err != nil {
+		t.Fatal("Healthy after compaction: got error: ", err)
+	}
+	h.put("foo", "bar")
+	h.getVal("foo", "bar")
+	h.get(numKey(0), false)
+}
+
+func TestDB_MaxTotalSizeBlobFiles(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		Compression:       opt.NoCompression,
+		EnableBlobFiles:   true,
+		BlobFileThreshold: 100,
+		MaxTotalSize:      64 * opt.KiB,
+	})
+	defer h.close()
+
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 40; i++ {
+		h.put(numKey(i), value)
+	}
+	h.compactMem()
+	if size := h.db.diskUsage(); size < 40*int64(len(value)) {
+		t.Errorf("disk usage after compaction: got %d, want blob files counted", size)
+	}
+
+	// Blob files found when opening the DB are counted too.
+	h.reopenDB()
+	if size := h.db.diskUsage(); size < 40*int64(len(value)) {
+		t.Errorf("disk usage after reopen: got %d, want blob files counted", size)
+	}
+	for i := 40; ; i++ {
+		err := h.db.Put([]byte(numKey(i)), []byte(value), h.wo)
+		if _, ok := err.(*ErrQuotaExceeded); ok {
+			if i >= 40+40 {
+				t.Errorf("quota exceeded after %d puts, want blob files counted", i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+}
+
+func TestDB_NewIteratorAtSequence(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	scan := func(seq uint64) (string, error) {
+		iter := h.db.NewIteratorAtSequence(seq, nil, h.ro)
+		defer iter.Release()
+		var kvs []string
+		for iter.Next() {
+			kvs = append(kvs, string(iter.Key())+"="+string(iter.Value()))
+		}
+		return strings.Join(kvs, ","), iter.Error()
+	}
+	expect := func(seq uint64, want string) {
+		t.Helper()
+		if got, err := scan(seq); err != nil || got != want {
+			t.Fatalf("scan at %d: got %q, %v; want %q", seq, got, err, want)
+		}
+	}
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	seq1 := h.db.LastSequence()
+	h.put("a", "v2")
+	h.delete("b")
+	h.put("c", "v2")
+	seq2 := h.db.LastSequence()
+
+	expect(seq1, "a=v1,b=v1")
+	expect(seq2, "a=v2,c=v2")
+	if _, err := scan(seq2 + 1); err == nil {
+		t.Fatal("scan after the last sequence: got nil error")
+	}
+
+	// Flushing the memdb keeps every entry.
+	h.compactMem()
+	expect(seq1, "a=v1,b=v1")
+
+	// A retained sequence survives table compactions.
+	if err := h.db.RetainSequence(seq1); err != nil {
+		t.Fatal("RetainSequence: got error: ", err)
+	}
+	h.put("a", "v3")
+	h.compactMem()
+	h.compactRange("", "")
+	expect(seq1, "a=v1,b=v1")
+	expect(seq2, "a=v2,c=v2")
+
+	// Once released, a table compaction drops the hidden entries.
+	if err := h.db.RetainSequence(0); err != nil {
+		t.Fatal("RetainSequence: got error: ", err)
+	}
+	h.put("c", "v3")
+	h.compactMem()
+	h.compactRange("", "")
+	if _, err := scan(seq1); err != ErrSequenceCompacted {
+		t.Fatalf("scan at %d after compaction: got error %v, want ErrSequenceCompacted", seq1, err)
+	}
+	if err := h.db.RetainSequence(seq1); err != ErrSequenceCompacted {
+		t.Fatalf("RetainSequence of a compacted sequence: got error %v, want ErrSequenceCompacted", err)
+	}
+	expect(h.db.LastSequence(), "a=v3,c=v3")
+}
+
+func TestDB_OpenTable(t *testing.T) {
+	stor := storage.NewMemStorage()
+	db, err := Open(stor, nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(numKey(i)), []byte("old"), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	for i := 0; i < 10; i += 2 {
+		if err := db.Put([]byte(numKey(i)), []byte(numKey(i)), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	for i := 1; i < 10; i += 4 {
+		if err := db.Delete([]byte(numKey(i)), nil); err != nil {
+			t.Fatal("Delete: got error: ", err)
+		}
+	}
+	if err := db.CompactMemtable(); err != nil {
+		t.Fatal("CompactMemtable: got error: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	fds, err := stor.List(storage.TypeTable)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	if len(fds) != 1 {
+		t.Fatalf("got %d tables, want 1", len(fds))
+	}
+	iter, closer, err := OpenTable(stor, uint64(fds[0].Num), nil)
+	if err != nil {
+		t.Fatal("OpenTable: got error: ", err)
+	}
+	defer closer()
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		switch {
+		case i%4 == 1:
+		case i%2 == 0:
+			want = append(want, numKey(i)+"="+numKey(i))
+		default:
+			want = append(want, numKey(i)+"=old")
+		}
+	}
+	var got []string
+	for iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Value()))
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal("iterator: got error: ", err)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("forward: got %v, want %v", got, want)
+	}
+
+	got = got[:0]
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		got = append([]string{string(iter.Key()) + "=" + string(iter.Value())}, got...)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("backward: got %v, want %v", got, want)
+	}
+
+	if !iter.Seek([]byte(numKey(5))) || string(iter.Key()) != numKey(6) {
+		t.Fatalf("Seek: got key %q, want %q", iter.Key(), numKey(6))
+	}
+	if !iter.Prev() || string(iter.Key()) != numKey(4) {
+		t.Fatalf("Prev: got key %q, want %q", iter.Key(), numKey(4))
+	}
+	if !iter.Next() || string(iter.Key()) != numKey(6) {
+		t.Fatalf("Next: got key %q, want %q", iter.Key(), numKey(6))
+	}
+
+	if _, _, err := OpenTable(stor, uint64(fds[0].Num)+100, nil); err == nil {
+		t.Fatal("OpenTable of a missing table: expected error")
+	}
+}
+
+type retryableErr struct{ retryable bool }
+
+func (e retryableErr) Error() string   { return fmt.Sprintf("transient error (retryable=%v)", e.retryable) }
+func (e retryableErr) Retryable() bool { return e.retryable }
+
+// flakyStorage fails the reads of table files with the given error, as
+// long as its fails counter is positive.
+type flakyStorage struct {
+	storage.Storage
+	mu    sync.Mutex
+	fails int
+	err   error
+}
+
+func (s *flakyStorage) fail(n int, err error) {
+	s.mu.Lock()
+	s.fails, s.err = n, err
+	s.mu.Unlock()
+}
+
+func (s *flakyStorage) remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fails
+}
+
+func (s *flakyStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	r, err := s.Storage.Open(fd)
+	if err != nil || fd.Type != storage.TypeTable {
+		return r, err
+	}
+	return &flakyReader{r, s}, nil
+}
+
+type flakyReader struct {
+	storage.Reader
+	s *flakyStorage
+}
+
+func (r *flakyReader) ReadAt(p []byte, off int64) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.s.fails > 0 {
+		r.s.fails--
+		return 0, r.s.err
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestDB_StorageRetry(t *testing.T) {
+	stor := &flakyStorage{Storage: storage.NewMemStorage()}
+	db, err := Open(stor, nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	if err := db.Put([]byte("foo"), []byte("bar"), nil); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	if err := db.CompactMemtable(); err != nil {
+		t.Fatal("CompactMemtable: got error: ", err)
+	}
+	db.Close()
+
+	// Each case reopens the DB, so that the table is read from the storage.
+	for _, x := range []struct {
+		attempts, fails int
+		retryable       bool
+		ok              bool
+		remaining       int
+	}{
+		{attempts: 3, fails: 2, retryable: true, ok: true, remaining: 0},
+		{attempts: 2, fails: 2, retryable: true, ok: false, remaining: 0},
+		{attempts: 3, fails: 2, retryable: false, ok: false, remaining: 1},
+		{attempts: 0, fails: 1, retryable: true, ok: false, remaining: 0},
+	} {
+		o := &opt.Options{StorageRetry: &opt.RetryPolicy{MaxAttempts: x.attempts, Backoff: time.Millisecond}}
+		db, err := Open(stor, o)
+		if err != nil {
+			t.Fatal("Open: got error: ", err)
+		}
+		stor.fail(x.fails, retryableErr{x.retryable})
+		v, err := db.Get([]byte("foo"), nil)
+		switch {
+		case x.ok && (err != nil || string(v) != "bar"):
+			t.Errorf("%+v: Get: got (%q, %v), want bar", x, v, err)
+		case !x.ok && err == nil:
+			t.Errorf("%+v: Get: expected error", x)
+		}
+		if n := stor.remaining(); n != x.remaining {
+			t.Errorf("%+v: got %d remaining failures, want %d", x, n, x.remaining)
+		}
+		stor.fail(0, nil)
+		db.Close()
+	}
+}
+
+func TestDB_ApproximateMemoryUsage(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		u, err := h.db.ApproximateMemoryUsage()
+		if err != nil {
+			t.Fatal("ApproximateMemoryUsage: got error: ", err)
+		}
+		// The key/value buffer is preallocated.
+		if u.MemTables < int64(h.db.s.o.GetWriteBuffer()) {
+			t.Fatalf("memtables usage: got %d, want at least the write buffer %d", u.MemTables, h.db.s.o.GetWriteBuffer())
+		}
+		prev := u.MemTables
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 100; j++ {
+				h.put(fmt.Sprintf("%d-%d", i, j), strings.Repeat("v", 100))
+			}
+			if u, err = h.db.ApproximateMemoryUsage(); err != nil {
+				t.Fatal("ApproximateMemoryUsage: got error: ", err)
+			}
+			if u.MemTables <= prev {
+				t.Fatalf("memtables usage: got %d, want more than %d", u.MemTables, prev)
+			}
+			if u.Total() < u.MemTables {
+				t.Fatalf("total usage %d less than memtables usage %d", u.Total(), u.MemTables)
+			}
+			prev = u.MemTables
+		}
+	})
+}
+
+func TestDB_ApproximateMemoryUsageMemTables(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		MemTableArenaBlockSize: 4 * opt.KiB,
+		MemTableBloomBits:      10,
+	})
+	defer h.close()
+
+	u, err := h.db.ApproximateMemoryUsage()
+	if err != nil {
+		t.Fatal("ApproximateMemoryUsage: got error: ", err)
+	}
+	prev := u.MemTables
+	for j := 0; j < 100; j++ {
+		h.put(numKey(j), strings.Repeat("v", 100))
+	}
+	if u, err = h.db.ApproximateMemoryUsage(); err != nil {
+		t.Fatal("ApproximateMemoryUsage: got error: ", err)
+	}
+	// Blocks are allocated as the pairs are put, the nodes take more.
+	if u.MemTables < prev+100*100 {
+		t.Errorf("memtables usage: got %d, want at least %d", u.MemTables, prev+100*100)
+	}
+
+	em := h.db.getEffectiveMem()
+	defer em.decref()
+	b, ok := em.Table.(*memBloomTable)
+	if !ok {
+		t.Fatalf("memdb: got %T, want *memBloomTable", em.Table)
+	}
+	if got, min := memTableUsage(b), memTableUsage(b.Table)+1; got < min {
+		t.Errorf("memtable usage with filter: got %d, want at least %d", got, min)
+	}
+}
+
+func TestDB_ApproximateMemoryUsageSharedCache(t *testing.T) {
+	c := cache.NewCache(cache.NewLRU(1 << 20))
+	o := &opt.Options{BlockCache: c}
+	h1 := newDbHarnessWopt(t, o)
+	defer h1.close()
+	h2 := newDbHarnessWopt(t, o)
+	defer h2.close()
+
+	for i := 0; i < 100; i++ {
+		h1.put(numKey(i), strings.Repeat("v", 100))
+	}
+	h1.compactMem()
+	for i := 0; i < 100; i++ {
+		h1.getVal(numKey(i), strings.Repeat("v", 100))
+	}
+
+	u1, err := h1.db.ApproximateMemoryUsage()
+	if err != nil {
+		t.Fatal("ApproximateMemoryUsage: got error: ", err)
+	}
+	u2, err := h2.db.ApproximateMemoryUsage()
+	if err != nil {
+		t.Fatal("ApproximateMemoryUsage: got error: ", err)
+	}
+	if u1.BlockCache == 0 || u1.BlockCache != int64(c.Size()) {
+		t.Errorf("block cache usage of the reading DB: got %d, want %d", u1.BlockCache, c.Size())
+	}
+	if u2.BlockCache != 0 {
+		t.Errorf("block cache usage of the idle DB: got %d, want 0", u2.BlockCache)
+	}
+}
+
+func TestDB_ValueMeta(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{ValueMetaSize: 4})
+	defer h.close()
+
+	h.put("foo", "v001bar")
+	h.put("baz", "v002")
+	if err := h.db.Put([]byte("short"), []byte("v0"), h.wo); err == nil {
+		t.Fatal("Put of a value shorter than the header: expected error")
+	} else if e, ok := err.(*ErrValueTooShort); !ok || e.Size != 2 || e.Min != 4 {
+		t.Fatalf("Put of a value shorter than the header: got error %v", err)
+	}
+	b := new(Batch)
+	b.Put([]byte("qux"), []byte("v003qux"))
+	b.Put([]byte("short"), nil)
+	if err := h.db.Write(b, h.wo); err == nil {
+		t.Fatal("Write of a value shorter than the header: expected error")
+	}
+	h.delete("baz")
+	h.put("baz", "v003")
+
+	check := func() {
+		t.Helper()
+		h.getVal("foo", "bar")
+		h.getVal("baz", "")
+		h.get("qux", false)
+		for key, want := range map[string][2]string{"foo": {"bar", "v001"}, "baz": {"", "v003"}} {
+			value, vmeta, err := h.db.GetValueMeta([]byte(key), h.ro)
+			if err != nil {
+				t.Fatalf("GetValueMeta(%q): got error: %v", key, err)
+			}
+			if string(value) != want[0] || string(vmeta) != want[1] {
+				t.Fatalf("GetValueMeta(%q): got (%q, %q), want (%q, %q)", key, value, vmeta, want[0], want[1])
+			}
+		}
+
+		iter := h.db.NewIterator(nil, h.ro).(ValueMetaIterator)
+		defer iter.Release()
+		var got []string
+		for iter.Next() {
+			got = append(got, fmt.Sprintf("%s=%s:%s", iter.Key(), iter.Meta(), iter.Value()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator: got error: ", err)
+		}
+		if want := "baz=v003:,foo=v001:bar"; strings.Join(got, ",") != want {
+			t.Fatalf("iterator: got %q, want %q", strings.Join(got, ","), want)
+		}
+	}
+	check()
+	h.compactMem()
+	check()
+	h.reopenDB()
+	check()
+}
+
+func TestDB_ExportImportSSTables(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for i := 0; i < 200; i++ {
+		h.put(numKey(i), "old")
+	}
+	h.compactRange("", "")
+	for i := 0; i < 200; i += 3 {
+		h.put(numKey(i), numKey(i))
+	}
+	h.compactMem()
+	for i := 1; i < 200; i += 3 {
+		h.delete(numKey(i))
+	}
+	h.put("mem", "mem")
+
+	var buf bytes.Buffer
+	if err := h.db.ExportSSTables(&buf); err != nil {
+		t.Fatal("ExportSSTables: got error: ", err)
+	}
+	// Writes after the export aren't exported.
+	h.put("after", "after")
+
+	stor := storage.NewMemStorage()
+	if err := ImportSSTables(stor, bytes.NewReader(buf.Bytes()), nil); err != nil {
+		t.Fatal("ImportSSTables: got error: ", err)
+	}
+	if err := ImportSSTables(stor, bytes.NewReader(buf.Bytes()), nil); err != os.ErrExist {
+		t.Fatalf("ImportSSTables into an existing DB: got error %v, want %v", err, os.ErrExist)
+	}
+	db, err := Open(stor, nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	defer db.Close()
+
+	dump := func(db *DB) []string {
+		iter := db.NewIterator(nil, nil)
+		defer iter.Release()
+		var kvs []string
+		for iter.Next() {
+			if string(iter.Key()) != "after" {
+				kvs = append(kvs, string(iter.Key())+"="+string(iter.Value()))
+			}
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator: got error: ", err)
+		}
+		return kvs
+	}
+	got, want := dump(db), dump(h.db)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("imported DB: got %v, want %v", got, want)
+	}
+	if _, err := db.Get([]byte("after"), nil); err != ErrNotFound {
+		t.Fatalf("Get of a key written after the export: got error %v, want %v", err, ErrNotFound)
+	}
+	if db.LastSequence() < h.db.LastSequence()-1 {
+		t.Fatalf("imported DB last sequence: got %d, want at least %d", db.LastSequence(), h.db.LastSequence()-1)
+	}
+
+	// New writes supersede the imported keys, even once compacted.
+	if err := db.Put([]byte(numKey(0)), []byte("new"), nil); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	if v, err := db.Get([]byte(numKey(0)), nil); err != nil || string(v) != "new" {
+		t.Fatalf("Get: got (%q, %v), want new", v, err)
+	}
+}
+
+func TestDB_ExportSSTablesBlobFiles(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		EnableBlobFiles:   true,
+		BlobFileThreshold: 100,
+	})
+	defer h.close()
+
+	h.put("a", "a")
+	// An obsolete blob file waiting for GC doesn't prevent export.
+	w, err := h.stor.Create(storage.FileDesc{Type: storage.TypeBlob, Num: 1000})
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Close()
+	if err := h.db.ExportSSTables(io.Discard); err != nil {
+		t.Fatal("ExportSSTables with an obsolete blob file: got error: ", err)
+	}
+
+	h.put("big", strings.Repeat("x", 1000))
+	if err := h.db.ExportSSTables(io.Discard); err != errExportBlobFiles {
+		t.Fatalf("ExportSSTables with a blob reference: got error %v, want %v", err, errExportBlobFiles)
+	}
+}
+
+func TestDB_MaxBlockSize(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockSize:                    1024,
+		MaxBlockSize:                 4096,
+	})
+	defer h.close()
+
+	big := strings.Repeat("x", 8000)
+	err := h.db.Put([]byte("big"), []byte(big), h.wo)
+	if e, ok := err.(*ErrEntryTooLarge); !ok || e.Max != 4096 {
+		t.Fatalf("Put entry over limit: got error %v, want *ErrEntryTooLarge", err)
+	}
+	b := new(Batch)
+	b.Put([]byte("a"), []byte("a"))
+	b.Put([]byte("big"), []byte(big))
+	if _, ok := h.db.Write(b, h.wo).(*ErrEntryTooLarge); !ok {
+		t.Fatal("Write batch with an entry over limit: expecting *ErrEntryTooLarge")
+	}
+	h.get("a", false)
+
+	// Entries larger than a block but under the limit are written to a
+	// block of their own.
+	mid := strings.Repeat("y", 3000)
+	h.put("k1", "v1")
+	h.put("k2", mid)
+	h.put("k3", "v3")
+	h.compactMem()
+	h.getVal("k1", "v1")
+	h.getVal("k2", mid)
+	h.getVal("k3", "v3")
+
+	// Without a limit, any entry is accepted.
+	h.o.MaxBlockSize = 0
+	h.reopenDB()
+	h.put("big", big)
+	h.compactMem()
+	h.getVal("big", big)
+	h.getVal("k2", mid)
+}
+
+func TestDB_MaxBlockSizeBlobFiles(t *testing.T) {
+	big := strings.Repeat("x", 8000)
+	for _, v := range []int{opt.FormatV1, opt.FormatV2} {
+		h := newDbHarnessWopt(t, &opt.Options{
+			DisableLargeBatchTransaction: true,
+			BlockSize:                    1024,
+			MaxBlockSize:                 4096,
+			EnableBlobFiles:              true,
+			BlobFileThreshold:            100,
+			MaxFormatVersion:             v,
+		})
+		err := h.db.Put([]byte("big"), []byte(big), h.wo)
+		if v < opt.FormatV2 {
+			// Blob files are disabled by the format version, the value
+			// stays inline.
+			if _, ok := err.(*ErrEntryTooLarge); !ok {
+				t.Errorf("format %d: got error %v, want *ErrEntryTooLarge", v, err)
+			}
+		} else if err != nil {
+			t.Errorf("format %d: got error %v, want nil", v, err)
+		} else {
+			h.compactMem()
+			h.getVal("big", big)
+		}
+		h.close()
+	}
+}
+
+func TestDB_AliveSnapshotSequences(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	if seqs := h.db.AliveSnapshotSequences(); len(seqs) != 0 {
+		t.Fatalf("no snapshot: got %v, want none", seqs)
+	}
+	h.put("a", "1")
+	s1, _ := h.db.GetSnapshot()
+	s2, _ := h.db.GetSnapshot()
+	h.put("a", "2")
+	h.put("b", "2")
+	s3, _ := h.db.GetSnapshot()
+	seq1, seq3 := h.db.LastSequence()-2, h.db.LastSequence()
+
+	check := func(want ...uint64) {
+		t.Helper()
+		got := h.db.AliveSnapshotSequences()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("AliveSnapshotSequences: got %v, want %v", got, want)
+		}
+	}
+	check(seq1, seq3)
+	s1.Release()
+	check(seq1, seq3)
+	s2.Release()
+	check(seq3)
+	s3.Release()
+	check()
+}
+
+func TestDB_RewriteAll(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 100; i++ {
+		h.put(numKey(i), value)
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	for i := 0; i < 100; i += 2 {
+		h.put(numKey(i), value+"2")
+	}
+	h.compactMem()
+
+	tableSize := func() (size int64, nums []int64) {
+		v := h.db.s.version()
+		defer v.release()
+		for _, tables := range v.levels {
+			for _, t := range tables {
+				size += t.size
+				nums = append(nums, t.fd.Num)
+			}
+		}
+		return
+	}
+	size0, _ := tableSize()
+	lastNum := h.db.s.nextFileNum()
+
+	_, nums0 := tableSize()
+	n, err := h.db.RewriteAll(context.Background(), &opt.Options{Compression: opt.SnappyCompression})
+	if err != nil {
+		t.Fatal("RewriteAll: got error: ", err)
+	}
+	if n != len(nums0) {
+		t.Errorf("RewriteAll: got %d tables rewritten, want %d", n, len(nums0))
+	}
+	size1, nums := tableSize()
+	if size1 >= size0/2 {
+		t.Errorf("table size after rewrite with compression: got %d, want less than %d", size1, size0/2)
+	}
+	for _, num := range nums {
+		if num < lastNum {
+			t.Errorf("table @%d wasn't rewritten", num)
+		}
+	}
+	check := func() {
+		for i := 0; i < 100; i++ {
+			if i%2 == 0 {
+				h.getVal(numKey(i), value+"2")
+			} else {
+				h.getVal(numKey(i), value)
+			}
+		}
+	}
+	check()
+
+	// Tables written after the rewrite use the new options too.
+	h.put("new", value)
+	h.compactMem()
+	if size2, _ := tableSize(); size2-size1 >= int64(len(value)) {
+		t.Errorf("size of a table flushed after rewrite: got %d, want less than %d", size2-size1, len(value))
+	}
+
+	h.o.Compression = opt.SnappyCompression
+	h.reopenDB()
+	check()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := h.db.RewriteAll(ctx, nil); n != 0 || err != context.Canceled {
+		t.Errorf("RewriteAll with canceled context: got %d, %v; want 0, %v", n, err, context.Canceled)
+	}
+	if _, err := h.db.RewriteAll(context.Background(), &opt.Options{Comparer: numberComparer{}}); err == nil {
+		t.Error("RewriteAll with a different comparer: expecting error")
+	} else if _, ok := err.(*ErrInvalidOption); !ok {
+		t.Errorf("RewriteAll with a different comparer: got error %v, want *ErrInvalidOption", err)
+	}
+}
+
+func TestDB_RewriteAllUnsetComparer(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{Comparer: numberComparer{}})
+	defer h.close()
+
+	for i := 0; i < 10; i++ {
+		h.put(fmt.Sprintf("[%d]", i), "v")
+	}
+	h.compactMem()
+
+	// Unset options keep the comparer of the DB.
+	for _, o := range []*opt.Options{nil, {Compression: opt.NoCompression}} {
+		if n, err := h.db.RewriteAll(context.Background(), o); err != nil || n == 0 {
+			t.Errorf("RewriteAll(%+v): got %d, %v; want tables rewritten", o, n, err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		h.getVal(fmt.Sprintf("[%d]", i), "v")
+	}
+}
+
+func TestDB_IteratorCursor(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for i := 0; i < 20; i++ {
+		h.put(numKey(i), "v1")
+	}
+	seq := h.db.LastSequence()
+	if err := h.db.RetainSequence(seq); err != nil {
+		t.Fatal("RetainSequence: got error: ", err)
+	}
+
+	iter := h.db.NewIterator(nil, nil)
+	for i := 0; i < 10; i++ {
+		if !iter.Next() {
+			t.Fatal("Next: got false, want true")
+		}
+	}
+	cursor := iter.(CursorIterator).SaveCursor()
+	iter.Release()
+	if cursor == nil {
+		t.Fatal("SaveCursor: got nil")
+	}
+
+	// Writes after the cursor was saved aren't seen by the resumed scan,
+	// even once compacted.
+	for i := 0; i < 20; i++ {
+		h.put(numKey(i), "v2")
+	}
+	h.delete(numKey(15))
+	h.compactMem()
+	h.compactRange("", "")
+
+	iter = h.db.NewIteratorFromCursor(cursor, nil)
+	if string(iter.Key()) != numKey(9) {
+		t.Errorf("resumed iterator key: got %q, want %q", iter.Key(), numKey(9))
+	}
+	n := 10
+	for ; iter.Next(); n++ {
+		if string(iter.Key()) != numKey(n) || string(iter.Value()) != "v1" {
+			t.Fatalf("resumed iterator: got %q=%q, want %q=v1", iter.Key(), iter.Value(), numKey(n))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal("resumed iterator: got error: ", err)
+	}
+	iter.Release()
+	if n != 20 {
+		t.Errorf("resumed iterator: got %d keys, want 20", n)
+	}
+
+	if err := h.db.NewIteratorFromCursor(nil, nil).Error(); err != ErrInvalidCursor {
+		t.Errorf("NewIteratorFromCursor with an invalid cursor: got error %v, want %v", err, ErrInvalidCursor)
+	}
+
+	// Once no longer retained, the sequence is compacted away.
+	if err := h.db.RetainSequence(0); err != nil {
+		t.Fatal("RetainSequence: got error: ", err)
+	}
+	h.put(numKey(0), "v3")
+	h.compactMem()
+	h.compactRange("", "")
+	if err := h.db.NewIteratorFromCursor(cursor, nil).Error(); err != ErrSequenceCompacted {
+		t.Errorf("NewIteratorFromCursor at a compacted sequence: got error %v, want %v", err, ErrSequenceCompacted)
+	}
+}
+
+func TestDB_MemTableArenaBlockSize(t *testing.T) {
+	truno(t, &opt.Options{MemTableArenaBlockSize: 4 * opt.KiB, WriteBuffer: 64 * opt.KiB}, func(h *dbHarness) {
+		big := strings.Repeat("x", 10000)
+		for i := 0; i < 100; i++ {
+			if i%10 == 0 {
+				h.put(numKey(i), big)
+			} else {
+				h.put(numKey(i), "v"+numKey(i))
+			}
+		}
+		check := func() {
+			for i := 0; i < 100; i++ {
+				if i%10 == 0 {
+					h.getVal(numKey(i), big)
+				} else {
+					h.getVal(numKey(i), "v"+numKey(i))
+				}
+			}
+		}
+		check()
+		h.reopenDB()
+		check()
+		h.compactMem()
+		check()
+	})
+}
+
+func TestDB_MemTableArenaBlockSizeUnsupported(t *testing.T) {
+	// Validate rejects the combination, newMemTable falls back to the
+	// factory's own allocation if it isn't called.
+	db := &DB{s: &session{
+		o: &cachedOptions{Options: &opt.Options{
+			MemTableArenaBlockSize: 4 * opt.KiB,
+			MemTableFactory:        memdb.HashFactory,
+		}},
+		icmp: &iComparer{comparer.DefaultComparer},
+	}}
+	m := db.newMemTable(opt.KiB)
+	if _, ok := m.(*memdb.HashDB); !ok {
+		t.Fatalf("newMemTable: got %T, want *memdb.HashDB", m)
+	}
+	ikey := makeInternalKey(nil, []byte("foo"), 1, keyTypeVal)
+	if err := m.Put(ikey, []byte("bar")); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	if v, err := m.Get(ikey); err != nil || string(v) != "bar" {
+		t.Errorf("Get: got %q, %v; want bar", v, err)
+	}
+}
+
+func TestDB_OpenTransactionTimeout(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	tr, err := h.db.OpenTransactionTimeout(time.Second)
+	if err != nil {
+		t.Fatal("OpenTransactionTimeout: got error: ", err)
+	}
+	if err := tr.Put([]byte("foo"), []byte("v1"), nil); err != nil {
+		t.Fatal("Transaction.Put: got error: ", err)
+	}
+
+	// The write lock is held by the open transaction.
+	start := time.Now()
+	if _, err := h.db.OpenTransactionTimeout(50 * time.Millisecond); err != ErrTxnLockTimeout {
+		t.Fatalf("OpenTransactionTimeout with an open transaction: got error %v, want %v", err, ErrTxnLockTimeout)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("OpenTransactionTimeout returned after %v, want at least 50ms", d)
+	}
+
+	if err := tr.Commit(); err != nil {
+		t.Fatal("Transaction.Commit: got error: ", err)
+	}
+	tr, err = h.db.OpenTransactionTimeout(time.Second)
+	if err != nil {
+		t.Fatal("OpenTransactionTimeout after commit: got error: ", err)
+	}
+	tr.Discard()
+	h.getVal("foo", "v1")
+}
+
+func TestDB_KeyRange(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	check := func(wantMin, wantMax string) {
+		t.Helper()
+		smallest, largest, err := h.db.KeyRange()
+		if err != nil {
+			t.Fatal("KeyRange: got error: ", err)
+		}
+		if wantMin == "" {
+			if smallest != nil || largest != nil {
+				t.Fatalf("KeyRange: got (%q, %q), want nil keys", smallest, largest)
+			}
+			return
+		}
+		if string(smallest) != wantMin || string(largest) != wantMax {
+			t.Fatalf("KeyRange: got (%q, %q), want (%q, %q)", smallest, largest, wantMin, wantMax)
+		}
+	}
+	check("", "")
+
+	// Memdb only.
+	h.put("k5", "v")
+	h.put("k3", "v")
+	check("k3", "k5")
+
+	// Tables on several levels, and the memdb.
+	h.compactMem()
+	h.compactRange("", "")
+	h.put("k4", "v")
+	h.put("k7", "v")
+	h.compactMem()
+	h.put("k2", "v")
+	check("k2", "k7")
+
+	// Deleted ends are skipped.
+	h.delete("k2")
+	h.delete("k7")
+	check("k3", "k5")
+	h.compactMem()
+	check("k3", "k5")
+
+	for _, key := range []string{"k3", "k4", "k5"} {
+		h.delete(key)
+	}
+	check("", "")
+}
+
+func TestDB_CompactRangeMemdb(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	memLen := func() int {
+		mem := h.db.getEffectiveMem()
+		defer mem.decref()
+		return mem.Len()
+	}
+
+	h.put("a", "va")
+	h.compactMem()
+	h.put("b", "vb")
+
+	// Skipping the memdb leaves the recent writes in it.
+	if err := h.db.CompactRangeWithOptions(util.Range{}, &opt.CompactRangeOptions{SkipMemdb: true}); err != nil {
+		t.Fatal("CompactRangeWithOptions: got error: ", err)
+	}
+	if n := memLen(); n != 1 {
+		t.Fatalf("memdb entries after CompactRange skipping the memdb: got %d, want 1", n)
+	}
+
+	// By default the memdb is flushed, and its keys are in the tables.
+	if err := h.db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	if n := memLen(); n != 0 {
+		t.Fatalf("memdb entries after CompactRange: got %d, want 0", n)
+	}
+	v := h.db.s.version()
+	for _, key := range []string{"a", "b"} {
+		ikey := makeInternalKey(nil, []byte(key), keyMaxSeq, keyTypeSeek)
+		if value, _, err := v.get(nil, ikey, nil, false, nil); err != nil || string(value) != "v"+key {
+			t.Errorf("table lookup of %q: got (%q, %v), want v%s", key, value, err, key)
+		}
+	}
+	v.release()
+}
+
+func TestDB_ReadIgnoreFilters(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Filter:                       prefixFilter{},
+		MemTableBloomBits:            10,
+	})
+	defer h.close()
+
+	ro := &opt.ReadOptions{IgnoreFilters: true}
+
+	// The table filter excludes the key although the table holds it.
+	h.put("n1", "v1")
+	h.compactMem()
+	h.get("n1", false)
+	if v, err := h.db.Get([]byte("n1"), ro); err != nil || string(v) != "v1" {
+		t.Fatalf("Get ignoring filters: got (%q, %v), want v1", v, err)
+	}
+	if ret, err := h.db.Has([]byte("n1"), ro); err != nil || !ret {
+		t.Fatalf("Has ignoring filters: got (%v, %v), want (true, nil)", ret, err)
+	}
+
+	// Bypass the memdb bloom filter when writing, so that it excludes the
+	// key although the memdb holds it.
+	mem := h.db.getEffectiveMem()
+	b, ok := mem.Table.(*memBloomTable)
+	if !ok {
+		mem.decref()
+		t.Fatalf("memdb: got %T, want *memBloomTable", mem.Table)
+	}
+	err := b.Table.Put(makeInternalKey(nil, []byte("m1"), h.db.getSeq(), keyTypeVal), []byte("v1"))
+	mem.decref()
+	if err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	h.get("m1", false)
+	if v, err := h.db.Get([]byte("m1"), ro); err != nil || string(v) != "v1" {
+		t.Fatalf("Get ignoring filters: got (%q, %v), want v1", v, err)
+	}
+}
+
+func TestDB_DeleteMulti(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "va")
+	h.put("c", "vc")
+	h.compactMem()
+	h.put("d", "vd")
+	h.put("e", "ve")
+	h.delete("e")
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+	existed, err := h.db.DeleteMulti(keys, nil)
+	if err != nil {
+		t.Fatal("DeleteMulti: got error: ", err)
+	}
+	if got, want := fmt.Sprint(existed), "[true false true true false]"; got != want {
+		t.Fatalf("DeleteMulti: got %s, want %s", got, want)
+	}
+	for _, key := range keys {
+		h.get(string(key), false)
+	}
+
+	existed, err = h.db.DeleteMulti(keys, nil)
+	if err != nil {
+		t.Fatal("DeleteMulti: got error: ", err)
+	}
+	if got, want := fmt.Sprint(existed), "[false false false false false]"; got != want {
+		t.Fatalf("DeleteMulti again: got %s, want %s", got, want)
+	}
+	if existed, err := h.db.DeleteMulti(nil, nil); err != nil || len(existed) != 0 {
+		t.Fatalf("DeleteMulti of no keys: got (%v, %v), want none", existed, err)
+	}
+}
+
+func TestDB_CompactFile(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.put("c", "v1")
+	h.compactMem()
+	h.put("x", "v1")
+	h.put("z", "v1")
+	h.compactMem()
+	h.tablesPerLevel("2")
+
+	v := h.db.s.version()
+	var num int64
+	for _, t := range v.levels[0] {
+		if string(t.imin.ukey()) == "x" {
+			num = t.fd.Num
+		}
+	}
+	v.release()
+
+	if err := h.db.CompactFile(uint64(num)); err != nil {
+		t.Fatal("CompactFile: got error: ", err)
+	}
+	h.tablesPerLevel("1,1")
+	v = h.db.s.version()
+	if level, _ := v.findTable(num); level >= 0 {
+		t.Errorf("table @%d: still on L%d after CompactFile", num, level)
+	}
+	if imin := v.levels[1][0].imin.ukey(); string(imin) != "x" {
+		t.Errorf("L1 table: got min key %q, want x", imin)
+	}
+	v.release()
+	h.getVal("a", "v1")
+	h.getVal("x", "v1")
+	h.getVal("z", "v1")
+
+	if err := h.db.CompactFile(uint64(num)); err != ErrTableNotFound {
+		t.Fatalf("CompactFile of a compacted table: got %v, want ErrTableNotFound", err)
+	}
+}
+
+func TestDB_KeepObsoleteFiles(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		KeepObsoleteJournals:         1,
+		KeepObsoleteManifests:        2,
+	})
+	defer h.close()
+
+	count := func(ft storage.FileType) int {
+		fds, err := h.stor.List(ft)
+		if err != nil {
+			t.Fatal("List: got error: ", err)
+		}
+		return len(fds)
+	}
+
+	for i := 0; i < 5; i++ {
+		h.put("foo", fmt.Sprint(i))
+		h.compactMem()
+		h.reopenDB()
+	}
+	// The current manifest, its backup and the retained ones.
+	if n := count(storage.TypeManifest); n != 4 {
+		t.Errorf("manifests: got %d, want 4", n)
+	}
+	// The current journal and the retained one.
+	if n := count(storage.TypeJournal); n != 2 {
+		t.Errorf("journals: got %d, want 2", n)
+	}
+	h.getVal("foo", "4")
+
+	h.o.KeepObsoleteJournals = 0
+	h.o.KeepObsoleteManifests = 0
+	h.reopenDB()
+	if n := count(storage.TypeManifest); n != 2 {
+		t.Errorf("manifests without retention: got %d, want 2", n)
+	}
+	if n := count(storage.TypeJournal); n != 1 {
+		t.Errorf("journals without retention: got %d, want 1", n)
+	}
+	h.getVal("foo", "4")
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"github.com/btcsuite/goleveldb/leveldb/iterator"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// TombstoneIterator iterates over the deletion markers held by a DB, see
+// DB.NewTombstoneIterator.
+//
+// The iterator is not safe for concurrent use, and must be released after
+// use, by calling Release method.
+type TombstoneIterator struct {
+	its    []iterator.Iterator
+	levels []int
+	v      *version
+
+	i     int
+	key   []byte
+	seq   uint64
+	level int
+	err   error
+}
+
+// NewTombstoneIterator returns an iterator over the deletion markers, or
+// tombstones, of the keys in the given range, which are still held by the
+// memdbs or the tables of the DB. A tombstone is only dropped once compacted
+// into the level below which no table contains its key, until then it
+// takes up space even though its key reads as missing; this helps to find
+// out why deletes don't reclaim space.
+//
+// The tombstones are yielded source by source, from the newest to the
+// oldest: the memdbs, each level-0 table and then each deeper level. The
+// keys are sorted within a source, but the same key may be yielded more
+// than once if it was deleted more than once. The iterator reads from a
+// consistent view of the DB, taken when it is created.
+//
+// A nil Range.Start is treated as a key before all keys in the DB.
+// And a nil Range.Limit is treated as a key after all keys in the DB.
+func (db *DB) NewTombstoneIterator(r util.Range) *TombstoneIterator {
+	if err := db.ok(); err != nil {
+		return &TombstoneIterator{err: err}
+	}
+
+	slice := internalSlice(&r)
+	ro := &opt.ReadOptions{DontFillCache: true}
+	i := &TombstoneIterator{}
+	em, fm, v := db.getMemsVersion()
+	for _, m := range [...]*memDB{em, fm} {
+		if m == nil {
+			continue
+		}
+		mi := m.NewIterator(slice)
+		mi.SetReleaser(&memdbReleaser{m: m})
+		i.its = append(i.its, mi)
+		i.levels = append(i.levels, -1)
+	}
+	i.v = v
+	strict := opt.GetStrict(db.s.o.Options, ro, opt.StrictReader)
+	for level, tables := range i.v.levels {
+		if level == 0 {
+			for _, t := range tables {
+				i.its = append(i.its, db.s.tops.newIterator(t, slice, ro))
+				i.levels = append(i.levels, 0)
+			}
+		} else if len(tables) != 0 {
+			i.its = append(i.its, iterator.NewIndexedIterator(tables.newIndexIterator(db.s.tops, db.s.icmp, slice, ro), strict))
+			i.levels = append(i.levels, level)
+		}
+	}
+	return i
+}
+
+// Next moves the iterator to the next tombstone. It returns false if the
+// iterator is exhausted, released, or on error.
+func (i *TombstoneIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	for ; i.i < len(i.its); i.i++ {
+		iter := i.its[i.i]
+		for iter.Next() {
+			ukey, seq, kt, kerr := parseInternalKey(iter.Key())
+			if kerr != nil {
+				i.err = kerr
+				return false
+			}
+			if kt == keyTypeDel {
+				i.key = append(i.key[:0], ukey...)
+				i.seq = seq
+				i.level = i.levels[i.i]
+				return true
+			}
+		}
+		if err := iter.Error(); err != nil {
+			i.err = err
+			return false
+		}
+	}
+	i.key = nil
+	return false
+}
+
+// Key returns the key of the current tombstone. The caller should not
+// modify its contents, which are only valid until the next call to Next.
+func (i *TombstoneIterator) Key() []byte {
+	return i.key
+}
+
+// Seq returns the sequence number of the current tombstone.
+func (i *TombstoneIterator) Seq() uint64 {
+	return i.seq
+}
+
+// Level returns the level of the table holding the current tombstone, or
+// -1 if it is held by a memdb.
+func (i *TombstoneIterator) Level() int {
+	return i.level
+}
+
+// Error returns any accumulated error.
+func (i *TombstoneIterator) Error() error {
+	return i.err
+}
+
+// Release releases the iterator and the view of the DB it holds. It is
+// safe to call Release multiple times.
+func (i *TombstoneIterator) Release() {
+	for _, iter := range i.its {
+		iter.Release()
+	}
+	i.its = nil
+	if i.v != nil {
+		i.v.release()
+		i.v = nil
+	}
+	i.key = nil
+	if i.err == nil {
+		i.err = ErrIterReleased
+	}
+}
@@ -32,7 +32,7 @@ type Transaction struct {
 }
 
 // Get gets the value for the given key. It returns ErrNotFound if the
-// DB does not contains the key.
+// DB does not contains the key, see DB.Get.
 //
 // The returned slice is its own copy, it is safe to modify the contents
 // of the returned slice.
@@ -43,7 +43,8 @@ func (tr *Transaction) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
 	if tr.closed {
 		return nil, errTransactionDone
 	}
-	return tr.db.get(tr.mem.DB, tr.tables, key, tr.seq, ro)
+	value, err := tr.db.get(tr.mem.Table, tr.tables, key, tr.seq, ro)
+	return value, tr.db.notFound(err, key)
 }
 
 // Has returns true if the DB does contains the given key.
@@ -55,7 +56,7 @@ func (tr *Transaction) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
 	if tr.closed {
 		return false, errTransactionDone
 	}
-	return tr.db.has(tr.mem.DB, tr.tables, key, tr.seq, ro)
+	return tr.db.has(tr.mem.Table, tr.tables, key, tr.seq, ro)
 }
 
 // NewIterator returns an iterator for the latest snapshot of the transaction.
@@ -87,7 +88,7 @@ func (tr *Transaction) flush() error {
 	if tr.mem.Len() != 0 {
 		tr.stats.startTimer()
 		iter := tr.mem.NewIterator(nil)
-		t, n, err := tr.db.s.tops.createFrom(iter)
+		t, n, err := tr.db.s.tops.createFrom(iter, int64(tr.mem.Size()))
 		iter.Release()
 		tr.stats.stopTimer()
 		if err != nil {
@@ -103,12 +104,15 @@ func (tr *Transaction) flush() error {
 		tr.tables = append(tr.tables, t)
 		tr.rec.addTableFile(0, t)
 		tr.stats.write += t.size
-		tr.db.logf("transaction@flush created L0@%d N·%d S·%s %q:%q", t.fd.Num, n, shortenb(int(t.size)), t.imin, t.imax)
+		tr.db.logf("transaction@flush created L0@%d N·%d S·%s %q:%q", t.fd.Num, n, shortenb(t.size), t.imin, t.imax)
 	}
 	return nil
 }
 
 func (tr *Transaction) put(kt keyType, key, value []byte) error {
+	if tr.seq >= keyMaxSeq {
+		return ErrSequenceOverflow
+	}
 	tr.ikScratch = makeInternalKey(tr.ikScratch, key, tr.seq+1, kt)
 	if tr.mem.Free() < len(tr.ikScratch)+len(value) {
 		if err := tr.flush(); err != nil {
@@ -134,6 +138,18 @@ func (tr *Transaction) Put(key, value []byte, wo *opt.WriteOptions) error {
 	if tr.closed {
 		return errTransactionDone
 	}
+	if err := tr.db.writeOk(); err != nil {
+		return err
+	}
+	if err := tr.db.checkRecSize(key, value); err != nil {
+		return err
+	}
+	if err := tr.db.checkValueMeta(len(value)); err != nil {
+		return err
+	}
+	if err := tr.db.checkQuota(); err != nil {
+		return err
+	}
 	return tr.put(keyTypeVal, key, value)
 }
 
@@ -148,6 +164,12 @@ func (tr *Transaction) Delete(key []byte, wo *opt.WriteOptions) error {
 	if tr.closed {
 		return errTransactionDone
 	}
+	if err := tr.db.writeOk(); err != nil {
+		return err
+	}
+	if err := tr.db.checkRecSize(key, nil); err != nil {
+		return err
+	}
 	return tr.put(keyTypeDel, key, nil)
 }
 
@@ -167,6 +189,17 @@ func (tr *Transaction) Write(b *Batch, wo *opt.WriteOptions) error {
 	if tr.closed {
 		return errTransactionDone
 	}
+	if err := tr.db.writeOk(); err != nil {
+		return err
+	}
+	if err := tr.db.checkBatch(b, wo); err != nil {
+		return err
+	}
+	if tr.db.s.o.GetMaxTotalSize() > 0 && b.hasValues() {
+		if err := tr.db.checkQuota(); err != nil {
+			return err
+		}
+	}
 	return b.replayInternal(func(i int, kt keyType, k, v []byte) error {
 		return tr.put(kt, k, v)
 	})
@@ -230,6 +263,7 @@ func (tr *Transaction) Commit() error {
 
 		// Update compaction stats. This is safe as long as we hold compCommitLk.
 		tr.db.compStats.addStat(0, &tr.stats)
+		tr.db.updateWriteStall()
 
 		// Trigger table auto-compaction.
 		tr.db.compTrigger(tr.db.tcompCmdC)
@@ -285,6 +319,20 @@ func (db *DB) waitCompaction() error {
 // the transaction.
 // Closing the DB will discard open transaction.
 func (db *DB) OpenTransaction() (*Transaction, error) {
+	return db.openTransaction(nil)
+}
+
+// OpenTransactionTimeout is like OpenTransaction, but gives up waiting for
+// the in-flight transaction or write after the given duration, returning
+// ErrTxnLockTimeout, so that the caller can bound its latency instead of
+// blocking indefinitely.
+func (db *DB) OpenTransactionTimeout(d time.Duration) (*Transaction, error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	return db.openTransaction(timer.C)
+}
+
+func (db *DB) openTransaction(timeoutC <-chan time.Time) (*Transaction, error) {
 	if err := db.ok(); err != nil {
 		return nil, err
 	}
@@ -296,6 +344,8 @@ func (db *DB) OpenTransaction() (*Transaction, error) {
 		return nil, err
 	case <-db.closeC:
 		return nil, ErrClosed
+	case <-timeoutC:
+		return nil, ErrTxnLockTimeout
 	}
 
 	if db.tr != nil {
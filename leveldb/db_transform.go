@@ -0,0 +1,78 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/btcsuite/goleveldb/leveldb/errors"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+)
+
+// A journal written with opt.Options.BlockTransform begins with a header
+// record: the magic, the uvarint length of the transform name, the name and
+// the encoded check value. The other records are encoded batch records.
+// The magic can't begin a batch record, as its 8th byte would make the batch
+// sequence number overflow.
+const (
+	journalTransformMagic = "leveldb.transform:"
+	journalTransformCheck = "leveldb: journal transform check"
+)
+
+// Returns the journal header record for the given transform.
+func makeJournalTransformHeader(t opt.BlockTransform) ([]byte, error) {
+	name := t.Name()
+	header := make([]byte, len(journalTransformMagic)+binary.MaxVarintLen64+len(name))
+	n := copy(header, journalTransformMagic)
+	n += binary.PutUvarint(header[n:], uint64(len(name)))
+	n += copy(header[n:], name)
+	return t.Encode(header[:n], []byte(journalTransformCheck))
+}
+
+func isJournalTransformHeader(rec []byte) bool {
+	return bytes.HasPrefix(rec, []byte(journalTransformMagic))
+}
+
+// Returns the configured transform if it is the one of the header record of
+// the given journal, otherwise ErrBlockTransform.
+func (db *DB) checkJournalTransform(fd storage.FileDesc, header []byte) (opt.BlockTransform, error) {
+	t := db.s.o.GetBlockTransform()
+	if t == nil {
+		return nil, ErrBlockTransform
+	}
+	header = header[len(journalTransformMagic):]
+	nameLen, n := binary.Uvarint(header)
+	if n <= 0 || uint64(len(header)-n) < nameLen {
+		return nil, errors.NewErrCorrupted(fd, errors.New("leveldb: bad journal transform header"))
+	}
+	header = header[n:]
+	if string(header[:nameLen]) != t.Name() {
+		return nil, ErrBlockTransform
+	}
+	if check, err := t.Decode(nil, header[nameLen:]); err != nil || string(check) != journalTransformCheck {
+		return nil, ErrBlockTransform
+	}
+	return t, nil
+}
+
+// Writes the given batches as a single record encoded with the given
+// transform.
+func writeBatchesTransformed(wr io.Writer, t opt.BlockTransform, batches []*Batch, seq uint64) error {
+	rec := encodeBatchHeader(nil, seq, batchesLen(batches))
+	for _, batch := range batches {
+		rec = append(rec, batch.data...)
+	}
+	encoded, err := t.Encode(nil, rec)
+	if err != nil {
+		return err
+	}
+	_, err = wr.Write(encoded)
+	return err
+}
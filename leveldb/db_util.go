@@ -7,6 +7,13 @@
 package leveldb
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/pprof"
+	"sort"
+	"time"
+
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/iterator"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
@@ -33,12 +40,79 @@ func (sizes Sizes) Sum() int64 {
 	return sum
 }
 
+// Profiling labels of the DB goroutines, see runtime/pprof. The DB label
+// is the storage path, if the storage implements storage.Pather.
+const (
+	labelGoroutine = "leveldb"
+	labelDB        = "leveldb.db"
+)
+
+func (db *DB) setLabels() {
+	id := fmt.Sprintf("%p", db)
+	if p, ok := db.s.stor.Storage.(storage.Pather); ok {
+		id = p.Path()
+	}
+	db.labelDB = id
+}
+
+// Runs fn in a new goroutine labeled with the given name and the DB label;
+// the goroutine inherits the labels at creation, as do the goroutines it
+// starts.
+func (db *DB) goLabeled(name string, fn func()) {
+	labels := pprof.Labels(labelGoroutine, name, labelDB, db.labelDB)
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		go fn()
+	})
+}
+
 // Logging.
 func (db *DB) log(v ...interface{})                 { db.s.log(v...) }
 func (db *DB) logf(format string, v ...interface{}) { db.s.logf(format, v...) }
+func (db *DB) logFields(fields map[string]interface{}, msg string) {
+	db.s.logFields(fields, msg)
+}
+
+// Removes a journal file once it is obsoleted by a synced manifest.
+func (db *DB) removeJournal(fd storage.FileDesc) {
+	db.s.afterManifestSync(func() {
+		db.s.removeObsolete(fd)
+	})
+}
+
+// Syncs the manifest if lazily synced, see opt.LazyManifestSync.
+func (db *DB) syncManifest() error {
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+	return db.s.syncManifest()
+}
+
+// Syncs the manifest periodically, see opt.Options.ManifestSyncInterval.
+// A failed sync is retried on the next tick; the removals stay pending
+// meanwhile.
+func (db *DB) mManifestSync() {
+	defer db.closeW.Done()
+
+	ticker := time.NewTicker(db.s.o.GetManifestSyncInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.syncManifest(); err != nil {
+				db.logf("manifest@sync error %q", err)
+			}
+		case <-db.closeC:
+			return
+		}
+	}
+}
 
 // Check and clean files.
 func (db *DB) checkAndCleanFiles() error {
+	// Files pending removal are still referred to by the synced manifest.
+	if err := db.syncManifest(); err != nil {
+		return err
+	}
+
 	v := db.s.version()
 	defer v.release()
 
@@ -60,7 +134,7 @@ func (db *DB) checkAndCleanFiles() error {
 		keep := true
 		switch fd.Type {
 		case storage.TypeManifest:
-			keep = fd.Num >= db.s.manifestFd.Num
+			keep = fd.Num >= db.s.manifestFd.Num || fd == db.s.manifestPrevFd
 		case storage.TypeJournal:
 			if !db.frozenJournalFd.Zero() {
 				keep = fd.Num >= db.frozenJournalFd.Num
@@ -73,6 +147,16 @@ func (db *DB) checkAndCleanFiles() error {
 				tmap[fd.Num] = true
 				nt++
 			}
+		case storage.TypeBlob:
+			// Obsolete blob files are removed by blob GC.
+			db.blobGCPending = true
+			if db.s.o.GetMaxTotalSize() > 0 {
+				size, err := fileSize(db.s.stor, fd)
+				if err != nil {
+					return err
+				}
+				db.s.tops.setBlobSize(fd.Num, size)
+			}
 		}
 
 		if !keep {
@@ -80,6 +164,8 @@ func (db *DB) checkAndCleanFiles() error {
 		}
 	}
 
+	rem = db.s.retainObsolete(rem)
+
 	if nt != len(tmap) {
 		var mfds []storage.FileDesc
 		for num, present := range tmap {
@@ -91,7 +177,7 @@ func (db *DB) checkAndCleanFiles() error {
 		return errors.NewErrCorrupted(storage.FileDesc{}, &errors.ErrMissingFiles{Fds: mfds})
 	}
 
-	db.logf("db@janitor F·%d G·%d", len(fds), len(rem))
+	db.logFields(map[string]interface{}{"F": len(fds), "G": len(rem)}, "db@janitor")
 	for _, fd := range rem {
 		db.logf("db@janitor removing %s-%d", fd.Type, fd.Num)
 		if err := db.s.stor.Remove(fd); err != nil {
@@ -100,3 +186,266 @@ func (db *DB) checkAndCleanFiles() error {
 	}
 	return nil
 }
+
+type purgeResult struct {
+	n    int
+	size int64
+}
+
+// Returns the size of the given file.
+func fileSize(stor storage.Storage, fd storage.FileDesc) (int64, error) {
+	r, err := stor.Open(fd)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Seek(0, io.SeekEnd)
+}
+
+// Removes files no longer referred to by the DB. This must be called by the
+// table compaction goroutine while holding the write lock, so that no file
+// is being created, see PurgeObsoleteFiles.
+func (db *DB) purgeObsoleteFiles(res *purgeResult) error {
+	if err := db.syncManifest(); err != nil {
+		return err
+	}
+
+	db.memMu.RLock()
+	journalFd := db.journalFd
+	if !db.frozenJournalFd.Zero() {
+		journalFd = db.frozenJournalFd
+	}
+	db.memMu.RUnlock()
+
+	fds, err := db.s.stor.List(storage.TypeAll)
+	if err != nil {
+		return err
+	}
+
+	// Tables referred to by live versions, including the ones pinned by
+	// snapshots and iterators.
+	tables := db.s.liveTables()
+	defer db.s.releaseLiveTables(tables)
+	tmap := make(map[int64]*tFile, len(tables))
+	for _, t := range tables {
+		tmap[t.fd.Num] = t
+	}
+
+	var rem []storage.FileDesc
+	for _, fd := range fds {
+		keep := true
+		switch fd.Type {
+		case storage.TypeManifest:
+			keep = fd.Num >= db.s.manifestFd.Num || fd == db.s.manifestPrevFd
+		case storage.TypeJournal:
+			keep = fd.Num >= journalFd.Num
+		case storage.TypeTable:
+			_, keep = tmap[fd.Num]
+		case storage.TypeTemp:
+			// Temporary files are only used while recovering.
+			keep = false
+		}
+		if !keep {
+			rem = append(rem, fd)
+		}
+	}
+	rem = db.s.retainObsolete(rem)
+	_, brem, err := db.obsoleteBlobs()
+	if err != nil {
+		return err
+	}
+	rem = append(rem, brem...)
+
+	db.logFields(map[string]interface{}{"F": len(fds), "G": len(rem)}, "db@purge")
+	for _, fd := range rem {
+		size, err := fileSize(db.s.stor, fd)
+		if err != nil {
+			if isFileMissing(err) {
+				// Already removed.
+				continue
+			}
+			return err
+		}
+		db.logf("db@purge removing %s-%d S·%s", fd.Type, fd.Num, shortenb(size))
+		switch fd.Type {
+		case storage.TypeTable:
+			// Wait until no one use the table.
+			db.s.tops.remove(&tFile{fd: fd})
+		case storage.TypeBlob:
+			db.s.tops.removeBlob(fd)
+		default:
+			if err := db.s.stor.Remove(fd); err != nil {
+				return err
+			}
+		}
+		res.n++
+		res.size += size
+	}
+	return nil
+}
+
+// Rewrites the manifest twice, so that both the current manifest and its
+// backup are snapshots of the current version, and adds the superseded
+// manifests to res. Same constraint as purgeObsoleteFiles applies.
+func (db *DB) trimManifest(res *purgeResult) error {
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+
+	for i := 0; i < 2; i++ {
+		// The backup manifest is closed, hence can be read, and is
+		// removed once the new manifest is created.
+		fd := db.s.manifestPrevFd
+		var size int64
+		if !fd.Zero() {
+			var err error
+			size, err = fileSize(db.s.stor, fd)
+			if err != nil && !isFileMissing(err) {
+				return err
+			}
+		}
+		if err := db.s.newManifest(nil, nil); err != nil {
+			return err
+		}
+		// The backup manifest is retained instead if obsolete manifests
+		// are, see opt.Options.KeepObsoleteManifests.
+		if !fd.Zero() && db.s.o.GetKeepObsoleteManifests() == 0 {
+			db.logf("db@trim removing %s-%d S·%s", fd.Type, fd.Num, shortenb(size))
+			res.n++
+			res.size += size
+		}
+	}
+	return nil
+}
+
+// PurgeObsoleteFiles scans the storage and removes the files no longer
+// referred to by the DB, and returns the number of removed files and
+// their total size. Tables referred to by the current version or pinned
+// by snapshots and iterators are kept.
+//
+// Obsolete files are normally removed automatically as soon as they are
+// released; this allows reclaiming the space of files left behind, e.g. by
+// a crash, without reopening the DB. Writes are blocked while the scan is
+// in progress.
+func (db *DB) PurgeObsoleteFiles() (n int, size int64, err error) {
+	var res purgeResult
+	if err := db.purge(&res, false); err != nil {
+		return 0, 0, err
+	}
+	return res.n, res.size, nil
+}
+
+// FreeDiskSpace gives the space no longer needed by the DB back to the OS
+// at once, and returns the total size of the removed files. It removes
+// obsolete files as PurgeObsoleteFiles does, then rewrites the manifest and
+// its backup as snapshots of the current version, dropping the history of
+// version edits accumulated since the DB was opened; the size of the
+// rewritten manifests, usually tiny, isn't subtracted.
+//
+// Table files are rewritten by compaction only, e.g. call CompactRange
+// first to drop deleted entries. Blob files are only removed as a whole,
+// see GCBlobFiles. Writes are blocked while the call is in progress.
+func (db *DB) FreeDiskSpace() (size int64, err error) {
+	var res purgeResult
+	if err := db.purge(&res, true); err != nil {
+		return 0, err
+	}
+	return res.size, nil
+}
+
+func (db *DB) purge(res *purgeResult, trim bool) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.s.o.GetReadOnly() {
+		return ErrReadOnly
+	}
+
+	// Transactions create tables before committing them, hold the write
+	// lock so none is in-flight.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	defer func() { <-db.writeLockC }()
+
+	return db.compTriggerPurge(db.tcompCmdC, res, trim)
+}
+
+// CheckConsistency verifies the invariants of the current version, and
+// returns an ErrInconsistent, wrapped with errors.ErrCorrupted, listing the
+// violations. It checks that:
+//   - the smallest and largest keys of each table are valid internal keys,
+//     and the smallest isn't greater than the largest;
+//   - the tables of each level above zero are sorted and don't overlap;
+//   - no table is referenced twice;
+//   - every table referenced exists in the storage.
+//
+// This is a diagnostic, e.g. to catch a compaction bug in tests; it doesn't
+// read the tables.
+func (db *DB) CheckConsistency() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	v := db.s.version()
+	defer v.release()
+
+	icmp := db.s.icmp
+	var problems []string
+	levels := make(map[int64]int)
+	for level, tables := range v.levels {
+		for i, t := range tables {
+			if dup, ok := levels[t.fd.Num]; ok {
+				problems = append(problems, fmt.Sprintf("table %s referenced by level %d and %d", t.fd, dup, level))
+				continue
+			}
+			levels[t.fd.Num] = level
+
+			if !validInternalKey(t.imin) || !validInternalKey(t.imax) {
+				problems = append(problems, fmt.Sprintf("level %d table %s has invalid key range [%v .. %v]", level, t.fd, t.imin, t.imax))
+				continue
+			}
+			if icmp.Compare(t.imin, t.imax) > 0 {
+				problems = append(problems, fmt.Sprintf("level %d table %s smallest key %v is greater than largest key %v", level, t.fd, t.imin, t.imax))
+			}
+			if level == 0 || i == 0 {
+				continue
+			}
+			p := tables[i-1]
+			if !validInternalKey(p.imin) || !validInternalKey(p.imax) {
+				continue
+			}
+			if icmp.Compare(p.imin, t.imin) > 0 {
+				problems = append(problems, fmt.Sprintf("level %d tables %s and %s are not sorted", level, p.fd, t.fd))
+			}
+			if icmp.uCompare(p.imax.ukey(), t.imin.ukey()) >= 0 && icmp.uCompare(t.imax.ukey(), p.imin.ukey()) >= 0 {
+				problems = append(problems, fmt.Sprintf("level %d tables %s [%v .. %v] and %s [%v .. %v] overlap", level, p.fd, p.imin, p.imax, t.fd, t.imin, t.imax))
+			}
+		}
+	}
+
+	fds, err := db.s.stor.List(storage.TypeTable)
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		delete(levels, fd.Num)
+	}
+	var missing []int64
+	for num := range levels {
+		missing = append(missing, num)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	for _, num := range missing {
+		fd := storage.FileDesc{Type: storage.TypeTable, Num: num}
+		problems = append(problems, fmt.Sprintf("level %d table %s is missing", levels[num], fd))
+	}
+
+	if len(problems) > 0 {
+		return errors.NewErrCorrupted(storage.FileDesc{}, &ErrInconsistent{Problems: problems})
+	}
+	return nil
+}
@@ -7,11 +7,17 @@
 package leveldb
 
 import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
 	"sync/atomic"
 	"time"
 
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
 	"github.com/btcsuite/goleveldb/leveldb/memdb"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/table"
 	"github.com/btcsuite/goleveldb/leveldb/util"
 )
 
@@ -20,7 +26,12 @@ func (db *DB) writeJournal(batches []*Batch, seq uint64, sync bool) error {
 	if err != nil {
 		return err
 	}
-	if err := writeBatchesWithHeader(wr, batches, seq); err != nil {
+	if t := db.s.o.GetBlockTransform(); t != nil {
+		err = writeBatchesTransformed(wr, t, batches, seq)
+	} else {
+		err = writeBatchesWithHeader(wr, batches, seq)
+	}
+	if err != nil {
 		return err
 	}
 	if err := db.journal.Flush(); err != nil {
@@ -63,6 +74,37 @@ retry:
 	return
 }
 
+// Write stall reasons, indexed by stall level.
+var writeStallReasons = [...]string{"", opt.WriteStallSlowdown, opt.WriteStallPause}
+
+// Reports the write stall transitions caused by the level-0 table count to
+// the OnWriteStall callback. It must be called after the level-0 table count
+// or the triggers are changed.
+func (db *DB) updateWriteStall() {
+	f := db.s.o.GetOnWriteStall()
+	if f == nil {
+		return
+	}
+
+	db.writeStallMu.Lock()
+	defer db.writeStallMu.Unlock()
+	var stall int
+	switch tLen := db.s.tLen(0); {
+	case tLen >= db.s.o.GetWriteL0PauseTrigger():
+		stall = 2
+	case tLen >= db.s.o.GetWriteL0SlowdownTrigger():
+		stall = 1
+	}
+	for db.writeStall < stall {
+		db.writeStall++
+		f(writeStallReasons[db.writeStall], true)
+	}
+	for db.writeStall > stall {
+		f(writeStallReasons[db.writeStall], false)
+		db.writeStall--
+	}
+}
+
 func (db *DB) flush(n int) (mdb *memDB, mdbFree int, err error) {
 	delayed := false
 	slowdownTrigger := db.s.o.GetWriteL0SlowdownTrigger()
@@ -121,7 +163,7 @@ func (db *DB) flush(n int) (mdb *memDB, mdbFree int, err error) {
 		db.writeDelay += time.Since(start)
 		db.writeDelayN++
 	} else if db.writeDelayN > 0 {
-		db.logf("db@write was delayed N·%d T·%v", db.writeDelayN, db.writeDelay)
+		db.logFields(map[string]interface{}{"N": db.writeDelayN, "T": db.writeDelay}, "db@write was delayed")
 		atomic.AddInt32(&db.cWriteDelayN, int32(db.writeDelayN))
 		atomic.AddInt64(&db.cWriteDelay, int64(db.writeDelay))
 		db.writeDelay = 0
@@ -226,6 +268,10 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 
 	// Seq number.
 	seq := db.seq + 1
+	if uint64(batchesLen(batches)) > keyMaxSeq-db.seq {
+		db.unlockWrite(overflow, merged, ErrSequenceOverflow)
+		return ErrSequenceOverflow
+	}
 
 	// Write journal.
 	if err := db.writeJournal(batches, seq, sync); err != nil {
@@ -235,7 +281,7 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 
 	// Put batches.
 	for _, batch := range batches {
-		if err := batch.putMem(seq, mdb.DB); err != nil {
+		if err := batch.putMem(seq, mdb.Table); err != nil {
 			panic(err)
 		}
 		seq += uint64(batch.Len())
@@ -258,12 +304,31 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 // batch is small enough, write will try to merge the batches. Set NoWriteMerge
 // option to true to disable write merge.
 //
+// The batch is synced if either the Sync write option is set or the batch
+// has a sync point, see Batch.MarkSyncPoint. Write returns ErrOutOfSpace,
+// as do Put and Delete, while the disk is full, see Healthy. Write returns
+// ErrQuotaExceeded, as does Put, if the batch sets a value while the
+// MaxTotalSize option is exceeded.
+//
 // It is safe to modify the contents of the arguments after Write returns but
 // not before. Write will not modify content of the batch.
 func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
-	if err := db.ok(); err != nil || batch == nil || batch.Len() == 0 {
+	if err := db.writeOk(); err != nil || batch == nil || batch.Len() == 0 {
+		return err
+	}
+	if m := db.s.o.GetMetricsHook(); m != nil {
+		defer func(start time.Time) {
+			m.ObserveWrite(time.Since(start), batch.Len())
+		}(time.Now())
+	}
+	if err := db.checkBatch(batch, wo); err != nil {
 		return err
 	}
+	if db.s.o.GetMaxTotalSize() > 0 && batch.hasValues() {
+		if err := db.checkQuota(); err != nil {
+			return err
+		}
+	}
 
 	// If the batch size is larger than write buffer, it may justified to write
 	// using transaction instead. Using transaction the batch will be written
@@ -281,7 +346,7 @@ func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
 	}
 
 	merge := !wo.GetNoWriteMerge() && !db.s.o.GetNoWriteMerge()
-	sync := wo.GetSync() && !db.s.o.GetNoSync()
+	sync := (wo.GetSync() || batch.syncPoint > 0) && !db.s.o.GetNoSync()
 
 	// Acquire write lock.
 	if merge {
@@ -317,10 +382,36 @@ func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
 	return db.writeLocked(batch, nil, merge, sync)
 }
 
+// Apply applies the given dumped batch to the DB, as returned by
+// Batch.Dump, e.g. on another node. It returns an error satisfying
+// errors.IsCorrupted, and writes nothing, if the dump is malformed. See
+// also Write.
+//
+// It is safe to modify the contents of the arguments after Apply returns but
+// not before.
+func (db *DB) Apply(dumped []byte, wo *opt.WriteOptions) error {
+	batch := new(Batch)
+	if err := batch.Load(dumped); err != nil {
+		return err
+	}
+	return db.Write(batch, wo)
+}
+
 func (db *DB) putRec(kt keyType, key, value []byte, wo *opt.WriteOptions) error {
-	if err := db.ok(); err != nil {
+	if err := db.writeOk(); err != nil {
 		return err
 	}
+	if err := db.checkRecSize(key, value); err != nil {
+		return err
+	}
+	if kt != keyTypeDel {
+		if err := db.checkValueMeta(len(value)); err != nil {
+			return err
+		}
+		if err := db.checkQuota(); err != nil {
+			return err
+		}
+	}
 
 	merge := !wo.GetNoWriteMerge() && !db.s.o.GetNoWriteMerge()
 	sync := wo.GetSync() && !db.s.o.GetNoSync()
@@ -369,9 +460,60 @@ func (db *DB) putRec(kt keyType, key, value []byte, wo *opt.WriteOptions) error
 // It is safe to modify the contents of the arguments after Put returns but not
 // before.
 func (db *DB) Put(key, value []byte, wo *opt.WriteOptions) error {
+	if m := db.s.o.GetMetricsHook(); m != nil {
+		defer func(start time.Time) {
+			m.ObservePut(time.Since(start), len(key)+len(value))
+		}(time.Now())
+	}
 	return db.putRec(keyTypeVal, key, value, wo)
 }
 
+// PutReader sets the value for the given key, reading the value of the
+// given size from r. It returns io.ErrUnexpectedEOF, and writes nothing,
+// if r holds less than size bytes; the rest of r is not read. See also
+// Put.
+//
+// The value isn't streamed: it is read whole into a write batch, growing
+// by chunks as it is read, before the write lock is taken so a slow reader
+// doesn't hold back other writes, and written to the journal from there.
+// PutReader thus needs memory for the whole value; bound it with
+// opt.Options.MaxValueSize, checked before r is read. Without blob files
+// the value is then held twice until PutReader returns: by the write batch
+// and by the memtable, which keeps it until it is flushed to a table.
+// Values larger than the write buffer skip the journal and the memtable,
+// see opt.Options.DisableLargeBatchTransaction. With
+// opt.Options.EnableBlobFiles the value is moved to a blob file once the
+// memtable is flushed.
+//
+// It is safe to modify the contents of the key after PutReader returns but
+// not before.
+func (db *DB) PutReader(key []byte, size int64, r io.Reader, wo *opt.WriteOptions) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if size < 0 || size > math.MaxInt32 {
+		return fmt.Errorf("leveldb: invalid value size: %d", size)
+	}
+	if max := db.s.o.GetMaxValueSize(); max > 0 && size > int64(max) {
+		return &ErrValueTooLarge{Size: int(size), Max: max}
+	}
+	if err := db.checkRecSize(key, nil); err != nil {
+		return err
+	}
+	if err := db.checkValueMeta(int(size)); err != nil {
+		return err
+	}
+	if err := db.checkEntrySize(len(key), int(size)); err != nil {
+		return err
+	}
+
+	batch := new(Batch)
+	if err := batch.appendRecReader(key, int(size), r); err != nil {
+		return err
+	}
+	return db.Write(batch, wo)
+}
+
 // Delete deletes the value for the given key. Delete will not returns error if
 // key doesn't exist. Write merge also applies for Delete, see Write.
 //
@@ -381,7 +523,163 @@ func (db *DB) Delete(key []byte, wo *opt.WriteOptions) error {
 	return db.putRec(keyTypeDel, key, nil, wo)
 }
 
-func isMemOverlaps(icmp *iComparer, mem *memdb.DB, min, max []byte) bool {
+// DeleteMulti deletes the given keys in a single atomic batch, and returns
+// whether each of them existed right before the deletion. Existence is read
+// while holding the write lock, as of the sequence the batch is written
+// after, so no concurrent write can slip in between. DeleteMulti isn't
+// merged with concurrent writes.
+//
+// It is safe to modify the contents of the arguments after DeleteMulti
+// returns but not before.
+func (db *DB) DeleteMulti(keys [][]byte, wo *opt.WriteOptions) (existed []bool, err error) {
+	if err := db.writeOk(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return []bool{}, nil
+	}
+	batch := new(Batch)
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+	if err := db.checkBatch(batch, wo); err != nil {
+		return nil, err
+	}
+
+	// Acquire write lock.
+	select {
+	case db.writeLockC <- struct{}{}:
+		// Write lock acquired.
+	case err := <-db.compPerErrC:
+		// Compaction error.
+		return nil, err
+	case <-db.closeC:
+		// Closed
+		return nil, ErrClosed
+	}
+
+	existed = make([]bool, len(keys))
+	se := db.acquireSnapshot()
+	for i, key := range keys {
+		existed[i], err = db.has(nil, nil, key, se.seq, nil)
+		if err != nil {
+			break
+		}
+	}
+	db.releaseSnapshot(se)
+	if err != nil {
+		db.unlockWrite(false, 0, err)
+		return nil, err
+	}
+
+	sync := wo.GetSync() && !db.s.o.GetNoSync()
+	if err := db.writeLocked(batch, nil, false, sync); err != nil {
+		return nil, err
+	}
+	return existed, nil
+}
+
+// checkRecSize checks the given key and value against MaxKeySize and
+// MaxValueSize options, and the key against the comparer, see keyChecker.
+func (db *DB) checkRecSize(key, value []byte) error {
+	if max := db.s.o.GetMaxKeySize(); max > 0 && len(key) > max {
+		return &ErrKeyTooLarge{Size: len(key), Max: max}
+	}
+	if max := db.s.o.GetMaxValueSize(); max > 0 && len(value) > max {
+		return &ErrValueTooLarge{Size: len(value), Max: max}
+	}
+	if err := db.checkEntrySize(len(key), len(value)); err != nil {
+		return err
+	}
+	if kc := db.keyChecker(); kc != nil {
+		return kc.CheckKey(key)
+	}
+	return nil
+}
+
+// checkEntrySize checks that an entry with the given key and value lengths
+// fits in a table block of MaxBlockSize.
+func (db *DB) checkEntrySize(keyLen, valueLen int) error {
+	max := db.s.o.GetMaxBlockSize()
+	if max == 0 {
+		return nil
+	}
+	if db.s.o.GetEnableBlobFiles() && db.s.formatVersion() >= opt.FormatV2 &&
+		valueLen >= db.s.o.GetBlobFileThreshold() {
+		// The value is moved to a blob file, leaving a blob pointer.
+		valueLen = 3 * binary.MaxVarintLen64
+	}
+	if n := table.EntryBlockLen(keyLen+8, valueLen); n > max {
+		return &ErrEntryTooLarge{Size: n, Max: max}
+	}
+	return nil
+}
+
+// checkValueMeta checks the size of a value being set against
+// ValueMetaSize.
+func (db *DB) checkValueMeta(size int) error {
+	if min := db.s.o.GetValueMetaSize(); size < min {
+		return &ErrValueTooShort{Size: size, Min: min}
+	}
+	return nil
+}
+
+// keyChecker returns the comparer as a comparer.KeyChecker if it
+// implements it and the StrictKeys flag is set, otherwise nil.
+func (db *DB) keyChecker() comparer.KeyChecker {
+	if !db.s.o.GetStrict(opt.StrictKeys) {
+		return nil
+	}
+	kc, _ := db.s.icmp.ucmp.(comparer.KeyChecker)
+	return kc
+}
+
+// checkBatch checks the given batch against the size options and the
+// RejectDuplicateKeys write option.
+func (db *DB) checkBatch(batch *Batch, wo *opt.WriteOptions) error {
+	if err := db.checkBatchSize(batch); err != nil {
+		return err
+	}
+	if wo.GetRejectDuplicateKeys() {
+		if key := batch.duplicateKey(); key != nil {
+			return &ErrDuplicateKey{Key: append([]byte{}, key...)}
+		}
+	}
+	return nil
+}
+
+// checkBatchSize checks every record of the given batch, so that the batch
+// is rejected as a whole rather than partially applied.
+func (db *DB) checkBatchSize(batch *Batch) error {
+	maxKey, maxValue, minValue := db.s.o.GetMaxKeySize(), db.s.o.GetMaxValueSize(), db.s.o.GetValueMetaSize()
+	maxBlock := db.s.o.GetMaxBlockSize()
+	kc := db.keyChecker()
+	if maxKey == 0 && maxValue == 0 && minValue == 0 && maxBlock == 0 && kc == nil {
+		return nil
+	}
+	for _, index := range batch.index {
+		if maxKey > 0 && index.keyLen > maxKey {
+			return &ErrKeyTooLarge{Size: index.keyLen, Max: maxKey}
+		}
+		if maxValue > 0 && index.valueLen > maxValue {
+			return &ErrValueTooLarge{Size: index.valueLen, Max: maxValue}
+		}
+		if index.keyType != keyTypeDel && index.valueLen < minValue {
+			return &ErrValueTooShort{Size: index.valueLen, Min: minValue}
+		}
+		if err := db.checkEntrySize(index.keyLen, index.valueLen); err != nil {
+			return err
+		}
+		if kc != nil {
+			if err := kc.CheckKey(index.k(batch.data)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isMemOverlaps(icmp *iComparer, mem memdb.Table, min, max []byte) bool {
 	iter := mem.NewIterator(nil)
 	defer iter.Release()
 	return (max == nil || (iter.First() && icmp.uCompare(max, internalKey(iter.Key()).ukey()) >= 0)) &&
@@ -397,10 +695,22 @@ func isMemOverlaps(icmp *iComparer, mem *memdb.DB, min, max []byte) bool {
 // A nil Range.Start is treated as a key before all keys in the DB.
 // And a nil Range.Limit is treated as a key after all keys in the DB.
 // Therefore if both is nil then it will compact entire DB.
+//
+// The 'memdb' is flushed first if it holds keys within the range, so that
+// every write done before CompactRange is called is in the tables once it
+// returns; see CompactRangeWithOptions to skip the flush.
 func (db *DB) CompactRange(r util.Range) error {
+	return db.CompactRangeWithOptions(r, nil)
+}
+
+// CompactRangeWithOptions is like CompactRange, with the given options.
+func (db *DB) CompactRangeWithOptions(r util.Range, co *opt.CompactRangeOptions) error {
 	if err := db.ok(); err != nil {
 		return err
 	}
+	if co.GetSkipMemdb() {
+		return db.compTriggerRange(db.tcompCmdC, -1, r.Start, r.Limit)
+	}
 
 	// Lock writer.
 	select {
@@ -417,7 +727,7 @@ func (db *DB) CompactRange(r util.Range) error {
 		return ErrClosed
 	}
 	defer mdb.decref()
-	if isMemOverlaps(db.s.icmp, mdb.DB, r.Start, r.Limit) {
+	if isMemOverlaps(db.s.icmp, mdb.Table, r.Start, r.Limit) {
 		// Memdb compaction.
 		if _, err := db.rotateMem(0, false); err != nil {
 			<-db.writeLockC
@@ -429,12 +739,115 @@ func (db *DB) CompactRange(r util.Range) error {
 		}
 	} else {
 		<-db.writeLockC
+		// The frozen memdb may hold keys within the range too.
+		if db.hasFrozenMem() {
+			if err := db.compTriggerWait(db.mcompCmdC); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Table compaction.
 	return db.compTriggerRange(db.tcompCmdC, -1, r.Start, r.Limit)
 }
 
+// CompactFile compacts the table numbered fileNum with the tables it
+// overlaps in the next level, merging them into that level, e.g. to
+// remediate a table reported by VerifyChecksums. The level-0 tables
+// overlapping it, and the tables sharing a user key on its boundaries, are
+// compacted along, as they can't be left behind. CompactFile returns once
+// the compaction is committed.
+//
+// It returns ErrTableNotFound if no level of the DB holds the table, and
+// an error if the table is on the last level, see opt.Options.NumLevels.
+func (db *DB) CompactFile(fileNum uint64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.s.o.GetReadOnly() {
+		return ErrReadOnly
+	}
+	v := db.s.version()
+	level, _ := v.findTable(int64(fileNum))
+	v.release()
+	if level < 0 {
+		return ErrTableNotFound
+	}
+	return db.compTriggerFile(db.tcompCmdC, int64(fileNum))
+}
+
+// HintCompactionPriority biases the table compaction toward the given key
+// range, e.g. a read-hot range: whenever a level is due for compaction, a
+// table of that level overlapping the range is picked first, instead of the
+// next table in round-robin order. Unlike CompactRange, it doesn't compact
+// anything by itself nor wait; the range just gets compacted sooner as the
+// levels fill up.
+//
+// The hint stays in effect until replaced by another call, it isn't
+// persisted. A zero Range clears the hint.
+func (db *DB) HintCompactionPriority(r util.Range) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.s.o.GetReadOnly() {
+		return ErrReadOnly
+	}
+
+	var hint *util.Range
+	if r.Start != nil || r.Limit != nil {
+		hint = &util.Range{}
+		if r.Start != nil {
+			hint.Start = append([]byte{}, r.Start...)
+		}
+		if r.Limit != nil {
+			hint.Limit = append([]byte{}, r.Limit...)
+		}
+	}
+	db.s.compHint.Store(hint)
+	return nil
+}
+
+// CompactMemtable flushes the current memtable into a new table and
+// returns once the table is committed. Unlike CompactRange, it leaves
+// the tables already in the DB untouched, although the new table may
+// still trigger the usual background table compaction.
+//
+// It does nothing if the memtable is empty.
+func (db *DB) CompactMemtable() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	// Lock writer.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+
+	mdb := db.getEffectiveMem()
+	if mdb == nil {
+		<-db.writeLockC
+		return ErrClosed
+	}
+	empty := mdb.Len() == 0
+	mdb.decref()
+	if empty {
+		<-db.writeLockC
+		return nil
+	}
+
+	// Memdb compaction.
+	if _, err := db.rotateMem(0, false); err != nil {
+		<-db.writeLockC
+		return err
+	}
+	<-db.writeLockC
+	return db.compTriggerWait(db.mcompCmdC)
+}
+
 // SetReadOnly makes DB read-only. It will stay read-only until reopened.
 func (db *DB) SetReadOnly() error {
 	if err := db.ok(); err != nil {
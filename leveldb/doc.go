@@ -25,6 +25,11 @@
 //	err = db.Delete([]byte("key"), nil)
 //	...
 //
+// An empty key is a valid key, which sorts before all other keys; a nil
+// key and an empty non-nil key are the same key. Only a nil Start or Limit
+// of a util.Range has a special meaning, the range being unbounded on that
+// side, while an empty one is a bound like any other key.
+//
 // Iterate over database content:
 //
 //	iter := db.NewIterator(nil, nil)
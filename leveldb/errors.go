@@ -7,14 +7,95 @@
 package leveldb
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 )
 
 // Common errors.
 var (
-	ErrNotFound         = errors.ErrNotFound
-	ErrReadOnly         = errors.New("leveldb: read-only mode")
-	ErrSnapshotReleased = errors.New("leveldb: snapshot released")
-	ErrIterReleased     = errors.New("leveldb: iterator released")
-	ErrClosed           = errors.New("leveldb: closed")
+	ErrNotFound          = errors.ErrNotFound
+	ErrReadOnly          = errors.New("leveldb: read-only mode")
+	ErrSnapshotReleased  = errors.New("leveldb: snapshot released")
+	ErrIterReleased      = errors.New("leveldb: iterator released")
+	ErrClosed            = errors.New("leveldb: closed")
+	ErrNotSecondary      = errors.New("leveldb: not a secondary instance")
+	ErrOutOfSpace        = errors.New("leveldb: out of space")
+	ErrSequenceCompacted = errors.New("leveldb: sequence compacted away")
+	ErrSequenceOverflow  = errors.New("leveldb: sequence number overflow")
+	ErrInvalidCursor     = errors.New("leveldb: invalid iterator cursor")
+	ErrTxnLockTimeout    = errors.New("leveldb: timed out waiting for the write lock")
+	ErrTableNotFound     = errors.New("leveldb: table not found")
+	ErrBlockCacheFull    = errors.New("leveldb: too many DBs sharing the block cache")
+	ErrBlockTransform    = errors.ErrBlockTransform
 )
+
+// ErrKeyTooLarge is returned by write operations when a key is larger than
+// the MaxKeySize option permits. The write is not applied.
+type ErrKeyTooLarge struct {
+	Size, Max int
+}
+
+func (e *ErrKeyTooLarge) Error() string {
+	return fmt.Sprintf("leveldb: key too large: %d bytes (max %d)", e.Size, e.Max)
+}
+
+// ErrValueTooLarge is returned by write operations when a value is larger
+// than the MaxValueSize option permits. The write is not applied.
+type ErrValueTooLarge struct {
+	Size, Max int
+}
+
+func (e *ErrValueTooLarge) Error() string {
+	return fmt.Sprintf("leveldb: value too large: %d bytes (max %d)", e.Size, e.Max)
+}
+
+// ErrValueTooShort is returned by write operations when a value is shorter
+// than the metadata header of the ValueMetaSize option. The write is not
+// applied.
+type ErrValueTooShort struct {
+	Size, Min int
+}
+
+func (e *ErrValueTooShort) Error() string {
+	return fmt.Sprintf("leveldb: value too short: %d bytes (min %d)", e.Size, e.Min)
+}
+
+// ErrEntryTooLarge is returned by write operations when an entry doesn't
+// fit in a table block of the MaxBlockSize option. The write is not
+// applied.
+type ErrEntryTooLarge = errors.ErrEntryTooLarge
+
+// ErrQuotaExceeded is returned by write operations setting a value while
+// the disk space used by the DB exceeds the MaxTotalSize option. The write
+// is not applied.
+type ErrQuotaExceeded struct {
+	Size, Max int64
+}
+
+func (e *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("leveldb: quota exceeded: %d bytes used (max %d)", e.Size, e.Max)
+}
+
+// ErrDuplicateKey is returned by write operations when a batch holds more
+// than one record for the same key, and the RejectDuplicateKeys write
+// option is set. The write is not applied.
+type ErrDuplicateKey struct {
+	Key []byte
+}
+
+func (e *ErrDuplicateKey) Error() string {
+	return fmt.Sprintf("leveldb: duplicate key in batch: %q", e.Key)
+}
+
+// ErrInconsistent is returned by CheckConsistency, wrapped with
+// errors.ErrCorrupted, when the current version violates the level
+// invariants. Each problem names the offending tables.
+type ErrInconsistent struct {
+	Problems []string
+}
+
+func (e *ErrInconsistent) Error() string {
+	return fmt.Sprintf("leveldb: inconsistent version: %s", strings.Join(e.Problems, "; "))
+}
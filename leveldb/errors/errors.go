@@ -20,6 +20,11 @@ var (
 	ErrNotFound    = New("leveldb: not found")
 	ErrReleased    = util.ErrReleased
 	ErrHasReleaser = util.ErrHasReleaser
+
+	// ErrBlockTransform is returned when reading data written with another
+	// block transform, or with the same one configured differently, e.g.
+	// with another encryption key; see opt.Options.BlockTransform.
+	ErrBlockTransform = New("leveldb: block transform mismatch")
 )
 
 // New returns an error that formats as the given text.
@@ -58,6 +63,38 @@ func IsCorrupted(err error) bool {
 	return false
 }
 
+// ErrKeyNotFound is ErrNotFound carrying the key that wasn't found; see
+// opt.Options.VerboseNotFound. It unwraps to ErrNotFound, thus must be
+// checked with errors.Is rather than compared.
+type ErrKeyNotFound struct {
+	key []byte
+}
+
+// NewErrKeyNotFound creates new ErrKeyNotFound error. The key is copied.
+func NewErrKeyNotFound(key []byte) error {
+	return &ErrKeyNotFound{append([]byte{}, key...)}
+}
+
+func (e *ErrKeyNotFound) Error() string {
+	return fmt.Sprintf("%v: key %q", ErrNotFound, e.key)
+}
+
+// Key returns the key that wasn't found.
+func (e *ErrKeyNotFound) Key() []byte { return e.key }
+
+func (e *ErrKeyNotFound) Unwrap() error { return ErrNotFound }
+
+// ErrEntryTooLarge is returned when an entry, i.e. a key and its value,
+// doesn't fit in a 'sorted table' block of the MaxBlockSize option. The
+// entry is not written. Size is the size of a block holding only the entry.
+type ErrEntryTooLarge struct {
+	Size, Max int
+}
+
+func (e *ErrEntryTooLarge) Error() string {
+	return fmt.Sprintf("leveldb: entry too large for a block: %d bytes (max %d)", e.Size, e.Max)
+}
+
 // ErrMissingFiles is the type that indicating a corruption due to missing
 // files. ErrMissingFiles always wrapped with ErrCorrupted.
 type ErrMissingFiles struct {
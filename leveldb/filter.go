@@ -8,6 +8,7 @@ package leveldb
 
 import (
 	"github.com/btcsuite/goleveldb/leveldb/filter"
+	"github.com/btcsuite/goleveldb/leveldb/util"
 )
 
 type iFilter struct {
@@ -29,3 +30,9 @@ type iFilterGenerator struct {
 func (g iFilterGenerator) Add(key []byte) {
 	g.FilterGenerator.Add(internalKey(key).ukey())
 }
+
+func (g iFilterGenerator) Release() {
+	if r, ok := g.FilterGenerator.(util.Releaser); ok {
+		r.Release()
+	}
+}
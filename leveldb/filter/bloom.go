@@ -7,6 +7,8 @@
 package filter
 
 import (
+	"sync"
+
 	"github.com/btcsuite/goleveldb/leveldb/util"
 )
 
@@ -59,10 +61,17 @@ func (f bloomFilter) NewGenerator() FilterGenerator {
 	} else if k > 30 {
 		k = 30
 	}
-	return &bloomFilterGenerator{
-		n: int(f),
-		k: k,
-	}
+	g := bloomGeneratorPool.Get().(*bloomFilterGenerator)
+	g.n = int(f)
+	g.k = k
+	g.released = false
+	return g
+}
+
+// Released generators are pooled, so that their key hashes buffer is
+// reused by the next table.
+var bloomGeneratorPool = sync.Pool{
+	New: func() interface{} { return new(bloomFilterGenerator) },
 }
 
 type bloomFilterGenerator struct {
@@ -70,6 +79,18 @@ type bloomFilterGenerator struct {
 	k uint8
 
 	keyHashes []uint32
+	released  bool
+}
+
+// Release resets the generator and puts it back to the pool. The
+// generator must not be used afterward.
+func (g *bloomFilterGenerator) Release() {
+	if g.released {
+		return
+	}
+	g.released = true
+	g.keyHashes = g.keyHashes[:0]
+	bloomGeneratorPool.Put(g)
 }
 
 func (g *bloomFilterGenerator) Add(key []byte) {
@@ -89,7 +110,11 @@ func (g *bloomFilterGenerator) Generate(b Buffer) {
 	nBytes := (nBits + 7) / 8
 	nBits = nBytes * 8
 
+	// The buffer may be reused, Alloc doesn't clear it.
 	dest := b.Alloc(int(nBytes) + 1)
+	for i := range dest {
+		dest[i] = 0
+	}
 	dest[nBytes] = g.k
 	for _, kh := range g.keyHashes {
 		delta := (kh >> 17) | (kh << 15) // Rotate right 17 bits
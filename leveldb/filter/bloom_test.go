@@ -7,6 +7,7 @@
 package filter
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/btcsuite/goleveldb/leveldb/util"
 	"testing"
@@ -140,3 +141,33 @@ func TestBloomFilter_VaryingLengths(t *testing.T) {
 		t.Error("mediocre false positive rate is more than expected")
 	}
 }
+
+func TestBloomFilter_Release(t *testing.T) {
+	bloom := NewBloomFilter(10)
+	build := func(g FilterGenerator, n int, b *util.Buffer) []byte {
+		for i := 0; i < n; i++ {
+			var k [4]byte
+			binary.LittleEndian.PutUint32(k[:], uint32(i))
+			g.Add(k[:])
+		}
+		g.Generate(b)
+		return append([]byte{}, b.Bytes()...)
+	}
+
+	want := build(bloom.NewGenerator(), 100, &util.Buffer{})
+	for i := 0; i < 3; i++ {
+		g := bloom.NewGenerator()
+		// Keys added but not generated are dropped on release.
+		g.Add([]byte("pending"))
+		g.(util.Releaser).Release()
+		g.(util.Releaser).Release()
+
+		g = bloom.NewGenerator()
+		// Dirty buffer, as reused by the table writer.
+		b := util.NewBuffer(bytes.Repeat([]byte{0xff}, 256)[:0])
+		if got := build(g, 100, b); string(got) != string(want) {
+			t.Fatalf("filter from reused generator differs: got %x, want %x", got, want)
+		}
+		g.(util.Releaser).Release()
+	}
+}
@@ -45,6 +45,10 @@ type Filter interface {
 }
 
 // FilterGenerator is the filter generator.
+//
+// A filter generator may also implement util.Releaser, in which case
+// Release is called once the table is written; the generator won't be
+// used afterward, which allows reusing its resources.
 type FilterGenerator interface {
 	// Add adds a key to the filter generator.
 	//
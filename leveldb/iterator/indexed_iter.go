@@ -7,6 +7,8 @@
 package iterator
 
 import (
+	"sync/atomic"
+
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/util"
 )
@@ -30,6 +32,8 @@ type indexedIterator struct {
 	err    error
 	errf   func(err error)
 	closed bool
+
+	released int32
 }
 
 func (i *indexedIterator) setData() {
@@ -210,9 +214,11 @@ func (i *indexedIterator) Value() []byte {
 }
 
 func (i *indexedIterator) Release() {
-	i.clearData()
-	i.index.Release()
-	i.BasicReleaser.Release()
+	if atomic.CompareAndSwapInt32(&i.released, 0, 1) {
+		i.clearData()
+		i.index.Release()
+		i.BasicReleaser.Release()
+	}
 }
 
 func (i *indexedIterator) Error() error {
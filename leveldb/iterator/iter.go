@@ -61,7 +61,11 @@ type CommonIterator interface {
 	// method.
 	util.ReleaseSetter
 
-	// TODO: Remove this when ready.
+	// Valid returns whether the iterator is positioned at a key/value pair.
+	// It always equals the value returned by the last call to a 'seeks
+	// method', and is false before the first one, after the iterator is
+	// exhausted, on error or after Release. Use Error to tell an
+	// exhausted iterator from a failed one.
 	Valid() bool
 
 	// Error returns any accumulated error. Exhausting all the key/value pairs
@@ -75,6 +79,16 @@ type CommonIterator interface {
 // yield no key/value pairs. The error can be queried by calling the Error
 // method. Calling Release is still necessary.
 //
+// Both following loop shapes are equivalent:
+//
+//	for iter.Next() {
+//		// Use iter.Key() and iter.Value().
+//	}
+//
+//	for iter.First(); iter.Valid(); iter.Next() {
+//		// Use iter.Key() and iter.Value().
+//	}
+//
 // An iterator must be released after use, but it is not necessary to read
 // an iterator until exhaustion.
 // Also, an iterator is not necessarily safe for concurrent use, but it is
@@ -104,6 +118,16 @@ type ErrorCallbackSetter interface {
 	SetErrorCallback(f func(err error))
 }
 
+// ProgressReporter is the interface that wraps basic Progress method.
+//
+// ProgressReporter implemented by DB iterators, including the ones of
+// snapshots and transactions.
+type ProgressReporter interface {
+	// Progress returns the approximate fraction, from 0 to 1, of the
+	// iterator's range consumed so far.
+	Progress() float64
+}
+
 type emptyIterator struct {
 	util.BasicReleaser
 	err error
@@ -7,6 +7,8 @@
 package iterator
 
 import (
+	"sync/atomic"
+
 	"github.com/btcsuite/goleveldb/leveldb/comparer"
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/util"
@@ -30,9 +32,12 @@ type mergedIterator struct {
 	keys     [][]byte
 	index    int
 	dir      dir
+	heap     []int
+	reverse  bool
 	err      error
 	errf     func(err error)
 	releaser util.Releaser
+	released int32
 }
 
 func assertKey(key []byte) []byte {
@@ -78,7 +83,8 @@ func (i *mergedIterator) First() bool {
 		}
 	}
 	i.dir = dirSOI
-	return i.next()
+	i.initHeap(false)
+	return i.top()
 }
 
 func (i *mergedIterator) Last() bool {
@@ -100,7 +106,8 @@ func (i *mergedIterator) Last() bool {
 		}
 	}
 	i.dir = dirEOI
-	return i.prev()
+	i.initHeap(true)
+	return i.top()
 }
 
 func (i *mergedIterator) Seek(key []byte) bool {
@@ -122,25 +129,116 @@ func (i *mergedIterator) Seek(key []byte) bool {
 		}
 	}
 	i.dir = dirSOI
-	return i.next()
+	i.initHeap(false)
+	return i.top()
 }
 
-func (i *mergedIterator) next() bool {
-	var key []byte
-	if i.dir == dirForward {
-		key = i.keys[i.index]
+// Whether the input iterator a comes before b in the heap. Equal keys are
+// ordered by index, so the lowest index iterator shadows the others.
+func (i *mergedIterator) less(a, b int) bool {
+	c := i.cmp.Compare(i.keys[a], i.keys[b])
+	if i.reverse {
+		c = -c
 	}
-	for x, tkey := range i.keys {
-		if tkey != nil && (key == nil || i.cmp.Compare(tkey, key) < 0) {
-			key = tkey
-			i.index = x
+	return c < 0 || (c == 0 && a < b)
+}
+
+func (i *mergedIterator) down(n int) {
+	h := i.heap
+	for {
+		m := 2*n + 1
+		if m >= len(h) {
+			return
+		}
+		if r := m + 1; r < len(h) && i.less(h[r], h[m]) {
+			m = r
 		}
+		if !i.less(h[m], h[n]) {
+			return
+		}
+		h[n], h[m] = h[m], h[n]
+		n = m
 	}
-	if key == nil {
-		i.dir = dirEOI
+}
+
+// Rebuilds the heap of the input iterators holding a key. The heap yields
+// the smallest key first, or the largest if reverse is true, so neither
+// direction rescans all input iterators on each step.
+func (i *mergedIterator) initHeap(reverse bool) {
+	i.reverse = reverse
+	i.heap = i.heap[:0]
+	for x, key := range i.keys {
+		if key != nil {
+			i.heap = append(i.heap, x)
+		}
+	}
+	for n := len(i.heap)/2 - 1; n >= 0; n-- {
+		i.down(n)
+	}
+}
+
+// Moves the input iterator at the given heap position one step in the heap
+// direction, then restores the heap. Only the top of the heap and its
+// children are ever moved, which are never before their parent afterwards,
+// thus sifting down is enough.
+func (i *mergedIterator) advance(n int) bool {
+	x := i.heap[n]
+	iter := i.iters[x]
+	var ok bool
+	if i.reverse {
+		ok = iter.Prev()
+	} else {
+		ok = iter.Next()
+	}
+	switch {
+	case ok:
+		i.keys[x] = assertKey(iter.Key())
+	case i.iterErr(iter):
+		return false
+	default:
+		i.keys[x] = nil
+		last := len(i.heap) - 1
+		i.heap[n] = i.heap[last]
+		i.heap = i.heap[:last]
+	}
+	if n < len(i.heap) {
+		i.down(n)
+	}
+	return true
+}
+
+// Makes the top of the heap the current input iterator. The other input
+// iterators that hold the same key are moved past it, as it shadows them;
+// they are the next ones in the heap, i.e. children of the top.
+func (i *mergedIterator) top() bool {
+	if len(i.heap) == 0 {
+		if i.reverse {
+			i.dir = dirSOI
+		} else {
+			i.dir = dirEOI
+		}
 		return false
 	}
-	i.dir = dirForward
+	x := i.heap[0]
+	key := i.keys[x]
+	for len(i.heap) > 1 {
+		n := 1
+		if len(i.heap) > 2 && i.less(i.heap[2], i.heap[1]) {
+			n = 2
+		}
+		if i.cmp.Compare(i.keys[i.heap[n]], key) != 0 {
+			break
+		}
+		if !i.advance(n) {
+			return false
+		}
+	}
+	i.index = x
+	if i.reverse {
+		i.dir = dirBackward
+	} else {
+		i.dir = dirForward
+	}
 	return true
 }
 
@@ -163,36 +261,11 @@ func (i *mergedIterator) Next() bool {
 		return i.Next()
 	}
 
-	x := i.index
-	iter := i.iters[x]
-	switch {
-	case iter.Next():
-		i.keys[x] = assertKey(iter.Key())
-	case i.iterErr(iter):
+	// The current input iterator is the top of the heap.
+	if !i.advance(0) {
 		return false
-	default:
-		i.keys[x] = nil
 	}
-	return i.next()
-}
-
-func (i *mergedIterator) prev() bool {
-	var key []byte
-	if i.dir == dirBackward {
-		key = i.keys[i.index]
-	}
-	for x, tkey := range i.keys {
-		if tkey != nil && (key == nil || i.cmp.Compare(tkey, key) > 0) {
-			key = tkey
-			i.index = x
-		}
-	}
-	if key == nil {
-		i.dir = dirSOI
-		return false
-	}
-	i.dir = dirBackward
-	return true
+	return i.top()
 }
 
 func (i *mergedIterator) Prev() bool {
@@ -222,19 +295,16 @@ func (i *mergedIterator) Prev() bool {
 				i.keys[x] = nil
 			}
 		}
+		// The other input iterators are now before the current one, which
+		// is thus the top of the heap.
+		i.initHeap(true)
 	}
 
-	x := i.index
-	iter := i.iters[x]
-	switch {
-	case iter.Prev():
-		i.keys[x] = assertKey(iter.Key())
-	case i.iterErr(iter):
+	// The current input iterator is the top of the heap.
+	if !i.advance(0) {
 		return false
-	default:
-		i.keys[x] = nil
 	}
-	return i.prev()
+	return i.top()
 }
 
 func (i *mergedIterator) Key() []byte {
@@ -252,13 +322,14 @@ func (i *mergedIterator) Value() []byte {
 }
 
 func (i *mergedIterator) Release() {
-	if i.dir != dirReleased {
+	if atomic.CompareAndSwapInt32(&i.released, 0, 1) {
 		i.dir = dirReleased
 		for _, iter := range i.iters {
 			iter.Release()
 		}
 		i.iters = nil
 		i.keys = nil
+		i.heap = nil
 		if i.releaser != nil {
 			i.releaser.Release()
 			i.releaser = nil
@@ -287,8 +358,12 @@ func (i *mergedIterator) SetErrorCallback(f func(err error)) {
 // NewMergedIterator returns an iterator that merges its input. Walking the
 // resultant iterator will return all key/value pairs of all input iterators
 // in strictly increasing key order, as defined by cmp.
-// The input's key ranges may overlap, but there are assumed to be no duplicate
-// keys: if iters[i] contains a key k then iters[j] will not contain that key k.
+// The input's key ranges may overlap, e.g. the input may be iterators of
+// several DBs or snapshots. If more than one input iterator contains a key
+// then only the pair of the iterator with the lowest index is returned: if
+// iters[i] and iters[j], with i < j, both contain a key k then iters[i]
+// shadows k of iters[j]. Each input iterator must not contain duplicate
+// keys itself.
 // None of the iters may be nil.
 //
 // If strict is true the any 'corruption errors' (i.e errors.IsCorrupted(err) == true)
@@ -300,5 +375,6 @@ func NewMergedIterator(iters []Iterator, cmp comparer.Comparer, strict bool) Ite
 		cmp:    cmp,
 		strict: strict,
 		keys:   make([][]byte, len(iters)),
+		heap:   make([]int, 0, len(iters)),
 	}
 }
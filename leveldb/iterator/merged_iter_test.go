@@ -7,6 +7,11 @@
 package iterator_test
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -56,5 +61,109 @@ var _ = testutil.Defer(func() {
 		Describe("with three, all filled iterators", Test(3, 0))
 		Describe("with one filled, one empty iterators", Test(1, 1))
 		Describe("with one filled, two empty iterators", Test(1, 2))
+		Describe("with many filled, some empty iterators", Test(8, 2))
+
+		TestDup := func(n int) func() {
+			return func() {
+				It("Should return the pair of the lowest index iterator", func(done Done) {
+					rnd := testutil.NewRand()
+
+					// Each key goes to one or more iterators, with a value
+					// telling which.
+					filledKV := make([]testutil.KeyValue, n)
+					kv := testutil.KeyValue_Generate(nil, 100, 1, 1, 10, 4, 4)
+					want := &testutil.KeyValue{}
+					kv.Iterate(func(i int, key, value []byte) {
+						first := -1
+						for x := range filledKV {
+							if rnd.Intn(2) == 0 || (x == n-1 && first < 0) {
+								filledKV[x].Put(key, []byte(fmt.Sprintf("%s-%d", value, x)))
+								if first < 0 {
+									first = x
+								}
+							}
+						}
+						want.Put(key, []byte(fmt.Sprintf("%s-%d", value, first)))
+					})
+
+					iters := make([]Iterator, n)
+					for x := range iters {
+						iters[x] = NewArrayIterator(filledKV[x])
+					}
+
+					t := testutil.IteratorTesting{
+						KeyValue: want.Clone(),
+						Iter:     NewMergedIterator(iters, comparer.DefaultComparer, true),
+					}
+					testutil.DoIteratorTesting(&t)
+					done <- true
+				}, 15.0)
+			}
+		}
+
+		Describe("with duplicate keys", TestDup(3))
+		Describe("with duplicate keys in many iterators", TestDup(16))
+
+		Describe("when released repeatedly", func() {
+			It("Should release its resources only once", func() {
+				var n countReleaser
+				iter := NewMergedIterator([]Iterator{
+					NewArrayIterator(&testutil.KeyValue{}),
+					NewArrayIterator(&testutil.KeyValue{}),
+				}, comparer.DefaultComparer, true)
+				iter.SetReleaser(&n)
+
+				var wg sync.WaitGroup
+				for x := 0; x < 2; x++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						iter.Release()
+					}()
+				}
+				wg.Wait()
+				iter.Release()
+				Expect(atomic.LoadInt32((*int32)(&n))).Should(Equal(int32(1)))
+			})
+		})
 	})
 })
+
+type countReleaser int32
+
+func (r *countReleaser) Release() {
+	atomic.AddInt32((*int32)(r), 1)
+}
+
+func benchmarkMergedIterator(b *testing.B, reverse bool) {
+	const n = 16
+	kvs := make([]testutil.KeyValue, n)
+	for i := 0; i < n*10000; i++ {
+		kvs[i%n].PutString(fmt.Sprintf("%016d", i), "value")
+	}
+
+	b.ResetTimer()
+	for x := 0; x < b.N; x++ {
+		iters := make([]Iterator, n)
+		for i := range iters {
+			iters[i] = NewArrayIterator(kvs[i])
+		}
+		iter := NewMergedIterator(iters, comparer.DefaultComparer, true)
+		if reverse {
+			for ok := iter.Last(); ok; ok = iter.Prev() {
+			}
+		} else {
+			for iter.Next() {
+			}
+		}
+		iter.Release()
+	}
+}
+
+func BenchmarkMergedIteratorNext(b *testing.B) {
+	benchmarkMergedIterator(b, false)
+}
+
+func BenchmarkMergedIteratorPrev(b *testing.B) {
+	benchmarkMergedIterator(b, true)
+}
@@ -138,6 +138,13 @@ type Reader struct {
 	// n is the number of bytes of buf that are valid. Once reading has started,
 	// only the final block can have n < blockSize.
 	n int
+	// off is the offset of buf within the underlying reader.
+	off int64
+	// recOff is the offset of the current journal within the underlying
+	// reader.
+	recOff int64
+	// truncated is the number of bytes dropped from the tail.
+	truncated int64
 	// last is whether the current chunk is the last chunk of the journal.
 	last bool
 	// err is any accumulated error.
@@ -161,6 +168,35 @@ func NewReader(r io.Reader, dropper Dropper, strict, checksum bool) *Reader {
 
 var errSkip = errors.New("leveldb/journal: skipped")
 
+// truncate drops everything from the given offset to the end of the
+// underlying reader, which is the expected state of a journal whose last
+// write is incomplete (e.g. due to a crash). No valid chunk follows a
+// truncated tail, so it is never considered as corruption.
+func (r *Reader) truncate(off int64, first bool) error {
+	r.truncated += r.off + int64(r.n) - off
+	r.i = r.n
+	r.j = r.n
+	r.err = io.EOF
+	if first {
+		return io.EOF
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// isZeroTail returns whether buf[i:] is at the tail of the underlying reader
+// and contains only zeroes.
+func (r *Reader) isZeroTail(i int) bool {
+	if r.n == blockSize {
+		return false
+	}
+	for _, c := range r.buf[i:r.n] {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *Reader) corrupt(n int, reason string, skip bool) error {
 	if r.dropper != nil {
 		r.dropper.Drop(&ErrCorrupted{n, reason})
@@ -181,7 +217,15 @@ func (r *Reader) nextChunk(first bool) error {
 			length := binary.LittleEndian.Uint16(r.buf[r.j+4 : r.j+6])
 			chunkType := r.buf[r.j+6]
 			unprocBlock := r.n - r.j
+			// Offset of the journal this chunk belongs to.
+			tailOff := r.recOff
+			if first {
+				tailOff = r.off + int64(r.j)
+			}
 			if checksum == 0 && length == 0 && chunkType == 0 {
+				if r.isZeroTail(r.j) {
+					return r.truncate(tailOff, first)
+				}
 				// Drop entire block.
 				r.i = r.n
 				r.j = r.n
@@ -195,6 +239,10 @@ func (r *Reader) nextChunk(first bool) error {
 			}
 			r.i = r.j + headerSize
 			r.j = r.j + headerSize + int(length)
+			if r.j >= r.n && r.n < blockSize && (r.j > r.n || r.checksum && checksum != util.NewCRC(r.buf[r.i-1:r.j]).Value()) {
+				// The last chunk is incomplete.
+				return r.truncate(tailOff, first)
+			}
 			if r.j > r.n {
 				// Drop entire block.
 				r.i = r.n
@@ -212,6 +260,9 @@ func (r *Reader) nextChunk(first bool) error {
 				// Report the error, but skip it.
 				return r.corrupt(chunkLength, "orphan chunk", true)
 			}
+			if first {
+				r.recOff = r.off + int64(r.i-headerSize)
+			}
 			r.last = chunkType == fullChunkType || chunkType == lastChunkType
 			return nil
 		}
@@ -219,10 +270,10 @@ func (r *Reader) nextChunk(first bool) error {
 		// The last block.
 		if r.n < blockSize && r.n > 0 {
 			if !first {
-				return r.corrupt(0, "missing chunk part", false)
+				// Missing chunk part.
+				return r.truncate(r.recOff, first)
 			}
-			r.err = io.EOF
-			return r.err
+			return r.truncate(r.off+int64(r.j), first)
 		}
 
 		// Read block.
@@ -230,9 +281,12 @@ func (r *Reader) nextChunk(first bool) error {
 		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return err
 		}
+		r.off += int64(r.n)
 		if n == 0 {
 			if !first {
-				return r.corrupt(0, "missing chunk part", false)
+				// Missing chunk part.
+				r.n = 0
+				return r.truncate(r.recOff, first)
 			}
 			r.err = io.EOF
 			return r.err
@@ -273,11 +327,22 @@ func (r *Reader) Reset(reader io.Reader, dropper Dropper, strict, checksum bool)
 	r.i = 0
 	r.j = 0
 	r.n = 0
+	r.off = 0
+	r.recOff = 0
+	r.truncated = 0
 	r.last = true
 	r.err = nil
 	return err
 }
 
+// Truncated returns number of bytes dropped from the tail of the underlying
+// reader so far, because the last journal is incomplete. An incomplete
+// journal at the tail is expected after a crash, thus it is never reported
+// as corruption, regardless of the strict flag.
+func (r *Reader) Truncated() int64 {
+	return r.truncated
+}
+
 type singleReader struct {
 	r   *Reader
 	seq int
@@ -816,3 +816,156 @@ func TestCorrupt_MiddleChuckLengthOverflow(t *testing.T) {
 		t.Fatalf("last next: unexpected error: %v", err)
 	}
 }
+
+func TestCorrupt_TruncatedTail(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	w := NewWriter(buf)
+
+	// First record.
+	ww, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ww.Write(bytes.Repeat([]byte("0"), blockSize/2)); err != nil {
+		t.Fatalf("write #0: unexpected error: %v", err)
+	}
+
+	// Second record.
+	ww, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ww.Write(bytes.Repeat([]byte("0"), blockSize)); err != nil {
+		t.Fatalf("write #1: unexpected error: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cut := range []int{1, 100, blockSize / 2} {
+		b := buf.Bytes()
+		b = b[:len(b)-cut]
+		r := NewReader(bytes.NewReader(b), dropper{t}, true, true)
+
+		// First read (first record).
+		rr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, rr)
+		if err != nil {
+			t.Fatalf("cut %d: read #0: %v", cut, err)
+		}
+		if want := int64(blockSize / 2); n != want {
+			t.Fatalf("cut %d: read #0: got %d bytes want %d", cut, n, want)
+		}
+
+		// Second read (truncated second record).
+		rr, err = r.Next()
+		if err != nil {
+			t.Fatalf("cut %d: next #1: %v", cut, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, rr); err != io.ErrUnexpectedEOF {
+			t.Fatalf("cut %d: read #1: unexpected error: %v", cut, err)
+		}
+
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("cut %d: last next: unexpected error: %v", cut, err)
+		}
+		if want := int64(len(b) - (blockSize/2 + headerSize)); r.Truncated() != want {
+			t.Fatalf("cut %d: got %d truncated bytes want %d", cut, r.Truncated(), want)
+		}
+	}
+}
+
+func TestCorrupt_TruncatedTailFirstChunk(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	w := NewWriter(buf)
+	for i := 0; i < 2; i++ {
+		ww, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ww.Write(bytes.Repeat([]byte("0"), 100)); err != nil {
+			t.Fatalf("write #%d: unexpected error: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	b = b[:len(b)-10]
+	r := NewReader(bytes.NewReader(b), dropper{t}, true, true)
+
+	rr, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := io.Copy(ioutil.Discard, rr); err != nil || n != 100 {
+		t.Fatalf("read #0: got %d bytes, err %v", n, err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("last next: unexpected error: %v", err)
+	}
+	if want := int64(headerSize + 90); r.Truncated() != want {
+		t.Fatalf("got %d truncated bytes want %d", r.Truncated(), want)
+	}
+}
+
+func TestCorrupt_InteriorFlip(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	w := NewWriter(buf)
+	for i := 0; i < 3; i++ {
+		ww, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ww.Write(bytes.Repeat([]byte("0"), 100)); err != nil {
+			t.Fatalf("write #%d: unexpected error: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	// Corrupting record #1, valid record #2 follows.
+	b[headerSize+100+headerSize+50] ^= 0x80
+
+	// Strict.
+	r := NewReader(bytes.NewReader(b), dropper{t}, true, true)
+	rr, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rr); err != nil {
+		t.Fatalf("read #0: %v", err)
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Fatalf("strict next: expect corruption error, got: %v", err)
+	}
+	if r.Truncated() != 0 {
+		t.Fatalf("strict: got %d truncated bytes want 0", r.Truncated())
+	}
+
+	// Non-strict, the whole block is dropped.
+	r = NewReader(bytes.NewReader(b), dropper{t}, false, true)
+	rr, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rr); err != nil {
+		t.Fatalf("read #0: %v", err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("non-strict next: unexpected error: %v", err)
+	}
+	if r.Truncated() != 0 {
+		t.Fatalf("non-strict: got %d truncated bytes want 0", r.Truncated())
+	}
+}
@@ -36,6 +36,8 @@ func (kt keyType) String() string {
 		return "d"
 	case keyTypeVal:
 		return "v"
+	case keyTypeBlob:
+		return "b"
 	}
 	return fmt.Sprintf("<invalid:%#x>", uint(kt))
 }
@@ -43,8 +45,9 @@ func (kt keyType) String() string {
 // Value types encoded as the last component of internal keys.
 // Don't modify; this value are saved to disk.
 const (
-	keyTypeDel = keyType(0)
-	keyTypeVal = keyType(1)
+	keyTypeDel  = keyType(0)
+	keyTypeVal  = keyType(1)
+	keyTypeBlob = keyType(2) // Value is a pointer into a blob file.
 )
 
 // keyTypeSeek defines the keyType that should be passed when constructing an
@@ -52,7 +55,7 @@ const (
 // sort sequence numbers in decreasing order and the value type is
 // embedded as the low 8 bits in the sequence number in internal keys,
 // we need to use the highest-numbered ValueType, not the lowest).
-const keyTypeSeek = keyTypeVal
+const keyTypeSeek = keyTypeBlob
 
 const (
 	// Maximum value possible for sequence number; the 8-bits are
@@ -75,7 +78,7 @@ type internalKey []byte
 func makeInternalKey(dst, ukey []byte, seq uint64, kt keyType) internalKey {
 	if seq > keyMaxSeq {
 		panic("leveldb: invalid sequence number")
-	} else if kt > keyTypeVal {
+	} else if kt > keyTypeBlob {
 		panic("leveldb: invalid type")
 	}
 
@@ -91,7 +94,7 @@ func parseInternalKey(ik []byte) (ukey []byte, seq uint64, kt keyType, err error
 	}
 	num := binary.LittleEndian.Uint64(ik[len(ik)-8:])
 	seq, kt = uint64(num>>8), keyType(num&0xff)
-	if kt > keyTypeVal {
+	if kt > keyTypeBlob {
 		return nil, 0, 0, newErrInternalKeyCorrupted(ik, "invalid type")
 	}
 	ukey = ik[:len(ik)-8]
@@ -125,7 +128,7 @@ func (ik internalKey) num() uint64 {
 func (ik internalKey) parseNum() (seq uint64, kt keyType) {
 	num := ik.num()
 	seq, kt = uint64(num>>8), keyType(num&0xff)
-	if kt > keyTypeVal {
+	if kt > keyTypeBlob {
 		panic(fmt.Sprintf("leveldb: internal key %q, len=%d: invalid type %#x", []byte(ik), len(ik), kt))
 	}
 	return
@@ -0,0 +1,143 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"sync/atomic"
+
+	"github.com/btcsuite/goleveldb/leveldb/memdb"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// The filter of a memdb is first sized for a key per memBloomBytesPerKey
+// bytes of its capacity, but at least memBloomMinKeys keys.
+const (
+	memBloomBytesPerKey = 64
+	memBloomMinKeys     = 1024
+)
+
+// memBloomTable is a memdb which keeps a bloom filter of the user keys put
+// into it, see opt.Options.MemTableBloomBits. Once the filter holds as many
+// keys as it was sized for, a filter twice as large is added instead of
+// rebuilding it, so the keys are never rescanned; a key may be in any of
+// the filters.
+//
+// Puts are done by a single writer, while lookups may run concurrently, so
+// the filter bits are accessed atomically. The bits of a key are set before
+// the key is put, hence a reader seeing the key in the memdb sees it in the
+// filter as well.
+type memBloomTable struct {
+	memdb.Table
+	bitsPerKey int
+	filters    atomic.Value // []*memBloomFilter
+}
+
+func newMemBloomTable(t memdb.Table, bitsPerKey int) *memBloomTable {
+	b := &memBloomTable{Table: t, bitsPerKey: bitsPerKey}
+	b.resetFilters()
+	return b
+}
+
+func (b *memBloomTable) resetFilters() {
+	keys := b.Capacity() / memBloomBytesPerKey
+	if keys < memBloomMinKeys {
+		keys = memBloomMinKeys
+	}
+	b.filters.Store([]*memBloomFilter{newMemBloomFilter(keys, b.bitsPerKey)})
+}
+
+// Put adds the user key of the given internal key to the filter, then puts
+// the key/value pair.
+func (b *memBloomTable) Put(key, value []byte) error {
+	filters := b.filters.Load().([]*memBloomFilter)
+	f := filters[len(filters)-1]
+	if f.n >= f.keys {
+		f = newMemBloomFilter(2*f.keys, b.bitsPerKey)
+		b.filters.Store(append(filters[:len(filters):len(filters)], f))
+	}
+	f.add(util.Hash(internalKey(key).ukey(), 0xbc9f1d34))
+	return b.Table.Put(key, value)
+}
+
+// Reset resets the table and its filter.
+func (b *memBloomTable) Reset() {
+	b.Table.Reset()
+	b.resetFilters()
+}
+
+// MemoryUsage returns the memory held by the table and its filter.
+func (b *memBloomTable) MemoryUsage() int {
+	n := memTableUsage(b.Table)
+	for _, f := range b.filters.Load().([]*memBloomFilter) {
+		n += len(f.bits) * 8
+	}
+	return n
+}
+
+// Returns false if the table definitely doesn't hold the given user key.
+func (b *memBloomTable) mayContain(ukey []byte) bool {
+	kh := util.Hash(ukey, 0xbc9f1d34)
+	for _, f := range b.filters.Load().([]*memBloomFilter) {
+		if f.contains(kh) {
+			return true
+		}
+	}
+	return false
+}
+
+type memBloomFilter struct {
+	bits  []uint64
+	nBits uint32
+	k     uint8
+	keys  int // number of keys the filter is sized for
+	n     int // number of keys added; writer only
+}
+
+func newMemBloomFilter(keys, bitsPerKey int) *memBloomFilter {
+	// Round down to reduce probing cost a little bit.
+	k := uint8(bitsPerKey * 69 / 100) // 0.69 =~ ln(2)
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+	words := (keys*bitsPerKey + 63) / 64
+	return &memBloomFilter{
+		bits:  make([]uint64, words),
+		nBits: uint32(words * 64),
+		k:     k,
+		keys:  keys,
+	}
+}
+
+func (f *memBloomFilter) add(kh uint32) {
+	delta := (kh >> 17) | (kh << 15) // Rotate right 17 bits
+	for j := uint8(0); j < f.k; j++ {
+		bitpos := kh % f.nBits
+		p, m := &f.bits[bitpos/64], uint64(1)<<(bitpos%64)
+		for {
+			old := atomic.LoadUint64(p)
+			if old&m != 0 || atomic.CompareAndSwapUint64(p, old, old|m) {
+				break
+			}
+		}
+		kh += delta
+	}
+	f.n++
+}
+
+func (f *memBloomFilter) contains(kh uint32) bool {
+	delta := (kh >> 17) | (kh << 15) // Rotate right 17 bits
+	for j := uint8(0); j < f.k; j++ {
+		bitpos := kh % f.nBits
+		if atomic.LoadUint64(&f.bits[bitpos/64])&(uint64(1)<<(bitpos%64)) == 0 {
+			return false
+		}
+		kh += delta
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package memdb
+
+// arena is the append-only buffer of the keys/values of a DB. Each
+// key/value pair is stored contiguously, at an offset returned by alloc.
+//
+// With a zero block size, the arena is a single buffer preallocated to the
+// capacity, which is grown, thus copied, when full. Otherwise it is made of
+// blocks of the given size allocated as needed: a pair which doesn't fit
+// in the free space of the last block starts a new block, and a pair larger
+// than a block gets a buffer of its own, spanning the offsets of as many
+// blocks as needed.
+type arena struct {
+	blockSize   int
+	minCapacity int
+	blocks      [][]byte // nil for the blocks spanned by an oversized pair
+	allocated   int      // sum of the block lengths
+	used        int      // sum of the pair lengths
+	next        int      // offset of the next pair
+}
+
+func newArena(capacity, blockSize int) *arena {
+	a := &arena{blockSize: blockSize, minCapacity: capacity}
+	if blockSize == 0 {
+		a.blocks = [][]byte{make([]byte, 0, capacity)}
+	}
+	return a
+}
+
+// Appends the given key/value pair and returns its offset.
+func (a *arena) alloc(key, value []byte) int {
+	n := len(key) + len(value)
+	a.used += n
+	if a.blockSize == 0 {
+		b := a.blocks[0]
+		o := len(b)
+		b = append(b, key...)
+		a.blocks[0] = append(b, value...)
+		return o
+	}
+
+	bs := a.blockSize
+	o := a.next
+	if n == 0 {
+		return o
+	}
+	if r := o % bs; r == 0 || r+n > bs {
+		// Start a new block.
+		i := (o + bs - 1) / bs
+		o = i * bs
+		size := bs
+		if n > bs {
+			size = n
+		}
+		for len(a.blocks) < i {
+			a.blocks = append(a.blocks, nil)
+		}
+		// Allocate the block, unless reusing the one kept by reset.
+		if i >= len(a.blocks) || size != bs {
+			if i < len(a.blocks) {
+				a.allocated -= len(a.blocks[i])
+				a.blocks = a.blocks[:i]
+			}
+			a.blocks = append(a.blocks, make([]byte, size))
+			a.allocated += size
+		}
+	}
+	b := a.blocks[o/bs][o%bs:]
+	copy(b, key)
+	copy(b[len(key):], value)
+	if n > bs {
+		// Skip the offsets of the blocks spanned by the pair.
+		a.next = o + (n+bs-1)/bs*bs
+	} else {
+		a.next = o + n
+	}
+	return o
+}
+
+// Returns n bytes at the given offset.
+func (a *arena) get(o, n int) []byte {
+	if a.blockSize == 0 {
+		return a.blocks[0][o : o+n]
+	}
+	if n == 0 {
+		return []byte{}
+	}
+	r := o % a.blockSize
+	return a.blocks[o/a.blockSize][r : r+n]
+}
+
+// Returns the capacity of the arena, which is the capacity given to
+// newArena unless exceeded. The free space left at the end of the blocks
+// doesn't count, so that the pairs of a full arena always sum to the
+// capacity.
+func (a *arena) capacity() int {
+	if a.blockSize == 0 {
+		return cap(a.blocks[0])
+	}
+	if a.used > a.minCapacity {
+		return a.used
+	}
+	return a.minCapacity
+}
+
+// Returns the space left before the capacity is exceeded.
+func (a *arena) free() int {
+	if a.blockSize == 0 {
+		return cap(a.blocks[0]) - len(a.blocks[0])
+	}
+	return a.capacity() - a.used
+}
+
+// Returns the allocated bytes, used or not.
+func (a *arena) allocatedSize() int {
+	if a.blockSize == 0 {
+		return cap(a.blocks[0])
+	}
+	return a.allocated
+}
+
+// Returns the allocated bytes not used by any pair.
+func (a *arena) slack() int {
+	if a.blockSize == 0 {
+		return cap(a.blocks[0]) - len(a.blocks[0])
+	}
+	return a.allocated - a.used
+}
+
+// Empties the arena. The first block is kept for reuse, the other blocks
+// are released.
+func (a *arena) reset() {
+	a.used = 0
+	a.next = 0
+	if a.blockSize == 0 {
+		a.blocks[0] = a.blocks[0][:0]
+		return
+	}
+	if len(a.blocks) > 0 && len(a.blocks[0]) == a.blockSize {
+		for i := 1; i < len(a.blocks); i++ {
+			a.blocks[i] = nil
+		}
+		a.blocks = a.blocks[:1]
+		a.allocated = a.blockSize
+	} else {
+		a.blocks = nil
+		a.allocated = 0
+	}
+}
@@ -8,6 +8,7 @@ package memdb
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"testing"
 
@@ -40,6 +41,34 @@ func BenchmarkPutRandom(b *testing.B) {
 	}
 }
 
+// Measures the insert throughput and the memory allocated but unused, by
+// value size and arena block size, see NewWithArenaBlockSize. The DB is
+// reset whenever full, as a DB 'memdb' would be rotated.
+func BenchmarkPutArena(b *testing.B) {
+	for _, vsize := range []int{16, 64 * 1024} {
+		for _, bs := range []int{0, 4 * 1024, 64 * 1024, 1024 * 1024} {
+			b.Run(fmt.Sprintf("value=%d/block=%d", vsize, bs), func(b *testing.B) {
+				var key [8]byte
+				value := make([]byte, vsize)
+				p := NewWithArenaBlockSize(comparer.DefaultComparer, 4*1024*1024, bs)
+
+				b.SetBytes(int64(len(key) + vsize))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if p.Free() < len(key)+vsize {
+						p.Reset()
+					}
+					binary.BigEndian.PutUint64(key[:], uint64(i))
+					p.Put(key[:], value)
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(p.Slack()), "slack-B")
+			})
+		}
+	}
+}
+
 func BenchmarkGet(b *testing.B) {
 	buf := make([][4]byte, b.N)
 	for i := range buf {
@@ -73,3 +102,33 @@ func BenchmarkGetRandom(b *testing.B) {
 		p.Get(buf[rand.Int()%b.N][:])
 	}
 }
+
+func BenchmarkHashPutRandom(b *testing.B) {
+	buf := make([][4]byte, b.N)
+	for i := range buf {
+		binary.LittleEndian.PutUint32(buf[i][:], uint32(rand.Int()))
+	}
+
+	b.ResetTimer()
+	p := NewHash(comparer.DefaultComparer, 0)
+	for i := range buf {
+		p.Put(buf[i][:], nil)
+	}
+}
+
+func BenchmarkHashGetRandom(b *testing.B) {
+	buf := make([][4]byte, b.N)
+	for i := range buf {
+		binary.LittleEndian.PutUint32(buf[i][:], uint32(i))
+	}
+
+	p := NewHash(comparer.DefaultComparer, 0)
+	for i := range buf {
+		p.Put(buf[i][:], nil)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Get(buf[rand.Int()%b.N][:])
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package memdb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
+	"github.com/btcsuite/goleveldb/leveldb/iterator"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// Prefixer is the interface that wraps the basic Prefix method. The
+// comparer given to NewHash may implement it to group keys into hash
+// buckets.
+type Prefixer interface {
+	// Prefix returns the prefix of the given key. Keys sharing a prefix
+	// must be adjacent in the comparer order.
+	Prefix(key []byte) []byte
+}
+
+type hashEntry struct {
+	kv   int // offset of the key/value in kvData
+	klen int
+	vlen int
+}
+
+// HashDB is an in-memory key/value table with hash buckets. Keys are
+// grouped into buckets by prefix, see Prefixer, and each bucket is kept
+// sorted; lookups only visit the bucket of the given key, which makes
+// them faster than DB lookups on large tables. In return, ordered
+// iteration needs to sort all keys first.
+//
+// Find only searches the bucket of the given key, it returns ErrNotFound
+// if the bucket doesn't contain a key greater than or equal to the given
+// key, even if other buckets do.
+type HashDB struct {
+	cmp    comparer.BasicComparer
+	prefix func(key []byte) []byte
+
+	mu      sync.RWMutex
+	kvData  []byte
+	buckets map[string][]hashEntry
+	n       int
+	kvSize  int
+}
+
+func (p *HashDB) key(e hashEntry) []byte {
+	return p.kvData[e.kv : e.kv+e.klen]
+}
+
+func (p *HashDB) value(e hashEntry) []byte {
+	o := e.kv + e.klen
+	return p.kvData[o : o+e.vlen]
+}
+
+// Returns the bucket of the given key and the smallest index in it whose
+// key is greater than or equal to the given key; need external
+// synchronization.
+func (p *HashDB) find(key []byte) (bucket []hashEntry, i int, exact bool) {
+	bucket = p.buckets[string(p.prefix(key))]
+	i = sort.Search(len(bucket), func(i int) bool {
+		return p.cmp.Compare(p.key(bucket[i]), key) >= 0
+	})
+	exact = i < len(bucket) && p.cmp.Compare(p.key(bucket[i]), key) == 0
+	return
+}
+
+// Put sets the value for the given key. It overwrites any previous value
+// for that key; a HashDB is not a multi-map.
+//
+// It is safe to modify the contents of the arguments after Put returns.
+func (p *HashDB) Put(key []byte, value []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := hashEntry{kv: len(p.kvData), klen: len(key), vlen: len(value)}
+	p.kvData = append(p.kvData, key...)
+	p.kvData = append(p.kvData, value...)
+
+	bucket, i, exact := p.find(key)
+	if exact {
+		p.kvSize += len(value) - bucket[i].vlen
+		bucket[i] = e
+		return nil
+	}
+	bucket = append(bucket, hashEntry{})
+	copy(bucket[i+1:], bucket[i:])
+	bucket[i] = e
+	p.buckets[string(p.prefix(key))] = bucket
+
+	p.kvSize += len(key) + len(value)
+	p.n++
+	return nil
+}
+
+// Delete deletes the value for the given key. It returns ErrNotFound if
+// the HashDB does not contain the key.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (p *HashDB) Delete(key []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bucket, i, exact := p.find(key)
+	if !exact {
+		return ErrNotFound
+	}
+	p.kvSize -= bucket[i].klen + bucket[i].vlen
+	p.n--
+
+	prefix := string(p.prefix(key))
+	if len(bucket) == 1 {
+		delete(p.buckets, prefix)
+	} else {
+		p.buckets[prefix] = append(bucket[:i], bucket[i+1:]...)
+	}
+	return nil
+}
+
+// Contains returns true if the given key are in the HashDB.
+//
+// It is safe to modify the contents of the arguments after Contains returns.
+func (p *HashDB) Contains(key []byte) bool {
+	p.mu.RLock()
+	_, _, exact := p.find(key)
+	p.mu.RUnlock()
+	return exact
+}
+
+// Get gets the value for the given key. It returns error.ErrNotFound if the
+// HashDB does not contain the key.
+//
+// The caller should not modify the contents of the returned slice, but
+// it is safe to modify the contents of the argument after Get returns.
+func (p *HashDB) Get(key []byte) (value []byte, err error) {
+	p.mu.RLock()
+	if bucket, i, exact := p.find(key); exact {
+		value = p.value(bucket[i])
+	} else {
+		err = ErrNotFound
+	}
+	p.mu.RUnlock()
+	return
+}
+
+// Find finds key/value pair whose key is greater than or equal to the
+// given key, within the bucket of the given key. It returns ErrNotFound
+// if the bucket doesn't contain such pair.
+//
+// The caller should not modify the contents of the returned slice, but
+// it is safe to modify the contents of the argument after Find returns.
+func (p *HashDB) Find(key []byte) (rkey, value []byte, err error) {
+	p.mu.RLock()
+	if bucket, i, _ := p.find(key); i < len(bucket) {
+		rkey, value = p.key(bucket[i]), p.value(bucket[i])
+	} else {
+		err = ErrNotFound
+	}
+	p.mu.RUnlock()
+	return
+}
+
+type hashArray struct {
+	cmp     comparer.BasicComparer
+	kvData  []byte
+	entries []hashEntry
+}
+
+func (a *hashArray) Len() int {
+	return len(a.entries)
+}
+
+func (a *hashArray) key(i int) []byte {
+	e := a.entries[i]
+	return a.kvData[e.kv : e.kv+e.klen]
+}
+
+func (a *hashArray) Less(i, j int) bool {
+	return a.cmp.Compare(a.key(i), a.key(j)) < 0
+}
+
+func (a *hashArray) Swap(i, j int) {
+	a.entries[i], a.entries[j] = a.entries[j], a.entries[i]
+}
+
+func (a *hashArray) Search(key []byte) int {
+	return sort.Search(len(a.entries), func(i int) bool {
+		return a.cmp.Compare(a.key(i), key) >= 0
+	})
+}
+
+func (a *hashArray) Index(i int) (key, value []byte) {
+	e := a.entries[i]
+	o := e.kv + e.klen
+	return a.kvData[e.kv:o], a.kvData[o : o+e.vlen]
+}
+
+// NewIterator returns an iterator of the HashDB. The iterator sorts the
+// key/value pairs of the HashDB, as of the time NewIterator is called;
+// it doesn't observe later modifications.
+//
+// Slice allows slicing the iterator to only contains keys in the given
+// range. A nil Range.Start is treated as a key before all keys in the
+// HashDB. And a nil Range.Limit is treated as a key after all keys in
+// the HashDB.
+//
+// The iterator must be released after use, by calling Release method.
+//
+// Also read Iterator documentation of the leveldb/iterator package.
+func (p *HashDB) NewIterator(slice *util.Range) iterator.Iterator {
+	p.mu.RLock()
+	a := &hashArray{
+		cmp:     p.cmp,
+		kvData:  p.kvData,
+		entries: make([]hashEntry, 0, p.n),
+	}
+	for _, bucket := range p.buckets {
+		for _, e := range bucket {
+			if slice != nil {
+				key := p.key(e)
+				if (slice.Start != nil && p.cmp.Compare(key, slice.Start) < 0) ||
+					(slice.Limit != nil && p.cmp.Compare(key, slice.Limit) >= 0) {
+					continue
+				}
+			}
+			a.entries = append(a.entries, e)
+		}
+	}
+	p.mu.RUnlock()
+	sort.Sort(a)
+	return iterator.NewArrayIterator(a)
+}
+
+// Capacity returns keys/values buffer capacity.
+func (p *HashDB) Capacity() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return cap(p.kvData)
+}
+
+// MemoryUsage returns the approximate size of the memory held by the DB,
+// the key/value buffer and the bucket entries.
+func (p *HashDB) MemoryUsage() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return cap(p.kvData) + p.n*3*intSize
+}
+
+// Size returns sum of keys and values length. Note that deleted
+// key/value will not be accounted for, but it will still consume
+// the buffer, since the buffer is append only.
+func (p *HashDB) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.kvSize
+}
+
+// Free returns keys/values free buffer before need to grow.
+func (p *HashDB) Free() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return cap(p.kvData) - len(p.kvData)
+}
+
+// Len returns the number of entries in the HashDB.
+func (p *HashDB) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.n
+}
+
+// Reset resets the HashDB to initial empty state. Allows reuse the buffer.
+func (p *HashDB) Reset() {
+	p.mu.Lock()
+	p.n = 0
+	p.kvSize = 0
+	p.kvData = p.kvData[:0]
+	p.buckets = make(map[string][]hashEntry)
+	p.mu.Unlock()
+}
+
+func wholeKey(key []byte) []byte { return key }
+
+// NewHash creates a new initialized in-memory key/value HashDB. The
+// capacity is the initial key/value buffer capacity. The capacity is
+// advisory, not enforced.
+//
+// Keys are grouped into buckets by the prefix given by the comparer, if
+// it implements Prefixer; otherwise each key is its own bucket and Find
+// only finds exact matches.
+//
+// This HashDB is append-only, deleting an entry would remove entry but not
+// reclaim KV buffer.
+//
+// The returned HashDB instance is safe for concurrent use.
+func NewHash(cmp comparer.BasicComparer, capacity int) *HashDB {
+	p := &HashDB{
+		cmp:     cmp,
+		prefix:  wholeKey,
+		kvData:  make([]byte, 0, capacity),
+		buckets: make(map[string][]hashEntry),
+	}
+	if x, ok := cmp.(Prefixer); ok {
+		p.prefix = x.Prefix
+	}
+	return p
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package memdb
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
+	"github.com/btcsuite/goleveldb/leveldb/iterator"
+	"github.com/btcsuite/goleveldb/leveldb/testutil"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+func (p *HashDB) TestPut(key []byte, value []byte) error {
+	p.Put(key, value)
+	return nil
+}
+
+func (p *HashDB) TestDelete(key []byte) error {
+	p.Delete(key)
+	return nil
+}
+
+func (p *HashDB) TestFind(key []byte) (rkey, rvalue []byte, err error) {
+	return p.Find(key)
+}
+
+func (p *HashDB) TestGet(key []byte) (value []byte, err error) {
+	return p.Get(key)
+}
+
+func (p *HashDB) TestNewIterator(slice *util.Range) iterator.Iterator {
+	return p.NewIterator(slice)
+}
+
+// prefixComparer groups keys by the given number of leading bytes.
+type prefixComparer struct {
+	comparer.Comparer
+	n int
+}
+
+func (c prefixComparer) Prefix(key []byte) []byte {
+	if len(key) < c.n {
+		return key
+	}
+	return key[:c.n]
+}
+
+var _ = testutil.Defer(func() {
+	Describe("HashDB", func() {
+		// A single bucket, so Find behaves as on DB.
+		cmp := prefixComparer{comparer.DefaultComparer, 0}
+
+		Describe("write test", func() {
+			It("should do write correctly", func() {
+				db := NewHash(cmp, 0)
+				t := testutil.DBTesting{
+					DB:      db,
+					Deleted: testutil.KeyValue_Generate(nil, 1000, 1, 1, 30, 5, 5).Clone(),
+					PostFn: func(t *testutil.DBTesting) {
+						Expect(db.Len()).Should(Equal(t.Present.Len()))
+						Expect(db.Size()).Should(Equal(t.Present.Size()))
+						switch t.Act {
+						case testutil.DBPut, testutil.DBOverwrite:
+							Expect(db.Contains(t.ActKey)).Should(BeTrue())
+						default:
+							Expect(db.Contains(t.ActKey)).Should(BeFalse())
+						}
+					},
+				}
+				testutil.DoDBTesting(&t)
+			})
+		})
+
+		Describe("read test", func() {
+			testutil.AllKeyValueTesting(nil, func(kv testutil.KeyValue) testutil.DB {
+				db := NewHash(cmp, 0)
+				kv.IterateShuffled(nil, func(i int, key, value []byte) {
+					db.Put(key, value)
+				})
+				return db
+			}, nil, nil)
+		})
+
+		It("should only find keys within the bucket", func() {
+			db := NewHash(prefixComparer{comparer.DefaultComparer, 1}, 0)
+			for _, key := range []string{"a1", "a3", "b1", "b2"} {
+				Expect(db.Put([]byte(key), []byte("v"+key))).ShouldNot(HaveOccurred())
+			}
+
+			rkey, rvalue, err := db.Find([]byte("a2"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(rkey).Should(Equal([]byte("a3")))
+			Expect(rvalue).Should(Equal([]byte("va3")))
+
+			_, _, err = db.Find([]byte("a4"))
+			Expect(err).Should(Equal(ErrNotFound))
+			_, _, err = db.Find([]byte("c"))
+			Expect(err).Should(Equal(ErrNotFound))
+
+			Expect(db.Delete([]byte("a1"))).ShouldNot(HaveOccurred())
+			Expect(db.Delete([]byte("a1"))).Should(Equal(ErrNotFound))
+
+			iter := db.NewIterator(&util.Range{Start: []byte("a2"), Limit: []byte("b2")})
+			var keys []string
+			for iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			iter.Release()
+			Expect(keys).Should(Equal([]string{"a3", "b1"}))
+		})
+	})
+})
@@ -10,6 +10,8 @@ package memdb
 import (
 	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/goleveldb/leveldb/comparer"
 	"github.com/btcsuite/goleveldb/leveldb/errors"
@@ -25,6 +27,31 @@ var (
 
 const tMaxHeight = 12
 
+// Size of an int, in bytes.
+const intSize = 32 << (^uint(0) >> 63) / 8
+
+// Number of DBs created, so that DBs created at once get distinct seeds.
+var seedCount int64
+
+// Returns a seed for the random source of the node heights of a new DB.
+// Seeds are unpredictable, so that the structure of a DB can't be steered
+// into its worst case by choosing the insertion order; tests wanting a
+// reproducible structure pass their own seed to newDB.
+func randSeed() int64 {
+	return time.Now().UnixNano() ^ atomic.AddInt64(&seedCount, 1)<<32
+}
+
+// Kind is the kind of a DB entry, see DB.PutTombstone.
+type Kind int
+
+// Kinds of DB entries.
+const (
+	// KindSet is the kind of entries set by Put.
+	KindSet Kind = iota
+	// KindDel is the kind of delete markers set by PutTombstone.
+	KindDel
+)
+
 type dbIter struct {
 	util.BasicReleaser
 	p          *DB
@@ -39,7 +66,7 @@ func (i *dbIter) fill(checkStart, checkLimit bool) bool {
 	if i.node != 0 {
 		n := i.p.nodeData[i.node]
 		m := n + i.p.nodeData[i.node+nKey]
-		i.key = i.p.kvData[n:m]
+		i.key = i.p.kv.get(n, m-n)
 		if i.slice != nil {
 			switch {
 			case checkLimit && i.slice.Limit != nil && i.p.cmp.Compare(i.key, i.slice.Limit) >= 0:
@@ -49,7 +76,7 @@ func (i *dbIter) fill(checkStart, checkLimit bool) bool {
 				goto bail
 			}
 		}
-		i.value = i.p.kvData[m : m+i.p.nodeData[i.node+nVal]]
+		i.value = i.p.kv.get(m, i.p.nodeData[i.node+nVal])
 		return true
 	}
 bail:
@@ -174,23 +201,32 @@ const (
 	nKV = iota
 	nKey
 	nVal
-	nHeight
+	nHeight // The kind is packed above the height, see nKindShift.
 	nNext
 )
 
+// Shift of the kind packed in the height field of a node.
+const nKindShift = 8
+
+// Returns the height field of a node of the given height and kind.
+func packHeight(h int, kind Kind) int {
+	return h | int(kind)<<nKindShift
+}
+
 // DB is an in-memory key/value database.
 type DB struct {
-	cmp comparer.BasicComparer
-	rnd *rand.Rand
+	cmp  comparer.BasicComparer
+	seed int64
+	rnd  *rand.Rand
 
-	mu     sync.RWMutex
-	kvData []byte
+	mu sync.RWMutex
+	kv *arena
 	// Node data:
 	// [0]         : KV offset
 	// [1]         : Key length
 	// [2]         : Value length
-	// [3]         : Height
-	// [3..height] : Next nodes
+	// [3]         : Height, and kind above nKindShift
+	// [4..height] : Next nodes
 	nodeData  []int
 	prevNode  [tMaxHeight]int
 	maxHeight int
@@ -198,6 +234,16 @@ type DB struct {
 	kvSize    int
 }
 
+// Returns the height of the given node; need external synchronization.
+func (p *DB) nodeHeight(node int) int {
+	return p.nodeData[node+nHeight] & (1<<nKindShift - 1)
+}
+
+// Returns the kind of the given node; need external synchronization.
+func (p *DB) nodeKind(node int) Kind {
+	return Kind(p.nodeData[node+nHeight] >> nKindShift)
+}
+
 func (p *DB) randHeight() (h int) {
 	const branching = 4
 	h = 1
@@ -216,7 +262,7 @@ func (p *DB) findGE(key []byte, prev bool) (int, bool) {
 		cmp := 1
 		if next != 0 {
 			o := p.nodeData[next]
-			cmp = p.cmp.Compare(p.kvData[o:o+p.nodeData[next+nKey]], key)
+			cmp = p.cmp.Compare(p.kv.get(o, p.nodeData[next+nKey]), key)
 		}
 		if cmp < 0 {
 			// Keep searching in this list
@@ -241,7 +287,7 @@ func (p *DB) findLT(key []byte) int {
 	for {
 		next := p.nodeData[node+nNext+h]
 		o := p.nodeData[next]
-		if next == 0 || p.cmp.Compare(p.kvData[o:o+p.nodeData[next+nKey]], key) >= 0 {
+		if next == 0 || p.cmp.Compare(p.kv.get(o, p.nodeData[next+nKey]), key) >= 0 {
 			if h == 0 {
 				break
 			}
@@ -275,16 +321,30 @@ func (p *DB) findLast() int {
 //
 // It is safe to modify the contents of the arguments after Put returns.
 func (p *DB) Put(key []byte, value []byte) error {
+	return p.put(key, value, KindSet)
+}
+
+// PutTombstone sets a delete marker for the given key, overwriting any
+// previous value. Unlike Delete, the key stays in the DB, so that GetKind
+// and FindKind tell a deleted key from a missing one; Get, Find and
+// iterators see a delete marker as an entry with an empty value.
+//
+// It is safe to modify the contents of the arguments after PutTombstone
+// returns.
+func (p *DB) PutTombstone(key []byte) error {
+	return p.put(key, nil, KindDel)
+}
+
+func (p *DB) put(key []byte, value []byte, kind Kind) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	if node, exact := p.findGE(key, true); exact {
-		kvOffset := len(p.kvData)
-		p.kvData = append(p.kvData, key...)
-		p.kvData = append(p.kvData, value...)
+		kvOffset := p.kv.alloc(key, value)
 		p.nodeData[node] = kvOffset
 		m := p.nodeData[node+nVal]
 		p.nodeData[node+nVal] = len(value)
+		p.nodeData[node+nHeight] = packHeight(p.nodeHeight(node), kind)
 		p.kvSize += len(value) - m
 		return nil
 	}
@@ -297,12 +357,10 @@ func (p *DB) Put(key []byte, value []byte) error {
 		p.maxHeight = h
 	}
 
-	kvOffset := len(p.kvData)
-	p.kvData = append(p.kvData, key...)
-	p.kvData = append(p.kvData, value...)
+	kvOffset := p.kv.alloc(key, value)
 	// Node
 	node := len(p.nodeData)
-	p.nodeData = append(p.nodeData, kvOffset, len(key), len(value), h)
+	p.nodeData = append(p.nodeData, kvOffset, len(key), len(value), packHeight(h, kind))
 	for i, n := range p.prevNode[:h] {
 		m := n + nNext + i
 		p.nodeData = append(p.nodeData, p.nodeData[m])
@@ -327,7 +385,7 @@ func (p *DB) Delete(key []byte) error {
 		return ErrNotFound
 	}
 
-	h := p.nodeData[node+nHeight]
+	h := p.nodeHeight(node)
 	for i, n := range p.prevNode[:h] {
 		m := n + nNext + i
 		p.nodeData[m] = p.nodeData[p.nodeData[m]+nNext+i]
@@ -357,7 +415,25 @@ func (p *DB) Get(key []byte) (value []byte, err error) {
 	p.mu.RLock()
 	if node, exact := p.findGE(key, false); exact {
 		o := p.nodeData[node] + p.nodeData[node+nKey]
-		value = p.kvData[o : o+p.nodeData[node+nVal]]
+		value = p.kv.get(o, p.nodeData[node+nVal])
+	} else {
+		err = ErrNotFound
+	}
+	p.mu.RUnlock()
+	return
+}
+
+// GetKind is like Get, but also returns the kind of the entry, which is
+// KindDel if the key has a delete marker, see PutTombstone.
+//
+// The caller should not modify the contents of the returned slice, but
+// it is safe to modify the contents of the argument after GetKind returns.
+func (p *DB) GetKind(key []byte) (value []byte, kind Kind, err error) {
+	p.mu.RLock()
+	if node, exact := p.findGE(key, false); exact {
+		o := p.nodeData[node] + p.nodeData[node+nKey]
+		value = p.kv.get(o, p.nodeData[node+nVal])
+		kind = p.nodeKind(node)
 	} else {
 		err = ErrNotFound
 	}
@@ -372,12 +448,23 @@ func (p *DB) Get(key []byte) (value []byte, err error) {
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Find returns.
 func (p *DB) Find(key []byte) (rkey, value []byte, err error) {
+	rkey, value, _, err = p.FindKind(key)
+	return
+}
+
+// FindKind is like Find, but also returns the kind of the found entry,
+// see GetKind.
+//
+// The caller should not modify the contents of the returned slice, but
+// it is safe to modify the contents of the argument after FindKind returns.
+func (p *DB) FindKind(key []byte) (rkey, value []byte, kind Kind, err error) {
 	p.mu.RLock()
 	if node, _ := p.findGE(key, false); node != 0 {
 		n := p.nodeData[node]
 		m := n + p.nodeData[node+nKey]
-		rkey = p.kvData[n:m]
-		value = p.kvData[m : m+p.nodeData[node+nVal]]
+		rkey = p.kv.get(n, m-n)
+		value = p.kv.get(m, p.nodeData[node+nVal])
+		kind = p.nodeKind(node)
 	} else {
 		err = ErrNotFound
 	}
@@ -408,7 +495,7 @@ func (p *DB) NewIterator(slice *util.Range) iterator.Iterator {
 func (p *DB) Capacity() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return cap(p.kvData)
+	return p.kv.capacity()
 }
 
 // Size returns sum of keys and values length. Note that deleted
@@ -420,11 +507,19 @@ func (p *DB) Size() int {
 	return p.kvSize
 }
 
+// MemoryUsage returns the approximate size of the memory held by the DB,
+// the key/value buffer as allocated and the skiplist nodes.
+func (p *DB) MemoryUsage() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.kv.allocatedSize() + cap(p.nodeData)*intSize
+}
+
 // Free returns keys/values free buffer before need to grow.
 func (p *DB) Free() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return cap(p.kvData) - len(p.kvData)
+	return p.kv.free()
 }
 
 // Len returns the number of entries in the DB.
@@ -437,11 +532,11 @@ func (p *DB) Len() int {
 // Reset resets the DB to initial empty state. Allows reuse the buffer.
 func (p *DB) Reset() {
 	p.mu.Lock()
-	p.rnd = rand.New(rand.NewSource(0xdeadbeef))
+	p.rnd = rand.New(rand.NewSource(p.seed))
 	p.maxHeight = 1
 	p.n = 0
 	p.kvSize = 0
-	p.kvData = p.kvData[:0]
+	p.kv.reset()
 	p.nodeData = p.nodeData[:nNext+tMaxHeight]
 	p.nodeData[nKV] = 0
 	p.nodeData[nKey] = 0
@@ -463,13 +558,41 @@ func (p *DB) Reset() {
 //
 // The returned DB instance is safe for concurrent use.
 func New(cmp comparer.BasicComparer, capacity int) *DB {
+	return NewWithArenaBlockSize(cmp, capacity, 0)
+}
+
+// NewWithArenaBlockSize is like New, but allocates the key/value buffer
+// by blocks of the given size, as needed, instead of preallocating the
+// whole capacity. A key/value pair larger than a block gets a buffer of its
+// own; growing the buffer then doesn't copy the pairs already in. Smaller
+// blocks waste less memory on small DBs, while larger blocks waste less on
+// the free space left at the end of each block. A zero block size means a
+// single buffer, as New.
+func NewWithArenaBlockSize(cmp comparer.BasicComparer, capacity, blockSize int) *DB {
+	return newDB(cmp, capacity, blockSize, randSeed())
+}
+
+// Creates a DB whose node heights are drawn from a random source of the
+// given seed, e.g. to reproduce the structure of a DB in a test. The seed
+// is kept across Reset.
+func newDB(cmp comparer.BasicComparer, capacity, blockSize int, seed int64) *DB {
 	p := &DB{
 		cmp:       cmp,
-		rnd:       rand.New(rand.NewSource(0xdeadbeef)),
+		seed:      seed,
+		rnd:       rand.New(rand.NewSource(seed)),
 		maxHeight: 1,
-		kvData:    make([]byte, 0, capacity),
-		nodeData:  make([]int, 4+tMaxHeight),
+		kv:        newArena(capacity, blockSize),
+		nodeData:  make([]int, nNext+tMaxHeight),
 	}
 	p.nodeData[nHeight] = tMaxHeight
 	return p
 }
+
+// Slack returns the bytes of the key/value buffer allocated but not used
+// by any key/value pair, e.g. the free space left at the end of each block,
+// see NewWithArenaBlockSize.
+func (p *DB) Slack() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.kv.slack()
+}
@@ -7,6 +7,9 @@
 package memdb
 
 import (
+	"bytes"
+	"math/rand"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -21,8 +24,8 @@ func (p *DB) TestFindLT(key []byte) (rkey, value []byte, err error) {
 	if node := p.findLT(key); node != 0 {
 		n := p.nodeData[node]
 		m := n + p.nodeData[node+nKey]
-		rkey = p.kvData[n:m]
-		value = p.kvData[m : m+p.nodeData[node+nVal]]
+		rkey = p.kv.get(n, m-n)
+		value = p.kv.get(m, p.nodeData[node+nVal])
 	} else {
 		err = ErrNotFound
 	}
@@ -35,8 +38,8 @@ func (p *DB) TestFindLast() (rkey, value []byte, err error) {
 	if node := p.findLast(); node != 0 {
 		n := p.nodeData[node]
 		m := n + p.nodeData[node+nKey]
-		rkey = p.kvData[n:m]
-		value = p.kvData[m : m+p.nodeData[node+nVal]]
+		rkey = p.kv.get(n, m-n)
+		value = p.kv.get(m, p.nodeData[node+nVal])
 	} else {
 		err = ErrNotFound
 	}
@@ -89,6 +92,145 @@ var _ = testutil.Defer(func() {
 			})
 		})
 
+		Describe("tombstone test", func() {
+			It("should tell a delete marker from a missing key", func() {
+				db := New(comparer.DefaultComparer, 0)
+				Expect(db.Put([]byte("a"), []byte("va"))).ShouldNot(HaveOccurred())
+				Expect(db.Put([]byte("b"), []byte("vb"))).ShouldNot(HaveOccurred())
+				Expect(db.PutTombstone([]byte("b"))).ShouldNot(HaveOccurred())
+				Expect(db.PutTombstone([]byte("c"))).ShouldNot(HaveOccurred())
+				Expect(db.Len()).Should(Equal(3))
+
+				value, kind, err := db.GetKind([]byte("a"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(value).Should(Equal([]byte("va")))
+				Expect(kind).Should(Equal(KindSet))
+
+				for _, key := range []string{"b", "c"} {
+					value, kind, err = db.GetKind([]byte(key))
+					Expect(err).ShouldNot(HaveOccurred(), "Key %q", key)
+					Expect(value).Should(BeEmpty(), "Value for key %q", key)
+					Expect(kind).Should(Equal(KindDel), "Kind for key %q", key)
+				}
+
+				_, _, err = db.GetKind([]byte("d"))
+				Expect(err).Should(Equal(ErrNotFound))
+
+				rkey, _, kind, err := db.FindKind([]byte("ab"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(rkey).Should(Equal([]byte("b")))
+				Expect(kind).Should(Equal(KindDel))
+
+				// Setting a deleted key again makes it a plain entry.
+				Expect(db.Put([]byte("b"), []byte("vb2"))).ShouldNot(HaveOccurred())
+				value, kind, err = db.GetKind([]byte("b"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(value).Should(Equal([]byte("vb2")))
+				Expect(kind).Should(Equal(KindSet))
+
+				Expect(db.Delete([]byte("c"))).ShouldNot(HaveOccurred())
+				_, _, err = db.GetKind([]byte("c"))
+				Expect(err).Should(Equal(ErrNotFound))
+
+				db.Reset()
+				Expect(db.PutTombstone([]byte("a"))).ShouldNot(HaveOccurred())
+				_, kind, err = db.GetKind([]byte("a"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(kind).Should(Equal(KindDel))
+			})
+		})
+
+		Describe("arena test", func() {
+			It("should do write correctly", func() {
+				db := NewWithArenaBlockSize(comparer.DefaultComparer, 0, 64)
+				t := testutil.DBTesting{
+					DB:      db,
+					Deleted: testutil.KeyValue_Generate(nil, 1000, 1, 1, 30, 5, 100).Clone(),
+					PostFn: func(t *testutil.DBTesting) {
+						Expect(db.Len()).Should(Equal(t.Present.Len()))
+						Expect(db.Size()).Should(Equal(t.Present.Size()))
+					},
+				}
+				testutil.DoDBTesting(&t)
+			})
+
+			It("should give oversized pairs a block of their own", func() {
+				db := NewWithArenaBlockSize(comparer.DefaultComparer, 1000, 64)
+				Expect(db.Capacity()).Should(Equal(1000))
+				Expect(db.Free()).Should(Equal(1000))
+				Expect(db.Slack()).Should(Equal(0))
+
+				big := bytes.Repeat([]byte{'x'}, 150)
+				Expect(db.Put([]byte("a"), []byte("va"))).ShouldNot(HaveOccurred())
+				Expect(db.Put([]byte("b"), big)).ShouldNot(HaveOccurred())
+				Expect(db.Put([]byte("c"), []byte("vc"))).ShouldNot(HaveOccurred())
+				// Two blocks, and the buffer of the oversized pair.
+				Expect(db.Size()).Should(Equal(157))
+				Expect(db.Slack()).Should(Equal(2*64 + 151 - 157))
+				Expect(db.Free()).Should(Equal(1000 - 157))
+
+				for _, kv := range [][2][]byte{{[]byte("a"), []byte("va")}, {[]byte("b"), big}, {[]byte("c"), []byte("vc")}} {
+					value, err := db.Get(kv[0])
+					Expect(err).ShouldNot(HaveOccurred(), "Key %q", kv[0])
+					Expect(value).Should(Equal(kv[1]), "Value for key %q", kv[0])
+				}
+
+				db.Reset()
+				Expect(db.Slack()).Should(Equal(64))
+				Expect(db.Put([]byte("d"), []byte("vd"))).ShouldNot(HaveOccurred())
+				value, err := db.Get([]byte("d"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(value).Should(Equal([]byte("vd")))
+				Expect(db.Slack()).Should(Equal(64 - 3))
+			})
+		})
+
+		Describe("memory usage test", func() {
+			It("should account the buffer and the nodes", func() {
+				// The buffer is preallocated, while blocks are allocated as
+				// needed.
+				Expect(New(comparer.DefaultComparer, 1000).MemoryUsage()).Should(BeNumerically(">=", 1000))
+				Expect(NewWithArenaBlockSize(comparer.DefaultComparer, 1000, 64).MemoryUsage()).Should(BeNumerically("<", 1000))
+
+				for _, db := range []*DB{New(comparer.DefaultComparer, 1000), NewWithArenaBlockSize(comparer.DefaultComparer, 1000, 64)} {
+					prev := db.MemoryUsage()
+					for i := 0; i < 10; i++ {
+						Expect(db.Put([]byte{byte(i)}, make([]byte, 100))).ShouldNot(HaveOccurred())
+					}
+					Expect(db.MemoryUsage()).Should(BeNumerically(">=", prev+10*101))
+				}
+			})
+		})
+
+		Describe("seed test", func() {
+			It("should build the same structure from the same seed", func() {
+				kv := testutil.KeyValue_Generate(nil, 500, 1, 1, 10, 1, 10)
+				build := func(seed int64) *DB {
+					db := newDB(comparer.DefaultComparer, 0, 0, seed)
+					kv.IterateShuffled(rand.New(rand.NewSource(1)), func(i int, key, value []byte) {
+						db.Put(key, value)
+					})
+					return db
+				}
+
+				db1, db2 := build(42), build(42)
+				Expect(db1.nodeData).Should(Equal(db2.nodeData))
+				Expect(db1.maxHeight).Should(Equal(db2.maxHeight))
+				Expect(build(43).nodeData).ShouldNot(Equal(db1.nodeData))
+
+				// Reset restarts the random source.
+				db1.Reset()
+				kv.IterateShuffled(rand.New(rand.NewSource(1)), func(i int, key, value []byte) {
+					db1.Put(key, value)
+				})
+				Expect(db1.nodeData).Should(Equal(db2.nodeData))
+			})
+
+			It("should seed each DB differently by default", func() {
+				Expect(New(comparer.DefaultComparer, 0).seed).ShouldNot(Equal(New(comparer.DefaultComparer, 0).seed))
+			})
+		})
+
 		Describe("read test", func() {
 			testutil.AllKeyValueTesting(nil, func(kv testutil.KeyValue) testutil.DB {
 				// Building the DB.
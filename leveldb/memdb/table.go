@@ -0,0 +1,109 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package memdb
+
+import (
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
+	"github.com/btcsuite/goleveldb/leveldb/iterator"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// Table is the interface of an in-memory key/value table. It is
+// implemented by DB, the default skiplist based table, and by HashDB.
+//
+// A Table must be safe for concurrent use.
+type Table interface {
+	// Put sets the value for the given key, overwriting any previous value.
+	Put(key []byte, value []byte) error
+
+	// Delete deletes the value for the given key. It returns ErrNotFound
+	// if the table does not contain the key.
+	Delete(key []byte) error
+
+	// Contains returns true if the given key are in the table.
+	Contains(key []byte) bool
+
+	// Get gets the value for the given key. It returns ErrNotFound if the
+	// table does not contain the key.
+	Get(key []byte) (value []byte, err error)
+
+	// Find finds key/value pair whose key is greater than or equal to the
+	// given key. It returns ErrNotFound if the table doesn't contain
+	// such pair.
+	Find(key []byte) (rkey, value []byte, err error)
+
+	// NewIterator returns an iterator of the table, in key order.
+	NewIterator(slice *util.Range) iterator.Iterator
+
+	// Capacity returns keys/values buffer capacity.
+	Capacity() int
+
+	// Size returns sum of keys and values length.
+	Size() int
+
+	// Free returns keys/values free buffer before need to grow.
+	Free() int
+
+	// Len returns the number of entries in the table.
+	Len() int
+
+	// Reset resets the table to initial empty state.
+	Reset()
+}
+
+// Factory creates in-memory key/value tables.
+type Factory interface {
+	New(cmp comparer.BasicComparer, capacity int) Table
+}
+
+// FactoryFunc is an adapter to allow the use of ordinary functions as
+// Factory.
+type FactoryFunc func(cmp comparer.BasicComparer, capacity int) Table
+
+// New calls f(cmp, capacity).
+func (f FactoryFunc) New(cmp comparer.BasicComparer, capacity int) Table {
+	return f(cmp, capacity)
+}
+
+// ArenaFactory is the interface of the factories whose tables can allocate
+// their key/value buffer by blocks, see NewWithArenaBlockSize.
+type ArenaFactory interface {
+	Factory
+
+	// NewWithArenaBlockSize is like New, but the tables allocate their
+	// key/value buffer by blocks of the given size.
+	NewWithArenaBlockSize(cmp comparer.BasicComparer, capacity, blockSize int) Table
+}
+
+type skiplistFactory struct{}
+
+func (skiplistFactory) New(cmp comparer.BasicComparer, capacity int) Table {
+	return New(cmp, capacity)
+}
+
+func (skiplistFactory) NewWithArenaBlockSize(cmp comparer.BasicComparer, capacity, blockSize int) Table {
+	return NewWithArenaBlockSize(cmp, capacity, blockSize)
+}
+
+var (
+	// SkiplistFactory creates skiplist based tables, see New. It
+	// implements ArenaFactory.
+	SkiplistFactory Factory = skiplistFactory{}
+
+	// HashFactory creates hash based tables, see NewHash.
+	HashFactory Factory = FactoryFunc(func(cmp comparer.BasicComparer, capacity int) Table {
+		return NewHash(cmp, capacity)
+	})
+)
+
+// MemoryUser is the interface of the tables that can report the memory
+// they hold, which Capacity doesn't account for in full.
+type MemoryUser interface {
+	// MemoryUsage returns the approximate size of the memory held by the
+	// table: its key/value buffer and its index structures.
+	MemoryUsage() int
+}
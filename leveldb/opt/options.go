@@ -8,11 +8,15 @@
 package opt
 
 import (
+	"fmt"
+	"io"
 	"math"
+	"time"
 
 	"github.com/btcsuite/goleveldb/leveldb/cache"
 	"github.com/btcsuite/goleveldb/leveldb/comparer"
 	"github.com/btcsuite/goleveldb/leveldb/filter"
+	"github.com/btcsuite/goleveldb/leveldb/memdb"
 )
 
 const (
@@ -22,8 +26,10 @@ const (
 )
 
 var (
+	DefaultBlobFileThreshold             = 4 * KiB
 	DefaultBlockCacher                   = LRUCacher
 	DefaultBlockCacheCapacity            = 8 * MiB
+	DefaultBlockCachePolicy              = LRUCachePolicy
 	DefaultBlockRestartInterval          = 16
 	DefaultBlockSize                     = 4 * KiB
 	DefaultCompactionExpandLimitFactor   = 25
@@ -36,8 +42,14 @@ var (
 	DefaultCompactionTotalSizeMultiplier = 10.0
 	DefaultCompressionType               = SnappyCompression
 	DefaultIteratorSamplingRate          = 1 * MiB
+	DefaultManifestSyncInterval          = time.Second
+	DefaultManifestSyncType              = EagerManifestSync
+	DefaultMaxFormatVersion              = LatestFormat
+	DefaultMemTableFactory               = memdb.SkiplistFactory
 	DefaultOpenFilesCacher               = LRUCacher
 	DefaultOpenFilesCacheCapacity        = 500
+	DefaultRecoveryConcurrency           = 4
+	DefaultTableCacheShards              = 1
 	DefaultWriteBuffer                   = 4 * MiB
 	DefaultWriteL0PauseTrigger           = 12
 	DefaultWriteL0SlowdownTrigger        = 8
@@ -65,10 +77,52 @@ var (
 	// LRUCacher is the LRU-cache algorithm.
 	LRUCacher = &CacherFunc{cache.NewLRU}
 
+	// TwoQueueCacher is the scan-resistant 2Q-cache algorithm.
+	TwoQueueCacher = &CacherFunc{cache.New2Q}
+
+	// ClockCacher is the CLOCK-cache algorithm.
+	ClockCacher = &CacherFunc{cache.NewClock}
+
 	// NoCacher is the value to disable caching algorithm.
 	NoCacher = &CacherFunc{}
 )
 
+// CachePolicy is the eviction policy of a cache.
+type CachePolicy uint
+
+func (p CachePolicy) String() string {
+	switch p {
+	case DefaultCachePolicy:
+		return "default"
+	case LRUCachePolicy:
+		return "lru"
+	case TwoQueueCachePolicy:
+		return "2q"
+	case ClockCachePolicy:
+		return "clock"
+	}
+	return "invalid"
+}
+
+// Cacher returns the caching algorithm implementing the policy.
+func (p CachePolicy) Cacher() Cacher {
+	switch p {
+	case TwoQueueCachePolicy:
+		return TwoQueueCacher
+	case ClockCachePolicy:
+		return ClockCacher
+	}
+	return LRUCacher
+}
+
+const (
+	DefaultCachePolicy CachePolicy = iota
+	LRUCachePolicy
+	TwoQueueCachePolicy
+	ClockCachePolicy
+	nCachePolicy
+)
+
 // Compression is the 'sorted table' block compression algorithm to use.
 type Compression uint
 
@@ -91,6 +145,88 @@ const (
 	nCompression
 )
 
+// ManifestSync is the policy of syncing the manifest on version edits.
+type ManifestSync uint
+
+func (m ManifestSync) String() string {
+	switch m {
+	case DefaultManifestSync:
+		return "default"
+	case EagerManifestSync:
+		return "eager"
+	case LazyManifestSync:
+		return "lazy"
+	}
+	return "invalid"
+}
+
+const (
+	DefaultManifestSync ManifestSync = iota
+	EagerManifestSync
+	LazyManifestSync
+	nManifestSync
+)
+
+// BlockTransform is the interface that transforms the blocks of the
+// 'sorted tables' and the records of the journals on their way to and from
+// the storage, e.g. to encrypt them. Decode must reverse Encode, and both
+// must be safe for concurrent use.
+type BlockTransform interface {
+	// Name returns the name of the transform, which is recorded along
+	// with the transformed data.
+	Name() string
+
+	// Encode appends the encoded src to dst and returns the result.
+	Encode(dst, src []byte) ([]byte, error)
+
+	// Decode appends the decoded src to dst and returns the result.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// MetricsHook is the interface that observes DB operations, e.g. to feed
+// latency histograms. The methods are called synchronously by the DB, so
+// they must be cheap, and concurrently, so they must be safe for
+// concurrent use.
+type MetricsHook interface {
+	// ObserveGet is called after each Get, found reports whether the key
+	// was found.
+	ObserveGet(d time.Duration, found bool)
+
+	// ObservePut is called after each Put, size is the sum of the key and
+	// value lengths.
+	ObservePut(d time.Duration, size int)
+
+	// ObserveWrite is called after each Write, batchLen is the number of
+	// records of the batch.
+	ObserveWrite(d time.Duration, batchLen int)
+
+	// ObserveCompaction is called after each compaction, level is the
+	// source level, or -1 for a memdb flush; readBytes and writeBytes are
+	// the sizes of the input and output of the compaction.
+	ObserveCompaction(d time.Duration, level, outputLevel int, readBytes, writeBytes int64)
+}
+
+// Reasons of write stalls, see Options.OnWriteStall.
+const (
+	WriteStallSlowdown = "slowdown"
+	WriteStallPause    = "pause"
+)
+
+// RetryPolicy defines how storage operations failing with a transient
+// error are retried, see Options.StorageRetry.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of an operation,
+	// including the first one. A value below 2 disables retrying.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, doubled before each
+	// subsequent retry.
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay before a retry. Zero means no cap.
+	MaxBackoff time.Duration
+}
+
 // Strict is the DB 'strict level'.
 type Strict uint
 
@@ -106,6 +242,8 @@ const (
 	// If present then a corrupted or invalid chunk or block in journal
 	// will cause an error instead of being dropped.
 	// This will prevent database with corrupted journal to be opened.
+	// An incomplete record at the tail of the journal, as left by a crash
+	// during write, is always dropped and never considered as corruption.
 	StrictJournal
 
 	// If present then 'sorted table' block checksum will be verified.
@@ -126,8 +264,13 @@ const (
 	// 'strict level' will override global ones.
 	StrictOverride
 
+	// If present then keys of write operations are checked by the
+	// comparer, if it implements comparer.KeyChecker; e.g. a key of the
+	// wrong length is rejected under comparer.NewFixedLengthComparer.
+	StrictKeys
+
 	// StrictAll enables all strict flags.
-	StrictAll = StrictManifest | StrictJournalChecksum | StrictJournal | StrictBlockChecksum | StrictCompaction | StrictReader | StrictRecovery
+	StrictAll = StrictManifest | StrictJournalChecksum | StrictJournal | StrictBlockChecksum | StrictCompaction | StrictReader | StrictRecovery | StrictKeys
 
 	// DefaultStrict is the default strict flags. Specify any strict flags
 	// will override default strict flags as whole (i.e. not OR'ed).
@@ -137,6 +280,33 @@ const (
 	NoStrict = ^StrictAll
 )
 
+// On-disk format versions, see Options.MaxFormatVersion.
+//
+// Compatibility matrix:
+//
+//	Format  Features            Readable by
+//	1       original LevelDB    any LevelDB implementation
+//	2       blob files          this package with blob files support
+//	3       two-level indexes   this package with two-level index support
+//	4       block transforms    this package with block transform support
+//
+// A DB is always readable by versions of this package that support its
+// format version; opening a DB with a newer format version than supported
+// fails with leveldb.ErrUnsupportedFormat. Format version 1 isn't recorded
+// in the DB; any newer format version is, in a manifest record that other
+// LevelDB implementations and versions of this package that predate format
+// versions fail to decode, so they can't open the DB at all. The upgrade is
+// one-way, a DB is never downgraded.
+const (
+	FormatV1 = 1
+	FormatV2 = 2
+	FormatV3 = 3
+	FormatV4 = 4
+
+	// LatestFormat is the newest format version supported by this package.
+	LatestFormat = FormatV4
+)
+
 // Options holds the optional parameters for the DB at large.
 type Options struct {
 	// AltFilters defines one or more 'alternative filters'.
@@ -146,18 +316,51 @@ type Options struct {
 	// The default value is nil
 	AltFilters []filter.Filter
 
+	// BlobFileThreshold defines the minimum value size (in bytes) for a value
+	// to be stored in a blob file, when EnableBlobFiles is true.
+	//
+	// The default value is 4KiB.
+	BlobFileThreshold int
+
+	// BlockCache is a 'sorted table' block cache to share with other DBs,
+	// e.g. cache.NewCache(cache.NewLRU(capacity)), so that the block
+	// caching of all of them is bounded by its capacity. Each DB keeps its
+	// blocks under its own namespaces and evicts them once closed; the
+	// cache is never closed by a DB, and DB.SetOptions can't change its
+	// capacity. DB.Stats reports the size of the whole shared cache.
+	// At most 65536 open DBs can share a block cache, and their table
+	// numbers must stay below 2^48.
+	//
+	// If set, BlockCacher, BlockCacheCapacity and BlockCachePolicy are
+	// ignored; DisableBlockCache still disables block caching.
+	//
+	// The default value is nil, which gives the DB its own block cache.
+	BlockCache *cache.Cache
+
 	// BlockCacher provides cache algorithm for LevelDB 'sorted table' block caching.
-	// Specify NoCacher to disable caching algorithm.
+	// Specify NoCacher to disable caching algorithm, which has the same
+	// effect as DisableBlockCache.
 	//
-	// The default value is LRUCacher.
+	// The default value is nil, which selects the algorithm of
+	// BlockCachePolicy.
 	BlockCacher Cacher
 
 	// BlockCacheCapacity defines the capacity of the 'sorted table' block caching.
-	// Use -1 for zero, this has same effect as specifying NoCacher to BlockCacher.
+	// Use -1 for zero, this has same effect as specifying NoCacher to
+	// BlockCacher, or DisableBlockCache.
 	//
 	// The default value is 8MiB.
 	BlockCacheCapacity int
 
+	// BlockCachePolicy defines the eviction policy of the 'sorted table'
+	// block caching, it is ignored if BlockCacher is set. LRUCachePolicy
+	// suits most workloads; TwoQueueCachePolicy keeps scans, e.g. from
+	// iterators, from evicting frequently read blocks; ClockCachePolicy
+	// approximates LRU with cheaper cache hits.
+	//
+	// The default value is LRUCachePolicy.
+	BlockCachePolicy CachePolicy
+
 	// BlockRestartInterval is the number of keys between restart points for
 	// delta encoding of keys.
 	//
@@ -170,6 +373,26 @@ type Options struct {
 	// The default value is 4KiB.
 	BlockSize int
 
+	// BlockTransform defines the transform of the 'sorted table' blocks and
+	// the journal records, e.g. to encrypt them at rest. Each table and
+	// journal records the transform name and a check value encoded with
+	// it, so reading data with another transform, or the same one with
+	// another key, fails with errors.ErrBlockTransform instead of returning
+	// garbage. Data written without a transform stays readable, so a
+	// transform can be set on an existing DB.
+	//
+	// The manifest, which holds the smallest and largest key of each
+	// table, and the blob files are not transformed.
+	//
+	// Block transforms need format version FormatV4; unlike other features,
+	// the transform isn't left disabled if MaxFormatVersion is older, the
+	// options are rejected instead. A DB that ever had this option set
+	// can't be opened by versions of this package without block transform
+	// support.
+	//
+	// The default value is nil.
+	BlockTransform BlockTransform
+
 	// CompactionExpandLimitFactor limits compaction size after expanded.
 	// This will be multiplied by table size limit at compaction target level.
 	//
@@ -196,6 +419,17 @@ type Options struct {
 	// The default value is 1.
 	CompactionSourceLimitFactor int
 
+	// CompactionStatsWriter defines a writer that receives a record of each
+	// completed compaction, including memdb flushes, encoded as one JSON
+	// object per line. See leveldb.CompactionRecord for the fields.
+	//
+	// The writer is called by the compaction goroutines, one write at a
+	// time; a slow writer delays compactions. Write errors are logged and
+	// otherwise ignored.
+	//
+	// The default value is nil.
+	CompactionStatsWriter io.Writer
+
 	// CompactionTableSize limits size of 'sorted table' that compaction generates.
 	// The limits for each level will be calculated as:
 	//   CompactionTableSize * (CompactionTableSizeMultiplier ^ Level)
@@ -249,18 +483,34 @@ type Options struct {
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
 
+	// CompressionPerLevel defines per-level 'sorted table' block compression,
+	// overriding Compression, e.g. to leave level-0 uncompressed for speed
+	// and compress deeper levels, or to not compress already compressed
+	// data at all. Use DefaultCompression to fall back to Compression for a
+	// level. Tables flushed from the memdb use the level-0 compression,
+	// whatever level they are put at.
+	//
+	// Each block records its compression, so changing it only affects new
+	// tables.
+	//
+	// The default value is nil.
+	CompressionPerLevel []Compression
+
 	// DisableBufferPool allows disable use of util.BufferPool functionality.
 	//
 	// The default value is false.
 	DisableBufferPool bool
 
 	// DisableBlockCache allows disable use of cache.Cache functionality on
-	// 'sorted table' block.
+	// 'sorted table' block. Every block read then goes straight to the
+	// storage, and the 'cachedblock' property reports zero.
 	//
 	// The default value is false.
 	DisableBlockCache bool
 
 	// DisableCompactionBackoff allows disable compaction retry backoff.
+	// Compactions failing because the disk is full are still backed off,
+	// see OnOutOfSpace.
 	//
 	// The default value is false.
 	DisableCompactionBackoff bool
@@ -272,6 +522,23 @@ type Options struct {
 	// The default is false.
 	DisableLargeBatchTransaction bool
 
+	// EnableBlobFiles allows storing large values in separate blob files
+	// instead of inline in the 'sorted tables'. Values of at least
+	// BlobFileThreshold bytes are moved to a blob file when a memdb is
+	// flushed, and the table only stores a small pointer to it, so
+	// compaction rewrites only keys and pointers.
+	//
+	// A blob file is removed once no table refers to it anymore. Blob files
+	// are never rewritten, so a blob file is kept as long as any of its
+	// values is still live.
+	//
+	// Blob files need format version FormatV2, see MaxFormatVersion. A DB
+	// that ever had this option enabled can't be opened by versions of this
+	// package without blob files support.
+	//
+	// The default value is false.
+	EnableBlobFiles bool
+
 	// ErrorIfExist defines whether an error should returned if the DB already
 	// exist.
 	//
@@ -285,6 +552,15 @@ type Options struct {
 	// The default value is false.
 	ErrorIfMissing bool
 
+	// ExtendedCurrentFile defines whether OpenFile and RecoverFile should
+	// write the CURRENT file in the extended format, which also records a
+	// magic header and the creation time; see storage.FileOptions.
+	// Versions of this package that predate the extended format can't open
+	// a DB which CURRENT file is in that format.
+	//
+	// The default value is false.
+	ExtendedCurrentFile bool
+
 	// Filter defines an 'effective filter' to use. An 'effective filter'
 	// if defined will be used to generate per-table filter block.
 	// The filter name will be stored on disk.
@@ -300,6 +576,19 @@ type Options struct {
 	// The default value is nil.
 	Filter filter.Filter
 
+	// InitialSequence defines the sequence number of a newly created DB;
+	// the first write gets sequence number InitialSequence+1. It allows
+	// aligning sequence numbers with the indices of an external log, see
+	// DB.LastSequence. It must not exceed 2^56-1, the largest sequence
+	// number; writes that would go past it fail with
+	// leveldb.ErrSequenceOverflow.
+	//
+	// This only applies when the DB is created, it is ignored when opening
+	// an existing DB.
+	//
+	// The default value is 0.
+	InitialSequence uint64
+
 	// IteratorSamplingRate defines approximate gap (in bytes) between read
 	// sampling of an iterator. The samples will be used to determine when
 	// compaction should be triggered.
@@ -307,6 +596,147 @@ type Options struct {
 	// The default is 1MiB.
 	IteratorSamplingRate int
 
+	// KeepObsoleteJournals defines the number of obsolete journal files
+	// retained, the most recent ones, instead of being removed once their
+	// 'memdb' is flushed. This keeps some history for post-mortem analysis
+	// of recovery bugs; the retained journals are never replayed.
+	//
+	// The default value is 0.
+	KeepObsoleteJournals int
+
+	// KeepObsoleteManifests defines the number of obsolete manifest files
+	// retained, the most recent ones, besides the current manifest and its
+	// backup. This keeps some history of the version edits for post-mortem
+	// analysis of compaction bugs. The retained manifests are never used to
+	// recover the DB, a corrupted manifest only falls back to its backup.
+	//
+	// The default value is 0.
+	KeepObsoleteManifests int
+
+	// ManifestSync defines when the manifest is synced. EagerManifestSync
+	// syncs it on every version edit, i.e. on every memdb flush and table
+	// compaction commit. LazyManifestSync syncs it every
+	// ManifestSyncInterval and on close instead, taking the fsync off the
+	// commit path.
+	//
+	// With LazyManifestSync, a crash may lose the version edits committed
+	// since the last sync; the DB then reopens at the last synced version.
+	// No data is lost: the journals and tables obsoleted by the lost edits
+	// are only removed once the manifest is synced, so lost memdb flushes
+	// are replayed from the journals, lost compactions are done again, and
+	// their output tables are removed as leftovers. Only the work is lost.
+	// It has no effect if NoSync is true.
+	//
+	// The default value is EagerManifestSync.
+	ManifestSync ManifestSync
+
+	// ManifestSyncInterval defines the interval between manifest syncs
+	// when ManifestSync is LazyManifestSync.
+	//
+	// The default value is 1 second.
+	ManifestSyncInterval time.Duration
+
+	// MaxBlockSize defines the hard ceiling of the uncompressed size of a
+	// 'sorted table' block. Blocks are cut once they reach BlockSize, but
+	// an entry larger than BlockSize gets a block of its own, so a block
+	// can be as large as the largest entry. Writes of an entry which
+	// doesn't fit in a block of MaxBlockSize, counting the 8 bytes of
+	// sequence number and type appended to its key, are rejected with an
+	// errors.ErrEntryTooLarge. A value stored in a blob file only takes up
+	// a small pointer in its block, see EnableBlobFiles. The ceiling only
+	// applies to new writes, the entries already written are kept as is.
+	//
+	// The default value is 0, which means no ceiling.
+	MaxBlockSize int
+
+	// MaxCompactionBytes defines the maximum total size (in bytes) of the
+	// input tables of a single table compaction, to bound its duration and
+	// IO burst. A compaction that would exceed it is trimmed to a smaller
+	// key range, and the remainder is left to a following compaction. A
+	// compaction always takes at least one table of the source level, and
+	// level-0 compactions aren't trimmed, since level-0 tables may overlap
+	// each other. Zero means unlimited.
+	//
+	// The default value is 0.
+	MaxCompactionBytes int64
+
+	// MaxFormatVersion defines the newest on-disk format version the DB may
+	// be upgraded to. The DB is upgraded on open, to the oldest format
+	// version that supports the enabled features, but never beyond
+	// MaxFormatVersion; features that need a newer format version are left
+	// disabled. Keep this at the format version supported by the oldest
+	// binary the DB may be rolled back to. A DB is never downgraded.
+	//
+	// The default value is LatestFormat.
+	MaxFormatVersion int
+
+	// MaxKeySize defines the maximum size (in bytes) of a single key. Writes
+	// with a larger key are rejected with ErrKeyTooLarge before being
+	// applied. Zero means unlimited.
+	//
+	// The default value is 0.
+	MaxKeySize int
+
+	// MaxTotalSize defines a quota (in bytes) of the disk space used by
+	// the DB, counting the tables of the current version, the blob files,
+	// see EnableBlobFiles, and the journals, the latter approximated by the
+	// size of their 'memdb'. While the quota is exceeded, writes setting a
+	// value, including those of a transaction, are rejected with
+	// ErrQuotaExceeded before being applied, while deletes are let through,
+	// so that deleting keys then compacting them, see DB.CompactRange,
+	// brings the usage back under the quota. Compactions aren't bound by
+	// the quota, they may use more space temporarily. Zero means
+	// unlimited.
+	//
+	// The default value is 0.
+	MaxTotalSize int64
+
+	// MaxValueSize defines the maximum size (in bytes) of a single value.
+	// Writes with a larger value are rejected with ErrValueTooLarge before
+	// being applied. Zero means unlimited.
+	//
+	// The default value is 0.
+	MaxValueSize int
+
+	// MemTableArenaBlockSize defines the size of the blocks the 'memdb'
+	// allocates its keys/values by, see memdb.NewWithArenaBlockSize. By
+	// default, each 'memdb' preallocates a single buffer of WriteBuffer
+	// size, which is copied whenever a large batch grows it. Blocks are
+	// instead allocated as the 'memdb' fills up, and a key/value larger
+	// than a block gets a buffer of its own: small blocks waste less memory
+	// on lightly written DBs, large ones waste less on the free space left
+	// at the end of each block with large values. Zero means a single
+	// buffer; otherwise it must be between 4 KiB and 256 MiB, and the
+	// MemTableFactory must implement memdb.ArenaFactory.
+	//
+	// The default value is 0.
+	MemTableArenaBlockSize int
+
+	// MemTableBloomBits defines the number of bits per key of a bloom
+	// filter kept for each 'memdb', so that a Get of a key missing from
+	// the 'memdb' can skip searching it. The filter is updated on each
+	// write and discarded with the 'memdb' once flushed. It speeds up
+	// lookups of missing keys with large write buffers, at the cost of
+	// slightly slower writes. Zero disables the filter.
+	//
+	// The default value is 0.
+	MemTableBloomBits int
+
+	// MemTableFactory defines the in-memory structure of the 'memdb'.
+	// memdb.HashFactory gives faster point lookups, at the cost of slower
+	// iteration, since the 'memdb' has to be sorted first; it suits
+	// workloads of mostly Put and Get. Flushing a 'memdb' iterates it once.
+	//
+	// The default value is memdb.SkiplistFactory.
+	MemTableFactory memdb.Factory
+
+	// MetricsHook defines the hook observing the DB operations, see
+	// MetricsHook. The durations of Put and Write include the time spent
+	// waiting on write stalls.
+	//
+	// The default value is nil.
+	MetricsHook MetricsHook
+
 	// NoSync allows completely disable fsync.
 	//
 	// The default is false.
@@ -317,6 +747,81 @@ type Options struct {
 	// The default is false.
 	NoWriteMerge bool
 
+	// NumLevels defines the maximum number of levels, including level-0.
+	// Tables of the last level are never compacted into a further level.
+	// It must be at least 2, and the CompactionTotalSize of the last level,
+	// see CompactionTotalSizeMultiplier, must not overflow.
+	//
+	// The level count is recorded in the DB once set, and can't be changed
+	// afterwards; Open returns an ErrInvalidOption if the DB has another
+	// level count, while zero uses the level count of the DB, if any. The
+	// level count is recorded in a manifest record that other LevelDB
+	// implementations and versions of this package that predate NumLevels
+	// fail to decode, so a non-zero NumLevels makes the DB unreadable by
+	// them, and this can't be undone.
+	//
+	// The default value is 0, which means no limit.
+	NumLevels int
+
+	// OnOutOfSpace, if not nil, is called with the error when a compaction
+	// fails because the disk is full (ENOSPC), and with nil once a
+	// compaction succeeds again. Meanwhile the failed compaction is retried
+	// with backoff, writes are rejected with ErrOutOfSpace, see DB.Healthy.
+	//
+	// It is called synchronously by the compaction goroutine, so it must
+	// not block nor write to the DB.
+	//
+	// The default value is nil.
+	OnOutOfSpace func(err error)
+
+	// OnTableCacheEvict, if not nil, is called with the file number of a
+	// 'sorted table' whose file is closed by the open files cache, whether
+	// evicted, removed or on DB close; see OnTableCacheOpen.
+	//
+	// It is called synchronously, while the cache entry is locked, so it
+	// must not block nor use the DB.
+	//
+	// The default value is nil.
+	OnTableCacheEvict func(fileNum uint64)
+
+	// OnTableCacheOpen, if not nil, is called with the file number of a
+	// 'sorted table' whose file is opened by the open files cache. Along
+	// with OnTableCacheEvict, this allows to account the file handles held
+	// by the DB, e.g. against a global budget.
+	//
+	// It is called synchronously, after the file is opened, so it must not
+	// block nor use the DB.
+	//
+	// The default value is nil.
+	OnTableCacheOpen func(fileNum uint64)
+
+	// OnWriteStall, if not nil, is called when writes begin or end being
+	// stalled by the number of 'sorted table' at level-0: reason is
+	// WriteStallSlowdown while the count is at least WriteL0SlowdownTrigger,
+	// and WriteStallPause while it is at least WriteL0PauseTrigger; throttled
+	// is true when the stall begins and false when it ends. A pause stall
+	// begins and ends within a slowdown stall.
+	//
+	// It is called synchronously, by the goroutine which changed the
+	// level-0 count or the triggers, i.e. a compaction, a transaction
+	// commit, Open or DB.SetOptions, so it must not block nor write to the
+	// DB.
+	//
+	// The default value is nil.
+	OnWriteStall func(reason string, throttled bool)
+
+	// OpenFilesCache is an open files cache to share with other DBs, e.g.
+	// cache.NewCache(cache.NewLRU(capacity)), so that the number of files
+	// kept open by all of them is bounded by its capacity. Sharing works
+	// as for BlockCache.
+	//
+	// If set, OpenFilesCacher, OpenFilesCacheCapacity and TableCacheShards
+	// are ignored.
+	//
+	// The default value is nil, which gives the DB its own open files
+	// cache.
+	OpenFilesCache *cache.Cache
+
 	// OpenFilesCacher provides cache algorithm for open files caching.
 	// Specify NoCacher to disable caching algorithm.
 	//
@@ -329,14 +834,103 @@ type Options struct {
 	// The default value is 500.
 	OpenFilesCacheCapacity int
 
+	// PinIndexBlocks defines whether each open table should hold its index
+	// block in memory for as long as the table is open, instead of reading
+	// it through the block cache where it may be evicted. This trades
+	// memory, bounded by the sum of the index blocks of the open tables,
+	// for consistently fast seeks. See also DBStats.PinnedIndexSize. Index
+	// blocks are always held if there is no block cache, see
+	// DisableBlockCache.
+	//
+	// The default value is false.
+	PinIndexBlocks bool
+
+	// PreallocateTableFiles defines whether to reserve the expected size of
+	// a 'sorted table' file on disk before writing it: the memdb size for
+	// a flush, and the table size for a compaction. This reduces file
+	// fragmentation and metadata updates, and a full disk is detected
+	// before the table is written rather than midway. The unused space is
+	// released when the table is finished.
+	//
+	// This is only supported on Linux, by the file-system backed storage;
+	// elsewhere it has no effect.
+	//
+	// The default value is false.
+	PreallocateTableFiles bool
+
 	// If true then opens DB in read-only mode.
 	//
 	// The default value is false.
 	ReadOnly bool
 
+	// RecoveryConcurrency defines the maximum number of journals that are
+	// read and decoded concurrently while recovering the DB. Records are
+	// still applied to the 'memdb' in journal order; this only bounds how
+	// many journals are read ahead, and thus the memory held during
+	// recovery. Journals read ahead also can't exceed RecoveryConcurrency
+	// times WriteBuffer bytes in total, a larger journal is read alone.
+	// Use 1 to read journals one at a time.
+	//
+	// The default value is 4.
+	RecoveryConcurrency int
+
+	// StorageRetry defines the retry policy of the storage operations, the
+	// table, blob, journal and manifest files being opened, created, read,
+	// written and synced. An operation is retried only if it failed with an
+	// error flagged as retryable by the storage, see
+	// storage.RetryableError; any other error is returned immediately. This
+	// is meant for network-backed storages, whose operations may fail with
+	// transient errors such as timeouts or throttling.
+	//
+	// The default value is nil, which means no retry.
+	StorageRetry *RetryPolicy
+
 	// Strict defines the DB strict level.
 	Strict Strict
 
+	// TableCacheShards defines the number of shards of the open files
+	// cache. Files are spread over the shards by file number, each shard
+	// holding its share of OpenFilesCacheCapacity behind its own lock, so
+	// that concurrent reads of different files don't contend on the same
+	// lock. The number of shards is capped by OpenFilesCacheCapacity.
+	//
+	// The default value is 1.
+	TableCacheShards int
+
+	// TwoLevelIndex allows a table to split its index block into partitions
+	// of about BlockSize bytes each, indexed by a small top-level index
+	// block, once the index block grows beyond BlockSize. Only the top-level
+	// index block is held in memory by PinIndexBlocks, and a lookup reads a
+	// single partition instead of the whole index block, which helps with
+	// very large tables. Tables with a small index are written as usual.
+	//
+	// Two-level indexes need format version FormatV3, see MaxFormatVersion.
+	// A DB that ever had this option enabled can't be opened by versions of
+	// this package without two-level index support.
+	//
+	// The default value is false.
+	TwoLevelIndex bool
+
+	// ValueMetaSize defines the size of a fixed-size metadata header, e.g. a
+	// version or a TTL timestamp, held by the first bytes of every value.
+	// The header is stored together with the value, but split from it on
+	// read: Get of DB, Snapshot and Transaction and the DB iterators return
+	// the value body, while DB.GetValueMeta and the Meta method of the DB
+	// iterators return the header. Writes setting a value shorter than
+	// ValueMetaSize are rejected.
+	//
+	// The default value is 0, which means no metadata header.
+	ValueMetaSize int
+
+	// VerboseNotFound makes Get of DB, Snapshot and Transaction return an
+	// errors.ErrKeyNotFound carrying the key that wasn't found, instead of
+	// the ErrNotFound sentinel. It unwraps to ErrNotFound, so callers must
+	// check it with errors.Is rather than compare it. This costs an
+	// allocation per missing key, and is meant for debugging.
+	//
+	// The default value is false.
+	VerboseNotFound bool
+
 	// WriteBuffer defines maximum size of a 'memdb' before flushed to
 	// 'sorted table'. 'memdb' is an in-memory DB backed by an on-disk
 	// unsorted journal.
@@ -347,13 +941,14 @@ type Options struct {
 	WriteBuffer int
 
 	// WriteL0StopTrigger defines number of 'sorted table' at level-0 that will
-	// pause write.
+	// pause write. It must not be less than WriteL0SlowdownTrigger.
 	//
 	// The default value is 12.
 	WriteL0PauseTrigger int
 
 	// WriteL0SlowdownTrigger defines number of 'sorted table' at level-0 that
-	// will trigger write slowdown.
+	// will trigger write slowdown. It must be greater than
+	// CompactionL0Trigger.
 	//
 	// The default value is 8.
 	WriteL0SlowdownTrigger int
@@ -366,9 +961,25 @@ func (o *Options) GetAltFilters() []filter.Filter {
 	return o.AltFilters
 }
 
+func (o *Options) GetBlobFileThreshold() int {
+	if o == nil || o.BlobFileThreshold <= 0 {
+		return DefaultBlobFileThreshold
+	}
+	return o.BlobFileThreshold
+}
+
+func (o *Options) GetBlockCache() *cache.Cache {
+	if o == nil {
+		return nil
+	}
+	return o.BlockCache
+}
+
 func (o *Options) GetBlockCacher() Cacher {
-	if o == nil || o.BlockCacher == nil {
+	if o == nil {
 		return DefaultBlockCacher
+	} else if o.BlockCacher == nil {
+		return o.GetBlockCachePolicy().Cacher()
 	} else if o.BlockCacher == NoCacher {
 		return nil
 	}
@@ -384,6 +995,13 @@ func (o *Options) GetBlockCacheCapacity() int {
 	return o.BlockCacheCapacity
 }
 
+func (o *Options) GetBlockCachePolicy() CachePolicy {
+	if o == nil || o.BlockCachePolicy <= DefaultCachePolicy || o.BlockCachePolicy >= nCachePolicy {
+		return DefaultBlockCachePolicy
+	}
+	return o.BlockCachePolicy
+}
+
 func (o *Options) GetBlockRestartInterval() int {
 	if o == nil || o.BlockRestartInterval <= 0 {
 		return DefaultBlockRestartInterval
@@ -398,20 +1016,27 @@ func (o *Options) GetBlockSize() int {
 	return o.BlockSize
 }
 
-func (o *Options) GetCompactionExpandLimit(level int) int {
+func (o *Options) GetBlockTransform() BlockTransform {
+	if o == nil {
+		return nil
+	}
+	return o.BlockTransform
+}
+
+func (o *Options) GetCompactionExpandLimit(level int) int64 {
 	factor := DefaultCompactionExpandLimitFactor
 	if o != nil && o.CompactionExpandLimitFactor > 0 {
 		factor = o.CompactionExpandLimitFactor
 	}
-	return o.GetCompactionTableSize(level+1) * factor
+	return o.GetCompactionTableSize(level+1) * int64(factor)
 }
 
-func (o *Options) GetCompactionGPOverlaps(level int) int {
+func (o *Options) GetCompactionGPOverlaps(level int) int64 {
 	factor := DefaultCompactionGPOverlapsFactor
 	if o != nil && o.CompactionGPOverlapsFactor > 0 {
 		factor = o.CompactionGPOverlapsFactor
 	}
-	return o.GetCompactionTableSize(level+2) * factor
+	return o.GetCompactionTableSize(level+2) * int64(factor)
 }
 
 func (o *Options) GetCompactionL0Trigger() int {
@@ -421,15 +1046,22 @@ func (o *Options) GetCompactionL0Trigger() int {
 	return o.CompactionL0Trigger
 }
 
-func (o *Options) GetCompactionSourceLimit(level int) int {
+func (o *Options) GetCompactionSourceLimit(level int) int64 {
 	factor := DefaultCompactionSourceLimitFactor
 	if o != nil && o.CompactionSourceLimitFactor > 0 {
 		factor = o.CompactionSourceLimitFactor
 	}
-	return o.GetCompactionTableSize(level+1) * factor
+	return o.GetCompactionTableSize(level+1) * int64(factor)
 }
 
-func (o *Options) GetCompactionTableSize(level int) int {
+func (o *Options) GetCompactionStatsWriter() io.Writer {
+	if o == nil {
+		return nil
+	}
+	return o.CompactionStatsWriter
+}
+
+func (o *Options) GetCompactionTableSize(level int) int64 {
 	var (
 		base = DefaultCompactionTableSize
 		mult float64
@@ -447,7 +1079,7 @@ func (o *Options) GetCompactionTableSize(level int) int {
 	if mult == 0 {
 		mult = math.Pow(DefaultCompactionTableSizeMultiplier, float64(level))
 	}
-	return int(float64(base) * mult)
+	return int64(float64(base) * mult)
 }
 
 func (o *Options) GetCompactionTotalSize(level int) int64 {
@@ -485,6 +1117,15 @@ func (o *Options) GetCompression() Compression {
 	return o.Compression
 }
 
+func (o *Options) GetCompressionPerLevel(level int) Compression {
+	if o != nil && level >= 0 && level < len(o.CompressionPerLevel) {
+		if c := o.CompressionPerLevel[level]; c > DefaultCompression && c < nCompression {
+			return c
+		}
+	}
+	return o.GetCompression()
+}
+
 func (o *Options) GetDisableBufferPool() bool {
 	if o == nil {
 		return false
@@ -513,6 +1154,13 @@ func (o *Options) GetDisableLargeBatchTransaction() bool {
 	return o.DisableLargeBatchTransaction
 }
 
+func (o *Options) GetEnableBlobFiles() bool {
+	if o == nil {
+		return false
+	}
+	return o.EnableBlobFiles
+}
+
 func (o *Options) GetErrorIfExist() bool {
 	if o == nil {
 		return false
@@ -527,6 +1175,13 @@ func (o *Options) GetErrorIfMissing() bool {
 	return o.ErrorIfMissing
 }
 
+func (o *Options) GetExtendedCurrentFile() bool {
+	if o == nil {
+		return false
+	}
+	return o.ExtendedCurrentFile
+}
+
 func (o *Options) GetFilter() filter.Filter {
 	if o == nil {
 		return nil
@@ -534,6 +1189,13 @@ func (o *Options) GetFilter() filter.Filter {
 	return o.Filter
 }
 
+func (o *Options) GetInitialSequence() uint64 {
+	if o == nil {
+		return 0
+	}
+	return o.InitialSequence
+}
+
 func (o *Options) GetIteratorSamplingRate() int {
 	if o == nil || o.IteratorSamplingRate <= 0 {
 		return DefaultIteratorSamplingRate
@@ -541,6 +1203,104 @@ func (o *Options) GetIteratorSamplingRate() int {
 	return o.IteratorSamplingRate
 }
 
+func (o *Options) GetKeepObsoleteJournals() int {
+	if o == nil || o.KeepObsoleteJournals < 0 {
+		return 0
+	}
+	return o.KeepObsoleteJournals
+}
+
+func (o *Options) GetKeepObsoleteManifests() int {
+	if o == nil || o.KeepObsoleteManifests < 0 {
+		return 0
+	}
+	return o.KeepObsoleteManifests
+}
+
+func (o *Options) GetManifestSync() ManifestSync {
+	if o == nil || o.ManifestSync <= DefaultManifestSync || o.ManifestSync >= nManifestSync {
+		return DefaultManifestSyncType
+	}
+	return o.ManifestSync
+}
+
+func (o *Options) GetManifestSyncInterval() time.Duration {
+	if o == nil || o.ManifestSyncInterval <= 0 {
+		return DefaultManifestSyncInterval
+	}
+	return o.ManifestSyncInterval
+}
+
+func (o *Options) GetMaxBlockSize() int {
+	if o == nil || o.MaxBlockSize <= 0 {
+		return 0
+	}
+	return o.MaxBlockSize
+}
+
+func (o *Options) GetMaxCompactionBytes() int64 {
+	if o == nil || o.MaxCompactionBytes <= 0 {
+		return 0
+	}
+	return o.MaxCompactionBytes
+}
+
+func (o *Options) GetMaxFormatVersion() int {
+	if o == nil || o.MaxFormatVersion <= 0 {
+		return DefaultMaxFormatVersion
+	}
+	return o.MaxFormatVersion
+}
+
+func (o *Options) GetMaxKeySize() int {
+	if o == nil || o.MaxKeySize <= 0 {
+		return 0
+	}
+	return o.MaxKeySize
+}
+
+func (o *Options) GetMaxTotalSize() int64 {
+	if o == nil || o.MaxTotalSize <= 0 {
+		return 0
+	}
+	return o.MaxTotalSize
+}
+
+func (o *Options) GetMaxValueSize() int {
+	if o == nil || o.MaxValueSize <= 0 {
+		return 0
+	}
+	return o.MaxValueSize
+}
+
+func (o *Options) GetMemTableBloomBits() int {
+	if o == nil || o.MemTableBloomBits <= 0 {
+		return 0
+	}
+	return o.MemTableBloomBits
+}
+
+func (o *Options) GetMemTableArenaBlockSize() int {
+	if o == nil {
+		return 0
+	}
+	return o.MemTableArenaBlockSize
+}
+
+func (o *Options) GetMemTableFactory() memdb.Factory {
+	if o == nil || o.MemTableFactory == nil {
+		return DefaultMemTableFactory
+	}
+	return o.MemTableFactory
+}
+
+func (o *Options) GetMetricsHook() MetricsHook {
+	if o == nil {
+		return nil
+	}
+	return o.MetricsHook
+}
+
 func (o *Options) GetNoSync() bool {
 	if o == nil {
 		return false
@@ -555,6 +1315,48 @@ func (o *Options) GetNoWriteMerge() bool {
 	return o.NoWriteMerge
 }
 
+func (o *Options) GetNumLevels() int {
+	if o == nil {
+		return 0
+	}
+	return o.NumLevels
+}
+
+func (o *Options) GetOnOutOfSpace() func(err error) {
+	if o == nil {
+		return nil
+	}
+	return o.OnOutOfSpace
+}
+
+func (o *Options) GetOnTableCacheEvict() func(fileNum uint64) {
+	if o == nil {
+		return nil
+	}
+	return o.OnTableCacheEvict
+}
+
+func (o *Options) GetOnTableCacheOpen() func(fileNum uint64) {
+	if o == nil {
+		return nil
+	}
+	return o.OnTableCacheOpen
+}
+
+func (o *Options) GetOnWriteStall() func(reason string, throttled bool) {
+	if o == nil {
+		return nil
+	}
+	return o.OnWriteStall
+}
+
+func (o *Options) GetOpenFilesCache() *cache.Cache {
+	if o == nil {
+		return nil
+	}
+	return o.OpenFilesCache
+}
+
 func (o *Options) GetOpenFilesCacher() Cacher {
 	if o == nil || o.OpenFilesCacher == nil {
 		return DefaultOpenFilesCacher
@@ -574,6 +1376,20 @@ func (o *Options) GetOpenFilesCacheCapacity() int {
 	return o.OpenFilesCacheCapacity
 }
 
+func (o *Options) GetPinIndexBlocks() bool {
+	if o == nil {
+		return false
+	}
+	return o.PinIndexBlocks
+}
+
+func (o *Options) GetPreallocateTableFiles() bool {
+	if o == nil {
+		return false
+	}
+	return o.PreallocateTableFiles
+}
+
 func (o *Options) GetReadOnly() bool {
 	if o == nil {
 		return false
@@ -581,6 +1397,20 @@ func (o *Options) GetReadOnly() bool {
 	return o.ReadOnly
 }
 
+func (o *Options) GetRecoveryConcurrency() int {
+	if o == nil || o.RecoveryConcurrency <= 0 {
+		return DefaultRecoveryConcurrency
+	}
+	return o.RecoveryConcurrency
+}
+
+func (o *Options) GetStorageRetry() *RetryPolicy {
+	if o == nil {
+		return nil
+	}
+	return o.StorageRetry
+}
+
 func (o *Options) GetStrict(strict Strict) bool {
 	if o == nil || o.Strict == 0 {
 		return DefaultStrict&strict != 0
@@ -588,6 +1418,34 @@ func (o *Options) GetStrict(strict Strict) bool {
 	return o.Strict&strict != 0
 }
 
+func (o *Options) GetTableCacheShards() int {
+	if o == nil || o.TableCacheShards <= 0 {
+		return DefaultTableCacheShards
+	}
+	return o.TableCacheShards
+}
+
+func (o *Options) GetTwoLevelIndex() bool {
+	if o == nil {
+		return false
+	}
+	return o.TwoLevelIndex
+}
+
+func (o *Options) GetValueMetaSize() int {
+	if o == nil || o.ValueMetaSize < 0 {
+		return 0
+	}
+	return o.ValueMetaSize
+}
+
+func (o *Options) GetVerboseNotFound() bool {
+	if o == nil {
+		return false
+	}
+	return o.VerboseNotFound
+}
+
 func (o *Options) GetWriteBuffer() int {
 	if o == nil || o.WriteBuffer <= 0 {
 		return DefaultWriteBuffer
@@ -609,21 +1467,208 @@ func (o *Options) GetWriteL0SlowdownTrigger() int {
 	return o.WriteL0SlowdownTrigger
 }
 
+// ErrInvalidOption is returned by Options.Validate when an option value is
+// invalid.
+type ErrInvalidOption struct {
+	Name   string
+	Reason string
+}
+
+func (e *ErrInvalidOption) Error() string {
+	return fmt.Sprintf("leveldb: cannot set option '%s': %s", e.Name, e.Reason)
+}
+
+// Clone returns a copy of the options, which can be changed without
+// affecting the original. The slices and the StorageRetry policy are
+// copied, but shared objects such as the Comparer, Filter or caches are
+// not, by design.
+func (o *Options) Clone() *Options {
+	if o == nil {
+		return nil
+	}
+	no := *o
+	if o.AltFilters != nil {
+		no.AltFilters = append([]filter.Filter(nil), o.AltFilters...)
+	}
+	if o.CompactionTableSizeMultiplierPerLevel != nil {
+		no.CompactionTableSizeMultiplierPerLevel = append([]float64(nil), o.CompactionTableSizeMultiplierPerLevel...)
+	}
+	if o.CompactionTotalSizeMultiplierPerLevel != nil {
+		no.CompactionTotalSizeMultiplierPerLevel = append([]float64(nil), o.CompactionTotalSizeMultiplierPerLevel...)
+	}
+	if o.CompressionPerLevel != nil {
+		no.CompressionPerLevel = append([]Compression(nil), o.CompressionPerLevel...)
+	}
+	if o.StorageRetry != nil {
+		rp := *o.StorageRetry
+		no.StorageRetry = &rp
+	}
+	return &no
+}
+
+// Validate checks the options for invalid values and inconsistencies, and
+// returns an *ErrInvalidOption describing the first problem found. Zero
+// values are valid and mean default, while negative values are only valid
+// where documented. Validate is called by Open; a nil Options is valid.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	for _, x := range []struct {
+		name  string
+		value int64
+	}{
+		{"BlobFileThreshold", int64(o.BlobFileThreshold)},
+		{"BlockRestartInterval", int64(o.BlockRestartInterval)},
+		{"BlockSize", int64(o.BlockSize)},
+		{"CompactionExpandLimitFactor", int64(o.CompactionExpandLimitFactor)},
+		{"CompactionGPOverlapsFactor", int64(o.CompactionGPOverlapsFactor)},
+		{"CompactionL0Trigger", int64(o.CompactionL0Trigger)},
+		{"CompactionSourceLimitFactor", int64(o.CompactionSourceLimitFactor)},
+		{"CompactionTableSize", int64(o.CompactionTableSize)},
+		{"CompactionTotalSize", int64(o.CompactionTotalSize)},
+		{"IteratorSamplingRate", int64(o.IteratorSamplingRate)},
+		{"KeepObsoleteJournals", int64(o.KeepObsoleteJournals)},
+		{"KeepObsoleteManifests", int64(o.KeepObsoleteManifests)},
+		{"ManifestSyncInterval", int64(o.ManifestSyncInterval)},
+		{"MaxBlockSize", int64(o.MaxBlockSize)},
+		{"MaxCompactionBytes", o.MaxCompactionBytes},
+		{"MaxFormatVersion", int64(o.MaxFormatVersion)},
+		{"MaxKeySize", int64(o.MaxKeySize)},
+		{"MaxTotalSize", o.MaxTotalSize},
+		{"MaxValueSize", int64(o.MaxValueSize)},
+		{"MemTableBloomBits", int64(o.MemTableBloomBits)},
+		{"RecoveryConcurrency", int64(o.RecoveryConcurrency)},
+		{"TableCacheShards", int64(o.TableCacheShards)},
+		{"ValueMetaSize", int64(o.ValueMetaSize)},
+		{"WriteBuffer", int64(o.WriteBuffer)},
+		{"WriteL0PauseTrigger", int64(o.WriteL0PauseTrigger)},
+		{"WriteL0SlowdownTrigger", int64(o.WriteL0SlowdownTrigger)},
+	} {
+		if x.value < 0 {
+			return &ErrInvalidOption{x.name, fmt.Sprintf("must not be negative, got %d", x.value)}
+		}
+	}
+	for _, x := range []struct {
+		name   string
+		values []float64
+	}{
+		{"CompactionTableSizeMultiplier", []float64{o.CompactionTableSizeMultiplier}},
+		{"CompactionTableSizeMultiplierPerLevel", o.CompactionTableSizeMultiplierPerLevel},
+		{"CompactionTotalSizeMultiplier", []float64{o.CompactionTotalSizeMultiplier}},
+		{"CompactionTotalSizeMultiplierPerLevel", o.CompactionTotalSizeMultiplierPerLevel},
+	} {
+		for _, v := range x.values {
+			if v < 0 || math.IsNaN(v) {
+				return &ErrInvalidOption{x.name, fmt.Sprintf("must not be negative, got %v", v)}
+			}
+		}
+	}
+	for _, c := range o.CompressionPerLevel {
+		if c < DefaultCompression || c >= nCompression {
+			return &ErrInvalidOption{"CompressionPerLevel", fmt.Sprintf("invalid compression %d", c)}
+		}
+	}
+	if rp := o.StorageRetry; rp != nil {
+		switch {
+		case rp.MaxAttempts < 0:
+			return &ErrInvalidOption{"StorageRetry", fmt.Sprintf("MaxAttempts must not be negative, got %d", rp.MaxAttempts)}
+		case rp.Backoff < 0:
+			return &ErrInvalidOption{"StorageRetry", fmt.Sprintf("Backoff must not be negative, got %v", rp.Backoff)}
+		case rp.MaxBackoff < 0:
+			return &ErrInvalidOption{"StorageRetry", fmt.Sprintf("MaxBackoff must not be negative, got %v", rp.MaxBackoff)}
+		}
+	}
+	if o.NumLevels < 0 || o.NumLevels == 1 {
+		return &ErrInvalidOption{"NumLevels", "must be at least 2"}
+	}
+	if max := o.GetMaxBlockSize(); max > 0 && max < o.GetBlockSize() {
+		return &ErrInvalidOption{"MaxBlockSize", fmt.Sprintf("must not be less than BlockSize (%d)", o.GetBlockSize())}
+	}
+	if bs := o.MemTableArenaBlockSize; bs != 0 {
+		if bs < 4*KiB || bs > 256*MiB {
+			return &ErrInvalidOption{"MemTableArenaBlockSize", fmt.Sprintf("must be between 4 KiB and 256 MiB, got %d", bs)}
+		}
+		if _, ok := o.GetMemTableFactory().(memdb.ArenaFactory); !ok {
+			return &ErrInvalidOption{"MemTableArenaBlockSize", "not supported by the MemTableFactory"}
+		}
+	}
+	if o.BlockTransform != nil && o.GetMaxFormatVersion() < FormatV4 {
+		return &ErrInvalidOption{"BlockTransform", "needs format version FormatV4, see MaxFormatVersion"}
+	}
+	if o.InitialSequence > 1<<56-1 {
+		return &ErrInvalidOption{"InitialSequence", "exceeds maximum sequence number"}
+	}
+	if o.Comparer != nil && o.Comparer.Name() == "" {
+		return &ErrInvalidOption{"Comparer", "must have a name"}
+	}
+
+	// The level-0 triggers must be ordered as: pause >= slowdown > compaction.
+	slowdown, pause, compaction := o.GetWriteL0SlowdownTrigger(), o.GetWriteL0PauseTrigger(), o.GetCompactionL0Trigger()
+	switch {
+	case slowdown <= compaction:
+		return &ErrInvalidOption{"WriteL0SlowdownTrigger", fmt.Sprintf("must be greater than CompactionL0Trigger (%d)", compaction)}
+	case pause < slowdown:
+		return &ErrInvalidOption{"WriteL0PauseTrigger", fmt.Sprintf("must not be less than WriteL0SlowdownTrigger (%d)", slowdown)}
+	}
+	return nil
+}
+
+// BufferPool is a pool of byte slices, see ReadOptions.BufferPool. It
+// is implemented by util.BufferPool.
+type BufferPool interface {
+	// Get returns a slice of length n.
+	Get(n int) []byte
+
+	// Put returns the given slice to the pool.
+	Put(b []byte)
+}
+
 // ReadOptions holds the optional parameters for 'read operation'. The
 // 'read operation' includes Get, Find and NewIterator.
 type ReadOptions struct {
+	// BufferPool defines the pool the value returned by Get is allocated
+	// from, instead of being allocated on the heap. The caller may return
+	// the value to the pool once done with it, to recycle its buffer and
+	// cut GC pressure; the value must not be used once returned to the
+	// pool. Values returned by iterators are not allocated from the pool.
+	//
+	// The default value is nil.
+	BufferPool BufferPool
+
 	// DontFillCache defines whether block reads for this 'read operation'
 	// should be cached. If false then the block will be cached. This does
 	// not affects already cached block.
 	//
+	// This applies to data, index and filter blocks alike, so large one-shot
+	// scans could set it to avoid evicting the working set. Compaction reads
+	// always set it.
+	//
 	// The default value is false.
 	DontFillCache bool
 
+	// IgnoreFilters defines whether the filters should be bypassed by this
+	// 'read operation', i.e. whether Get and Has should always look the
+	// key up in the index and data blocks, even when the filter of a table
+	// or the memdb bloom filter excludes it. This is meant for diagnosing
+	// a filter suspected to produce false negatives, at the cost of the
+	// reads the filters would save.
+	//
+	// The default value is false.
+	IgnoreFilters bool
+
 	// Strict will be OR'ed with global DB 'strict level' unless StrictOverride
 	// is present. Currently only StrictReader that has effect here.
 	Strict Strict
 }
 
+func (ro *ReadOptions) GetBufferPool() BufferPool {
+	if ro == nil {
+		return nil
+	}
+	return ro.BufferPool
+}
+
 func (ro *ReadOptions) GetDontFillCache() bool {
 	if ro == nil {
 		return false
@@ -631,6 +1676,13 @@ func (ro *ReadOptions) GetDontFillCache() bool {
 	return ro.DontFillCache
 }
 
+func (ro *ReadOptions) GetIgnoreFilters() bool {
+	if ro == nil {
+		return false
+	}
+	return ro.IgnoreFilters
+}
+
 func (ro *ReadOptions) GetStrict(strict Strict) bool {
 	if ro == nil {
 		return false
@@ -638,6 +1690,24 @@ func (ro *ReadOptions) GetStrict(strict Strict) bool {
 	return ro.Strict&strict != 0
 }
 
+// CompactRangeOptions holds the optional parameters for DB.CompactRange.
+type CompactRangeOptions struct {
+	// SkipMemdb allows skipping the flush of the 'memdb' before compacting
+	// the tables, so that only the keys already in the tables are
+	// compacted; the recent writes within the range may then still be in
+	// the 'memdb' once the compaction returns.
+	//
+	// The default is false.
+	SkipMemdb bool
+}
+
+func (co *CompactRangeOptions) GetSkipMemdb() bool {
+	if co == nil {
+		return false
+	}
+	return co.SkipMemdb
+}
+
 // WriteOptions holds the optional parameters for 'write operation'. The
 // 'write operation' includes Write, Put and Delete.
 type WriteOptions struct {
@@ -646,6 +1716,14 @@ type WriteOptions struct {
 	// The default is false.
 	NoWriteMerge bool
 
+	// RejectDuplicateKeys defines whether a batch holding more than one
+	// record, Put or Delete, for the same key should be rejected, as it
+	// often indicates a bug in the batch construction. Otherwise the last
+	// record wins.
+	//
+	// The default value is false.
+	RejectDuplicateKeys bool
+
 	// Sync is whether to sync underlying writes from the OS buffer cache
 	// through to actual disk, if applicable. Setting Sync can result in
 	// slower writes.
@@ -668,6 +1746,13 @@ func (wo *WriteOptions) GetNoWriteMerge() bool {
 	return wo.NoWriteMerge
 }
 
+func (wo *WriteOptions) GetRejectDuplicateKeys() bool {
+	if wo == nil {
+		return false
+	}
+	return wo.RejectDuplicateKeys
+}
+
 func (wo *WriteOptions) GetSync() bool {
 	if wo == nil {
 		return false
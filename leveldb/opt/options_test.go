@@ -0,0 +1,153 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package opt
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
+	"github.com/btcsuite/goleveldb/leveldb/filter"
+	"github.com/btcsuite/goleveldb/leveldb/memdb"
+)
+
+type unnamedComparer struct {
+	comparer.Comparer
+}
+
+func (unnamedComparer) Name() string { return "" }
+
+func TestOptions_Clone(t *testing.T) {
+	if (*Options)(nil).Clone() != nil {
+		t.Error("Clone of nil: want nil")
+	}
+
+	o := &Options{
+		AltFilters:                            []filter.Filter{filter.NewBloomFilter(10)},
+		BlockSize:                             1024,
+		CompactionTableSizeMultiplierPerLevel: []float64{1, 2},
+		CompactionTotalSizeMultiplierPerLevel: []float64{3, 4},
+		Comparer:                              comparer.DefaultComparer,
+		CompressionPerLevel:                   []Compression{NoCompression},
+		StorageRetry:                          &RetryPolicy{MaxAttempts: 3},
+	}
+	c := o.Clone()
+	if c == o || c.BlockSize != 1024 || c.Comparer != o.Comparer || c.AltFilters[0] != o.AltFilters[0] {
+		t.Fatalf("Clone: got %+v", c)
+	}
+	c.BlockSize = 2048
+	c.AltFilters[0] = nil
+	c.CompactionTableSizeMultiplierPerLevel[0] = 10
+	c.CompactionTotalSizeMultiplierPerLevel[0] = 10
+	c.CompressionPerLevel[0] = SnappyCompression
+	c.StorageRetry.MaxAttempts = 5
+	if o.BlockSize != 1024 || o.AltFilters[0] == nil || o.CompactionTableSizeMultiplierPerLevel[0] != 1 || o.CompactionTotalSizeMultiplierPerLevel[0] != 3 || o.CompressionPerLevel[0] != NoCompression || o.StorageRetry.MaxAttempts != 3 {
+		t.Errorf("Clone: changing the clone changed the original: %+v", o)
+	}
+}
+
+func TestOptions_CompactionSizes(t *testing.T) {
+	o := &Options{
+		CompactionTableSize:                   1 * GiB,
+		CompactionTableSizeMultiplier:         10,
+		CompactionExpandLimitFactor:           25,
+		CompactionGPOverlapsFactor:            10,
+		CompactionSourceLimitFactor:           1,
+		CompactionTotalSize:                   1 * GiB,
+		CompactionTotalSizeMultiplierPerLevel: []float64{1, 1, 1, 1, 1000},
+	}
+	if got, want := o.GetCompactionTableSize(3), int64(1000*GiB); got != want {
+		t.Errorf("GetCompactionTableSize(3): got %d, want %d", got, want)
+	}
+	if got, want := o.GetCompactionExpandLimit(2), int64(25*1000*GiB); got != want {
+		t.Errorf("GetCompactionExpandLimit(2): got %d, want %d", got, want)
+	}
+	if got, want := o.GetCompactionGPOverlaps(1), int64(10*1000*GiB); got != want {
+		t.Errorf("GetCompactionGPOverlaps(1): got %d, want %d", got, want)
+	}
+	if got, want := o.GetCompactionSourceLimit(2), int64(1000*GiB); got != want {
+		t.Errorf("GetCompactionSourceLimit(2): got %d, want %d", got, want)
+	}
+	if got, want := o.GetCompactionTotalSize(4), int64(1000*GiB); got != want {
+		t.Errorf("GetCompactionTotalSize(4): got %d, want %d", got, want)
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	for _, o := range []*Options{
+		nil,
+		{},
+		{BlockCacheCapacity: -1, OpenFilesCacheCapacity: -1},
+		{NumLevels: 2},
+		{WriteL0SlowdownTrigger: 5, WriteL0PauseTrigger: 5},
+		{InitialSequence: 1<<56 - 1},
+		{MaxBlockSize: 4096},
+		{MemTableArenaBlockSize: 64 * KiB},
+		{StorageRetry: &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}},
+		{CompressionPerLevel: []Compression{NoCompression, DefaultCompression, SnappyCompression}},
+	} {
+		if err := o.Validate(); err != nil {
+			t.Errorf("Validate(%+v): got error: %v", o, err)
+		}
+	}
+
+	for _, x := range []struct {
+		o    *Options
+		name string
+	}{
+		{&Options{BlobFileThreshold: -1}, "BlobFileThreshold"},
+		{&Options{BlockRestartInterval: -1}, "BlockRestartInterval"},
+		{&Options{BlockSize: -1}, "BlockSize"},
+		{&Options{CompactionExpandLimitFactor: -1}, "CompactionExpandLimitFactor"},
+		{&Options{CompactionGPOverlapsFactor: -1}, "CompactionGPOverlapsFactor"},
+		{&Options{CompactionL0Trigger: -1}, "CompactionL0Trigger"},
+		{&Options{CompactionSourceLimitFactor: -1}, "CompactionSourceLimitFactor"},
+		{&Options{CompactionTableSize: -1}, "CompactionTableSize"},
+		{&Options{CompactionTotalSize: -1}, "CompactionTotalSize"},
+		{&Options{IteratorSamplingRate: -1}, "IteratorSamplingRate"},
+		{&Options{KeepObsoleteJournals: -1}, "KeepObsoleteJournals"},
+		{&Options{KeepObsoleteManifests: -1}, "KeepObsoleteManifests"},
+		{&Options{ManifestSyncInterval: -1}, "ManifestSyncInterval"},
+		{&Options{MaxBlockSize: -1}, "MaxBlockSize"},
+		{&Options{MaxBlockSize: 1024}, "MaxBlockSize"},
+		{&Options{MaxCompactionBytes: -1}, "MaxCompactionBytes"},
+		{&Options{MaxTotalSize: -1}, "MaxTotalSize"},
+		{&Options{MaxFormatVersion: -1}, "MaxFormatVersion"},
+		{&Options{MaxKeySize: -1}, "MaxKeySize"},
+		{&Options{MaxValueSize: -1}, "MaxValueSize"},
+		{&Options{MemTableArenaBlockSize: -1}, "MemTableArenaBlockSize"},
+		{&Options{MemTableArenaBlockSize: 512 * MiB}, "MemTableArenaBlockSize"},
+		{&Options{MemTableArenaBlockSize: 64 * KiB, MemTableFactory: memdb.HashFactory}, "MemTableArenaBlockSize"},
+		{&Options{MemTableBloomBits: -1}, "MemTableBloomBits"},
+		{&Options{RecoveryConcurrency: -1}, "RecoveryConcurrency"},
+		{&Options{TableCacheShards: -1}, "TableCacheShards"},
+		{&Options{ValueMetaSize: -1}, "ValueMetaSize"},
+		{&Options{WriteBuffer: -1}, "WriteBuffer"},
+		{&Options{WriteL0PauseTrigger: -1}, "WriteL0PauseTrigger"},
+		{&Options{WriteL0SlowdownTrigger: -1}, "WriteL0SlowdownTrigger"},
+		{&Options{CompactionTableSizeMultiplier: -1}, "CompactionTableSizeMultiplier"},
+		{&Options{CompactionTableSizeMultiplierPerLevel: []float64{1, -1}}, "CompactionTableSizeMultiplierPerLevel"},
+		{&Options{CompactionTotalSizeMultiplier: math.NaN()}, "CompactionTotalSizeMultiplier"},
+		{&Options{CompactionTotalSizeMultiplierPerLevel: []float64{-1}}, "CompactionTotalSizeMultiplierPerLevel"},
+		{&Options{CompressionPerLevel: []Compression{NoCompression, nCompression}}, "CompressionPerLevel"},
+		{&Options{StorageRetry: &RetryPolicy{MaxAttempts: -1}}, "StorageRetry"},
+		{&Options{StorageRetry: &RetryPolicy{Backoff: -1}}, "StorageRetry"},
+		{&Options{NumLevels: -1}, "NumLevels"},
+		{&Options{NumLevels: 1}, "NumLevels"},
+		{&Options{InitialSequence: 1 << 56}, "InitialSequence"},
+		{&Options{Comparer: unnamedComparer{comparer.DefaultComparer}}, "Comparer"},
+		{&Options{WriteL0SlowdownTrigger: DefaultCompactionL0Trigger}, "WriteL0SlowdownTrigger"},
+		{&Options{CompactionL0Trigger: 10}, "WriteL0SlowdownTrigger"},
+		{&Options{WriteL0SlowdownTrigger: 10, WriteL0PauseTrigger: 9}, "WriteL0PauseTrigger"},
+	} {
+		err := x.o.Validate()
+		if e, ok := err.(*ErrInvalidOption); !ok || e.Name != x.name {
+			t.Errorf("Validate(%+v): got error %v, want invalid %s", x.o, err, x.name)
+		}
+	}
+}
@@ -7,14 +7,24 @@
 package leveldb
 
 import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+
 	"github.com/btcsuite/goleveldb/leveldb/filter"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 )
 
+// ErrInvalidOption is returned by DB.SetOptions when an option can't be
+// changed, or by Open when an option value is invalid, see
+// opt.Options.Validate.
+type ErrInvalidOption = opt.ErrInvalidOption
+
 func dupOptions(o *opt.Options) *opt.Options {
-	newo := &opt.Options{}
-	if o != nil {
-		*newo = *o
+	newo := o.Clone()
+	if newo == nil {
+		newo = &opt.Options{}
 	}
 	if newo.Strict == 0 {
 		newo.Strict = opt.DefaultStrict
@@ -46,22 +56,34 @@ func (s *session) setOptions(o *opt.Options) {
 const optCachedLevel = 7
 
 type cachedOptions struct {
+	// Need 64-bit alignment.
+	// Live-tunable options; see DB.SetOptions.
+	writeBuffer            int64
+	writeL0SlowdownTrigger int64
+	writeL0PauseTrigger    int64
+	compactionL0Trigger    int64
+
 	*opt.Options
 
-	compactionExpandLimit []int
-	compactionGPOverlaps  []int
-	compactionSourceLimit []int
-	compactionTableSize   []int
+	compactionExpandLimit []int64
+	compactionGPOverlaps  []int64
+	compactionSourceLimit []int64
+	compactionTableSize   []int64
 	compactionTotalSize   []int64
 }
 
 func (co *cachedOptions) cache() {
-	co.compactionExpandLimit = make([]int, optCachedLevel)
-	co.compactionGPOverlaps = make([]int, optCachedLevel)
-	co.compactionSourceLimit = make([]int, optCachedLevel)
-	co.compactionTableSize = make([]int, optCachedLevel)
+	co.compactionExpandLimit = make([]int64, optCachedLevel)
+	co.compactionGPOverlaps = make([]int64, optCachedLevel)
+	co.compactionSourceLimit = make([]int64, optCachedLevel)
+	co.compactionTableSize = make([]int64, optCachedLevel)
 	co.compactionTotalSize = make([]int64, optCachedLevel)
 
+	co.writeBuffer = int64(co.Options.GetWriteBuffer())
+	co.writeL0SlowdownTrigger = int64(co.Options.GetWriteL0SlowdownTrigger())
+	co.writeL0PauseTrigger = int64(co.Options.GetWriteL0PauseTrigger())
+	co.compactionL0Trigger = int64(co.Options.GetCompactionL0Trigger())
+
 	for level := 0; level < optCachedLevel; level++ {
 		co.compactionExpandLimit[level] = co.Options.GetCompactionExpandLimit(level)
 		co.compactionGPOverlaps[level] = co.Options.GetCompactionGPOverlaps(level)
@@ -71,28 +93,28 @@ func (co *cachedOptions) cache() {
 	}
 }
 
-func (co *cachedOptions) GetCompactionExpandLimit(level int) int {
+func (co *cachedOptions) GetCompactionExpandLimit(level int) int64 {
 	if level < optCachedLevel {
 		return co.compactionExpandLimit[level]
 	}
 	return co.Options.GetCompactionExpandLimit(level)
 }
 
-func (co *cachedOptions) GetCompactionGPOverlaps(level int) int {
+func (co *cachedOptions) GetCompactionGPOverlaps(level int) int64 {
 	if level < optCachedLevel {
 		return co.compactionGPOverlaps[level]
 	}
 	return co.Options.GetCompactionGPOverlaps(level)
 }
 
-func (co *cachedOptions) GetCompactionSourceLimit(level int) int {
+func (co *cachedOptions) GetCompactionSourceLimit(level int) int64 {
 	if level < optCachedLevel {
 		return co.compactionSourceLimit[level]
 	}
 	return co.Options.GetCompactionSourceLimit(level)
 }
 
-func (co *cachedOptions) GetCompactionTableSize(level int) int {
+func (co *cachedOptions) GetCompactionTableSize(level int) int64 {
 	if level < optCachedLevel {
 		return co.compactionTableSize[level]
 	}
@@ -105,3 +127,131 @@ func (co *cachedOptions) GetCompactionTotalSize(level int) int64 {
 	}
 	return co.Options.GetCompactionTotalSize(level)
 }
+
+func (co *cachedOptions) GetWriteBuffer() int {
+	return int(atomic.LoadInt64(&co.writeBuffer))
+}
+
+func (co *cachedOptions) GetWriteL0SlowdownTrigger() int {
+	return int(atomic.LoadInt64(&co.writeL0SlowdownTrigger))
+}
+
+func (co *cachedOptions) GetWriteL0PauseTrigger() int {
+	return int(atomic.LoadInt64(&co.writeL0PauseTrigger))
+}
+
+func (co *cachedOptions) GetCompactionL0Trigger() int {
+	return int(atomic.LoadInt64(&co.compactionL0Trigger))
+}
+
+// Validates the level-0 triggers, see opt.Options.Validate.
+func checkL0Triggers(slowdown, pause, compaction int) error {
+	o := &opt.Options{
+		WriteL0SlowdownTrigger: slowdown,
+		WriteL0PauseTrigger:    pause,
+		CompactionL0Trigger:    compaction,
+	}
+	return o.Validate()
+}
+
+// SetOptions changes options of the DB without reopening it. The options
+// are keyed by the name of the corresponding opt.Options field, and the
+// values are formatted as decimal integer. The values have the same
+// semantic as the opt.Options fields, e.g. zero means default value.
+//
+// Only following options can be changed:
+//
+//	BlockCacheCapacity      (not if the block cache is disabled or shared)
+//	OpenFilesCacheCapacity  (not if the open files cache is disabled or shared)
+//	WriteBuffer             (applies to memdb created afterward)
+//	WriteL0SlowdownTrigger
+//	WriteL0PauseTrigger
+//	CompactionL0Trigger
+//
+// Either all or none of the given options will be applied. An
+// *ErrInvalidOption is returned if any of the options can't be changed, or
+// if the level-0 triggers would no longer be ordered, see
+// opt.Options.WriteL0SlowdownTrigger.
+//
+// It is safe to call SetOptions concurrently with other DB methods.
+func (db *DB) SetOptions(options map[string]string) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	// Validate all options first.
+	no := &opt.Options{}
+	for name, value := range options {
+		var dst *int
+		switch name {
+		case "BlockCacheCapacity":
+			if db.s.tops.bcache == nil {
+				return &ErrInvalidOption{Name: name, Reason: "block cache is disabled"}
+			}
+			if db.s.o.GetBlockCache() != nil {
+				return &ErrInvalidOption{Name: name, Reason: "block cache is shared"}
+			}
+			dst = &no.BlockCacheCapacity
+		case "OpenFilesCacheCapacity":
+			if db.s.o.GetOpenFilesCacheCapacity() == 0 {
+				return &ErrInvalidOption{Name: name, Reason: "open files cache is disabled"}
+			}
+			if db.s.o.GetOpenFilesCache() != nil {
+				return &ErrInvalidOption{Name: name, Reason: "open files cache is shared"}
+			}
+			dst = &no.OpenFilesCacheCapacity
+		case "WriteBuffer":
+			dst = &no.WriteBuffer
+		case "WriteL0SlowdownTrigger":
+			dst = &no.WriteL0SlowdownTrigger
+		case "WriteL0PauseTrigger":
+			dst = &no.WriteL0PauseTrigger
+		case "CompactionL0Trigger":
+			dst = &no.CompactionL0Trigger
+		default:
+			if _, ok := reflect.TypeOf(opt.Options{}).FieldByName(name); ok {
+				return &ErrInvalidOption{Name: name, Reason: "cannot be changed while the DB is open"}
+			}
+			return &ErrInvalidOption{Name: name, Reason: "unknown option"}
+		}
+		x, err := strconv.Atoi(value)
+		if err != nil {
+			return &ErrInvalidOption{Name: name, Reason: fmt.Sprintf("invalid value %q", value)}
+		}
+		*dst = x
+	}
+	slowdown, pause, compaction := db.s.o.GetWriteL0SlowdownTrigger(), db.s.o.GetWriteL0PauseTrigger(), db.s.o.GetCompactionL0Trigger()
+	if _, ok := options["WriteL0SlowdownTrigger"]; ok {
+		slowdown = no.GetWriteL0SlowdownTrigger()
+	}
+	if _, ok := options["WriteL0PauseTrigger"]; ok {
+		pause = no.GetWriteL0PauseTrigger()
+	}
+	if _, ok := options["CompactionL0Trigger"]; ok {
+		compaction = no.GetCompactionL0Trigger()
+	}
+	if err := checkL0Triggers(slowdown, pause, compaction); err != nil {
+		return err
+	}
+
+	// Apply.
+	for name := range options {
+		switch name {
+		case "BlockCacheCapacity":
+			db.s.tops.bcache.SetCapacity(no.GetBlockCacheCapacity())
+		case "OpenFilesCacheCapacity":
+			db.s.tops.cache.SetCapacity(no.GetOpenFilesCacheCapacity())
+		case "WriteBuffer":
+			atomic.StoreInt64(&db.s.o.writeBuffer, int64(no.GetWriteBuffer()))
+		case "WriteL0SlowdownTrigger":
+			atomic.StoreInt64(&db.s.o.writeL0SlowdownTrigger, int64(no.GetWriteL0SlowdownTrigger()))
+		case "WriteL0PauseTrigger":
+			atomic.StoreInt64(&db.s.o.writeL0PauseTrigger, int64(no.GetWriteL0PauseTrigger()))
+		case "CompactionL0Trigger":
+			atomic.StoreInt64(&db.s.o.compactionL0Trigger, int64(no.GetCompactionL0Trigger()))
+		}
+		db.logf("db@options %s·%s", name, options[name])
+	}
+	db.updateWriteStall()
+	return nil
+}
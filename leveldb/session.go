@@ -11,6 +11,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/journal"
@@ -33,6 +34,31 @@ func newErrManifestCorrupted(fd storage.FileDesc, field, reason string) error {
 	return errors.NewErrCorrupted(fd, &ErrManifestCorrupted{field, reason})
 }
 
+// ErrComparerMismatch is returned when opening a DB with a different
+// comparer than the one it was created with. Expected is the comparer name
+// recorded in the manifest, the DB must be opened with that comparer.
+type ErrComparerMismatch struct {
+	Expected string
+	Got      string
+}
+
+func (e *ErrComparerMismatch) Error() string {
+	return fmt.Sprintf("leveldb: comparer mismatch: DB was created with '%s', got '%s'", e.Expected, e.Got)
+}
+
+// ErrUnsupportedFormat is returned when opening a DB with a newer on-disk
+// format version than supported by this package, see opt.LatestFormat, or
+// by Recover when the tables need a newer format version than
+// opt.Options.MaxFormatVersion, which is then reported as Latest.
+type ErrUnsupportedFormat struct {
+	Version int
+	Latest  int
+}
+
+func (e *ErrUnsupportedFormat) Error() string {
+	return fmt.Sprintf("leveldb: unsupported format version %d, latest supported is %d", e.Version, e.Latest)
+}
+
 // session represent a persistent database session.
 type session struct {
 	// Need 64-bit alignment.
@@ -41,6 +67,8 @@ type session struct {
 	stPrevJournalNum int64 // prev journal file number; no longer used; for compatibility with older version of leveldb
 	stTempFileNum    int64
 	stSeqNum         uint64 // last mem compacted seq; need external synchronization
+	stFormatVersion  int32  // on-disk format version
+	stNumLevels      int32  // maximum number of levels, zero if unlimited
 
 	stor     *iStorage
 	storLock storage.Locker
@@ -48,14 +76,31 @@ type session struct {
 	icmp     *iComparer
 	tops     *tOps
 	fileRef  map[int64]int
+	fileTab  map[int64]*tFile // tables referenced by live versions
 
 	manifest       *journal.Writer
 	manifestWriter storage.Writer
 	manifestFd     storage.FileDesc
+	manifestPrevFd storage.FileDesc // previous manifest, kept as backup
+
+	// Lazy manifest sync, see opt.LazyManifestSync.
+	manifestSyncMu  sync.Mutex
+	manifestDirty   bool     // manifest written since the last sync
+	manifestPending []func() // removals waiting for the manifest sync
+
+	// Obsolete manifests and journals retained, see
+	// opt.Options.KeepObsoleteManifests and KeepObsoleteJournals.
+	obsoleteMu sync.Mutex
+	obsolete   map[storage.FileType][]storage.FileDesc
 
 	stCompPtrs []internalKey // compaction pointers; need external synchronization
+	compHint   atomic.Value  // *util.Range, see DB.HintCompactionPriority
 	stVersion  *version      // current version
 	vmu        sync.Mutex
+
+	secondary bool // files are owned by another DB instance, never modify them
+	shared    bool // secondary without journals, see OpenShared
+	pinned    bool // secondary without journals at manifestFd, see OpenAtManifest
 }
 
 // Creates new initialized session instance.
@@ -67,20 +112,53 @@ func newSession(stor storage.Storage, o *opt.Options) (s *session, err error) {
 	if err != nil {
 		return
 	}
-	s = &session{
+	s, err = initSession(stor, storLock, o)
+	if err != nil {
+		storLock.Unlock()
+	}
+	return
+}
+
+// Creates new initialized session instance of a secondary DB. The storage
+// is not locked, since it is owned by the primary DB.
+func newSecondarySession(stor storage.Storage, o *opt.Options) (s *session, err error) {
+	if stor == nil {
+		return nil, os.ErrInvalid
+	}
+	s, err = initSession(stor, nil, o)
+	if err != nil {
+		return
+	}
+	s.secondary = true
+	return s, nil
+}
+
+func initSession(stor storage.Storage, storLock storage.Locker, o *opt.Options) (*session, error) {
+	s := &session{
 		stor:     newIStorage(stor),
 		storLock: storLock,
 		fileRef:  make(map[int64]int),
+		fileTab:  make(map[int64]*tFile),
+		obsolete: make(map[storage.FileType][]storage.FileDesc),
 	}
 	s.setOptions(o)
-	s.tops = newTableOps(s)
+	s.stor.retry = s.o.GetStorageRetry()
+	s.setFormatVersion(opt.FormatV1)
+	tops, err := newTableOps(s)
+	if err != nil {
+		return nil, err
+	}
+	s.tops = tops
 	s.setVersion(newVersion(s))
 	s.log("log@legend F·NumFile S·FileSize N·Entry C·BadEntry B·BadBlock Ke·KeyError D·DroppedEntry L·Level Q·SeqNum T·TimeElapsed")
-	return
+	return s, nil
 }
 
 // Close session.
 func (s *session) close() {
+	if err := s.syncManifest(); err != nil {
+		s.logf("manifest@sync error %q", err)
+	}
 	s.tops.close()
 	if s.manifest != nil {
 		s.manifest.Close()
@@ -95,7 +173,9 @@ func (s *session) close() {
 
 // Release session lock.
 func (s *session) release() {
-	s.storLock.Unlock()
+	if s.storLock != nil {
+		s.storLock.Unlock()
+	}
 }
 
 // Create a new database session; need external synchronization.
@@ -116,11 +196,98 @@ func (s *session) recover() (err error) {
 		}
 	}()
 
-	fd, err := s.stor.GetMeta()
+	fd := s.manifestFd
+	if !s.pinned {
+		fd, err = s.stor.GetMeta()
+		if err != nil {
+			return
+		}
+	}
+
+	staging, rec, err := s.recoverManifest(fd)
+	if err != nil {
+		if !errors.IsCorrupted(err) || s.pinned {
+			return
+		}
+
+		// The active manifest is corrupted, try the manifest it superseded,
+		// which is kept as backup, see newManifest. Older manifests are
+		// never tried: they may be generations retained for analysis, see
+		// opt.Options.KeepObsoleteManifests, far behind the tables.
+		bfd, ok, lerr := s.prevManifest(fd)
+		if lerr != nil || !ok {
+			return
+		}
+		s.logf("manifest@recovery %s-%d corrupted, falling back to %s-%d: %v", fd.Type, fd.Num, bfd.Type, bfd.Num, err)
+		bstaging, brec, berr := s.recoverManifest(bfd)
+		if berr != nil {
+			s.logf("manifest@recovery fallback %s-%d failed: %v", bfd.Type, bfd.Num, berr)
+			return
+		}
+		s.manifestFd = bfd
+		s.recordCommited(brec)
+		s.setVersion(bstaging.finish())
+		s.setNextFileNum(brec.nextFileNum)
+		return s.checkFallback(fd)
+	}
+
+	s.manifestFd = fd
+	// Commit the record first, the version depends on the level count.
+	s.recordCommited(rec)
+	s.setVersion(staging.finish())
+	s.setNextFileNum(rec.nextFileNum)
+	return nil
+}
+
+// Returns the manifest preceding the given one in storage, if any.
+func (s *session) prevManifest(fd storage.FileDesc) (prev storage.FileDesc, ok bool, err error) {
+	fds, err := s.stor.List(storage.TypeManifest)
 	if err != nil {
 		return
 	}
+	for _, x := range fds {
+		if x.Num < fd.Num && (!ok || x.Num > prev.Num) {
+			prev, ok = x, true
+		}
+	}
+	return
+}
+
+// Checks the session recovered from the backup of the corrupted manifest
+// fd against the storage. The file numbers found in storage are skipped,
+// since the backup may predate some of them. A table the backup doesn't
+// refer to may hold data committed by the corrupted manifest only, which
+// the janitor would remove, so the recovery is rejected as corrupted
+// instead; see RecoverFile. Need external synchronization.
+func (s *session) checkFallback(fd storage.FileDesc) error {
+	fds, err := s.stor.List(storage.TypeAll)
+	if err != nil {
+		return err
+	}
+	v := s.version()
+	defer v.release()
+	tmap := make(map[int64]bool)
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			tmap[t.fd.Num] = true
+		}
+	}
+	var orphans []storage.FileDesc
+	for _, x := range fds {
+		s.markFileNum(x.Num)
+		if x.Type == storage.TypeTable && !tmap[x.Num] {
+			orphans = append(orphans, x)
+		}
+	}
+	if len(orphans) > 0 {
+		s.logf("manifest@recovery fallback rejected, %d tables not referred to", len(orphans))
+		return errors.NewErrCorrupted(fd, errors.New("leveldb: manifest backup doesn't refer to all tables"))
+	}
+	return nil
+}
 
+// Replay the given manifest file; need external synchronization.
+func (s *session) recoverManifest(fd storage.FileDesc) (staging *versionStaging, rec *sessionRecord, err error) {
 	reader, err := s.stor.Open(fd)
 	if err != nil {
 		return
@@ -131,10 +298,11 @@ func (s *session) recover() (err error) {
 		// Options.
 		strict = s.o.GetStrict(opt.StrictManifest)
 
-		jr      = journal.NewReader(reader, dropper{s, fd}, strict, true)
-		rec     = &sessionRecord{}
-		staging = s.stVersion.newStaging()
+		jr = journal.NewReader(reader, dropper{s: s, fd: fd}, strict, true)
 	)
+	rec = &sessionRecord{}
+	staging = newVersion(s).newStaging()
+	s.stCompPtrs = nil
 	for {
 		var r io.Reader
 		r, err = jr.Next()
@@ -143,7 +311,7 @@ func (s *session) recover() (err error) {
 				err = nil
 				break
 			}
-			return errors.SetFd(err, fd)
+			return nil, nil, errors.SetFd(err, fd)
 		}
 
 		err = rec.decode(r)
@@ -157,7 +325,7 @@ func (s *session) recover() (err error) {
 		} else {
 			err = errors.SetFd(err, fd)
 			if strict || !errors.IsCorrupted(err) {
-				return
+				return nil, nil, err
 			}
 			s.logf("manifest error: %v (skipped)", errors.SetFd(err, fd))
 		}
@@ -168,22 +336,22 @@ func (s *session) recover() (err error) {
 
 	switch {
 	case !rec.has(recComparer):
-		return newErrManifestCorrupted(fd, "comparer", "missing")
+		err = newErrManifestCorrupted(fd, "comparer", "missing")
 	case rec.comparer != s.icmp.uName():
-		return newErrManifestCorrupted(fd, "comparer", fmt.Sprintf("mismatch: want '%s', got '%s'", s.icmp.uName(), rec.comparer))
+		err = &ErrComparerMismatch{Expected: rec.comparer, Got: s.icmp.uName()}
 	case !rec.has(recNextFileNum):
-		return newErrManifestCorrupted(fd, "next-file-num", "missing")
+		err = newErrManifestCorrupted(fd, "next-file-num", "missing")
 	case !rec.has(recJournalNum):
-		return newErrManifestCorrupted(fd, "journal-file-num", "missing")
+		err = newErrManifestCorrupted(fd, "journal-file-num", "missing")
 	case !rec.has(recSeqNum):
-		return newErrManifestCorrupted(fd, "seq-num", "missing")
+		err = newErrManifestCorrupted(fd, "seq-num", "missing")
+	case rec.has(recFormatVersion) && rec.formatVersion > opt.LatestFormat:
+		err = &ErrUnsupportedFormat{Version: rec.formatVersion, Latest: opt.LatestFormat}
 	}
-
-	s.manifestFd = fd
-	s.setVersion(staging.finish())
-	s.setNextFileNum(rec.nextFileNum)
-	s.recordCommited(rec)
-	return nil
+	if err != nil {
+		return nil, nil, err
+	}
+	return
 }
 
 // Commit session; need external synchronization.
@@ -12,6 +12,7 @@ import (
 	"github.com/btcsuite/goleveldb/leveldb/iterator"
 	"github.com/btcsuite/goleveldb/leveldb/memdb"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/util"
 )
 
 func (s *session) pickMemdbLevel(umin, umax []byte, maxLevel int) int {
@@ -20,11 +21,11 @@ func (s *session) pickMemdbLevel(umin, umax []byte, maxLevel int) int {
 	return v.pickMemdbLevel(umin, umax, maxLevel)
 }
 
-func (s *session) flushMemdb(rec *sessionRecord, mdb *memdb.DB, maxLevel int) (int, error) {
+func (s *session) flushMemdb(rec *sessionRecord, mdb memdb.Table, maxLevel int) (int, error) {
 	// Create sorted table.
 	iter := mdb.NewIterator(nil)
 	defer iter.Release()
-	t, n, err := s.tops.createFrom(iter)
+	t, n, err := s.tops.createFrom(iter, int64(mdb.Size()))
 	if err != nil {
 		return 0, err
 	}
@@ -37,10 +38,13 @@ func (s *session) flushMemdb(rec *sessionRecord, mdb *memdb.DB, maxLevel int) (i
 	// higher level, thus maximum possible level is always picked, while
 	// overlapping deletion marker pushed into lower level.
 	// See: https://github.com/syndtr/goleveldb/issues/127.
+	if n := s.numLevels(); n > 0 && maxLevel > n-1 {
+		maxLevel = n - 1
+	}
 	flushLevel := s.pickMemdbLevel(t.imin.ukey(), t.imax.ukey(), maxLevel)
 	rec.addTableFile(flushLevel, t)
 
-	s.logf("memdb@flush created L%d@%d N·%d S·%s %q:%q", flushLevel, t.fd.Num, n, shortenb(int(t.size)), t.imin, t.imax)
+	s.logf("memdb@flush created L%d@%d N·%d S·%s %q:%q", flushLevel, t.fd.Num, n, shortenb(t.size), t.imin, t.imax)
 	return flushLevel, nil
 }
 
@@ -54,10 +58,22 @@ func (s *session) pickCompaction() *compaction {
 		sourceLevel = v.cLevel
 		cptr := s.getCompPtr(sourceLevel)
 		tables := v.levels[sourceLevel]
-		for _, t := range tables {
-			if cptr == nil || s.icmp.Compare(t.imax, cptr) > 0 {
-				t0 = append(t0, t)
-				break
+		// Tables overlapping the hinted range go first, then the tables
+		// are picked round-robin.
+		if hint, _ := s.compHint.Load().(*util.Range); hint != nil {
+			for _, t := range tables {
+				if t.overlaps(s.icmp, hint.Start, hint.Limit) {
+					t0 = append(t0, t)
+					break
+				}
+			}
+		}
+		if len(t0) == 0 {
+			for _, t := range tables {
+				if cptr == nil || s.icmp.Compare(t.imax, cptr) > 0 {
+					t0 = append(t0, t)
+					break
+				}
 			}
 		}
 		if len(t0) == 0 {
@@ -74,14 +90,14 @@ func (s *session) pickCompaction() *compaction {
 		}
 	}
 
-	return newCompaction(s, v, sourceLevel, t0)
+	return newCompaction(s, v, sourceLevel, t0, false)
 }
 
 // Create compaction from given level and range; need external synchronization.
 func (s *session) getCompactionRange(sourceLevel int, umin, umax []byte, noLimit bool) *compaction {
 	v := s.version()
 
-	if sourceLevel >= len(v.levels) {
+	if sourceLevel >= len(v.levels) || !s.levelCompactable(sourceLevel) {
 		v.release()
 		return nil
 	}
@@ -97,7 +113,7 @@ func (s *session) getCompactionRange(sourceLevel int, umin, umax []byte, noLimit
 	// and we must not pick one file and drop another older file if the
 	// two files overlap.
 	if !noLimit && sourceLevel > 0 {
-		limit := int64(v.s.o.GetCompactionSourceLimit(sourceLevel))
+		limit := v.s.o.GetCompactionSourceLimit(sourceLevel)
 		total := int64(0)
 		for i, t := range t0 {
 			total += t.size
@@ -109,18 +125,23 @@ func (s *session) getCompactionRange(sourceLevel int, umin, umax []byte, noLimit
 		}
 	}
 
-	return newCompaction(s, v, sourceLevel, t0)
+	return newCompaction(s, v, sourceLevel, t0, noLimit)
 }
 
-func newCompaction(s *session, v *version, sourceLevel int, t0 tFiles) *compaction {
+// Creates a compaction of the given tables; unless noLimit, the compaction
+// is trimmed to opt.Options.MaxCompactionBytes.
+func newCompaction(s *session, v *version, sourceLevel int, t0 tFiles, noLimit bool) *compaction {
 	c := &compaction{
 		s:             s,
 		v:             v,
 		sourceLevel:   sourceLevel,
 		levels:        [2]tFiles{t0, nil},
-		maxGPOverlaps: int64(s.o.GetCompactionGPOverlaps(sourceLevel)),
+		maxGPOverlaps: s.o.GetCompactionGPOverlaps(sourceLevel),
 		tPtrs:         make([]int, len(v.levels)),
 	}
+	if !noLimit {
+		c.maxBytes = s.o.GetMaxCompactionBytes()
+	}
 	c.expand()
 	c.save()
 	return c
@@ -134,6 +155,7 @@ type compaction struct {
 	sourceLevel   int
 	levels        [2]tFiles
 	maxGPOverlaps int64
+	maxBytes      int64
 
 	gp                tFiles
 	gpi               int
@@ -172,7 +194,7 @@ func (c *compaction) release() {
 
 // Expand compacted tables; need external synchronization.
 func (c *compaction) expand() {
-	limit := int64(c.s.o.GetCompactionExpandLimit(c.sourceLevel))
+	limit := c.s.o.GetCompactionExpandLimit(c.sourceLevel)
 	vt0 := c.v.levels[c.sourceLevel]
 	vt1 := tFiles{}
 	if level := c.sourceLevel + 1; level < len(c.v.levels) {
@@ -187,6 +209,17 @@ func (c *compaction) expand() {
 		imin, imax = t0.getRange(c.s.icmp)
 	}
 	t1 = vt1.getOverlaps(t1, c.s.icmp, imin.ukey(), imax.ukey(), false)
+
+	// Level-0 tables may overlap each other, so leaving some out isn't
+	// safe; thus level-0 compactions aren't trimmed.
+	if c.maxBytes > 0 && c.sourceLevel > 0 && t0.size()+t1.size() > c.maxBytes {
+		if n, x1 := c.trim(vt1, t0); n < len(t0) {
+			c.s.logf("table@compaction trimming L%d F·%d -> F·%d", c.sourceLevel, len(t0), n)
+			t0, t1 = t0[:n], x1
+			imin, imax = t0.getRange(c.s.icmp)
+		}
+	}
+
 	// Get entire range covered by compaction.
 	amin, amax := append(t0, t1...).getRange(c.s.icmp)
 
@@ -194,13 +227,13 @@ func (c *compaction) expand() {
 	// changing the number of "sourceLevel+1" files we pick up.
 	if len(t1) > 0 {
 		exp0 := vt0.getOverlaps(nil, c.s.icmp, amin.ukey(), amax.ukey(), c.sourceLevel == 0)
-		if len(exp0) > len(t0) && t1.size()+exp0.size() < limit {
+		if len(exp0) > len(t0) && t1.size()+exp0.size() < limit && (c.maxBytes <= 0 || t1.size()+exp0.size() <= c.maxBytes) {
 			xmin, xmax := exp0.getRange(c.s.icmp)
 			exp1 := vt1.getOverlaps(nil, c.s.icmp, xmin.ukey(), xmax.ukey(), false)
 			if len(exp1) == len(t1) {
 				c.s.logf("table@compaction expanding L%d+L%d (F·%d S·%s)+(F·%d S·%s) -> (F·%d S·%s)+(F·%d S·%s)",
-					c.sourceLevel, c.sourceLevel+1, len(t0), shortenb(int(t0.size())), len(t1), shortenb(int(t1.size())),
-					len(exp0), shortenb(int(exp0.size())), len(exp1), shortenb(int(exp1.size())))
+					c.sourceLevel, c.sourceLevel+1, len(t0), shortenb(t0.size()), len(t1), shortenb(t1.size()),
+					len(exp0), shortenb(exp0.size()), len(exp1), shortenb(exp1.size()))
 				imin, imax = xmin, xmax
 				t0, t1 = exp0, exp1
 				amin, amax = append(t0, t1...).getRange(c.s.icmp)
@@ -218,6 +251,27 @@ func (c *compaction) expand() {
 	c.imin, c.imax = imin, imax
 }
 
+// Returns the number of leading tables of t0, which must be sorted, to
+// compact, and the tables of vt1 they overlap, so that the compaction
+// input fits maxBytes, or is as small as possible. Tables sharing a user
+// key on their boundary are never split, since the newer entries of the
+// key would then be moved below older ones; need external synchronization.
+func (c *compaction) trim(vt1, t0 tFiles) (n int, t1 tFiles) {
+	n = len(t0)
+	for i := len(t0) - 1; i > 0; i-- {
+		if c.s.icmp.uCompare(t0[i-1].imax.ukey(), t0[i].imin.ukey()) == 0 {
+			continue
+		}
+		imin, imax := t0[:i].getRange(c.s.icmp)
+		x1 := vt1.getOverlaps(nil, c.s.icmp, imin.ukey(), imax.ukey(), false)
+		n, t1 = i, x1
+		if t0[:i].size()+x1.size() <= c.maxBytes {
+			break
+		}
+	}
+	return
+}
+
 // Check whether compaction is trivial.
 func (c *compaction) trivial() bool {
 	return len(c.levels[0]) == 1 && len(c.levels[1]) == 0 && c.gp.size() <= c.maxGPOverlaps
@@ -32,6 +32,8 @@ const (
 	recAddTable    = 7
 	// 8 was used for large value refs
 	recPrevJournalNum = 9
+	recFormatVersion  = 10
+	recNumLevels      = 11
 )
 
 type cpRecord struct {
@@ -59,6 +61,8 @@ type sessionRecord struct {
 	prevJournalNum int64
 	nextFileNum    int64
 	seqNum         uint64
+	formatVersion  int
+	numLevels      int
 	compPtrs       []cpRecord
 	addedTables    []atRecord
 	deletedTables  []dtRecord
@@ -96,6 +100,16 @@ func (p *sessionRecord) setSeqNum(num uint64) {
 	p.seqNum = num
 }
 
+func (p *sessionRecord) setFormatVersion(v int) {
+	p.hasRec |= 1 << recFormatVersion
+	p.formatVersion = v
+}
+
+func (p *sessionRecord) setNumLevels(n int) {
+	p.hasRec |= 1 << recNumLevels
+	p.numLevels = n
+}
+
 func (p *sessionRecord) addCompPtr(level int, ikey internalKey) {
 	p.hasRec |= 1 << recCompPtr
 	p.compPtrs = append(p.compPtrs, cpRecord{level, ikey})
@@ -174,6 +188,14 @@ func (p *sessionRecord) encode(w io.Writer) error {
 		p.putUvarint(w, recSeqNum)
 		p.putUvarint(w, p.seqNum)
 	}
+	if p.has(recFormatVersion) {
+		p.putUvarint(w, recFormatVersion)
+		p.putUvarint(w, uint64(p.formatVersion))
+	}
+	if p.has(recNumLevels) {
+		p.putUvarint(w, recNumLevels)
+		p.putUvarint(w, uint64(p.numLevels))
+	}
 	for _, r := range p.compPtrs {
 		p.putUvarint(w, recCompPtr)
 		p.putUvarint(w, uint64(r.level))
@@ -295,6 +317,16 @@ func (p *sessionRecord) decode(r io.Reader) error {
 			if p.err == nil {
 				p.setSeqNum(x)
 			}
+		case recFormatVersion:
+			x := p.readUvarint("format-version", br)
+			if p.err == nil {
+				p.setFormatVersion(int(x))
+			}
+		case recNumLevels:
+			x := p.readUvarint("num-levels", br)
+			if p.err == nil {
+				p.setNumLevels(int(x))
+			}
 		case recCompPtr:
 			level := p.readLevel("comp-ptr.level", br)
 			ikey := p.readBytes("comp-ptr.ikey", br)
@@ -58,5 +58,7 @@ func TestSessionRecord_EncodeDecode(t *testing.T) {
 	v.setPrevJournalNum(big + 99)
 	v.setNextFileNum(big + 200)
 	v.setSeqNum(uint64(big + 1000))
+	v.setFormatVersion(2)
+	v.setNumLevels(5)
 	test()
 }
@@ -8,22 +8,28 @@ package leveldb
 
 import (
 	"fmt"
+	"sort"
 	"sync/atomic"
 
 	"github.com/btcsuite/goleveldb/leveldb/journal"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/storage"
 )
 
 // Logging.
 
 type dropper struct {
-	s  *session
-	fd storage.FileDesc
+	s       *session
+	fd      storage.FileDesc
+	dropped *int64 // Optional, counts the dropped bytes.
 }
 
 func (d dropper) Drop(err error) {
 	if e, ok := err.(*journal.ErrCorrupted); ok {
-		d.s.logf("journal@drop %s-%d S·%s %q", d.fd.Type, d.fd.Num, shortenb(e.Size), e.Reason)
+		d.s.logf("journal@drop %s-%d S·%s %q", d.fd.Type, d.fd.Num, shortenb(int64(e.Size)), e.Reason)
+		if d.dropped != nil {
+			*d.dropped += int64(e.Size)
+		}
 	} else {
 		d.s.logf("journal@drop %s-%d %q", d.fd.Type, d.fd.Num, err)
 	}
@@ -32,6 +38,16 @@ func (d dropper) Drop(err error) {
 func (s *session) log(v ...interface{})                 { s.stor.Log(fmt.Sprint(v...)) }
 func (s *session) logf(format string, v ...interface{}) { s.stor.Log(fmt.Sprintf(format, v...)) }
 
+// Logs an event with structured fields, which are formatted into the
+// message if the storage isn't a storage.FieldLogger.
+func (s *session) logFields(fields map[string]interface{}, msg string) {
+	if l, ok := s.stor.Storage.(storage.FieldLogger); ok {
+		l.Logf(fields, msg)
+	} else {
+		s.stor.Log(storage.FormatLogFields(fields, msg))
+	}
+}
+
 // File utils.
 
 func (s *session) newTemp() storage.FileDesc {
@@ -39,18 +55,43 @@ func (s *session) newTemp() storage.FileDesc {
 	return storage.FileDesc{storage.TypeTemp, num}
 }
 
-func (s *session) addFileRef(fd storage.FileDesc, ref int) int {
-	ref += s.fileRef[fd.Num]
+func (s *session) addFileRef(t *tFile, ref int) int {
+	ref += s.fileRef[t.fd.Num]
 	if ref > 0 {
-		s.fileRef[fd.Num] = ref
+		s.fileRef[t.fd.Num] = ref
+		s.fileTab[t.fd.Num] = t
 	} else if ref == 0 {
-		delete(s.fileRef, fd.Num)
+		delete(s.fileRef, t.fd.Num)
+		delete(s.fileTab, t.fd.Num)
 	} else {
-		panic(fmt.Sprintf("negative ref: %v", fd))
+		panic(fmt.Sprintf("negative ref: %v", t.fd))
 	}
 	return ref
 }
 
+// Get all tables referenced by live versions. This will incr the tables
+// ref, must call releaseLiveTables after use.
+func (s *session) liveTables() tFiles {
+	s.vmu.Lock()
+	defer s.vmu.Unlock()
+	tables := make(tFiles, 0, len(s.fileTab))
+	for _, t := range s.fileTab {
+		s.addFileRef(t, 1)
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+func (s *session) releaseLiveTables(tables tFiles) {
+	s.vmu.Lock()
+	defer s.vmu.Unlock()
+	for _, t := range tables {
+		if s.addFileRef(t, -1) == 0 {
+			s.tops.remove(t)
+		}
+	}
+}
+
 // Session state.
 
 // Get current version. This will incr version ref, must call
@@ -92,6 +133,89 @@ func (s *session) setNextFileNum(num int64) {
 	atomic.StoreInt64(&s.stNextFileNum, num)
 }
 
+// Get on-disk format version.
+func (s *session) formatVersion() int {
+	return int(atomic.LoadInt32(&s.stFormatVersion))
+}
+
+// Set on-disk format version.
+func (s *session) setFormatVersion(v int) {
+	atomic.StoreInt32(&s.stFormatVersion, int32(v))
+}
+
+// Returns the format version the DB should be upgraded to, that is the
+// oldest one supporting the enabled features allowed by MaxFormatVersion,
+// or zero if no upgrade is needed.
+func (s *session) upgradeFormatVersion() int {
+	max := s.o.GetMaxFormatVersion()
+	v := opt.FormatV1
+	if s.o.GetEnableBlobFiles() && opt.FormatV2 <= max {
+		v = opt.FormatV2
+	}
+	if s.o.GetTwoLevelIndex() && opt.FormatV3 <= max {
+		v = opt.FormatV3
+	}
+	if s.o.GetBlockTransform() != nil && opt.FormatV4 <= max {
+		v = opt.FormatV4
+	}
+	if v <= s.formatVersion() {
+		return 0
+	}
+	return v
+}
+
+// Get maximum number of levels, zero if unlimited.
+func (s *session) numLevels() int {
+	return int(atomic.LoadInt32(&s.stNumLevels))
+}
+
+// Set maximum number of levels.
+func (s *session) setNumLevels(n int) {
+	atomic.StoreInt32(&s.stNumLevels, int32(n))
+}
+
+// Returns whether tables of the given level may be compacted into the
+// next level.
+func (s *session) levelCompactable(level int) bool {
+	n := s.numLevels()
+	return n == 0 || level < n-1
+}
+
+// Validates the NumLevels option against the level count of the DB, and
+// applies it if the DB has none; need external synchronization.
+func (s *session) checkNumLevels() error {
+	n := s.o.GetNumLevels()
+	if n == 0 {
+		return nil
+	}
+	if n < 2 {
+		return &ErrInvalidOption{Name: "NumLevels", Reason: "must be at least 2"}
+	}
+	for level := 1; level < n; level++ {
+		if s.o.GetCompactionTotalSize(level) <= 0 {
+			return &ErrInvalidOption{Name: "NumLevels", Reason: fmt.Sprintf("total size of level %d overflows", level)}
+		}
+	}
+	if cur := s.numLevels(); cur != 0 {
+		if cur != n {
+			return &ErrInvalidOption{Name: "NumLevels", Reason: fmt.Sprintf("DB has %d levels", cur)}
+		}
+		return nil
+	}
+
+	v := s.version()
+	defer v.release()
+	for level := n; level < len(v.levels); level++ {
+		if len(v.levels[level]) > 0 {
+			return &ErrInvalidOption{Name: "NumLevels", Reason: fmt.Sprintf("DB has tables at level %d", level)}
+		}
+	}
+	s.setNumLevels(n)
+	// The current version was built without the level limit.
+	v.computeCompaction()
+	return nil
+}
+
 // Mark file number as used.
 func (s *session) markFileNum(num int64) {
 	nextFileNum := num + 1
@@ -165,6 +289,16 @@ func (s *session) fillRecord(r *sessionRecord, snapshot bool) {
 		}
 
 		r.setComparer(s.icmp.uName())
+
+		// Format version 1 isn't recorded, to keep the DB readable by
+		// other LevelDB implementations.
+		if v := s.formatVersion(); v > opt.FormatV1 && !r.has(recFormatVersion) {
+			r.setFormatVersion(v)
+		}
+
+		if n := s.numLevels(); n > 0 && !r.has(recNumLevels) {
+			r.setNumLevels(n)
+		}
 	}
 }
 
@@ -183,6 +317,14 @@ func (s *session) recordCommited(rec *sessionRecord) {
 		s.stSeqNum = rec.seqNum
 	}
 
+	if rec.has(recFormatVersion) {
+		s.setFormatVersion(rec.formatVersion)
+	}
+
+	if rec.has(recNumLevels) {
+		s.setNumLevels(rec.numLevels)
+	}
+
 	for _, r := range rec.compPtrs {
 		s.setCompPtr(r.level, internalKey(r.ikey))
 	}
@@ -216,12 +358,18 @@ func (s *session) newManifest(rec *sessionRecord, v *version) (err error) {
 			if s.manifestWriter != nil {
 				s.manifestWriter.Close()
 			}
-			if !s.manifestFd.Zero() {
-				s.stor.Remove(s.manifestFd)
+			// Keep the previous manifest as backup, so that the session
+			// could still be recovered if the new one got corrupted.
+			if !s.manifestPrevFd.Zero() {
+				s.removeObsolete(s.manifestPrevFd)
 			}
+			s.manifestPrevFd = s.manifestFd
 			s.manifestFd = fd
 			s.manifestWriter = writer
 			s.manifest = jw
+			if s.lazyManifestSync() {
+				s.setManifestDirty()
+			}
 		} else {
 			writer.Close()
 			s.stor.Remove(fd)
@@ -260,7 +408,9 @@ func (s *session) flushManifest(rec *sessionRecord) (err error) {
 	if err != nil {
 		return
 	}
-	if !s.o.GetNoSync() {
+	if s.lazyManifestSync() {
+		s.setManifestDirty()
+	} else if !s.o.GetNoSync() {
 		err = s.manifestWriter.Sync()
 		if err != nil {
 			return
@@ -269,3 +419,128 @@ func (s *session) flushManifest(rec *sessionRecord) (err error) {
 	s.recordCommited(rec)
 	return
 }
+
+func (s *session) lazyManifestSync() bool {
+	return s.o.GetManifestSync() == opt.LazyManifestSync && !s.o.GetNoSync()
+}
+
+func (s *session) setManifestDirty() {
+	s.manifestSyncMu.Lock()
+	s.manifestDirty = true
+	s.manifestSyncMu.Unlock()
+}
+
+// Returns the number of obsolete files of the given type to retain, see
+// opt.Options.KeepObsoleteManifests and KeepObsoleteJournals.
+func (s *session) keepObsolete(ft storage.FileType) int {
+	switch ft {
+	case storage.TypeManifest:
+		return s.o.GetKeepObsoleteManifests()
+	case storage.TypeJournal:
+		return s.o.GetKeepObsoleteJournals()
+	}
+	return 0
+}
+
+// Removes the given obsolete manifest or journal file. If obsolete files
+// of its type are retained, the file is retained instead, and the oldest
+// retained file beyond the limit, if any, is removed.
+func (s *session) removeObsolete(fd storage.FileDesc) error {
+	if keep := s.keepObsolete(fd.Type); keep > 0 {
+		s.obsoleteMu.Lock()
+		kept := append(s.obsolete[fd.Type], fd)
+		if len(kept) <= keep {
+			s.obsolete[fd.Type] = kept
+			s.obsoleteMu.Unlock()
+			return nil
+		}
+		fd = kept[0]
+		s.obsolete[fd.Type] = kept[1:]
+		s.obsoleteMu.Unlock()
+	}
+	return s.stor.Remove(fd)
+}
+
+// Returns the given obsolete files without the most recent manifests and
+// journals to retain, which become the retained files removeObsolete
+// starts from. Only manifests older than the backup manifest are retained,
+// so that the backup stays the manifest preceding the current one, see
+// session.recover; need external synchronization.
+func (s *session) retainObsolete(fds []storage.FileDesc) []storage.FileDesc {
+	s.obsoleteMu.Lock()
+	defer s.obsoleteMu.Unlock()
+
+	retained := make(map[storage.FileDesc]bool)
+	for _, ft := range [...]storage.FileType{storage.TypeManifest, storage.TypeJournal} {
+		keep := s.keepObsolete(ft)
+		if keep == 0 {
+			continue
+		}
+		var kept []storage.FileDesc
+		for _, fd := range fds {
+			if fd.Type == ft && (ft != storage.TypeManifest || fd.Num < s.manifestPrevFd.Num) {
+				kept = append(kept, fd)
+			}
+		}
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].Num < kept[j].Num
+		})
+		if len(kept) > keep {
+			kept = kept[len(kept)-keep:]
+		}
+		for _, fd := range kept {
+			retained[fd] = true
+		}
+		s.obsolete[ft] = kept
+	}
+	if len(retained) == 0 {
+		return fds
+	}
+	var rem []storage.FileDesc
+	for _, fd := range fds {
+		if !retained[fd] {
+			rem = append(rem, fd)
+		}
+	}
+	return rem
+}
+
+// Runs the removal of a file obsoleted by a committed version edit, once
+// the edit is synced to the manifest. Otherwise a crash could leave the
+// manifest referring to the removed file.
+func (s *session) afterManifestSync(remove func()) {
+	s.manifestSyncMu.Lock()
+	if s.manifestDirty {
+		s.manifestPending = append(s.manifestPending, remove)
+		s.manifestSyncMu.Unlock()
+		return
+	}
+	s.manifestSyncMu.Unlock()
+	remove()
+}
+
+// Syncs the manifest if written since the last sync, then runs the pending
+// removals; need external synchronization with commits.
+func (s *session) syncManifest() error {
+	s.manifestSyncMu.Lock()
+	dirty := s.manifestDirty
+	s.manifestSyncMu.Unlock()
+	if !dirty {
+		return nil
+	}
+	if s.manifestWriter != nil {
+		if err := s.manifestWriter.Sync(); err != nil {
+			return err
+		}
+	}
+	// Removals queued during the sync were obsoleted by edits written
+	// before it, since commits are excluded.
+	s.manifestSyncMu.Lock()
+	pending := s.manifestPending
+	s.manifestDirty, s.manifestPending = false, nil
+	s.manifestSyncMu.Unlock()
+	for _, remove := range pending {
+		remove()
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package leveldb
 
 import (
 	"sync/atomic"
+	"time"
 
+	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/storage"
 )
 
@@ -10,15 +12,41 @@ type iStorage struct {
 	storage.Storage
 	read  uint64
 	write uint64
+	retry *opt.RetryPolicy
+}
+
+// Reports whether an operation which failed with the given error on the
+// given attempt, counted from 1, should be retried, in which case it
+// sleeps for the backoff of the retry policy first.
+func (c *iStorage) shouldRetry(err error, attempt int) bool {
+	p := c.retry
+	if p == nil || attempt >= p.MaxAttempts || !storage.IsRetryable(err) {
+		return false
+	}
+	backoff := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || backoff < p.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	time.Sleep(backoff)
+	return true
 }
 
 func (c *iStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
 	r, err := c.Storage.Open(fd)
+	for attempt := 1; err != nil && c.shouldRetry(err, attempt); attempt++ {
+		r, err = c.Storage.Open(fd)
+	}
 	return &iStorageReader{r, c}, err
 }
 
 func (c *iStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
 	w, err := c.Storage.Create(fd)
+	for attempt := 1; err != nil && c.shouldRetry(err, attempt); attempt++ {
+		w, err = c.Storage.Create(fd)
+	}
 	return &iStorageWriter{w, c}, err
 }
 
@@ -32,7 +60,7 @@ func (c *iStorage) writes() uint64 {
 
 // newIStorage returns the given storage wrapped by iStorage.
 func newIStorage(s storage.Storage) *iStorage {
-	return &iStorage{s, 0, 0}
+	return &iStorage{Storage: s}
 }
 
 type iStorageReader struct {
@@ -42,12 +70,22 @@ type iStorageReader struct {
 
 func (r *iStorageReader) Read(p []byte) (n int, err error) {
 	n, err = r.Reader.Read(p)
+	for attempt := 1; err != nil && r.c.shouldRetry(err, attempt); attempt++ {
+		var m int
+		m, err = r.Reader.Read(p[n:])
+		n += m
+	}
 	atomic.AddUint64(&r.c.read, uint64(n))
 	return n, err
 }
 
 func (r *iStorageReader) ReadAt(p []byte, off int64) (n int, err error) {
 	n, err = r.Reader.ReadAt(p, off)
+	for attempt := 1; err != nil && r.c.shouldRetry(err, attempt); attempt++ {
+		var m int
+		m, err = r.Reader.ReadAt(p[n:], off+int64(n))
+		n += m
+	}
 	atomic.AddUint64(&r.c.read, uint64(n))
 	return n, err
 }
@@ -59,6 +97,26 @@ type iStorageWriter struct {
 
 func (w *iStorageWriter) Write(p []byte) (n int, err error) {
 	n, err = w.Writer.Write(p)
+	for attempt := 1; err != nil && w.c.shouldRetry(err, attempt); attempt++ {
+		var m int
+		m, err = w.Writer.Write(p[n:])
+		n += m
+	}
 	atomic.AddUint64(&w.c.write, uint64(n))
 	return n, err
 }
+
+func (w *iStorageWriter) Sync() error {
+	err := w.Writer.Sync()
+	for attempt := 1; err != nil && w.c.shouldRetry(err, attempt); attempt++ {
+		err = w.Writer.Sync()
+	}
+	return err
+}
+
+func (w *iStorageWriter) Preallocate(size int64) error {
+	if p, ok := w.Writer.(storage.Preallocator); ok {
+		return p.Preallocate(size)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -70,10 +71,20 @@ func writeFileSynced(filename string, data []byte, perm os.FileMode) error {
 
 const logSizeThreshold = 1024 * 1024 // 1 MiB
 
+// Storages opened with FileOptions.NoFinalizer, kept reachable until closed
+// so that the finalizers of their files never release the lock.
+var (
+	fsPinnedMu sync.Mutex
+	fsPinned   = make(map[*fileStorage]struct{})
+)
+
 // fileStorage is a file-system backed storage.
 type fileStorage struct {
-	path     string
-	readOnly bool
+	path       string
+	readOnly   bool
+	extCurrent bool
+	namer      Namer
+	logFormat  LogFormat
 
 	mu      sync.Mutex
 	flock   fileLock
@@ -92,6 +103,75 @@ type fileStorage struct {
 //
 // The storage must be closed after use, by calling Close method.
 func OpenFile(path string, readOnly bool) (Storage, error) {
+	return openFile(path, readOnly, true, nil)
+}
+
+// LogFormat is the format of the LOG file of a filesystem-backed storage.
+type LogFormat int
+
+// Log formats.
+const (
+	// LogText writes each event as a timestamped line of text, preceded
+	// by a separator line on each new day.
+	LogText LogFormat = iota
+
+	// LogJSON writes each event as a line holding a JSON object, e.g.:
+	//
+	//	{"ts":"2006-01-02T15:04:05.999999999Z07:00","msg":"db@open done","fields":{"T":1234}}
+	LogJSON
+)
+
+// FileOptions holds the optional parameters of a filesystem-backed storage.
+type FileOptions struct {
+	// ExtendedCurrent defines whether SetMeta writes the CURRENT file in
+	// the extended format, which starts with a magic line and records the
+	// CURRENT format version and creation time along with the manifest
+	// name. Both formats are accepted when reading, but older versions of
+	// this package can't read the extended format.
+	ExtendedCurrent bool
+
+	// Namer defines the file name scheme of the storage. The names of the
+	// CURRENT, LOCK and LOG files are fixed and the Namer must not
+	// produce them.
+	//
+	// The default value is DefaultNamer.
+	Namer Namer
+
+	// NoFinalizer defines whether to not close the storage once it is no
+	// longer referenced. By default a storage that is never closed is
+	// closed by a finalizer, which logs a warning to the LOG file; that
+	// hides the leak and releases the LOCK at an unpredictable time. With
+	// NoFinalizer, a leaked storage and its LOCK stay held until the
+	// process exits, so that the leak is detectable, e.g. by a subsequent
+	// OpenFile failing, at the cost of leaking its file descriptors.
+	NoFinalizer bool
+
+	// LogFormat defines the format of the LOG file. Switching the format
+	// of an existing LOG file leaves a mix of both formats in it until it
+	// is rotated.
+	//
+	// The default value is LogText.
+	LogFormat LogFormat
+}
+
+// OpenFileWithOptions is like OpenFile but with the given options; a nil
+// FileOptions is the same as OpenFile.
+func OpenFileWithOptions(path string, readOnly bool, o *FileOptions) (Storage, error) {
+	return openFile(path, readOnly, true, o)
+}
+
+// OpenFileUnlocked returns a new read-only filesystem-backed storage
+// implementation with the given path, without acquiring the file lock.
+// This allows reading a DB that is concurrently opened, and locked, by
+// another process; see leveldb.OpenSecondary. The files may be modified or
+// removed at any time by the other process.
+//
+// The storage must be closed after use, by calling Close method.
+func OpenFileUnlocked(path string) (Storage, error) {
+	return openFile(path, true, false, nil)
+}
+
+func openFile(path string, readOnly, lock bool, o *FileOptions) (s Storage, err error) {
 	if fi, err := os.Stat(path); err == nil {
 		if !fi.IsDir() {
 			return nil, fmt.Errorf("leveldb/storage: open %s: not a directory", path)
@@ -104,16 +184,19 @@ func OpenFile(path string, readOnly bool) (Storage, error) {
 		return nil, err
 	}
 
-	flock, err := newFileLock(filepath.Join(path, "LOCK"), readOnly)
-	if err != nil {
-		return nil, err
-	}
-
-	defer func() {
+	var flock fileLock
+	if lock {
+		flock, err = newFileLock(filepath.Join(path, "LOCK"), readOnly)
 		if err != nil {
-			flock.release()
+			return nil, err
 		}
-	}()
+
+		defer func() {
+			if err != nil {
+				flock.release()
+			}
+		}()
+	}
 
 	var (
 		logw    *os.File
@@ -137,11 +220,36 @@ func OpenFile(path string, readOnly bool) (Storage, error) {
 		flock:    flock,
 		logw:     logw,
 		logSize:  logSize,
+		namer:    DefaultNamer,
+	}
+	if o != nil {
+		fs.extCurrent = o.ExtendedCurrent
+		fs.logFormat = o.LogFormat
+		if o.Namer != nil {
+			fs.namer = o.Namer
+		}
+	}
+	if o != nil && o.NoFinalizer {
+		fsPinnedMu.Lock()
+		fsPinned[fs] = struct{}{}
+		fsPinnedMu.Unlock()
+	} else {
+		runtime.SetFinalizer(fs, (*fileStorage).finalize)
 	}
-	runtime.SetFinalizer(fs, (*fileStorage).Close)
 	return fs, nil
 }
 
+// Closes a storage that was never closed, see FileOptions.NoFinalizer.
+func (fs *fileStorage) finalize() {
+	fs.Log("close: warning, storage was not closed, closing it on finalization")
+	fs.Close()
+}
+
+// Path returns the path of the storage directory.
+func (fs *fileStorage) Path() string {
+	return fs.path
+}
+
 func (fs *fileStorage) Lock() (Locker, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -183,7 +291,37 @@ func (fs *fileStorage) printDay(t time.Time) {
 	fs.logw.Write([]byte("=============== " + t.Format("Jan 2, 2006 (MST)") + " ===============\n"))
 }
 
+type jsonLogEntry struct {
+	Ts     string                 `json:"ts"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// Need external synchronization.
+func (fs *fileStorage) appendJSONLog(t time.Time, msg string, fields map[string]interface{}) {
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	e := jsonLogEntry{t.Format(time.RFC3339Nano), msg, fields}
+	b, err := json.Marshal(&e)
+	if err != nil {
+		// Some of the field values aren't encodable, use their text
+		// representation instead.
+		e.Fields = make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			e.Fields[k] = fmt.Sprint(v)
+		}
+		b, _ = json.Marshal(&e)
+	}
+	fs.buf = append(fs.buf[:0], b...)
+	fs.buf = append(fs.buf, '\n')
+}
+
 func (fs *fileStorage) doLog(t time.Time, str string) {
+	fs.doLogFields(t, nil, str)
+}
+
+func (fs *fileStorage) doLogFields(t time.Time, fields map[string]interface{}, str string) {
 	if fs.logSize > logSizeThreshold {
 		// Rotate log file.
 		fs.logw.Close()
@@ -200,6 +338,15 @@ func (fs *fileStorage) doLog(t time.Time, str string) {
 		// Force printDay on new log file.
 		fs.day = 0
 	}
+	if fs.logFormat == LogJSON {
+		fs.appendJSONLog(t, str, fields)
+		n, _ := fs.logw.Write(fs.buf)
+		fs.logSize += int64(n)
+		return
+	}
+	if fields != nil {
+		str = FormatLogFields(fields, str)
+	}
 	fs.printDay(t)
 	hour, min, sec := t.Clock()
 	msec := t.Nanosecond() / 1e3
@@ -231,14 +378,95 @@ func (fs *fileStorage) Log(str string) {
 	}
 }
 
+// Logf implements FieldLogger.Logf.
+func (fs *fileStorage) Logf(fields map[string]interface{}, msg string) {
+	if !fs.readOnly {
+		t := time.Now()
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.open < 0 {
+			return
+		}
+		fs.doLogFields(t, fields, msg)
+	}
+}
+
 func (fs *fileStorage) log(str string) {
 	if !fs.readOnly {
 		fs.doLog(time.Now(), str)
 	}
 }
 
+// Extended CURRENT file layout.
+//
+// The first line is the magic followed by the format version, the
+// following lines are 'key: value' pairs; the 'manifest' key is required,
+// unknown keys are ignored. Every line, including the last, ends with a
+// newline. E.g.:
+//
+//	goleveldb CURRENT 1
+//	manifest: MANIFEST-000005
+//	created: 2016-01-02T15:04:05Z
+const (
+	fsCurrentMagic   = "goleveldb CURRENT "
+	fsCurrentVersion = 1
+)
+
+func fsGenCurrent(namer Namer, fd FileDesc, ext bool, t time.Time) string {
+	if !ext {
+		return namer.Name(fd) + "\n"
+	}
+	return fmt.Sprintf("%s%d\nmanifest: %s\ncreated: %s\n",
+		fsCurrentMagic, fsCurrentVersion, namer.Name(fd), t.UTC().Format(time.RFC3339))
+}
+
+// Parses CURRENT file content, either a plain manifest name or the
+// extended format.
+func fsParseCurrent(namer Namer, b []byte) (fd FileDesc, err error) {
+	errCorrupted := func(reason string) error {
+		return &ErrCorrupted{
+			Err: errors.New("leveldb/storage: " + reason),
+		}
+	}
+	if len(b) < 1 || b[len(b)-1] != '\n' {
+		return fd, errCorrupted("corrupted or incomplete CURRENT file")
+	}
+	lines := strings.Split(string(b[:len(b)-1]), "\n")
+	if !strings.HasPrefix(lines[0], fsCurrentMagic) {
+		var ok bool
+		if fd, ok = namer.Parse(lines[0]); len(lines) != 1 || !ok {
+			return fd, errCorrupted("corrupted or incomplete CURRENT file")
+		}
+		return fd, nil
+	}
+	v, err := strconv.Atoi(lines[0][len(fsCurrentMagic):])
+	if err != nil || v < 1 {
+		return fd, errCorrupted(fmt.Sprintf("invalid CURRENT format version %q", lines[0][len(fsCurrentMagic):]))
+	} else if v > fsCurrentVersion {
+		return fd, errCorrupted(fmt.Sprintf("unsupported CURRENT format version %d", v))
+	}
+	var found bool
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return fd, errCorrupted(fmt.Sprintf("invalid CURRENT line %q", line))
+		}
+		if line[:i] == "manifest" {
+			var ok bool
+			if fd, ok = namer.Parse(line[i+2:]); !ok || fd.Type != TypeManifest {
+				return fd, errCorrupted(fmt.Sprintf("invalid CURRENT manifest %q", line[i+2:]))
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fd, errCorrupted("CURRENT file missing manifest")
+	}
+	return fd, nil
+}
+
 func (fs *fileStorage) setMeta(fd FileDesc) error {
-	content := fsGenName(fd) + "\n"
+	content := fsGenCurrent(fs.namer, fd, fs.extCurrent, time.Now())
 	// Check and backup old CURRENT file.
 	currentPath := filepath.Join(fs.path, "CURRENT")
 	if _, err := os.Stat(currentPath); err == nil {
@@ -247,7 +475,8 @@ func (fs *fileStorage) setMeta(fd FileDesc) error {
 			fs.log(fmt.Sprintf("backup CURRENT: %v", err))
 			return err
 		}
-		if string(b) == content {
+		if cfd, err := fsParseCurrent(fs.namer, b); err == nil && cfd == fd &&
+			strings.HasPrefix(string(b), fsCurrentMagic) == fs.extCurrent {
 			// Content not changed, do nothing.
 			return nil
 		}
@@ -328,15 +557,12 @@ func (fs *fileStorage) GetMeta() (FileDesc, error) {
 			}
 			return nil, err
 		}
-		var fd FileDesc
-		if len(b) < 1 || b[len(b)-1] != '\n' || !fsParseNamePtr(string(b[:len(b)-1]), &fd) {
+		fd, err := fsParseCurrent(fs.namer, b)
+		if err != nil {
 			fs.log(fmt.Sprintf("%s: corrupted content: %q", name, b))
-			err := &ErrCorrupted{
-				Err: errors.New("leveldb/storage: corrupted or incomplete CURRENT file"),
-			}
 			return nil, err
 		}
-		if _, err := os.Stat(filepath.Join(fs.path, fsGenName(fd))); err != nil {
+		if _, err := os.Stat(filepath.Join(fs.path, fs.namer.Name(fd))); err != nil {
 			if os.IsNotExist(err) {
 				fs.log(fmt.Sprintf("%s: missing target file: %s", name, fd))
 				err = os.ErrNotExist
@@ -438,29 +664,143 @@ func (fs *fileStorage) GetMeta() (FileDesc, error) {
 	return FileDesc{}, curErr
 }
 
+// Number of directory entries read at a time by ListFunc.
+const fsListBatch = 256
+
 func (fs *fileStorage) List(ft FileType) (fds []FileDesc, err error) {
+	err = fs.ListFunc(ft, func(fd FileDesc) error {
+		fds = append(fds, fd)
+		return nil
+	})
+	if err != nil {
+		fds = nil
+	}
+	return
+}
+
+// ListFunc implements FileLister. The directory is read in batches, and
+// fn is called without holding the storage lock, so fn may call other
+// storage methods.
+func (fs *fileStorage) ListFunc(ft FileType, fn func(fd FileDesc) error) error {
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
 	if fs.open < 0 {
+		fs.mu.Unlock()
+		return ErrClosed
+	}
+	fs.mu.Unlock()
+	dir, err := os.Open(fs.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dir.Close(); cerr != nil {
+			fs.Log(fmt.Sprintf("close dir: %v", cerr))
+		}
+	}()
+	for {
+		names, err := dir.Readdirnames(fsListBatch)
+		for _, name := range names {
+			if fd, ok := fs.namer.Parse(name); ok && fd.Type&ft != 0 {
+				if err := fn(fd); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// GetUnrecognizedFiles implements UnrecognizedFileLister. The names the
+// namer can't parse are reported, except for the LOCK, LOG and CURRENT
+// files of the storage and their variants.
+func (fs *fileStorage) GetUnrecognizedFiles() ([]string, error) {
+	fs.mu.Lock()
+	if fs.open < 0 {
+		fs.mu.Unlock()
 		return nil, ErrClosed
 	}
+	fs.mu.Unlock()
 	dir, err := os.Open(fs.path)
 	if err != nil {
-		return
+		return nil, err
 	}
-	names, err := dir.Readdirnames(0)
-	// Close the dir first before checking for Readdirnames error.
-	if cerr := dir.Close(); cerr != nil {
-		fs.log(fmt.Sprintf("close dir: %v", cerr))
+	defer func() {
+		if cerr := dir.Close(); cerr != nil {
+			fs.Log(fmt.Sprintf("close dir: %v", cerr))
+		}
+	}()
+	var names []string
+	for {
+		batch, err := dir.Readdirnames(fsListBatch)
+		for _, name := range batch {
+			if _, ok := fs.namer.Parse(name); !ok && !fsIsStorageName(name) {
+				names = append(names, name)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
 	}
-	if err == nil {
-		for _, name := range names {
-			if fd, ok := fsParseName(name); ok && fd.Type&ft != 0 {
-				fds = append(fds, fd)
+	sort.Strings(names)
+	return names, nil
+}
+
+// DiskUsage implements DiskUsager. The directory is scanned once, and the
+// sizes of the files the namer can parse or the storage keeps beside them
+// are summed; unrecognized files, see GetUnrecognizedFiles, don't count.
+func (fs *fileStorage) DiskUsage() (int64, error) {
+	fs.mu.Lock()
+	if fs.open < 0 {
+		fs.mu.Unlock()
+		return 0, ErrClosed
+	}
+	fs.mu.Unlock()
+	dir, err := os.Open(fs.path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := dir.Close(); cerr != nil {
+			fs.Log(fmt.Sprintf("close dir: %v", cerr))
+		}
+	}()
+	var size int64
+	for {
+		infos, err := dir.Readdir(fsListBatch)
+		for _, fi := range infos {
+			if !fi.Mode().IsRegular() {
+				continue
 			}
+			if _, ok := fs.namer.Parse(fi.Name()); ok || fsIsStorageName(fi.Name()) {
+				size += fi.Size()
+			}
+		}
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
 		}
 	}
-	return
+}
+
+// Returns whether the given name is one of the files the storage keeps
+// beside the files of the DB.
+func fsIsStorageName(name string) bool {
+	switch name {
+	case "LOCK", "LOG", "LOG.old", "CURRENT", "CURRENT.bak":
+		return true
+	}
+	if strings.HasPrefix(name, "CURRENT.") {
+		_, err := strconv.ParseInt(name[8:], 10, 64)
+		return err == nil
+	}
+	return false
 }
 
 func (fs *fileStorage) Open(fd FileDesc) (Reader, error) {
@@ -473,9 +813,9 @@ func (fs *fileStorage) Open(fd FileDesc) (Reader, error) {
 	if fs.open < 0 {
 		return nil, ErrClosed
 	}
-	of, err := os.OpenFile(filepath.Join(fs.path, fsGenName(fd)), os.O_RDONLY, 0)
+	of, err := os.OpenFile(filepath.Join(fs.path, fs.namer.Name(fd)), os.O_RDONLY, 0)
 	if err != nil {
-		if fsHasOldName(fd) && os.IsNotExist(err) {
+		if fs.namer == DefaultNamer && fsHasOldName(fd) && os.IsNotExist(err) {
 			of, err = os.OpenFile(filepath.Join(fs.path, fsGenOldName(fd)), os.O_RDONLY, 0)
 			if err == nil {
 				goto ok
@@ -501,7 +841,7 @@ func (fs *fileStorage) Create(fd FileDesc) (Writer, error) {
 	if fs.open < 0 {
 		return nil, ErrClosed
 	}
-	of, err := os.OpenFile(filepath.Join(fs.path, fsGenName(fd)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	of, err := os.OpenFile(filepath.Join(fs.path, fs.namer.Name(fd)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -522,9 +862,9 @@ func (fs *fileStorage) Remove(fd FileDesc) error {
 	if fs.open < 0 {
 		return ErrClosed
 	}
-	err := os.Remove(filepath.Join(fs.path, fsGenName(fd)))
+	err := os.Remove(filepath.Join(fs.path, fs.namer.Name(fd)))
 	if err != nil {
-		if fsHasOldName(fd) && os.IsNotExist(err) {
+		if fs.namer == DefaultNamer && fsHasOldName(fd) && os.IsNotExist(err) {
 			if e1 := os.Remove(filepath.Join(fs.path, fsGenOldName(fd))); !os.IsNotExist(e1) {
 				fs.log(fmt.Sprintf("remove %s: %v (old name)", fd, err))
 				err = e1
@@ -552,7 +892,7 @@ func (fs *fileStorage) Rename(oldfd, newfd FileDesc) error {
 	if fs.open < 0 {
 		return ErrClosed
 	}
-	return rename(filepath.Join(fs.path, fsGenName(oldfd)), filepath.Join(fs.path, fsGenName(newfd)))
+	return rename(filepath.Join(fs.path, fs.namer.Name(oldfd)), filepath.Join(fs.path, fs.namer.Name(newfd)))
 }
 
 func (fs *fileStorage) Close() error {
@@ -563,6 +903,9 @@ func (fs *fileStorage) Close() error {
 	}
 	// Clear the finalizer.
 	runtime.SetFinalizer(fs, nil)
+	fsPinnedMu.Lock()
+	delete(fsPinned, fs)
+	fsPinnedMu.Unlock()
 
 	if fs.open > 0 {
 		fs.log(fmt.Sprintf("close: warning, %d files still open", fs.open))
@@ -571,14 +914,28 @@ func (fs *fileStorage) Close() error {
 	if fs.logw != nil {
 		fs.logw.Close()
 	}
+	if fs.flock == nil {
+		return nil
+	}
 	return fs.flock.release()
 }
 
 type fileWrap struct {
 	*os.File
-	fs     *fileStorage
-	fd     FileDesc
-	closed bool
+	fs       *fileStorage
+	fd       FileDesc
+	closed   bool
+	prealloc int64
+}
+
+func (fw *fileWrap) Preallocate(size int64) error {
+	if err := fallocate(fw.File, size); err != nil {
+		return err
+	}
+	if size > fw.prealloc {
+		fw.prealloc = size
+	}
+	return nil
 }
 
 func (fw *fileWrap) Sync() error {
@@ -604,6 +961,14 @@ func (fw *fileWrap) Close() error {
 	}
 	fw.closed = true
 	fw.fs.open--
+	if fw.prealloc > 0 {
+		// Release the preallocated space past the end of the file.
+		if off, err := fw.File.Seek(0, io.SeekCurrent); err == nil && off < fw.prealloc {
+			if err := fdeallocate(fw.File, off, fw.prealloc); err != nil {
+				fw.fs.log(fmt.Sprintf("deallocate %s: %v", fw.fd, err))
+			}
+		}
+	}
 	err := fw.File.Close()
 	if err != nil {
 		fw.fs.log(fmt.Sprintf("close %s: %v", fw.fd, err))
@@ -611,6 +976,16 @@ func (fw *fileWrap) Close() error {
 	return err
 }
 
+type defaultNamer struct{}
+
+func (defaultNamer) Name(fd FileDesc) string                  { return fsGenName(fd) }
+func (defaultNamer) Parse(name string) (fd FileDesc, ok bool) { return fsParseName(name) }
+
+// DefaultNamer is the LevelDB file name scheme, e.g. '000001.ldb',
+// '000002.log' and 'MANIFEST-000003'. Table files with the older '.sst'
+// extension are also recognized.
+var DefaultNamer Namer = defaultNamer{}
+
 func fsGenName(fd FileDesc) string {
 	switch fd.Type {
 	case TypeManifest:
@@ -621,6 +996,8 @@ func fsGenName(fd FileDesc) string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case TypeTemp:
 		return fmt.Sprintf("%06d.tmp", fd.Num)
+	case TypeBlob:
+		return fmt.Sprintf("%06d.blob", fd.Num)
 	default:
 		panic("invalid file type")
 	}
@@ -649,6 +1026,8 @@ func fsParseName(name string) (fd FileDesc, ok bool) {
 			fd.Type = TypeTable
 		case "tmp":
 			fd.Type = TypeTemp
+		case "blob":
+			fd.Type = TypeBlob
 		default:
 			return
 		}
@@ -0,0 +1,47 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+func isErrNotSupported(err error) bool {
+	return err == syscall.EOPNOTSUPP || err == syscall.ENOSYS
+}
+
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err != nil && !isErrNotSupported(err) {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
+
+// Releases the space allocated between off, the end of the file, and end.
+// Some file-systems only release it on truncate, others only on punching
+// a hole.
+func fdeallocate(f *os.File, off, end int64) error {
+	fd := int(f.Fd())
+	if err := syscall.Ftruncate(fd, off); err != nil {
+		return os.NewSyscallError("ftruncate", err)
+	}
+	err := syscall.Fallocate(fd, fallocKeepSize|fallocPunchHole, off, end-off)
+	if err != nil && !isErrNotSupported(err) {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func allocatedSize(t *testing.T, path string) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal("Stat: got error: ", err)
+	}
+	return st.Blocks * 512
+}
+
+func TestFileStorage_Preallocate(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+	fs, err := OpenFile(temp, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	const size = 1 << 20
+	fd := FileDesc{TypeTable, 1}
+	path := filepath.Join(temp, fsGenName(fd))
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if err := w.(Preallocator).Preallocate(size); err != nil {
+		t.Fatal("Preallocate: got error: ", err)
+	}
+	supported := allocatedSize(t, path) >= size
+	if !supported {
+		t.Log("fallocate is not supported by the file-system")
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal("Stat: got error: ", err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("size after Preallocate: got %d, want 0", fi.Size())
+	}
+
+	data := bytes.Repeat([]byte("leveldb"), 1000)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal("Sync: got error: ", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("ReadFile: got error: ", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("content: got %d bytes, want %d bytes", len(got), len(data))
+	}
+	if n := allocatedSize(t, path); supported && n >= size {
+		t.Errorf("allocated size after Close: got %d, want < %d", n, size)
+	}
+}
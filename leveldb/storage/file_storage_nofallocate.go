@@ -0,0 +1,22 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+func fallocate(f *os.File, size int64) error {
+	return nil
+}
+
+func fdeallocate(f *os.File, off, end int64) error {
+	return nil
+}
@@ -7,13 +7,17 @@
 package storage
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 var cases = []struct {
@@ -29,6 +33,7 @@ var cases = []struct {
 	{nil, "MANIFEST-000007", TypeManifest, 7},
 	{nil, "9223372036854775807.log", TypeJournal, 9223372036854775807},
 	{nil, "000100.tmp", TypeTemp, 100},
+	{nil, "000100.blob", TypeBlob, 100},
 }
 
 var invalidCases = []string{
@@ -398,3 +403,430 @@ func TestFileStorage_ReadOnlyLocking(t *testing.T) {
 	p3.Close()
 	p4.Close()
 }
+
+func TestFileStorage_UnlockedOpen(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	p1, err := OpenFile(temp, false)
+	if err != nil {
+		t.Fatal("OpenFile(1): got error: ", err)
+	}
+	defer p1.Close()
+
+	p2, err := OpenFileUnlocked(temp)
+	if err != nil {
+		t.Fatal("OpenFileUnlocked: got error: ", err)
+	}
+	if _, err := p2.Create(FileDesc{TypeTable, 1}); err != errReadOnly {
+		t.Errorf("Create: got error %v, want %v", err, errReadOnly)
+	}
+	if err := p2.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	// Still locked by the first storage.
+	if _, err := OpenFile(temp, false); err == nil {
+		t.Fatal("OpenFile(2): expect error")
+	}
+}
+
+func TestFileStorage_ListFunc(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+	fs, err := OpenFile(temp, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	const n = fsListBatch + 10
+	for i := 0; i < n; i++ {
+		w, err := fs.Create(FileDesc{TypeTable, int64(i)})
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		w.Close()
+	}
+	if w, err := fs.Create(FileDesc{TypeJournal, n}); err != nil {
+		t.Fatal("Create: got error: ", err)
+	} else {
+		w.Close()
+	}
+
+	seen := make(map[int64]bool)
+	err = ListFunc(fs, TypeTable, func(fd FileDesc) error {
+		if fd.Type != TypeTable {
+			t.Errorf("ListFunc: got file type %v", fd.Type)
+		}
+		if seen[fd.Num] {
+			t.Errorf("ListFunc: file %v enumerated twice", fd)
+		}
+		seen[fd.Num] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal("ListFunc: got error: ", err)
+	}
+	if len(seen) != n {
+		t.Fatalf("ListFunc: got %d files, want %d", len(seen), n)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = ListFunc(fs, TypeAll, func(fd FileDesc) error {
+		calls++
+		if calls == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Fatalf("ListFunc: got error %v, want %v", err, errStop)
+	}
+	if calls != 3 {
+		t.Fatalf("ListFunc: callback called %d times after early return, want 3", calls)
+	}
+}
+
+func TestFileStorage_GetUnrecognizedFiles(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+	fs, err := OpenFile(temp, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	for _, fd := range []FileDesc{{TypeManifest, 1}, {TypeJournal, 2}, {TypeTable, 3}} {
+		w, err := fs.Create(fd)
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		w.Close()
+	}
+	if err := fs.SetMeta(FileDesc{TypeManifest, 1}); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+
+	l, ok := fs.(UnrecognizedFileLister)
+	if !ok {
+		t.Fatal("file storage doesn't implement UnrecognizedFileLister")
+	}
+	if names, err := l.GetUnrecognizedFiles(); err != nil || len(names) != 0 {
+		t.Fatalf("GetUnrecognizedFiles: got (%q, %v), want none", names, err)
+	}
+
+	for _, name := range []string{"000004.ldb.bak", "backup", "CURRENT.x"} {
+		if err := ioutil.WriteFile(filepath.Join(temp, name), []byte("x"), 0644); err != nil {
+			t.Fatal("WriteFile: got error: ", err)
+		}
+	}
+	names, err := l.GetUnrecognizedFiles()
+	if err != nil {
+		t.Fatal("GetUnrecognizedFiles: got error: ", err)
+	}
+	if got, want := strings.Join(names, " "), "000004.ldb.bak CURRENT.x backup"; got != want {
+		t.Fatalf("GetUnrecognizedFiles: got %q, want %q", got, want)
+	}
+}
+
+func TestFileStorage_DiskUsage(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+	fs, err := OpenFile(temp, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	var want int64
+	for i, fd := range []FileDesc{{TypeManifest, 1}, {TypeJournal, 2}, {TypeTable, 3}, {TypeTable, 4}} {
+		w, err := fs.Create(fd)
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		n := 100 * (i + 1)
+		if _, err := w.Write(make([]byte, n)); err != nil {
+			t.Fatal("Write: got error: ", err)
+		}
+		w.Close()
+		want += int64(n)
+	}
+	if err := fs.SetMeta(FileDesc{TypeManifest, 1}); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+	// The storage files count, the unrecognized ones don't.
+	for _, name := range []string{"CURRENT", "LOG", "LOCK"} {
+		fi, err := os.Stat(filepath.Join(temp, name))
+		if err != nil {
+			t.Fatal("Stat: got error: ", err)
+		}
+		want += fi.Size()
+	}
+	if err := ioutil.WriteFile(filepath.Join(temp, "backup"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal("WriteFile: got error: ", err)
+	}
+
+	u, ok := fs.(DiskUsager)
+	if !ok {
+		t.Fatal("file storage doesn't implement DiskUsager")
+	}
+	if size, err := u.DiskUsage(); err != nil || size != want {
+		t.Fatalf("DiskUsage: got (%d, %v), want %d", size, err, want)
+	}
+}
+
+func TestFileStorage_ExtendedCurrent(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	fs, err := OpenFileWithOptions(temp, false, &FileOptions{ExtendedCurrent: true})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	for _, num := range []int64{1, 2} {
+		fd := FileDesc{TypeManifest, num}
+		w, err := fs.Create(fd)
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		w.Close()
+		if err := fs.SetMeta(fd); err != nil {
+			t.Fatal("SetMeta: got error: ", err)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(temp, "CURRENT"))
+	if err != nil {
+		t.Fatal("ReadFile: got error: ", err)
+	}
+	lines := strings.Split(string(b), "\n")
+	if len(lines) != 4 || lines[0] != "goleveldb CURRENT 1" || lines[1] != "manifest: MANIFEST-000002" ||
+		!strings.HasPrefix(lines[2], "created: ") || lines[3] != "" {
+		t.Fatalf("invalid CURRENT content: %q", b)
+	}
+	if fd, err := fs.GetMeta(); err != nil {
+		t.Fatal("GetMeta: got error: ", err)
+	} else if fd.Num != 2 {
+		t.Fatalf("GetMeta: got num %d, want 2", fd.Num)
+	}
+	fs.Close()
+
+	// Plain format still readable, and rewritten as such.
+	fs, err = OpenFile(temp, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+	if fd, err := fs.GetMeta(); err != nil || fd.Num != 2 {
+		t.Fatalf("GetMeta: got %v %v, want num 2", fd, err)
+	}
+	if err := fs.SetMeta(FileDesc{TypeManifest, 2}); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(temp, "CURRENT")); string(b) != "MANIFEST-000002\n" {
+		t.Fatalf("invalid CURRENT content: %q", b)
+	}
+}
+
+func TestFileStorage_ParseCurrent(t *testing.T) {
+	valid := []string{
+		"MANIFEST-000003\n",
+		"goleveldb CURRENT 1\nmanifest: MANIFEST-000003\n",
+		"goleveldb CURRENT 1\ncreated: 2016-01-02T15:04:05Z\nmanifest: MANIFEST-000003\nfoo: bar\n",
+	}
+	for _, c := range valid {
+		if fd, err := fsParseCurrent(DefaultNamer, []byte(c)); err != nil {
+			t.Errorf("%q: got error: %v", c, err)
+		} else if fd != (FileDesc{TypeManifest, 3}) {
+			t.Errorf("%q: got %v", c, fd)
+		}
+	}
+	invalid := []string{
+		"",
+		"MANIFEST-000003",
+		"MANIFEST-000003\nfoo\n",
+		"otherdb CURRENT 1\nmanifest: MANIFEST-000003\n",
+		"goleveldb CURRENT 2\nmanifest: MANIFEST-000003\n",
+		"goleveldb CURRENT x\nmanifest: MANIFEST-000003\n",
+		"goleveldb CURRENT 1\ncreated: 2016-01-02T15:04:05Z\n",
+		"goleveldb CURRENT 1\nmanifest: 000003.log\n",
+		"goleveldb CURRENT 1\nmanifest MANIFEST-000003\n",
+	}
+	for _, c := range invalid {
+		if _, err := fsParseCurrent(DefaultNamer, []byte(c)); !isCorrupted(err) {
+			t.Errorf("%q: got error %v, want corrupted", c, err)
+		}
+	}
+}
+
+type prefixNamer string
+
+func (p prefixNamer) Name(fd FileDesc) string {
+	return string(p) + DefaultNamer.Name(fd)
+}
+
+func (p prefixNamer) Parse(name string) (fd FileDesc, ok bool) {
+	if !strings.HasPrefix(name, string(p)) {
+		return
+	}
+	return DefaultNamer.Parse(name[len(p):])
+}
+
+func TestFileStorage_Namer(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	namer := prefixNamer("foo-")
+	fs, err := OpenFileWithOptions(temp, false, &FileOptions{Namer: namer})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	// A file of another scheme sharing the directory.
+	if err := ioutil.WriteFile(filepath.Join(temp, "000009.log"), nil, 0644); err != nil {
+		t.Fatal("WriteFile: got error: ", err)
+	}
+
+	fds := []FileDesc{{TypeManifest, 1}, {TypeJournal, 2}, {TypeTable, 3}}
+	for _, fd := range fds {
+		w, err := fs.Create(fd)
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		w.Close()
+		if _, err := os.Stat(filepath.Join(temp, namer.Name(fd))); err != nil {
+			t.Errorf("%v: got error: %v", fd, err)
+		}
+		if pfd, ok := namer.Parse(namer.Name(fd)); !ok || pfd != fd {
+			t.Errorf("%v: round trip got %v %v", fd, pfd, ok)
+		}
+	}
+
+	list, err := fs.List(TypeAll)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	if len(list) != len(fds) {
+		t.Fatalf("List: got %v, want %v", list, fds)
+	}
+
+	if err := fs.SetMeta(fds[0]); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(temp, "CURRENT")); string(b) != "foo-MANIFEST-000001\n" {
+		t.Fatalf("invalid CURRENT content: %q", b)
+	}
+	if fd, err := fs.GetMeta(); err != nil || fd != fds[0] {
+		t.Fatalf("GetMeta: got %v %v, want %v", fd, err, fds[0])
+	}
+
+	if err := fs.Rename(fds[2], FileDesc{TypeTable, 4}); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	if r, err := fs.Open(FileDesc{TypeTable, 4}); err != nil {
+		t.Fatal("Open: got error: ", err)
+	} else {
+		r.Close()
+	}
+	if err := fs.Remove(FileDesc{TypeTable, 4}); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, "000009.log")); err != nil {
+		t.Fatal("foreign file: got error: ", err)
+	}
+}
+
+func TestFileStorage_Finalizer(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	leak := func(o *FileOptions) {
+		if _, err := OpenFileWithOptions(temp, false, o); err != nil {
+			t.Fatal("OpenFile: got error: ", err)
+		}
+	}
+	finalized := func() bool {
+		for i := 0; i < 50; i++ {
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond)
+			b, err := ioutil.ReadFile(filepath.Join(temp, "LOG"))
+			if err != nil {
+				t.Fatal("ReadFile: got error: ", err)
+			}
+			if strings.Contains(string(b), "storage was not closed") {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A leaked storage is closed by the finalizer, with a warning.
+	leak(nil)
+	if !finalized() {
+		t.Fatal("finalizer warning not logged")
+	}
+	fs, err := OpenFile(temp, false)
+	if err != nil {
+		t.Fatal("OpenFile after finalization: got error: ", err)
+	}
+	fs.Close()
+	if err := os.Remove(filepath.Join(temp, "LOG")); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+
+	// Without finalizer the lock stays held.
+	leak(&FileOptions{NoFinalizer: true})
+	if finalized() {
+		t.Error("finalizer warning logged with NoFinalizer")
+	}
+	if fs, err := OpenFile(temp, false); err == nil {
+		fs.Close()
+		t.Error("OpenFile leaked storage: expecting lock error")
+	}
+}
+
+func TestFileStorage_LogFormat(t *testing.T) {
+	temp := tempDir(t)
+	defer os.RemoveAll(temp)
+
+	for _, format := range []LogFormat{LogText, LogJSON} {
+		os.Remove(filepath.Join(temp, "LOG"))
+		fs, err := OpenFileWithOptions(temp, false, &FileOptions{LogFormat: format})
+		if err != nil {
+			t.Fatal("OpenFile: got error: ", err)
+		}
+		fs.Log("plain event")
+		fs.(FieldLogger).Logf(map[string]interface{}{"N": 3, "F": "x"}, "structured event")
+		fs.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(temp, "LOG"))
+		if err != nil {
+			t.Fatal("ReadFile: got error: ", err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		switch format {
+		case LogText:
+			if len(lines) != 3 || !strings.HasSuffix(lines[2], " structured event F·x N·3") {
+				t.Errorf("text LOG: got %q", lines)
+			}
+		case LogJSON:
+			if len(lines) != 2 {
+				t.Fatalf("JSON LOG: got %q", lines)
+			}
+			for i, msg := range []string{"plain event", "structured event"} {
+				var e map[string]interface{}
+				if err := json.Unmarshal([]byte(lines[i]), &e); err != nil {
+					t.Fatalf("JSON LOG: invalid line %q: %v", lines[i], err)
+				}
+				if e["msg"] != msg || e["ts"] == nil || e["fields"] == nil {
+					t.Errorf("JSON LOG: got %q", lines[i])
+				}
+			}
+			if !strings.HasSuffix(lines[1], `"fields":{"F":"x","N":3}}`) {
+				t.Errorf("JSON LOG: got fields %q", lines[1])
+			}
+		}
+	}
+}
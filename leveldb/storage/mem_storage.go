@@ -12,7 +12,7 @@ import (
 	"sync"
 )
 
-const typeShift = 4
+const typeShift = 5
 
 // Verify at compile-time that typeShift is large enough to cover all FileType
 // values by confirming that 0 == 0.
@@ -92,6 +92,30 @@ func (ms *memStorage) List(ft FileType) ([]FileDesc, error) {
 	return fds, nil
 }
 
+// ListFunc implements FileLister. The file descriptors are collected
+// before fn is called, so fn may call other storage methods.
+func (ms *memStorage) ListFunc(ft FileType, fn func(fd FileDesc) error) error {
+	fds, _ := ms.List(ft)
+	for _, fd := range fds {
+		if err := fn(fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiskUsage implements DiskUsager, summing the sizes of the files held in
+// memory.
+func (ms *memStorage) DiskUsage() (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var size int64
+	for _, m := range ms.files {
+		size += int64(m.Len())
+	}
+	return size, nil
+}
+
 func (ms *memStorage) Open(fd FileDesc) (Reader, error) {
 	if !FileDescOk(fd) {
 		return nil, ErrInvalidFile
@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 )
 
 // FileType represent a file type.
@@ -22,8 +23,9 @@ const (
 	TypeJournal
 	TypeTable
 	TypeTemp
+	TypeBlob
 
-	TypeAll = TypeManifest | TypeJournal | TypeTable | TypeTemp
+	TypeAll = TypeManifest | TypeJournal | TypeTable | TypeTemp | TypeBlob
 )
 
 func (t FileType) String() string {
@@ -36,6 +38,8 @@ func (t FileType) String() string {
 		return "table"
 	case TypeTemp:
 		return "temp"
+	case TypeBlob:
+		return "blob"
 	}
 	return fmt.Sprintf("<unknown:%d>", t)
 }
@@ -70,6 +74,25 @@ func (e *ErrCorrupted) Error() string {
 	return e.Err.Error()
 }
 
+// RetryableError is the interface that may be implemented by the errors of
+// a storage, to flag the ones which are transient, e.g. timeouts or
+// throttling of a network-backed storage. The DB retries the operations
+// failing with such errors, see opt.Options.StorageRetry.
+type RetryableError interface {
+	error
+
+	// Retryable returns true if the failed operation may succeed if
+	// retried.
+	Retryable() bool
+}
+
+// IsRetryable returns true if the given error, or an error it wraps, is a
+// RetryableError flagged as retryable.
+func IsRetryable(err error) bool {
+	var re RetryableError
+	return errors.As(err, &re) && re.Retryable()
+}
+
 // Syncer is the interface that wraps basic Sync method.
 type Syncer interface {
 	// Sync commits the current contents of the file to stable storage.
@@ -112,6 +135,8 @@ func (fd FileDesc) String() string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case TypeTemp:
 		return fmt.Sprintf("%06d.tmp", fd.Num)
+	case TypeBlob:
+		return fmt.Sprintf("%06d.blob", fd.Num)
 	default:
 		return fmt.Sprintf("%#x-%d", fd.Type, fd.Num)
 	}
@@ -129,12 +154,118 @@ func FileDescOk(fd FileDesc) bool {
 	case TypeJournal:
 	case TypeTable:
 	case TypeTemp:
+	case TypeBlob:
 	default:
 		return false
 	}
 	return fd.Num >= 0
 }
 
+// Namer is the interface that maps file descriptors to file names and
+// back. It allows a storage to use another file name scheme than the
+// LevelDB one, e.g. to share a directory with other files.
+type Namer interface {
+	// Name returns the file name of the given file descriptor.
+	Name(fd FileDesc) string
+
+	// Parse returns the file descriptor the given file name refers to, and
+	// whether the name belongs to the scheme at all. Parse must accept
+	// every name returned by Name.
+	Parse(name string) (fd FileDesc, ok bool)
+}
+
+// FileLister is the interface that wraps the ListFunc method. A storage
+// may implement it to enumerate files without building the whole list.
+type FileLister interface {
+	// ListFunc calls fn for each file descriptor that match the given file
+	// types, as the files are enumerated. The file types may be OR'ed
+	// together. Enumeration stops at the first error returned by fn, and
+	// that error is returned.
+	ListFunc(ft FileType, fn func(fd FileDesc) error) error
+}
+
+// UnrecognizedFileLister is the interface that wraps the
+// GetUnrecognizedFiles method. A storage backed by a file-system directory
+// may implement it to report the stray files sharing its directory.
+type UnrecognizedFileLister interface {
+	// GetUnrecognizedFiles returns the sorted names of the directory
+	// entries that are neither files of the DB nor files of the storage
+	// itself, e.g. a half-copied backup or a misplaced file.
+	GetUnrecognizedFiles() ([]string, error)
+}
+
+// DiskUsager is the interface that wraps the DiskUsage method. A storage
+// may implement it to report the space its files use.
+type DiskUsager interface {
+	// DiskUsage returns the total size (in bytes) of the files of the
+	// storage, i.e. the files of the DB and the files the storage keeps
+	// beside them, such as the log.
+	DiskUsage() (int64, error)
+}
+
+// FieldLogger is the interface that wraps the Logf method. A storage may
+// implement it to record log events along with structured fields; see
+// FormatLogFields for storages that don't.
+type FieldLogger interface {
+	// Logf logs the given message along with the given fields.
+	Logf(fields map[string]interface{}, msg string)
+}
+
+// FormatLogFields formats the given message and fields as a text log
+// line; the fields follow the message as 'key·value' pairs, sorted by key.
+func FormatLogFields(fields map[string]interface{}, msg string) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := []byte(msg)
+	for _, k := range keys {
+		buf = append(buf, ' ')
+		buf = append(buf, k...)
+		buf = append(buf, "·"...)
+		buf = append(buf, fmt.Sprint(fields[k])...)
+	}
+	return string(buf)
+}
+
+// Pather is the interface that wraps the Path method. A storage backed by
+// a file-system directory may implement it.
+type Pather interface {
+	// Path returns the path of the storage directory.
+	Path() string
+}
+
+// Preallocator is the interface that wraps the Preallocate method. A
+// Writer may implement it to reserve disk space for a file up front.
+type Preallocator interface {
+	// Preallocate reserves size bytes of disk space for the file, without
+	// changing its size. Any space still unused is released on Close. It
+	// returns nil if preallocation isn't supported.
+	Preallocate(size int64) error
+}
+
+// ListFunc calls fn for each file descriptor of the given storage that
+// match the given file types. It uses the storage ListFunc method if the
+// storage implements FileLister, otherwise it iterates over the result of
+// List. Enumeration stops at the first error returned by fn, and that
+// error is returned.
+func ListFunc(s Storage, ft FileType, fn func(fd FileDesc) error) error {
+	if l, ok := s.(FileLister); ok {
+		return l.ListFunc(ft, fn)
+	}
+	fds, err := s.List(ft)
+	if err != nil {
+		return err
+	}
+	for _, fd := range fds {
+		if err := fn(fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Storage is the storage. A storage instance must be safe for concurrent use.
 type Storage interface {
 	// Lock locks the storage. Any subsequent attempt to call Lock will fail
@@ -9,9 +9,11 @@ package leveldb
 import (
 	"fmt"
 	"sort"
+	"sync"
 	"sync/atomic"
 
 	"github.com/btcsuite/goleveldb/leveldb/cache"
+	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/iterator"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/storage"
@@ -288,33 +290,222 @@ func (x *tFilesSortByNum) Less(i, j int) bool {
 	return x.lessByNum(i, j)
 }
 
+// tCache is the open files cache. It is sharded by file number, each shard
+// has its own cacher and thus its own lock, see opt.Options.TableCacheShards.
+//
+// A shared cache, see opt.Options.OpenFilesCache, has a single shard and
+// the namespaces of the DB are offset by ns. It is left open by Close, so
+// it tracks the closed state itself: tables released once closed must be
+// left alone, as for a closed cache.Cache.
+type tCache struct {
+	shards []*cache.Cache
+	shared bool
+	ns     uint64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newTCache(capacity, n int) *tCache {
+	if capacity > 0 && n > capacity {
+		n = capacity
+	}
+	c := &tCache{shards: make([]*cache.Cache, n)}
+	for i := range c.shards {
+		var cacher cache.Cacher
+		if capacity > 0 {
+			cacher = cache.NewLRU(c.shardCapacity(capacity, i))
+		}
+		c.shards[i] = cache.NewCache(cacher)
+	}
+	return c
+}
+
+// Creates a tCache over the given shared cache, the id must be unique
+// among the DBs sharing the cache.
+func newSharedTCache(c *cache.Cache, id uint64) *tCache {
+	return &tCache{shards: []*cache.Cache{c}, shared: true, ns: id << 1}
+}
+
+// Returns the share of the given capacity of the i-th shard.
+func (c *tCache) shardCapacity(capacity, i int) int {
+	n := len(c.shards)
+	if i < capacity%n {
+		return capacity/n + 1
+	}
+	return capacity / n
+}
+
+func (c *tCache) shard(key uint64) *cache.Cache {
+	return c.shards[key%uint64(len(c.shards))]
+}
+
+// Read locks a shared cache, it returns false if the cache is closed.
+func (c *tCache) rlock() bool {
+	if !c.shared {
+		return true
+	}
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (c *tCache) runlock() {
+	if c.shared {
+		c.mu.RUnlock()
+	}
+}
+
+func (c *tCache) Get(ns, key uint64, setFunc func() (size int, value cache.Value)) *cache.Handle {
+	if !c.rlock() {
+		return nil
+	}
+	defer c.runlock()
+	return c.shard(key).Get(c.ns|ns, key, setFunc)
+}
+
+func (c *tCache) Delete(ns, key uint64, onDel func()) bool {
+	if !c.rlock() {
+		return false
+	}
+	defer c.runlock()
+	return c.shard(key).Delete(c.ns|ns, key, onDel)
+}
+
+func (c *tCache) Evict(ns, key uint64) bool {
+	if !c.rlock() {
+		return false
+	}
+	defer c.runlock()
+	return c.shard(key).Evict(c.ns|ns, key)
+}
+
+// Size returns the number of open files.
+func (c *tCache) Size() (size int) {
+	for _, s := range c.shards {
+		size += s.Size()
+	}
+	return
+}
+
+// SetCapacity spreads the given capacity over the shards.
+func (c *tCache) SetCapacity(capacity int) {
+	for i, s := range c.shards {
+		s.SetCapacity(c.shardCapacity(capacity, i))
+	}
+}
+
+// Close closes the open files, a shared cache is left open.
+func (c *tCache) Close() {
+	if c.shared {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		c.shards[0].EvictNS(c.ns)
+		c.shards[0].EvictNS(c.ns | blobCacheNS)
+		return
+	}
+	for _, s := range c.shards {
+		s.Close()
+	}
+}
+
 // Table operations.
 type tOps struct {
 	s      *session
 	noSync bool
-	cache  *cache.Cache
+	cache  *tCache
 	bcache *cache.Cache
 	bpool  *util.BufferPool
+
+	// Whether the block cache is shared, see opt.Options.BlockCache; the
+	// block cache namespaces of the DB are then offset by bcacheNS.
+	bcacheShared bool
+	bcacheNS     uint64
+
+	blobMu      sync.Mutex
+	blobPending map[int64]struct{}
+	blobSizes   map[int64]int64
+	blobSize    int64
+
+	// Sum of the index and filter blocks held by the open tables.
+	pinnedIndexSize  int64
+	pinnedFilterSize int64
+
+	// Filter checks of table lookups, see DB.GetProperty.
+	filterChecked        uint64
+	filterNegative       uint64
+	filterFalsePositives uint64
+
+	wopt atomic.Value // *opt.Options, see DB.RewriteAll
+}
+
+// tReader is a cached open table.
+type tReader struct {
+	*table.Reader
+	r          storage.Reader // The table file, see DB.ExportSSTables.
+	t          *tOps
+	num        int64
+	indexSize  int64
+	filterSize int64
 }
 
-// Creates an empty table and returns table writer.
-func (t *tOps) create() (*tWriter, error) {
+func (r *tReader) Release() {
+	atomic.AddInt64(&r.t.pinnedIndexSize, -r.indexSize)
+	atomic.AddInt64(&r.t.pinnedFilterSize, -r.filterSize)
+	r.Reader.Release()
+	if f := r.t.s.o.GetOnTableCacheEvict(); f != nil {
+		f(uint64(r.num))
+	}
+}
+
+// Creates an empty table for the given level and returns table writer. The
+// expected size of the table is preallocated if enabled, zero means unknown.
+func (t *tOps) create(level int, size int64) (*tWriter, error) {
 	fd := storage.FileDesc{storage.TypeTable, t.s.allocFileNum()}
 	fw, err := t.s.stor.Create(fd)
 	if err != nil {
 		return nil, err
 	}
+	if size > 0 && t.s.o.GetPreallocateTableFiles() {
+		if p, ok := fw.(storage.Preallocator); ok {
+			if err := p.Preallocate(size); err != nil {
+				fw.Close()
+				t.s.stor.Remove(fd)
+				t.s.reuseFileNum(fd.Num)
+				return nil, err
+			}
+		}
+	}
+	o := t.s.o.Options
+	if wo, ok := t.wopt.Load().(*opt.Options); ok {
+		o = wo
+	}
+	noTwoLevelIndex := o.GetTwoLevelIndex() && t.s.formatVersion() < opt.FormatV3
+	if c := o.GetCompressionPerLevel(level); noTwoLevelIndex || c != o.GetCompression() || o.GetMaxBlockSize() > 0 {
+		o = o.Clone()
+		o.Compression = c
+		if noTwoLevelIndex {
+			o.TwoLevelIndex = false
+		}
+		// The block size ceiling is enforced on writes, the entries already
+		// written, e.g. before the ceiling was lowered, are kept as is.
+		o.MaxBlockSize = 0
+	}
 	return &tWriter{
 		t:  t,
 		fd: fd,
 		w:  fw,
-		tw: table.NewWriter(fw, t.s.o.Options),
+		tw: table.NewWriter(fw, o),
 	}, nil
 }
 
-// Builds table from src iterator.
-func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
-	w, err := t.create()
+// Builds a level-0 table from src iterator, see create for size.
+func (t *tOps) createFrom(src iterator.Iterator, size int64) (f *tFile, n int, err error) {
+	w, err := t.create(0, size)
 	if err != nil {
 		return
 	}
@@ -325,8 +516,39 @@ func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
 		}
 	}()
 
+	var (
+		bw        *bWriter
+		blobMin   int
+		ikScratch []byte
+	)
+	if t.s.o.GetEnableBlobFiles() && t.s.formatVersion() >= opt.FormatV2 {
+		blobMin = t.s.o.GetBlobFileThreshold()
+	}
+	defer func() {
+		if err != nil && bw != nil {
+			bw.drop()
+		}
+	}()
+
 	for src.Next() {
-		err = w.append(src.Key(), src.Value())
+		key, value := src.Key(), src.Value()
+		if blobMin > 0 && len(value) >= blobMin {
+			if ukey, seq, kt, kerr := parseInternalKey(key); kerr == nil && kt == keyTypeVal {
+				if bw == nil {
+					bw, err = t.createBlob()
+					if err != nil {
+						return
+					}
+				}
+				value, err = bw.append(value)
+				if err != nil {
+					return
+				}
+				ikScratch = makeInternalKey(ikScratch, ukey, seq, keyTypeBlob)
+				key = ikScratch
+			}
+		}
+		err = w.append(key, value)
 		if err != nil {
 			return
 		}
@@ -336,6 +558,14 @@ func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
 		return
 	}
 
+	// The blob file must be durable before the table referring it.
+	if bw != nil {
+		err = bw.finish()
+		if err != nil {
+			return
+		}
+	}
+
 	n = w.tw.EntriesLen()
 	f, err = w.finish()
 	return
@@ -344,52 +574,101 @@ func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
 // Opens table. It returns a cache handle, which should
 // be released after use.
 func (t *tOps) open(f *tFile) (ch *cache.Handle, err error) {
+	var opened bool
 	ch = t.cache.Get(0, uint64(f.fd.Num), func() (size int, value cache.Value) {
+		var bcache *cache.NamespaceGetter
+		if t.bcache != nil {
+			ns, ok := t.blockNS(f.fd.Num)
+			if !ok {
+				err = errTableNumOverflow
+				return 0, nil
+			}
+			bcache = &cache.NamespaceGetter{Cache: t.bcache, NS: ns}
+		}
+
 		var r storage.Reader
 		r, err = t.s.stor.Open(f.fd)
 		if err != nil {
 			return 0, nil
 		}
 
-		var bcache *cache.NamespaceGetter
-		if t.bcache != nil {
-			bcache = &cache.NamespaceGetter{Cache: t.bcache, NS: uint64(f.fd.Num)}
-		}
-
 		var tr *table.Reader
 		tr, err = table.NewReader(r, f.size, f.fd, bcache, t.bpool, t.s.o.Options)
 		if err != nil {
 			r.Close()
 			return 0, nil
 		}
-		return 1, tr
+		indexSize, filterSize := int64(tr.IndexBlockSize()), int64(tr.FilterBlockSize())
+		atomic.AddInt64(&t.pinnedIndexSize, indexSize)
+		atomic.AddInt64(&t.pinnedFilterSize, filterSize)
+		opened = true
+		return 1, &tReader{tr, r, t, f.fd.Num, indexSize, filterSize}
 
 	})
 	if ch == nil && err == nil {
 		err = ErrClosed
 	}
+	// Called out of the cache lock.
+	if opened {
+		if fn := t.s.o.GetOnTableCacheOpen(); fn != nil {
+			fn(uint64(f.fd.Num))
+		}
+	}
 	return
 }
 
 // Finds key/value pair whose key is greater than or equal to the
-// given key.
-func (t *tOps) find(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, rvalue []byte, err error) {
+// given key. The filter check is accounted and its result returned, see
+// tOps.filterFalsePositive.
+func (t *tOps) find(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, rvalue []byte, fres table.FilterResult, err error) {
 	ch, err := t.open(f)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, table.FilterNotChecked, err
 	}
 	defer ch.Release()
-	return ch.Value().(*table.Reader).Find(key, true, ro)
+	rkey, rvalue, fres, err = ch.Value().(*tReader).FindFiltered(key, ro, false)
+	t.countFilter(fres)
+	return
 }
 
-// Finds key that is greater than or equal to the given key.
-func (t *tOps) findKey(f *tFile, key []byte, ro *opt.ReadOptions) (rkey []byte, err error) {
+// Finds key that is greater than or equal to the given key. The filter
+// check is accounted as by find.
+func (t *tOps) findKey(f *tFile, key []byte, ro *opt.ReadOptions) (rkey []byte, fres table.FilterResult, err error) {
 	ch, err := t.open(f)
 	if err != nil {
-		return nil, err
+		return nil, table.FilterNotChecked, err
+	}
+	defer ch.Release()
+	rkey, _, fres, err = ch.Value().(*tReader).FindFiltered(key, ro, true)
+	t.countFilter(fres)
+	return
+}
+
+// Accounts a filter check.
+func (t *tOps) countFilter(fres table.FilterResult) {
+	switch fres {
+	case table.FilterExcluded:
+		atomic.AddUint64(&t.filterChecked, 1)
+		atomic.AddUint64(&t.filterNegative, 1)
+	case table.FilterPassed:
+		atomic.AddUint64(&t.filterChecked, 1)
+	}
+}
+
+// Accounts a lookup whose filter check passed but whose key isn't in the
+// table.
+func (t *tOps) filterFalsePositive() {
+	atomic.AddUint64(&t.filterFalsePositives, 1)
+}
+
+// Returns false if the table definitely doesn't contain the given key.
+func (t *tOps) mayContain(f *tFile, key []byte) (bool, error) {
+	ch, err := t.open(f)
+	if err != nil {
+		return false, err
 	}
 	defer ch.Release()
-	return ch.Value().(*table.Reader).FindKey(key, true, ro)
+	return ch.Value().(*tReader).MayContain(key)
 }
 
 // Returns approximate offset of the given key.
@@ -399,7 +678,17 @@ func (t *tOps) offsetOf(f *tFile, key []byte) (offset int64, err error) {
 		return
 	}
 	defer ch.Release()
-	return ch.Value().(*table.Reader).OffsetOf(key)
+	return ch.Value().(*tReader).OffsetOf(key)
+}
+
+// Returns the index entries of the data blocks within the given slice.
+func (t *tOps) indexEntries(f *tFile, slice *util.Range) ([]table.IndexEntry, error) {
+	ch, err := t.open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Release()
+	return ch.Value().(*tReader).IndexEntries(slice)
 }
 
 // Creates an iterator from the given table.
@@ -408,7 +697,7 @@ func (t *tOps) newIterator(f *tFile, slice *util.Range, ro *opt.ReadOptions) ite
 	if err != nil {
 		return iterator.NewEmptyIterator(err)
 	}
-	iter := ch.Value().(*table.Reader).NewIterator(slice, ro)
+	iter := ch.Value().(*tReader).NewIterator(slice, ro)
 	iter.SetReleaser(ch)
 	return iter
 }
@@ -416,55 +705,164 @@ func (t *tOps) newIterator(f *tFile, slice *util.Range, ro *opt.ReadOptions) ite
 // Removes table from persistent storage. It waits until
 // no one use the the table.
 func (t *tOps) remove(f *tFile) {
+	if t.s.secondary {
+		// The table is owned by the primary DB, just close it.
+		t.cache.Evict(0, uint64(f.fd.Num))
+		t.evictBlocks(f.fd.Num)
+		return
+	}
 	t.cache.Delete(0, uint64(f.fd.Num), func() {
-		if err := t.s.stor.Remove(f.fd); err != nil {
-			t.s.logf("table@remove removing @%d %q", f.fd.Num, err)
-		} else {
-			t.s.logf("table@remove removed @%d", f.fd.Num)
-		}
-		if t.bcache != nil {
-			t.bcache.EvictNS(uint64(f.fd.Num))
-		}
+		t.s.afterManifestSync(func() {
+			if err := t.s.stor.Remove(f.fd); err != nil {
+				t.s.logf("table@remove removing @%d %q", f.fd.Num, err)
+			} else {
+				t.s.logf("table@remove removed @%d", f.fd.Num)
+			}
+		})
+		t.evictBlocks(f.fd.Num)
 	})
 }
 
+// Returns the block cache namespace of the given table. It returns false
+// if the table number doesn't fit below the namespace offset of a shared
+// block cache.
+func (t *tOps) blockNS(num int64) (uint64, bool) {
+	if t.bcacheShared && uint64(num) > bcacheMaxNum {
+		return 0, false
+	}
+	return t.bcacheNS | uint64(num), true
+}
+
+// Evicts the cached blocks of the given table.
+func (t *tOps) evictBlocks(num int64) {
+	if t.bcache == nil {
+		return
+	}
+	if ns, ok := t.blockNS(num); ok {
+		t.bcache.EvictNS(ns)
+	}
+}
+
 // Closes the table ops instance. It will close all tables,
 // regadless still used or not.
 func (t *tOps) close() {
 	t.bpool.Close()
 	t.cache.Close()
 	if t.bcache != nil {
-		t.bcache.CloseWeak()
+		if !t.bcacheShared {
+			t.bcache.CloseWeak()
+			return
+		}
+		// Shared block cache, evicts the blocks of the live tables; blocks
+		// of the removed ones are already evicted.
+		t.s.vmu.Lock()
+		for num := range t.s.fileTab {
+			t.evictBlocks(num)
+		}
+		t.s.vmu.Unlock()
+		freeBlockCacheID(t.bcache, t.bcacheNS>>bcacheIDShift)
+	}
+}
+
+// Source of the ids telling apart the DBs sharing an open files cache.
+var sharedCacheID uint64
+
+// The block cache namespace of a table of a DB sharing the block cache is
+// the id of the DB in the high bits and the table number in the low bits.
+const (
+	bcacheIDShift = 48
+	bcacheMaxID   = 1<<(64-bcacheIDShift) - 1
+	bcacheMaxNum  = 1<<bcacheIDShift - 1
+)
+
+var errTableNumOverflow = errors.New("leveldb: table number too large for a shared block cache")
+
+// Ids in use of the DBs sharing a block cache, next is where the search
+// for a free id starts.
+type bcacheIDSet struct {
+	used map[uint64]struct{}
+	next uint64
+}
+
+var bcacheIDs = struct {
+	sync.Mutex
+	m map[*cache.Cache]*bcacheIDSet
+}{m: make(map[*cache.Cache]*bcacheIDSet)}
+
+// Allocates an id unique among the DBs sharing the given block cache, the
+// id must be freed by freeBlockCacheID once the DB is closed.
+func allocBlockCacheID(c *cache.Cache) (uint64, error) {
+	bcacheIDs.Lock()
+	defer bcacheIDs.Unlock()
+	ids := bcacheIDs.m[c]
+	if ids == nil {
+		ids = &bcacheIDSet{used: make(map[uint64]struct{})}
+		bcacheIDs.m[c] = ids
+	}
+	if len(ids.used) > bcacheMaxID {
+		return 0, ErrBlockCacheFull
+	}
+	for {
+		id := ids.next
+		ids.next = (id + 1) & bcacheMaxID
+		if _, ok := ids.used[id]; !ok {
+			ids.used[id] = struct{}{}
+			return id, nil
+		}
+	}
+}
+
+func freeBlockCacheID(c *cache.Cache, id uint64) {
+	bcacheIDs.Lock()
+	defer bcacheIDs.Unlock()
+	ids := bcacheIDs.m[c]
+	delete(ids.used, id)
+	if len(ids.used) == 0 {
+		delete(bcacheIDs.m, c)
 	}
 }
 
 // Creates new initialized table ops instance.
-func newTableOps(s *session) *tOps {
+func newTableOps(s *session) (*tOps, error) {
 	var (
-		cacher cache.Cacher
+		tcache *tCache
 		bcache *cache.Cache
 		bpool  *util.BufferPool
 	)
-	if s.o.GetOpenFilesCacheCapacity() > 0 {
-		cacher = cache.NewLRU(s.o.GetOpenFilesCacheCapacity())
-	}
+	var (
+		bcacheShared bool
+		bcacheNS     uint64
+	)
 	if !s.o.GetDisableBlockCache() {
-		var bcacher cache.Cacher
-		if s.o.GetBlockCacheCapacity() > 0 {
-			bcacher = cache.NewLRU(s.o.GetBlockCacheCapacity())
+		if c := s.o.GetBlockCache(); c != nil {
+			id, err := allocBlockCacheID(c)
+			if err != nil {
+				return nil, err
+			}
+			bcache, bcacheShared, bcacheNS = c, true, id<<bcacheIDShift
+		} else if cacher := s.o.GetBlockCacher(); cacher != nil && s.o.GetBlockCacheCapacity() > 0 {
+			bcache = cache.NewCache(cacher.New(s.o.GetBlockCacheCapacity()))
 		}
-		bcache = cache.NewCache(bcacher)
+	}
+	if c := s.o.GetOpenFilesCache(); c != nil {
+		tcache = newSharedTCache(c, atomic.AddUint64(&sharedCacheID, 1))
+	} else {
+		tcache = newTCache(s.o.GetOpenFilesCacheCapacity(), s.o.GetTableCacheShards())
 	}
 	if !s.o.GetDisableBufferPool() {
 		bpool = util.NewBufferPool(s.o.GetBlockSize() + 5)
 	}
 	return &tOps{
-		s:      s,
-		noSync: s.o.GetNoSync(),
-		cache:  cache.NewCache(cacher),
-		bcache: bcache,
-		bpool:  bpool,
-	}
+		s:            s,
+		noSync:       s.o.GetNoSync(),
+		cache:        tcache,
+		bcache:       bcache,
+		bpool:        bpool,
+		bcacheShared: bcacheShared,
+		bcacheNS:     bcacheNS,
+		blobPending:  make(map[int64]struct{}),
+		blobSizes:    make(map[int64]int64),
+	}, nil
 }
 
 // tWriter wraps the table writer. It keep track of file descriptor
@@ -514,7 +912,7 @@ func (w *tWriter) finish() (f *tFile, err error) {
 			return
 		}
 	}
-	f = newTableFile(w.fd, int64(w.tw.BytesLen()), internalKey(w.first), internalKey(w.last))
+	f = newTableFile(w.fd, w.tw.BytesLen(), internalKey(w.first), internalKey(w.last))
 	return
 }
 
@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/btcsuite/goleveldb/leveldb/cache"
 	"github.com/btcsuite/goleveldb/leveldb/comparer"
@@ -148,6 +149,8 @@ type blockIter struct {
 	offsetLimit     int
 	// Error.
 	err error
+	// Set once released.
+	released int32
 }
 
 func (i *blockIter) sErr(err error) {
@@ -415,7 +418,7 @@ func (i *blockIter) Value() []byte {
 }
 
 func (i *blockIter) Release() {
-	if i.dir != dirReleased {
+	if atomic.CompareAndSwapInt32(&i.released, 0, 1) {
 		i.tr = nil
 		i.block = nil
 		i.prevNode = nil
@@ -506,6 +509,45 @@ func (i *indexIter) Get() iterator.Iterator {
 	return i.tr.getDataIterErr(dataBH, slice, i.tr.verifyChecksum, i.fillCache)
 }
 
+// partitionIter iterates the top-level index of a two-level index. Its Get
+// yields the entries of each index partition, or the data blocks they point
+// to if data is set.
+type partitionIter struct {
+	*blockIter
+	tr    *Reader
+	slice *util.Range
+	// Options
+	data      bool
+	strict    bool
+	fillCache bool
+}
+
+func (i *partitionIter) Get() iterator.Iterator {
+	value := i.Value()
+	if value == nil {
+		return nil
+	}
+	partitionBH, n := decodeBlockHandle(value)
+	if n == 0 {
+		return iterator.NewEmptyIterator(i.tr.newErrCorruptedBH(i.tr.indexBH, "bad index partition handle"))
+	}
+
+	if !i.data {
+		// Used by lookups, which already hold the reader lock.
+		b, rel, err := i.tr.readBlockCached(partitionBH, true, i.fillCache)
+		if err != nil {
+			return iterator.NewEmptyIterator(err)
+		}
+		return i.tr.newBlockIter(b, rel, nil, true)
+	}
+
+	var slice *util.Range
+	if i.slice != nil && (i.blockIter.isFirst() || i.blockIter.isLast()) {
+		slice = i.slice
+	}
+	return i.tr.getPartitionDataIterErr(partitionBH, slice, i.strict, i.fillCache)
+}
+
 // Reader is a table reader.
 type Reader struct {
 	mu     sync.RWMutex
@@ -519,6 +561,8 @@ type Reader struct {
 	cmp            comparer.Comparer
 	filter         filter.Filter
 	verifyChecksum bool
+	twoLevelIndex  bool
+	transform      opt.BlockTransform
 
 	dataEnd                   int64
 	metaBH, indexBH, filterBH blockHandle
@@ -574,17 +618,27 @@ func (r *Reader) readRawBlock(bh blockHandle, verifyChecksum bool) ([]byte, erro
 		}
 	}
 
-	switch data[bh.length] {
+	payload, blockType := data[:bh.length], data[bh.length]
+	if r.transform != nil {
+		decoded, err := r.transform.Decode(nil, payload)
+		r.bpool.Put(data)
+		if err != nil {
+			return nil, r.newErrCorruptedBH(bh, "block transform: "+err.Error())
+		}
+		data, payload = decoded, decoded
+	}
+
+	switch blockType {
 	case blockTypeNoCompression:
-		data = data[:bh.length]
+		data = payload
 	case blockTypeSnappyCompression:
-		decLen, err := snappy.DecodedLen(data[:bh.length])
+		decLen, err := snappy.DecodedLen(payload)
 		if err != nil {
 			r.bpool.Put(data)
 			return nil, r.newErrCorruptedBH(bh, err.Error())
 		}
 		decData := r.bpool.Get(decLen)
-		decData, err = snappy.Decode(decData, data[:bh.length])
+		decData, err = snappy.Decode(decData, payload)
 		r.bpool.Put(data)
 		if err != nil {
 			r.bpool.Put(decData)
@@ -593,11 +647,33 @@ func (r *Reader) readRawBlock(bh blockHandle, verifyChecksum bool) ([]byte, erro
 		data = decData
 	default:
 		r.bpool.Put(data)
-		return nil, r.newErrCorruptedBH(bh, fmt.Sprintf("unknown compression type %#x", data[bh.length]))
+		return nil, r.newErrCorruptedBH(bh, fmt.Sprintf("unknown compression type %#x", blockType))
 	}
 	return data, nil
 }
 
+// Checks that the configured block transform is the one the table was
+// written with, by decoding the check block, and sets it.
+func (r *Reader) checkTransform(name string, checkBH blockHandle) error {
+	t := r.o.GetBlockTransform()
+	if t == nil || t.Name() != name {
+		return errors.ErrBlockTransform
+	}
+	if checkBH.length == 0 {
+		return r.newErrCorrupted(int64(r.metaBH.offset), int64(r.metaBH.length), "meta-block", "bad block transform check block handle")
+	}
+	encoded, err := r.readRawBlock(checkBH, true)
+	if err != nil {
+		return err
+	}
+	defer r.bpool.Put(encoded)
+	if check, err := t.Decode(nil, encoded); err != nil || string(check) != transformCheck {
+		return errors.ErrBlockTransform
+	}
+	r.transform = t
+	return nil
+}
+
 func (r *Reader) readBlock(bh blockHandle, verifyChecksum bool) (*block, error) {
 	data, err := r.readRawBlock(bh, verifyChecksum)
 	if err != nil {
@@ -713,6 +789,21 @@ func (r *Reader) getIndexBlock(fillCache bool) (b *block, rel util.Releaser, err
 	return r.indexBlock, util.NoopReleaser{}, nil
 }
 
+// Returns an iterator over the index entries, which map the last key of each
+// data block to its block handle, going through the index partitions if the
+// table has a two-level index. Need r.mu to be held.
+func (r *Reader) newIndexIter(fillCache bool) (iterator.Iterator, error) {
+	indexBlock, rel, err := r.getIndexBlock(fillCache)
+	if err != nil {
+		return nil, err
+	}
+	index := r.newBlockIter(indexBlock, rel, nil, true)
+	if !r.twoLevelIndex {
+		return index, nil
+	}
+	return iterator.NewIndexedIterator(&partitionIter{blockIter: index, tr: r, fillCache: fillCache}, true), nil
+}
+
 func (r *Reader) getFilterBlock(fillCache bool) (*filterBlock, util.Releaser, error) {
 	if r.filterBlock == nil {
 		return r.readFilterBlockCached(r.filterBH, fillCache)
@@ -779,6 +870,27 @@ func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChe
 	return r.getDataIter(dataBH, slice, verifyChecksum, fillCache)
 }
 
+func (r *Reader) getPartitionDataIterErr(partitionBH blockHandle, slice *util.Range, strict, fillCache bool) iterator.Iterator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return iterator.NewEmptyIterator(r.err)
+	}
+
+	b, rel, err := r.readBlockCached(partitionBH, true, fillCache)
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	index := &indexIter{
+		blockIter: r.newBlockIter(b, rel, slice, true),
+		tr:        r,
+		slice:     slice,
+		fillCache: fillCache,
+	}
+	return iterator.NewIndexedIterator(index, strict)
+}
+
 // NewIterator creates an iterator from the table.
 //
 // Slice allows slicing the iterator to only contains keys in the given
@@ -803,16 +915,45 @@ func (r *Reader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.It
 	if err != nil {
 		return iterator.NewEmptyIterator(err)
 	}
+	strict := opt.GetStrict(r.o, ro, opt.StrictReader)
+	if r.twoLevelIndex {
+		index := &partitionIter{
+			blockIter: r.newBlockIter(indexBlock, rel, slice, true),
+			tr:        r,
+			slice:     slice,
+			data:      true,
+			strict:    strict,
+			fillCache: fillCache,
+		}
+		return iterator.NewIndexedIterator(index, strict)
+	}
 	index := &indexIter{
 		blockIter: r.newBlockIter(indexBlock, rel, slice, true),
 		tr:        r,
 		slice:     slice,
-		fillCache: !ro.GetDontFillCache(),
+		fillCache: fillCache,
 	}
-	return iterator.NewIndexedIterator(index, opt.GetStrict(r.o, ro, opt.StrictReader))
+	return iterator.NewIndexedIterator(index, strict)
 }
 
-func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bool) (rkey, value []byte, err error) {
+// FilterResult is the outcome of the filter check of a lookup, see
+// FindFiltered.
+type FilterResult int
+
+// Filter check outcomes.
+const (
+	// FilterNotChecked means the filter wasn't consulted, e.g. the table
+	// has no filter, the filters are ignored by the ReadOptions or the key
+	// is past the last key of the table.
+	FilterNotChecked FilterResult = iota
+	// FilterExcluded means the filter excluded the key.
+	FilterExcluded
+	// FilterPassed means the filter didn't exclude the key, which may be a
+	// false positive.
+	FilterPassed
+)
+
+func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bool) (rkey, value []byte, fres FilterResult, err error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -821,13 +962,11 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 		return
 	}
 
-	indexBlock, rel, err := r.getIndexBlock(true)
+	fillCache := !ro.GetDontFillCache()
+	index, err := r.newIndexIter(fillCache)
 	if err != nil {
 		return
 	}
-	defer rel.Release()
-
-	index := r.newBlockIter(indexBlock, nil, nil, true)
 	defer index.Release()
 
 	if !index.Seek(key) {
@@ -840,24 +979,25 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 	dataBH, n := decodeBlockHandle(index.Value())
 	if n == 0 {
 		r.err = r.newErrCorruptedBH(r.indexBH, "bad data block handle")
-		return nil, nil, r.err
+		return nil, nil, fres, r.err
 	}
 
 	// The filter should only used for exact match.
-	if filtered && r.filter != nil {
-		filterBlock, frel, ferr := r.getFilterBlock(true)
+	if filtered && r.filter != nil && !ro.GetIgnoreFilters() {
+		filterBlock, frel, ferr := r.getFilterBlock(fillCache)
 		if ferr == nil {
 			if !filterBlock.contains(r.filter, dataBH.offset, key) {
 				frel.Release()
-				return nil, nil, ErrNotFound
+				return nil, nil, FilterExcluded, ErrNotFound
 			}
 			frel.Release()
+			fres = FilterPassed
 		} else if !errors.IsCorrupted(ferr) {
-			return nil, nil, ferr
+			return nil, nil, fres, ferr
 		}
 	}
 
-	data := r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache())
+	data := r.getDataIter(dataBH, nil, r.verifyChecksum, fillCache)
 	if !data.Seek(key) {
 		data.Release()
 		if err = data.Error(); err != nil {
@@ -875,10 +1015,10 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 		dataBH, n = decodeBlockHandle(index.Value())
 		if n == 0 {
 			r.err = r.newErrCorruptedBH(r.indexBH, "bad data block handle")
-			return nil, nil, r.err
+			return nil, nil, fres, r.err
 		}
 
-		data = r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache())
+		data = r.getDataIter(dataBH, nil, r.verifyChecksum, fillCache)
 		if !data.Next() {
 			data.Release()
 			if err = data.Error(); err == nil {
@@ -891,7 +1031,11 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 	// Key doesn't use block buffer, no need to copy the buffer.
 	rkey = data.Key()
 	if !noValue {
-		if r.bpool == nil {
+		if p := ro.GetBufferPool(); p != nil {
+			// The value is owned by the caller's pool, so it can't share
+			// the block buffer.
+			value = append(p.Get(len(data.Value()))[:0], data.Value()...)
+		} else if r.bpool == nil {
 			value = data.Value()
 		} else {
 			// Value does use block buffer, and since the buffer will be
@@ -914,7 +1058,8 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 // own copy.
 // It is safe to modify the contents of the argument after Find returns.
 func (r *Reader) Find(key []byte, filtered bool, ro *opt.ReadOptions) (rkey, value []byte, err error) {
-	return r.find(key, filtered, ro, false)
+	rkey, value, _, err = r.find(key, filtered, ro, false)
+	return
 }
 
 // FindKey finds key that is greater than or equal to the given key.
@@ -927,10 +1072,67 @@ func (r *Reader) Find(key []byte, filtered bool, ro *opt.ReadOptions) (rkey, val
 // own copy.
 // It is safe to modify the contents of the argument after Find returns.
 func (r *Reader) FindKey(key []byte, filtered bool, ro *opt.ReadOptions) (rkey []byte, err error) {
-	rkey, _, err = r.find(key, filtered, ro, true)
+	rkey, _, _, err = r.find(key, filtered, ro, true)
 	return
 }
 
+// FindFiltered is like Find with filtered set to true, or like FindKey if
+// noValue is true, and additionally returns the outcome of the filter
+// check. A lookup whose filter check passed but whose key is not found is
+// a false positive of the filter.
+//
+// The caller may modify the contents of the returned slice as it is its
+// own copy.
+// It is safe to modify the contents of the argument after FindFiltered
+// returns.
+func (r *Reader) FindFiltered(key []byte, ro *opt.ReadOptions, noValue bool) (rkey, value []byte, fres FilterResult, err error) {
+	return r.find(key, true, ro, noValue)
+}
+
+// MayContain returns false if the table definitely doesn't contain the
+// given key, either because the key is past the last key of the table
+// or because 'filter data' (if present) excludes it. Otherwise it returns
+// true, which may be a false positive. No data block is read.
+//
+// It is safe to modify the contents of the argument after MayContain
+// returns.
+func (r *Reader) MayContain(key []byte) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return false, r.err
+	}
+
+	index, err := r.newIndexIter(true)
+	if err != nil {
+		return false, err
+	}
+	defer index.Release()
+
+	if !index.Seek(key) {
+		return false, index.Error()
+	}
+	if r.filter == nil {
+		return true, nil
+	}
+
+	dataBH, n := decodeBlockHandle(index.Value())
+	if n == 0 {
+		r.err = r.newErrCorruptedBH(r.indexBH, "bad data block handle")
+		return false, r.err
+	}
+	filterBlock, frel, ferr := r.getFilterBlock(true)
+	if ferr != nil {
+		if errors.IsCorrupted(ferr) {
+			return true, nil
+		}
+		return false, ferr
+	}
+	defer frel.Release()
+	return filterBlock.contains(r.filter, dataBH.offset, key), nil
+}
+
 // Get gets the value for the given key. It returns errors.ErrNotFound
 // if the table does not contain the key.
 //
@@ -946,7 +1148,7 @@ func (r *Reader) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error)
 		return
 	}
 
-	rkey, value, err := r.find(key, false, ro, false)
+	rkey, value, _, err := r.find(key, false, ro, false)
 	if err == nil && r.cmp.Compare(rkey, key) != 0 {
 		value = nil
 		err = ErrNotFound
@@ -966,13 +1168,10 @@ func (r *Reader) OffsetOf(key []byte) (offset int64, err error) {
 		return
 	}
 
-	indexBlock, rel, err := r.readBlockCached(r.indexBH, true, true)
+	index, err := r.newIndexIter(true)
 	if err != nil {
 		return
 	}
-	defer rel.Release()
-
-	index := r.newBlockIter(indexBlock, nil, nil, true)
 	defer index.Release()
 	if index.Seek(key) {
 		dataBH, n := decodeBlockHandle(index.Value())
@@ -990,6 +1189,103 @@ func (r *Reader) OffsetOf(key []byte) (offset int64, err error) {
 	return
 }
 
+// IndexEntry is an entry of the table index: the index key of a data
+// block, which sorts at or after every key of the block and before every
+// key of the next block, and the location of the block.
+type IndexEntry struct {
+	Key    []byte
+	Handle BlockHandle
+}
+
+// IndexEntries returns the index entries of the data blocks which may hold
+// keys of the given slice, in key order. No data block is read.
+//
+// A nil Range.Start is treated as a key before all keys in the table.
+// And a nil Range.Limit is treated as a key after all keys in the table.
+//
+// The caller may modify the contents of the returned slice as it is its
+// own copy.
+func (r *Reader) IndexEntries(slice *util.Range) (entries []IndexEntry, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	index, err := r.newIndexIter(false)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Release()
+
+	var ok bool
+	if slice != nil && slice.Start != nil {
+		ok = index.Seek(slice.Start)
+	} else {
+		ok = index.First()
+	}
+	for ; ok; ok = index.Next() {
+		dataBH, n := decodeBlockHandle(index.Value())
+		if n == 0 {
+			r.err = r.newErrCorruptedBH(r.indexBH, "bad data block handle")
+			return nil, r.err
+		}
+		key := index.Key()
+		entries = append(entries, IndexEntry{
+			Key:    append([]byte{}, key...),
+			Handle: BlockHandle{dataBH.offset, dataBH.length},
+		})
+		// The block holding the limit is the last one.
+		if slice != nil && slice.Limit != nil && r.cmp.Compare(key, slice.Limit) >= 0 {
+			break
+		}
+	}
+	if err := index.Error(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// IndexBlockSize returns the size of the index block held by the table
+// reader for its lifetime, as done with opt.Options.PinIndexBlocks or
+// without a block cache, or zero if the index block is read through the
+// block cache instead. Only the
+// top-level index block of a two-level index is held, see
+// opt.Options.TwoLevelIndex.
+func (r *Reader) IndexBlockSize() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.indexBlock == nil {
+		return 0
+	}
+	return len(r.indexBlock.data)
+}
+
+// FilterBlockSize returns the size of the filter block held by the table
+// reader for its lifetime, or zero if the table has no filter or the
+// filter block is read through the block cache instead.
+func (r *Reader) FilterBlockSize() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.filterBlock == nil {
+		return 0
+	}
+	return len(r.filterBlock.data)
+}
+
+// TwoLevelIndex reports whether the table has a two-level index, see
+// opt.Options.TwoLevelIndex.
+func (r *Reader) TwoLevelIndex() bool {
+	return r.twoLevelIndex
+}
+
+// Transformed reports whether the blocks of the table are transformed, see
+// opt.Options.BlockTransform.
+func (r *Reader) Transformed() bool {
+	return r.transform != nil
+}
+
 // Release implements util.Releaser.
 // It also close the file if it is an io.Closer.
 func (r *Reader) Release() {
@@ -1013,6 +1309,81 @@ func (r *Reader) Release() {
 	r.err = ErrReaderReleased
 }
 
+// BlockHandle is the location of a block within a table file. The length
+// doesn't include the block trailer.
+type BlockHandle struct {
+	Offset, Length uint64
+}
+
+// Footer is the decoded table footer, it locates the metaindex and index
+// blocks of the table.
+type Footer struct {
+	MetaindexHandle BlockHandle
+	IndexHandle     BlockHandle
+
+	// Magic is the magic number ending the footer, read as a
+	// little-endian 64-bit integer; see Magic.
+	Magic uint64
+
+	// Version is the table format version. The LevelDB table format, the
+	// only one read and written by this package, has no version field in
+	// its footer and is reported as version 0.
+	Version int
+}
+
+// Magic is the magic number of the LevelDB table format.
+const Magic uint64 = 0xdb4775248b80fb57
+
+// Decodes the table footer, the reason is non-empty if the footer is
+// malformed.
+func decodeFooter(footer []byte) (metaBH, indexBH blockHandle, reason string) {
+	if string(footer[footerLen-len(magic):footerLen]) != magic {
+		return metaBH, indexBH, "bad magic number"
+	}
+
+	var n int
+	// Decode the metaindex block handle.
+	metaBH, n = decodeBlockHandle(footer)
+	if n == 0 {
+		return metaBH, indexBH, "bad metaindex block handle"
+	}
+
+	// Decode the index block handle.
+	indexBH, n = decodeBlockHandle(footer[n:])
+	if n == 0 {
+		return metaBH, indexBH, "bad index block handle"
+	}
+	return metaBH, indexBH, ""
+}
+
+// ReadFooter reads and decodes the footer of the table of the given size
+// from r, without opening the table. It is meant for tools inspecting
+// the layout of tables, e.g. when migrating between LevelDB-compatible
+// implementations.
+//
+// An *errors.ErrCorrupted is returned if r doesn't hold a table in the
+// LevelDB table format.
+func ReadFooter(r io.ReaderAt, size int64) (*Footer, error) {
+	if size < footerLen {
+		return nil, &errors.ErrCorrupted{Err: &ErrCorrupted{Pos: 0, Size: size, Kind: "table", Reason: "too small"}}
+	}
+
+	footerPos := size - footerLen
+	var footer [footerLen]byte
+	if _, err := r.ReadAt(footer[:], footerPos); err != nil && err != io.EOF {
+		return nil, err
+	}
+	metaBH, indexBH, reason := decodeFooter(footer[:])
+	if reason != "" {
+		return nil, &errors.ErrCorrupted{Err: &ErrCorrupted{Pos: footerPos, Size: footerLen, Kind: "table-footer", Reason: reason}}
+	}
+	return &Footer{
+		MetaindexHandle: BlockHandle{metaBH.offset, metaBH.length},
+		IndexHandle:     BlockHandle{indexBH.offset, indexBH.length},
+		Magic:           binary.LittleEndian.Uint64(footer[footerLen-len(magic):]),
+	}, nil
+}
+
 // NewReader creates a new initialized table reader for the file.
 // The fi, cache and bpool is optional and can be nil.
 //
@@ -1042,23 +1413,10 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 	if _, err := r.reader.ReadAt(footer[:], footerPos); err != nil && err != io.EOF {
 		return nil, err
 	}
-	if string(footer[footerLen-len(magic):footerLen]) != magic {
-		r.err = r.newErrCorrupted(footerPos, footerLen, "table-footer", "bad magic number")
-		return r, nil
-	}
-
-	var n int
-	// Decode the metaindex block handle.
-	r.metaBH, n = decodeBlockHandle(footer[:])
-	if n == 0 {
-		r.err = r.newErrCorrupted(footerPos, footerLen, "table-footer", "bad metaindex block handle")
-		return r, nil
-	}
-
-	// Decode the index block handle.
-	r.indexBH, n = decodeBlockHandle(footer[n:])
-	if n == 0 {
-		r.err = r.newErrCorrupted(footerPos, footerLen, "table-footer", "bad index block handle")
+	var reason string
+	r.metaBH, r.indexBH, reason = decodeFooter(footer[:])
+	if reason != "" {
+		r.err = r.newErrCorrupted(footerPos, footerLen, "table-footer", reason)
 		return r, nil
 	}
 
@@ -1076,10 +1434,23 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 	r.dataEnd = int64(r.metaBH.offset)
 
 	// Read metaindex.
+	var (
+		transformName string
+		checkBH       blockHandle
+	)
 	metaIter := r.newBlockIter(metaBlock, nil, nil, true)
 	for metaIter.Next() {
 		key := string(metaIter.Key())
-		if !strings.HasPrefix(key, "filter.") {
+		if key == twoLevelIndexKey {
+			r.twoLevelIndex = true
+			continue
+		}
+		if strings.HasPrefix(key, transformKeyPrefix) {
+			transformName = key[len(transformKeyPrefix):]
+			checkBH, _ = decodeBlockHandle(metaIter.Value())
+			continue
+		}
+		if r.filter != nil || !strings.HasPrefix(key, "filter.") {
 			continue
 		}
 		fn := key[7:]
@@ -1101,14 +1472,25 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 			r.filterBH = filterBH
 			// Update data end.
 			r.dataEnd = int64(filterBH.offset)
-			break
 		}
 	}
 	metaIter.Release()
 	metaBlock.Release()
 
-	// Cache index and filter block locally, since we don't have global cache.
-	if cache == nil {
+	// Check the block transform, blocks are read with it from now on.
+	if transformName != "" {
+		if err := r.checkTransform(transformName, checkBH); err != nil {
+			if errors.IsCorrupted(err) {
+				r.err = err
+				return r, nil
+			}
+			return nil, err
+		}
+	}
+
+	// Cache index block locally if we don't have global cache, or if it
+	// should be pinned.
+	if cache == nil || o.GetPinIndexBlocks() {
 		r.indexBlock, err = r.readBlock(r.indexBH, true)
 		if err != nil {
 			if errors.IsCorrupted(err) {
@@ -1117,6 +1499,10 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 			}
 			return nil, err
 		}
+	}
+
+	// Cache filter block locally, since we don't have global cache.
+	if cache == nil {
 		if r.filter != nil {
 			r.filterBlock, err = r.readFilterBlock(r.filterBH)
 			if err != nil {
@@ -55,6 +55,35 @@ Table footer:
 NOTE: All fixed-length integer are little-endian.
 */
 
+/*
+Two-level index:
+
+A table written with opt.Options.TwoLevelIndex whose index outgrows the
+block size splits it into index partitions, which are regular index blocks
+written after the filter block. The index block then becomes a top-level
+index whose entries map the last key of each partition to its block handle,
+and the metaindex block holds an "index.twolevel" entry with an empty value.
+
+    +-----+--------------+-------------------+-----+-------------------+-----------------+-------------+--------+
+    | ... | filter block | index partition 1 | ... | index partition n | metaindex block | index block | footer |
+    +-----+--------------+-------------------+-----+-------------------+-----------------+-------------+--------+
+*/
+
+/*
+Block transform:
+
+A table written with opt.Options.BlockTransform has all its blocks encoded
+by the transform, except the metaindex block. The encoding is applied after
+compression, the block trailer holds the compression type and the checksum
+of the encoded block. A check block, holding the transform check value, is
+written before the metaindex block, and the metaindex block holds a
+"transform.<name>" entry with the check block handle.
+
+    +-----+-------------+-----------------+-------------+--------+
+    | ... | check block | metaindex block | index block | footer |
+    +-----+-------------+-----------------+-------------+--------+
+*/
+
 /*
 Block:
 
@@ -152,6 +181,14 @@ const (
 	blockTypeNoCompression     = 0
 	blockTypeSnappyCompression = 1
 
+	// The metaindex key marking a table with a two-level index.
+	twoLevelIndexKey = "index.twolevel"
+
+	// The metaindex key prefix of the block transform check block, and
+	// the value it holds.
+	transformKeyPrefix = "transform."
+	transformCheck     = "leveldb/table: block transform check"
+
 	// Generate new filter every 2KB of data
 	filterBaseLg = 11
 	filterBase   = 1 << filterBaseLg
@@ -163,8 +200,11 @@ type blockHandle struct {
 
 func decodeBlockHandle(src []byte) (blockHandle, int) {
 	offset, n := binary.Uvarint(src)
+	if n <= 0 {
+		return blockHandle{}, 0
+	}
 	length, m := binary.Uvarint(src[n:])
-	if n == 0 || m == 0 {
+	if m <= 0 {
 		return blockHandle{}, 0
 	}
 	return blockHandle{offset, length}, n + m
@@ -8,10 +8,15 @@ package table
 
 import (
 	"bytes"
+	"fmt"
+	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/btcsuite/goleveldb/leveldb/cache"
+	"github.com/btcsuite/goleveldb/leveldb/errors"
+	"github.com/btcsuite/goleveldb/leveldb/filter"
 	"github.com/btcsuite/goleveldb/leveldb/iterator"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/storage"
@@ -19,10 +24,43 @@ import (
 	"github.com/btcsuite/goleveldb/leveldb/util"
 )
 
+// xorTransform is a block transform for testing, its key is the byte the
+// data is XOR'ed with.
+type xorTransform byte
+
+func (x xorTransform) Name() string { return "xor" }
+
+func (x xorTransform) Encode(dst, src []byte) ([]byte, error) {
+	for _, c := range src {
+		dst = append(dst, c^byte(x))
+	}
+	return dst, nil
+}
+
+func (x xorTransform) Decode(dst, src []byte) ([]byte, error) {
+	return x.Encode(dst, src)
+}
+
+type namedXorTransform struct {
+	xorTransform
+}
+
+func (namedXorTransform) Name() string { return "xor2" }
+
 type tableWrapper struct {
 	*Reader
 }
 
+type countingReaderAt struct {
+	r     *bytes.Reader
+	reads map[int64]int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads[off]++
+	return c.r.ReadAt(p, off)
+}
+
 func (t tableWrapper) TestFind(key []byte) (rkey, rvalue []byte, err error) {
 	return t.Reader.Find(key, false, nil)
 }
@@ -71,7 +109,9 @@ var _ = testutil.Defer(func() {
 				CheckOffset("k0", 0, 0)
 				CheckOffset("k01a", 0, 0)
 				CheckOffset("k02", 0, 0)
-				CheckOffset("k03", 0, 0)
+				// The k03 entry is larger than a block, thus gets a block
+				// of its own, following the 34 bytes one of k01 and k02.
+				CheckOffset("k03", 34, 0)
 				CheckOffset("k04", 10000, 1000)
 				CheckOffset("k04a", 210000, 1000)
 				CheckOffset("k05", 210000, 1000)
@@ -81,6 +121,313 @@ var _ = testutil.Defer(func() {
 			})
 		})
 
+		Describe("pinned index block test", func() {
+			var (
+				buf = &bytes.Buffer{}
+				o   = &opt.Options{
+					BlockSize:   512,
+					Compression: opt.NoCompression,
+				}
+			)
+
+			// Building the table.
+			tw := NewWriter(buf, o)
+			for i := 0; i < 100; i++ {
+				tw.Append([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte{'x'}, 100))
+			}
+			err := tw.Close()
+
+			Lookup := func(pin bool) (r *Reader, indexReads int) {
+				Expect(err).ShouldNot(HaveOccurred())
+
+				ra := &countingReaderAt{bytes.NewReader(buf.Bytes()), make(map[int64]int)}
+				// A tiny block cache, every block is evicted right away.
+				bcache := &cache.NamespaceGetter{Cache: cache.NewCache(cache.NewLRU(1)), NS: 0}
+				ro := *o
+				ro.PinIndexBlocks = pin
+				r, err := NewReader(ra, int64(buf.Len()), storage.FileDesc{}, bcache, nil, &ro)
+				Expect(err).ShouldNot(HaveOccurred())
+				for i := 0; i < 100; i++ {
+					value, err := r.Get([]byte(fmt.Sprintf("k%03d", i)), nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(value).Should(HaveLen(100))
+				}
+				return r, ra.reads[int64(r.indexBH.offset)]
+			}
+
+			It("Should read the index block only once if pinned", func() {
+				r, indexReads := Lookup(true)
+				defer r.Release()
+				Expect(indexReads).Should(Equal(1))
+				Expect(r.IndexBlockSize()).Should(BeNumerically(">", 0))
+			})
+
+			It("Should re-read the index block if not pinned", func() {
+				r, indexReads := Lookup(false)
+				defer r.Release()
+				Expect(indexReads).Should(BeNumerically(">", 1))
+				Expect(r.IndexBlockSize()).Should(BeZero())
+			})
+
+			It("Should report a corrupted pinned index block", func() {
+				r, _ := Lookup(true)
+				data := append([]byte(nil), buf.Bytes()...)
+				data[r.indexBH.offset]++
+				r.Release()
+
+				bcache := &cache.NamespaceGetter{Cache: cache.NewCache(cache.NewLRU(1)), NS: 0}
+				ro := *o
+				ro.PinIndexBlocks = true
+				r, err := NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, bcache, nil, &ro)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer r.Release()
+				_, err = r.Get([]byte("k000"), nil)
+				Expect(errors.IsCorrupted(err)).Should(BeTrue(), "got: %v", err)
+			})
+		})
+
+		Describe("footer test", func() {
+			var (
+				buf = &bytes.Buffer{}
+				o   = &opt.Options{
+					BlockSize: 512,
+				}
+			)
+
+			// Building the table.
+			tw := NewWriter(buf, o)
+			for i := 0; i < 100; i++ {
+				tw.Append([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte{'x'}, 100))
+			}
+			err := tw.Close()
+
+			It("Should read the footer of a table written by this package", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+
+				f, err := ReadFooter(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(f.Magic).Should(Equal(Magic))
+				Expect(f.Version).Should(BeZero())
+
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer tr.Release()
+				Expect(f.MetaindexHandle).Should(Equal(BlockHandle{tr.metaBH.offset, tr.metaBH.length}))
+				Expect(f.IndexHandle).Should(Equal(BlockHandle{tr.indexBH.offset, tr.indexBH.length}))
+				Expect(f.IndexHandle.Offset + f.IndexHandle.Length + blockTrailerLen + footerLen).Should(Equal(uint64(buf.Len())))
+			})
+
+			It("Should report a corrupted footer", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, err := ReadFooter(bytes.NewReader(buf.Bytes()), footerLen-1)
+				Expect(errors.IsCorrupted(err)).Should(BeTrue(), "too small: %v", err)
+
+				data := append([]byte{}, buf.Bytes()...)
+				data[len(data)-1] ^= 0xff
+				_, err = ReadFooter(bytes.NewReader(data), int64(len(data)))
+				Expect(errors.IsCorrupted(err)).Should(BeTrue(), "bad magic: %v", err)
+
+				data = append([]byte{}, buf.Bytes()...)
+				for i := len(data) - footerLen; i < len(data)-len(magic); i++ {
+					data[i] = 0xff
+				}
+				_, err = ReadFooter(bytes.NewReader(data), int64(len(data)))
+				Expect(errors.IsCorrupted(err)).Should(BeTrue(), "bad handles: %v", err)
+			})
+		})
+
+		Describe("two-level index test", func() {
+			Build := func(kv testutil.KeyValue, twoLevel bool) (*Reader, error) {
+				o := &opt.Options{
+					BlockSize:     128,
+					Filter:        filter.NewBloomFilter(10),
+					TwoLevelIndex: twoLevel,
+				}
+				buf := &bytes.Buffer{}
+
+				// Building the table.
+				tw := NewWriter(buf, o)
+				kv.Iterate(func(i int, key, value []byte) {
+					tw.Append(key, value)
+				})
+				if err := tw.Close(); err != nil {
+					return nil, err
+				}
+
+				// Opening the table, with its index block pinned.
+				return NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+			}
+
+			It("Should write a single-level index if the index is small", func() {
+				tr, err := Build(*testutil.KeyValue_Generate(nil, 3, 1, 1, 10, 100, 100), true)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer tr.Release()
+				Expect(tr.twoLevelIndex).Should(BeFalse())
+			})
+
+			kv := testutil.KeyValue_Generate(nil, 200, 1, 1, 10, 50, 100)
+			tr, err := Build(*kv, true)
+
+			It("Should write a two-level index if the index is large", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(tr.twoLevelIndex).Should(BeTrue())
+				Expect(tr.indexBlock.restartsLen).Should(BeNumerically(">", 1))
+
+				flat, err := Build(*kv, false)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer flat.Release()
+				Expect(flat.twoLevelIndex).Should(BeFalse())
+				Expect(tr.IndexBlockSize() * 5).Should(BeNumerically("<", flat.IndexBlockSize()))
+			})
+
+			It("Should look up every key through the index partitions", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+				var prev int64
+				kv.Iterate(func(i int, key, value []byte) {
+					v, err := tr.Get(key, nil)
+					Expect(err).ShouldNot(HaveOccurred(), "Get %q", key)
+					Expect(v).Should(Equal(value), "Get %q", key)
+					ok, err := tr.MayContain(key)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(ok).Should(BeTrue(), "MayContain %q", key)
+					offset, err := tr.OffsetOf(key)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(offset).Should(BeNumerically(">=", prev), "OffsetOf %q", key)
+					prev = offset
+				})
+			})
+
+			Describe("with iterators", func() {
+				if err == nil {
+					testutil.KeyValueTesting(nil, *kv, tableWrapper{tr}, nil, nil)
+				}
+			})
+		})
+
+		Describe("oversized entry test", func() {
+			o := &opt.Options{
+				BlockSize:   128,
+				Compression: opt.NoCompression,
+			}
+			kv := testutil.KeyValue{}
+			for i := 0; i < 30; i++ {
+				value := []byte(fmt.Sprintf("v%d", i))
+				if i%10 == 5 {
+					value = bytes.Repeat([]byte{'x'}, 1000)
+				}
+				kv.Put([]byte(fmt.Sprintf("k%02d", i)), value)
+			}
+
+			buf := &bytes.Buffer{}
+			tw := NewWriter(buf, o)
+			kv.Iterate(func(i int, key, value []byte) {
+				Expect(tw.Append(key, value)).ShouldNot(HaveOccurred())
+			})
+			Expect(tw.Close()).ShouldNot(HaveOccurred())
+			tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+
+			It("Should give an oversized entry a block of its own", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+				entries, err := tr.IndexEntries(nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				var n int
+				for _, e := range entries {
+					if e.Handle.Length < uint64(EntryBlockLen(3, 1000)) {
+						continue
+					}
+					n++
+					Expect(e.Handle.Length).Should(BeNumerically("==", EntryBlockLen(3, 1000)))
+					rkey, value, err := tr.Find(e.Key, false, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(value).Should(HaveLen(1000), "Find %q", rkey)
+					Expect(bytes.Compare(rkey, e.Key)).Should(BeNumerically("<=", 0))
+				}
+				Expect(n).Should(Equal(3))
+			})
+
+			Describe("with iterators", func() {
+				if err == nil {
+					testutil.KeyValueTesting(nil, kv, tableWrapper{tr}, nil, nil)
+				}
+			})
+
+			It("Should reject an entry larger than the block size ceiling", func() {
+				o := &opt.Options{BlockSize: 128, MaxBlockSize: 512}
+				tw := NewWriter(&bytes.Buffer{}, o)
+				Expect(tw.Append([]byte("a"), []byte("small"))).ShouldNot(HaveOccurred())
+				err := tw.Append([]byte("b"), bytes.Repeat([]byte{'x'}, 1000))
+				Expect(err).Should(Equal(&errors.ErrEntryTooLarge{Size: EntryBlockLen(1, 1000), Max: 512}))
+				Expect(tw.Append([]byte("c"), []byte("small"))).ShouldNot(HaveOccurred())
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				Expect(tw.EntriesLen()).Should(Equal(2))
+			})
+		})
+
+		Describe("block transform test", func() {
+			Build := func(kv testutil.KeyValue, wt, rt opt.BlockTransform) (*Reader, []byte, error) {
+				o := &opt.Options{
+					BlockSize:      128,
+					Filter:         filter.NewBloomFilter(10),
+					TwoLevelIndex:  true,
+					BlockTransform: wt,
+				}
+				buf := &bytes.Buffer{}
+
+				// Building the table.
+				tw := NewWriter(buf, o)
+				kv.Iterate(func(i int, key, value []byte) {
+					tw.Append(key, value)
+				})
+				if err := tw.Close(); err != nil {
+					return nil, nil, err
+				}
+
+				// Opening the table, with another transform.
+				o.BlockTransform = rt
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				return tr, buf.Bytes(), err
+			}
+
+			kv := testutil.KeyValue_Generate(nil, 200, 1, 1, 10, 50, 100)
+			tr, data, err := Build(*kv, xorTransform(0x5a), xorTransform(0x5a))
+
+			It("Should encode the blocks", func() {
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(tr.twoLevelIndex).Should(BeTrue())
+				kv.Iterate(func(i int, key, value []byte) {
+					Expect(bytes.Contains(data, value)).Should(BeFalse(), "value %q found in table", value)
+					v, err := tr.Get(key, nil)
+					Expect(err).ShouldNot(HaveOccurred(), "Get %q", key)
+					Expect(v).Should(Equal(value), "Get %q", key)
+				})
+			})
+
+			It("Should fail with another transform", func() {
+				for _, t := range []opt.BlockTransform{nil, xorTransform(0x33), namedXorTransform{0x5a}} {
+					_, _, err := Build(*kv, xorTransform(0x5a), t)
+					Expect(err).Should(Equal(errors.ErrBlockTransform), "transform %v", t)
+				}
+			})
+
+			It("Should read a table written without transform", func() {
+				tr, _, err := Build(*kv, nil, xorTransform(0x5a))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer tr.Release()
+				kv.Iterate(func(i int, key, value []byte) {
+					v, err := tr.Get(key, nil)
+					Expect(err).ShouldNot(HaveOccurred(), "Get %q", key)
+					Expect(v).Should(Equal(value), "Get %q", key)
+				})
+			})
+
+			Describe("with iterators", func() {
+				if err == nil {
+					testutil.KeyValueTesting(nil, *kv, tableWrapper{tr}, nil, nil)
+				}
+			})
+		})
+
 		Describe("read test", func() {
 			Build := func(kv testutil.KeyValue) testutil.DB {
 				o := &opt.Options{
@@ -121,3 +468,30 @@ var _ = testutil.Defer(func() {
 		})
 	})
 })
+
+func BenchmarkWriterSmallTables(b *testing.B) {
+	o := &opt.Options{
+		Filter: filter.NewBloomFilter(10),
+	}
+	keys := make([][]byte, 256)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%06d", i))
+	}
+	value := bytes.Repeat([]byte{'v'}, 32)
+	buf := new(bytes.Buffer)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w := NewWriter(buf, o)
+		for _, key := range keys {
+			if err := w.Append(key, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
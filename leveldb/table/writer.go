@@ -8,11 +8,12 @@ package table
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/btcsuite/goleveldb/leveldb/comparer"
+	"github.com/btcsuite/goleveldb/leveldb/errors"
 	"github.com/btcsuite/goleveldb/leveldb/filter"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
 	"github.com/btcsuite/goleveldb/leveldb/util"
@@ -83,13 +84,50 @@ func (w *blockWriter) bytesLen() int {
 	return w.buf.Len() + 4*restartsLen + 4
 }
 
+// Working buffers of the filter writers, pooled so that building many
+// small tables doesn't allocate them afresh each time.
+var filterScratchPool = sync.Pool{
+	New: func() interface{} { return new(filterScratch) },
+}
+
+type filterScratch struct {
+	buf     []byte
+	offsets []uint32
+}
+
 type filterWriter struct {
 	generator filter.FilterGenerator
+	scratch   *filterScratch
 	buf       util.Buffer
 	nKeys     int
 	offsets   []uint32
 }
 
+func (w *filterWriter) init(generator filter.FilterGenerator) {
+	w.generator = generator
+	w.scratch = filterScratchPool.Get().(*filterScratch)
+	w.buf = *util.NewBuffer(w.scratch.buf[:0])
+	w.offsets = w.scratch.offsets[:0]
+}
+
+// Puts the working buffers back to the pool and releases the generator,
+// the filter block must have been written.
+func (w *filterWriter) release() {
+	if w.generator == nil {
+		return
+	}
+	if r, ok := w.generator.(util.Releaser); ok {
+		r.Release()
+	}
+	w.generator = nil
+	w.scratch.buf = w.buf.Bytes()[:0]
+	w.scratch.offsets = w.offsets[:0]
+	filterScratchPool.Put(w.scratch)
+	w.scratch = nil
+	w.buf = util.Buffer{}
+	w.offsets = nil
+}
+
 func (w *filterWriter) add(key []byte) {
 	if w.generator == nil {
 		return
@@ -134,31 +172,42 @@ func (w *filterWriter) generate() {
 	}
 }
 
+// An index partition of a two-level index, see Writer.cutIndexPartition.
+type indexPartition struct {
+	key, data []byte
+}
+
 // Writer is a table writer.
 type Writer struct {
 	writer io.Writer
 	err    error
 	// Options
-	cmp         comparer.Comparer
-	filter      filter.Filter
-	compression opt.Compression
-	blockSize   int
-
-	dataBlock   blockWriter
-	indexBlock  blockWriter
-	filterBlock filterWriter
-	pendingBH   blockHandle
-	offset      uint64
-	nEntries    int
+	cmp           comparer.Comparer
+	filter        filter.Filter
+	compression   opt.Compression
+	blockSize     int
+	maxBlockSize  int
+	twoLevelIndex bool
+	transform     opt.BlockTransform
+
+	dataBlock       blockWriter
+	indexBlock      blockWriter
+	indexPartitions []indexPartition
+	filterBlock     filterWriter
+	pendingBH       blockHandle
+	offset          uint64
+	nEntries        int
+	nBlocks         int
 	// Scratch allocated enough for 5 uvarint. Block writer should not use
 	// first 20-bytes since it will be used to encode block handle, which
 	// then passed to the block writer itself.
 	scratch            [50]byte
 	comparerScratch    []byte
 	compressionScratch []byte
+	transformScratch   []byte
 }
 
-func (w *Writer) writeBlock(buf *util.Buffer, compression opt.Compression) (bh blockHandle, err error) {
+func (w *Writer) writeBlock(buf *util.Buffer, compression opt.Compression, transform bool) (bh blockHandle, err error) {
 	// Compress the buffer if necessary.
 	var b []byte
 	if compression == opt.SnappyCompression {
@@ -176,6 +225,17 @@ func (w *Writer) writeBlock(buf *util.Buffer, compression opt.Compression) (bh b
 		b = buf.Bytes()
 	}
 
+	// Encode the block, the trailer then applies to the encoded block.
+	if transform && w.transform != nil {
+		n := len(b) - blockTrailerLen
+		encoded, err := w.transform.Encode(w.transformScratch[:0], b[:n])
+		if err != nil {
+			return bh, err
+		}
+		w.transformScratch = append(encoded, b[n:]...)
+		b = w.transformScratch
+	}
+
 	// Calculate the checksum.
 	n := len(b) - 4
 	checksum := util.NewCRC(b[:n]).Value()
@@ -196,7 +256,9 @@ func (w *Writer) flushPendingBH(key []byte) {
 		return
 	}
 	var separator []byte
-	if len(key) == 0 {
+	// A nil key means there is no next key, the empty key is a key like
+	// any other.
+	if key == nil {
 		separator = w.cmp.Successor(w.comparerScratch[:0], w.dataBlock.prevKey)
 	} else {
 		separator = w.cmp.Separator(w.comparerScratch[:0], w.dataBlock.prevKey, key)
@@ -209,15 +271,30 @@ func (w *Writer) flushPendingBH(key []byte) {
 	n := encodeBlockHandle(w.scratch[:20], w.pendingBH)
 	// Append the block handle to the index block.
 	w.indexBlock.append(separator, w.scratch[:n])
+	w.nBlocks++
+	if w.twoLevelIndex && w.indexBlock.bytesLen() >= w.blockSize {
+		w.cutIndexPartition()
+	}
 	// Reset prev key of the data block.
 	w.dataBlock.prevKey = w.dataBlock.prevKey[:0]
 	// Clear pending block handle.
 	w.pendingBH = blockHandle{}
 }
 
+// Finishes the index block as a partition of a two-level index, the
+// partitions are written by Close.
+func (w *Writer) cutIndexPartition() {
+	w.indexBlock.finish()
+	w.indexPartitions = append(w.indexPartitions, indexPartition{
+		key:  append([]byte(nil), w.indexBlock.prevKey...),
+		data: append([]byte(nil), w.indexBlock.buf.Bytes()...),
+	})
+	w.indexBlock.reset()
+}
+
 func (w *Writer) finishBlock() error {
 	w.dataBlock.finish()
-	bh, err := w.writeBlock(&w.dataBlock.buf, w.compression)
+	bh, err := w.writeBlock(&w.dataBlock.buf, w.compression, true)
 	if err != nil {
 		return err
 	}
@@ -229,9 +306,24 @@ func (w *Writer) finishBlock() error {
 	return nil
 }
 
+// EntryBlockLen returns the uncompressed size of a block holding only an
+// entry with the given key and value lengths.
+func EntryBlockLen(keyLen, valueLen int) int {
+	var buf [binary.MaxVarintLen64]byte
+	// The shared key length is zero, followed by the unshared key and
+	// value lengths, the key and value, then a single restart point and
+	// the restart points count.
+	return 1 + binary.PutUvarint(buf[:], uint64(keyLen)) + binary.PutUvarint(buf[:], uint64(valueLen)) + keyLen + valueLen + 8
+}
+
 // Append appends key/value pair to the table. The keys passed must
 // be in increasing order.
 //
+// An entry larger than the block size gets a block of its own, which is
+// larger than the block size. It returns an *errors.ErrEntryTooLarge, and
+// appends nothing, if such block would be larger than the MaxBlockSize
+// option.
+//
 // It is safe to modify the contents of the arguments after Append returns.
 func (w *Writer) Append(key, value []byte) error {
 	if w.err != nil {
@@ -241,7 +333,18 @@ func (w *Writer) Append(key, value []byte) error {
 		w.err = fmt.Errorf("leveldb/table: Writer: keys are not in increasing order: %q, %q", w.dataBlock.prevKey, key)
 		return w.err
 	}
+	n := EntryBlockLen(len(key), len(value))
+	if w.maxBlockSize > 0 && n > w.maxBlockSize {
+		return &errors.ErrEntryTooLarge{Size: n, Max: w.maxBlockSize}
+	}
 
+	// Don't let an oversized entry share its block with smaller ones.
+	if w.dataBlock.nEntries > 0 && n >= w.blockSize {
+		if err := w.finishBlock(); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
 	w.flushPendingBH(key)
 	// Append key/value pair to the data block.
 	w.dataBlock.append(key, value)
@@ -261,7 +364,7 @@ func (w *Writer) Append(key, value []byte) error {
 
 // BlocksLen returns number of blocks written so far.
 func (w *Writer) BlocksLen() int {
-	n := w.indexBlock.nEntries
+	n := w.nBlocks
 	if w.pendingBH.length > 0 {
 		// Includes the pending block.
 		n++
@@ -275,8 +378,8 @@ func (w *Writer) EntriesLen() int {
 }
 
 // BytesLen returns number of bytes written so far.
-func (w *Writer) BytesLen() int {
-	return int(w.offset)
+func (w *Writer) BytesLen() int64 {
+	return int64(w.offset)
 }
 
 // Close will finalize the table. Calling Append is not possible
@@ -301,7 +404,41 @@ func (w *Writer) Close() error {
 	var filterBH blockHandle
 	w.filterBlock.finish()
 	if buf := &w.filterBlock.buf; buf.Len() > 0 {
-		filterBH, w.err = w.writeBlock(buf, opt.NoCompression)
+		filterBH, w.err = w.writeBlock(buf, opt.NoCompression, true)
+		if w.err != nil {
+			return w.err
+		}
+	}
+	w.filterBlock.release()
+
+	// Write the index partitions, if the index outgrew the block size. The
+	// index block then becomes the top-level index.
+	twoLevel := len(w.indexPartitions) > 0
+	if twoLevel {
+		if w.indexBlock.nEntries > 0 {
+			w.cutIndexPartition()
+		}
+		var buf util.Buffer
+		for _, p := range w.indexPartitions {
+			buf.Reset()
+			buf.Write(p.data)
+			bh, err := w.writeBlock(&buf, w.compression, true)
+			if err != nil {
+				w.err = err
+				return w.err
+			}
+			n := encodeBlockHandle(w.scratch[:20], bh)
+			w.indexBlock.append(p.key, w.scratch[:n])
+		}
+		w.indexPartitions = nil
+	}
+
+	// Write the block transform check block.
+	var checkBH blockHandle
+	if w.transform != nil {
+		var buf util.Buffer
+		buf.Write([]byte(transformCheck))
+		checkBH, w.err = w.writeBlock(&buf, opt.NoCompression, true)
 		if w.err != nil {
 			return w.err
 		}
@@ -313,8 +450,16 @@ func (w *Writer) Close() error {
 		n := encodeBlockHandle(w.scratch[:20], filterBH)
 		w.dataBlock.append(key, w.scratch[:n])
 	}
+	if twoLevel {
+		w.dataBlock.append([]byte(twoLevelIndexKey), nil)
+	}
+	if w.transform != nil {
+		key := []byte(transformKeyPrefix + w.transform.Name())
+		n := encodeBlockHandle(w.scratch[:20], checkBH)
+		w.dataBlock.append(key, w.scratch[:n])
+	}
 	w.dataBlock.finish()
-	metaindexBH, err := w.writeBlock(&w.dataBlock.buf, w.compression)
+	metaindexBH, err := w.writeBlock(&w.dataBlock.buf, w.compression, false)
 	if err != nil {
 		w.err = err
 		return w.err
@@ -322,7 +467,7 @@ func (w *Writer) Close() error {
 
 	// Write the index block.
 	w.indexBlock.finish()
-	indexBH, err := w.writeBlock(&w.indexBlock.buf, w.compression)
+	indexBH, err := w.writeBlock(&w.indexBlock.buf, w.compression, true)
 	if err != nil {
 		w.err = err
 		return w.err
@@ -356,6 +501,9 @@ func NewWriter(f io.Writer, o *opt.Options) *Writer {
 		filter:          o.GetFilter(),
 		compression:     o.GetCompression(),
 		blockSize:       o.GetBlockSize(),
+		maxBlockSize:    o.GetMaxBlockSize(),
+		twoLevelIndex:   o.GetTwoLevelIndex(),
+		transform:       o.GetBlockTransform(),
 		comparerScratch: make([]byte, 0),
 	}
 	// data block
@@ -367,7 +515,7 @@ func NewWriter(f io.Writer, o *opt.Options) *Writer {
 	w.indexBlock.scratch = w.scratch[20:]
 	// filter block
 	if w.filter != nil {
-		w.filterBlock.generator = w.filter.NewGenerator()
+		w.filterBlock.init(w.filter.NewGenerator())
 		w.filterBlock.flush(0)
 	}
 	return w
@@ -0,0 +1,263 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"github.com/btcsuite/goleveldb/leveldb/iterator"
+	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/storage"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+)
+
+// OpenTable opens the table file with the given number, directly through
+// the given storage, without opening the DB the table belongs to. It
+// returns an iterator over the user keys of the table, and a closer which
+// releases the iterator and closes the table.
+//
+// Each user key is yielded once, with its newest value within the table;
+// the keys whose newest entry in the table is a deletion are skipped. The
+// values stored in blob files are read from the same storage.
+//
+// The options must match the ones of the DB which wrote the table, in
+// particular the comparer and, if any, the block transform. The storage is
+// not locked, so the table may be read while the DB is open; the table must
+// not be removed by a compaction while it is being read though.
+func OpenTable(stor storage.Storage, fileNum uint64, o *opt.Options) (iterator.Iterator, func() error, error) {
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: int64(fileNum)}
+	size, err := fileSize(stor, fd)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := newSecondarySession(stor, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	ro := &opt.ReadOptions{DontFillCache: true}
+	i := &tableIter{
+		tops: s.tops,
+		icmp: s.icmp,
+		ro:   ro,
+		key:  make([]byte, 0),
+		iter: s.tops.newIterator(newTableFile(fd, size, nil, nil), nil, ro),
+	}
+	if err := i.iter.Error(); err != nil {
+		i.iter.Release()
+		s.close()
+		return nil, nil, err
+	}
+	closer := func() error {
+		i.Release()
+		s.close()
+		return nil
+	}
+	return i, closer, nil
+}
+
+// tableIter iterates over the user keys of a single table, see OpenTable.
+type tableIter struct {
+	util.BasicReleaser
+	tops *tOps
+	icmp *iComparer
+	ro   *opt.ReadOptions
+	iter iterator.Iterator
+
+	dir   dir
+	kt    keyType
+	key   []byte
+	value []byte
+	err   error
+}
+
+func (i *tableIter) setErr(err error) {
+	i.err = err
+	i.key = nil
+	i.value = nil
+}
+
+func (i *tableIter) iterErr() {
+	if err := i.iter.Error(); err != nil {
+		i.setErr(err)
+	}
+}
+
+func (i *tableIter) ok() bool {
+	if i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+	return true
+}
+
+// Resolves the value of the current key if it is a blob pointer.
+func (i *tableIter) resolve() bool {
+	if i.kt == keyTypeBlob {
+		value, err := i.tops.readBlob(i.value, i.ro)
+		if err != nil {
+			i.setErr(err)
+			return false
+		}
+		i.value = value
+	}
+	return true
+}
+
+// Moves forward to the newest entry of the next live user key, starting at
+// the current position and skipping the entries of the given user key.
+func (i *tableIter) next(skip []byte) bool {
+	for ; i.iter.Valid(); i.iter.Next() {
+		ukey, _, kt, kerr := parseInternalKey(i.iter.Key())
+		if kerr != nil {
+			i.setErr(kerr)
+			return false
+		}
+		if skip != nil && i.icmp.uCompare(ukey, skip) == 0 {
+			continue
+		}
+		if kt == keyTypeDel {
+			// Skip older entries of the deleted key.
+			i.key = append(i.key[:0], ukey...)
+			skip = i.key
+			continue
+		}
+		i.key = append(i.key[:0], ukey...)
+		i.value = append(i.value[:0], i.iter.Value()...)
+		i.kt = kt
+		i.dir = dirForward
+		return i.resolve()
+	}
+	i.dir = dirEOI
+	i.iterErr()
+	return false
+}
+
+// Moves backward to the previous live user key, starting at the current
+// position. The underlying iterator is left at the last entry preceding the
+// entries of the yielded key.
+func (i *tableIter) prev() bool {
+	var found, del bool
+	for ; i.iter.Valid(); i.iter.Prev() {
+		ukey, _, kt, kerr := parseInternalKey(i.iter.Key())
+		if kerr != nil {
+			i.setErr(kerr)
+			return false
+		}
+		if found && i.icmp.uCompare(ukey, i.key) != 0 {
+			if !del {
+				i.dir = dirBackward
+				return i.resolve()
+			}
+			found = false
+		}
+		// Entries of the same user key are walked from the oldest to the
+		// newest, keep the last one seen.
+		i.key = append(i.key[:0], ukey...)
+		found, del = true, kt == keyTypeDel
+		if !del {
+			i.value = append(i.value[:0], i.iter.Value()...)
+			i.kt = kt
+		}
+	}
+	if i.iterErr(); i.err != nil {
+		return false
+	}
+	if found && !del {
+		i.dir = dirBackward
+		return i.resolve()
+	}
+	i.dir = dirSOI
+	return false
+}
+
+func (i *tableIter) Valid() bool {
+	return i.err == nil && i.dir > dirEOI
+}
+
+func (i *tableIter) First() bool {
+	if !i.ok() {
+		return false
+	}
+	i.iter.First()
+	return i.next(nil)
+}
+
+func (i *tableIter) Last() bool {
+	if !i.ok() {
+		return false
+	}
+	i.iter.Last()
+	return i.prev()
+}
+
+func (i *tableIter) Seek(key []byte) bool {
+	if !i.ok() {
+		return false
+	}
+	i.iter.Seek(makeInternalKey(nil, key, keyMaxSeq, keyTypeSeek))
+	return i.next(nil)
+}
+
+func (i *tableIter) Next() bool {
+	if !i.ok() {
+		return false
+	}
+	switch i.dir {
+	case dirEOI:
+		return false
+	case dirSOI:
+		return i.First()
+	}
+	i.iter.Next()
+	return i.next(i.key)
+}
+
+func (i *tableIter) Prev() bool {
+	if !i.ok() {
+		return false
+	}
+	switch i.dir {
+	case dirSOI:
+		return false
+	case dirEOI:
+		return i.Last()
+	case dirForward:
+		// The underlying iterator is at the newest, thus first, entry of
+		// the current key.
+		i.iter.Prev()
+	}
+	return i.prev()
+}
+
+func (i *tableIter) Key() []byte {
+	if !i.Valid() {
+		return nil
+	}
+	return i.key
+}
+
+func (i *tableIter) Value() []byte {
+	if !i.Valid() {
+		return nil
+	}
+	return i.value
+}
+
+func (i *tableIter) Error() error {
+	return i.err
+}
+
+func (i *tableIter) Release() {
+	if i.dir != dirReleased {
+		i.iter.Release()
+		i.iter = nil
+		i.key = nil
+		i.value = nil
+		i.dir = dirReleased
+		i.BasicReleaser.Release()
+	}
+}
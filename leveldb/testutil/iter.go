@@ -110,6 +110,7 @@ func (t *IteratorTesting) First() {
 
 	ok := t.Iter.First()
 	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(t.Iter.Valid()).Should(Equal(ok), "Valid is inconsistent, %s", t.text())
 	if t.Len() > 0 {
 		t.Pos = 0
 		Expect(ok).Should(BeTrue(), t.Text())
@@ -127,6 +128,7 @@ func (t *IteratorTesting) Last() {
 
 	ok := t.Iter.Last()
 	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(t.Iter.Valid()).Should(Equal(ok), "Valid is inconsistent, %s", t.text())
 	if t.Len() > 0 {
 		t.Pos = t.Len() - 1
 		Expect(ok).Should(BeTrue(), t.Text())
@@ -144,6 +146,7 @@ func (t *IteratorTesting) Next() {
 
 	ok := t.Iter.Next()
 	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(t.Iter.Valid()).Should(Equal(ok), "Valid is inconsistent, %s", t.text())
 	if t.Pos < t.Len()-1 {
 		t.Pos++
 		Expect(ok).Should(BeTrue(), t.Text())
@@ -161,6 +164,7 @@ func (t *IteratorTesting) Prev() {
 
 	ok := t.Iter.Prev()
 	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(t.Iter.Valid()).Should(Equal(ok), "Valid is inconsistent, %s", t.text())
 	if t.Pos > 0 {
 		t.Pos--
 		Expect(ok).Should(BeTrue(), t.Text())
@@ -181,6 +185,7 @@ func (t *IteratorTesting) Seek(i int) {
 
 	ok := t.Iter.Seek(key)
 	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(t.Iter.Valid()).Should(Equal(ok), "Valid is inconsistent, %s", t.text())
 	Expect(ok).Should(BeTrue(), fmt.Sprintf("Seek from key %q to %q, to pos %d, %s", oldKey, key, i, t.text()))
 
 	t.Pos = i
@@ -201,6 +206,7 @@ func (t *IteratorTesting) SeekInexact(i int) {
 
 	ok := t.Iter.Seek(key)
 	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(t.Iter.Valid()).Should(Equal(ok), "Valid is inconsistent, %s", t.text())
 	Expect(ok).Should(BeTrue(), fmt.Sprintf("Seek from key %q to %q (%q), to pos %d, %s", oldKey, key, key1, i, t.text()))
 
 	t.Pos = i
@@ -216,6 +222,7 @@ func (t *IteratorTesting) SeekKey(key []byte) {
 
 	ok := t.Iter.Seek(key)
 	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(t.Iter.Valid()).Should(Equal(ok), "Valid is inconsistent, %s", t.text())
 	if i < t.Len() {
 		key_, _ := t.Index(i)
 		Expect(ok).Should(BeTrue(), fmt.Sprintf("Seek from key %q to %q (%q), to pos %d, %s", oldKey, key, key_, i, t.text()))
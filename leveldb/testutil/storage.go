@@ -60,6 +60,7 @@ const (
 	typeJournal
 	typeTable
 	typeTemp
+	typeBlob
 
 	typeCount
 )
@@ -98,6 +99,8 @@ func flattenType(m StorageMode, t storage.FileType) int {
 		return x + typeTable
 	case storage.TypeTemp:
 		return x + typeTemp
+	case storage.TypeBlob:
+		return x + typeBlob
 	default:
 		panic("invalid file type")
 	}
@@ -116,6 +119,8 @@ func listFlattenType(m StorageMode, t storage.FileType) []int {
 			ret = append(ret, x+typeTable)
 		case t&storage.TypeTemp != 0:
 			ret = append(ret, x+typeTemp)
+		case t&storage.TypeBlob != 0:
+			ret = append(ret, x+typeBlob)
 		}
 	}
 	switch {
@@ -158,6 +163,12 @@ func (err emulatedError) Error() string {
 	return fmt.Sprintf("emulated storage error: %v", err.err)
 }
 
+// Unwrap returns the emulated error, e.g. so that an emulated ENOSPC is
+// detected as such.
+func (err emulatedError) Unwrap() error {
+	return err.err
+}
+
 type storageLock struct {
 	s *Storage
 	l storage.Locker
@@ -177,6 +177,20 @@ func (p *BufferPool) Put(b []byte) {
 
 }
 
+// PooledSize returns the approximate size of the buffers held by the pool
+// for reuse.
+func (p *BufferPool) PooledSize() int {
+	if p == nil {
+		return 0
+	}
+
+	size := len(p.pool[0]) * p.baseline0
+	for i, ch := range p.pool[1:] {
+		size += len(ch) * int(atomic.LoadUint32(&p.size[i]))
+	}
+	return size
+}
+
 func (p *BufferPool) Close() {
 	if p == nil {
 		return
@@ -6,7 +6,13 @@
 
 package util
 
-// Range is a key range.
+import (
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
+)
+
+// Range is a key range. A nil Start or Limit means the range is unbounded
+// on that side, while an empty non-nil one is the empty key, which sorts
+// before all other keys.
 type Range struct {
 	// Start of the key range, include in the range.
 	Start []byte
@@ -30,3 +36,32 @@ func BytesPrefix(prefix []byte) *Range {
 	}
 	return &Range{prefix, limit}
 }
+
+// Contains returns true if the given key is within the key range.
+// A nil Start or Limit means the range is unbounded on that side.
+func (r *Range) Contains(key []byte, cmp comparer.Comparer) bool {
+	return (r.Start == nil || cmp.Compare(key, r.Start) >= 0) &&
+		(r.Limit == nil || cmp.Compare(key, r.Limit) < 0)
+}
+
+// Overlaps returns true if the key range and the given key range have at
+// least one key in common.
+func (r *Range) Overlaps(other *Range, cmp comparer.Comparer) bool {
+	return r.Intersect(other, cmp) != nil
+}
+
+// Intersect returns the key range that is within both the key range and
+// the given key range, or nil if they don't overlap.
+func (r *Range) Intersect(other *Range, cmp comparer.Comparer) *Range {
+	start, limit := r.Start, r.Limit
+	if start == nil || (other.Start != nil && cmp.Compare(other.Start, start) > 0) {
+		start = other.Start
+	}
+	if limit == nil || (other.Limit != nil && cmp.Compare(other.Limit, limit) < 0) {
+		limit = other.Limit
+	}
+	if start != nil && limit != nil && cmp.Compare(start, limit) >= 0 {
+		return nil
+	}
+	return &Range{Start: start, Limit: limit}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2014, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/goleveldb/leveldb/comparer"
+)
+
+func bytesRange(start, limit string) *Range {
+	r := &Range{}
+	if start != "" {
+		r.Start = []byte(start)
+	}
+	if limit != "" {
+		r.Limit = []byte(limit)
+	}
+	return r
+}
+
+func TestRangeContains(t *testing.T) {
+	cmp := comparer.DefaultComparer
+	tests := []struct {
+		r   *Range
+		key string
+		ok  bool
+	}{
+		{bytesRange("b", "d"), "a", false},
+		{bytesRange("b", "d"), "b", true},
+		{bytesRange("b", "d"), "c", true},
+		{bytesRange("b", "d"), "d", false},
+		{bytesRange("", "d"), "a", true},
+		{bytesRange("b", ""), "z", true},
+		{bytesRange("", ""), "", true},
+		{bytesRange("d", "b"), "c", false},
+	}
+	for i, x := range tests {
+		if got := x.r.Contains([]byte(x.key), cmp); got != x.ok {
+			t.Errorf("test %d: Contains(%q) got %v, want %v", i, x.key, got, x.ok)
+		}
+	}
+}
+
+func TestRangeIntersect(t *testing.T) {
+	cmp := comparer.DefaultComparer
+	tests := []struct {
+		a, b *Range
+		want *Range
+	}{
+		{bytesRange("a", "c"), bytesRange("b", "d"), bytesRange("b", "c")},
+		{bytesRange("a", "d"), bytesRange("b", "c"), bytesRange("b", "c")},
+		{bytesRange("a", "b"), bytesRange("b", "c"), nil},
+		{bytesRange("a", "b"), bytesRange("c", "d"), nil},
+		{bytesRange("", "c"), bytesRange("b", ""), bytesRange("b", "c")},
+		{bytesRange("", ""), bytesRange("b", "c"), bytesRange("b", "c")},
+		{bytesRange("", ""), bytesRange("", ""), bytesRange("", "")},
+		{bytesRange("", "b"), bytesRange("b", ""), nil},
+	}
+	for i, x := range tests {
+		for _, ab := range [][2]*Range{{x.a, x.b}, {x.b, x.a}} {
+			got := ab[0].Intersect(ab[1], cmp)
+			if x.want == nil {
+				if got != nil {
+					t.Errorf("test %d: Intersect got %q..%q, want nil", i, got.Start, got.Limit)
+				}
+			} else if got == nil || !bytes.Equal(got.Start, x.want.Start) || !bytes.Equal(got.Limit, x.want.Limit) ||
+				(got.Start == nil) != (x.want.Start == nil) || (got.Limit == nil) != (x.want.Limit == nil) {
+				t.Errorf("test %d: Intersect got %v, want %q..%q", i, got, x.want.Start, x.want.Limit)
+			}
+			if ok := ab[0].Overlaps(ab[1], cmp); ok != (x.want != nil) {
+				t.Errorf("test %d: Overlaps got %v, want %v", i, ok, x.want != nil)
+			}
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/btcsuite/goleveldb/leveldb/iterator"
 	"github.com/btcsuite/goleveldb/leveldb/opt"
+	"github.com/btcsuite/goleveldb/leveldb/table"
 	"github.com/btcsuite/goleveldb/leveldb/util"
 )
 
@@ -32,6 +33,9 @@ type version struct {
 	cLevel int
 	cScore float64
 
+	// Total size of the tables, set by computeCompaction().
+	size int64
+
 	cSeek unsafe.Pointer
 
 	closing  bool
@@ -53,7 +57,7 @@ func (v *version) incref() {
 		// Incr file ref.
 		for _, tt := range v.levels {
 			for _, t := range tt {
-				v.s.addFileRef(t.fd, 1)
+				v.s.addFileRef(t, 1)
 			}
 		}
 	}
@@ -69,7 +73,7 @@ func (v *version) releaseNB() {
 
 	for _, tt := range v.levels {
 		for _, t := range tt {
-			if v.s.addFileRef(t.fd, -1) == 0 {
+			if v.s.addFileRef(t, -1) == 0 {
 				v.s.tops.remove(t)
 			}
 		}
@@ -135,7 +139,9 @@ func (v *version) walkOverlapping(aux tFiles, ikey internalKey, f func(level int
 	}
 }
 
-func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue bool) (value []byte, tcomp bool, err error) {
+// Gets the value of the given key; if meta isn't nil, the tables searched
+// and the one the key was found at are recorded in it.
+func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue bool, meta *ReadMeta) (value []byte, tcomp bool, err error) {
 	if v.closing {
 		return nil, false, ErrClosed
 	}
@@ -151,6 +157,7 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 		zseq   uint64
 		zkt    keyType
 		zval   []byte
+		zt     *tFile
 	)
 
 	err = ErrNotFound
@@ -168,17 +175,28 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 
 		var (
 			fikey, fval []byte
+			fres        table.FilterResult
 			ferr        error
 		)
 		if noValue {
-			fikey, ferr = v.s.tops.findKey(t, ikey, ro)
+			fikey, fres, ferr = v.s.tops.findKey(t, ikey, ro)
 		} else {
-			fikey, fval, ferr = v.s.tops.find(t, ikey, ro)
+			fikey, fval, fres, ferr = v.s.tops.find(t, ikey, ro)
+		}
+		fpass := fres == table.FilterPassed
+		if meta != nil {
+			meta.TablesSearched++
+			if fres != table.FilterNotChecked {
+				meta.FilterChecked = true
+			}
 		}
 
 		switch ferr {
 		case nil:
 		case ErrNotFound:
+			if fpass {
+				v.s.tops.filterFalsePositive()
+			}
 			return true
 		default:
 			err = ferr
@@ -194,18 +212,24 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 						zseq = fseq
 						zkt = fkt
 						zval = fval
+						zt = t
 					}
 				} else {
+					meta.setTable(level, t)
 					switch fkt {
 					case keyTypeVal:
 						value = fval
 						err = nil
+					case keyTypeBlob:
+						value, err = v.readBlob(fval, ro, noValue)
 					case keyTypeDel:
 					default:
 						panic("leveldb: invalid internalKey type")
 					}
 					return false
 				}
+			} else if fpass {
+				v.s.tops.filterFalsePositive()
 			}
 		} else {
 			err = fkerr
@@ -215,10 +239,13 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 		return true
 	}, func(level int) bool {
 		if zfound {
+			meta.setTable(level, zt)
 			switch zkt {
 			case keyTypeVal:
 				value = zval
 				err = nil
+			case keyTypeBlob:
+				value, err = v.readBlob(zval, ro, noValue)
 			case keyTypeDel:
 			default:
 				panic("leveldb: invalid internalKey type")
@@ -229,13 +256,20 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 		return true
 	})
 
-	if tseek && tset.table.consumeSeek() <= 0 {
+	if tseek && v.s.levelCompactable(tset.level) && tset.table.consumeSeek() <= 0 {
 		tcomp = atomic.CompareAndSwapPointer(&v.cSeek, nil, unsafe.Pointer(tset))
 	}
 
 	return
 }
 
+func (v *version) readBlob(ptr []byte, ro *opt.ReadOptions, noValue bool) ([]byte, error) {
+	if noValue {
+		return nil, nil
+	}
+	return v.s.tops.readBlob(ptr, ro)
+}
+
 func (v *version) sampleSeek(ikey internalKey) (tcomp bool) {
 	var tset *tSet
 
@@ -253,6 +287,20 @@ func (v *version) sampleSeek(ikey internalKey) (tcomp bool) {
 	return
 }
 
+// Returns false if none of the tables may contain the given key, see
+// table.Reader.MayContain.
+func (v *version) mayContain(ikey internalKey) (ret bool, err error) {
+	if v.closing {
+		return false, ErrClosed
+	}
+
+	v.walkOverlapping(nil, ikey, func(level int, t *tFile) bool {
+		ret, err = v.s.tops.mayContain(t, ikey)
+		return !ret && err == nil
+	}, nil)
+	return
+}
+
 func (v *version) getIterators(slice *util.Range, ro *opt.ReadOptions) (its []iterator.Iterator) {
 	strict := opt.GetStrict(v.s.o.Options, ro, opt.StrictReader)
 	for level, tables := range v.levels {
@@ -294,6 +342,19 @@ func (v *version) tLen(level int) int {
 	return 0
 }
 
+// Returns the level holding the table numbered num, and the table; -1 and
+// nil if none does.
+func (v *version) findTable(num int64) (level int, t *tFile) {
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			if t.fd.Num == num {
+				return level, t
+			}
+		}
+	}
+	return -1, nil
+}
+
 func (v *version) offsetOf(ikey internalKey) (n int64, err error) {
 	for level, tables := range v.levels {
 		for _, t := range tables {
@@ -338,7 +399,7 @@ func (v *version) pickMemdbLevel(umin, umax []byte, maxLevel int) (level int) {
 				}
 				if gpLevel := level + 2; gpLevel < len(v.levels) {
 					overlaps = v.levels[gpLevel].getOverlaps(overlaps, v.s.icmp, umin, umax, false)
-					if overlaps.size() > int64(v.s.o.GetCompactionGPOverlaps(level)) {
+					if overlaps.size() > v.s.o.GetCompactionGPOverlaps(level) {
 						break
 					}
 				}
@@ -378,21 +439,22 @@ func (v *version) computeCompaction() {
 			score = float64(size) / float64(v.s.o.GetCompactionTotalSize(level))
 		}
 
-		if score > bestScore {
+		if score > bestScore && v.s.levelCompactable(level) {
 			bestLevel = level
 			bestScore = score
 		}
 
 		statFiles[level] = len(tables)
-		statSizes[level] = shortenb(int(size))
+		statSizes[level] = shortenb(size)
 		statScore[level] = fmt.Sprintf("%.2f", score)
 		statTotSize += size
 	}
 
 	v.cLevel = bestLevel
 	v.cScore = bestScore
+	v.size = statTotSize
 
-	v.s.logf("version@stat F·%v S·%s%v Sc·%v", statFiles, shortenb(int(statTotSize)), statSizes, statScore)
+	v.s.logf("version@stat F·%v S·%s%v Sc·%v", statFiles, shortenb(statTotSize), statSizes, statScore)
 }
 
 func (v *version) needCompaction() bool {
@@ -7,6 +7,7 @@ import (
 
 	"github.com/onsi/gomega"
 
+	"github.com/btcsuite/goleveldb/leveldb/storage"
 	"github.com/btcsuite/goleveldb/leveldb/testutil"
 )
 
@@ -179,3 +180,19 @@ func TestVersionStaging(t *testing.T) {
 		}
 	}
 }
+
+func TestTFilesLargeSize(t *testing.T) {
+	var tf tFiles
+	for i := 0; i < 3; i++ {
+		tf = append(tf, newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: int64(i)}, 3<<30, nil, nil))
+	}
+	if got, want := tf.size(), int64(9<<30); got != want {
+		t.Errorf("tFiles.size: got %d, want %d", got, want)
+	}
+	if got, want := shortenb(tf.size()), "9GiB"; got != want {
+		t.Errorf("shortenb: got %q, want %q", got, want)
+	}
+	if got, want := sshortenb(-5<<40), "-5TiB"; got != want {
+		t.Errorf("sshortenb: got %q, want %q", got, want)
+	}
+}